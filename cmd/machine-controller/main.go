@@ -15,20 +15,38 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/health"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
 
+	machineclientset "github.com/gardener/machine-controller-manager/pkg/client/clientset/versioned"
+	machinescheme "github.com/gardener/machine-controller-manager/pkg/client/clientset/versioned/scheme"
 	_ "github.com/gardener/machine-controller-manager/pkg/util/client/metrics/prometheus" // for client metric registration
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/app"
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/app/options"
 	_ "github.com/gardener/machine-controller-manager/pkg/util/reflector/prometheus" // for reflector metric registration
 	_ "github.com/gardener/machine-controller-manager/pkg/util/workqueue/prometheus" // for workqueue metric registration
 	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/component-base/cli/flag"
 	"k8s.io/component-base/logs"
+	"k8s.io/klog"
 	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
 )
 
@@ -36,20 +54,232 @@ func main() {
 
 	s := options.NewMCServer()
 	s.AddFlags(pflag.CommandLine)
+	spiOptions, clientFactoryOptions, validationOptions := core.NewOptions(), core.NewClientFactoryOptions(), validation.NewOptions()
+	var providerConfigPath, healthBindAddress string
+	var orphanScanInterval, orphanGracePeriod time.Duration
+	var inCluster bool
+	maintenanceInterval := 10 * time.Minute
+	watchSecrets := true
+	pflag.CommandLine.StringVar(&providerConfigPath, "provider-config", "",
+		"Path to a YAML file with provider-level defaults for all machine classes, i.e. default storage class and disk bus, allowed namespaces, image registry mirrors, and feature toggles")
+	pflag.CommandLine.StringVar(&healthBindAddress, "health-bind-address", "",
+		"Address on which to serve the /healthz and /readyz endpoints that check the connectivity to the provider clusters, e.g. \":8081\", empty means disabled")
+	pflag.CommandLine.DurationVar(&clientFactoryOptions.ConnectivityCheckTTL, "connectivity-check-ttl", clientFactoryOptions.ConnectivityCheckTTL,
+		"Duration for which the result of checking the connectivity to a provider cluster by the health and readiness endpoints is cached")
+	pflag.CommandLine.DurationVar(&clientFactoryOptions.ConnectivityCheckTimeout, "connectivity-check-timeout", clientFactoryOptions.ConnectivityCheckTimeout,
+		"Timeout of checking the connectivity to a provider cluster, must be shorter than the timeout of the liveness and readiness probes")
+	pflag.CommandLine.BoolVar(&watchSecrets, "watch-secrets", watchSecrets,
+		"Watch the secrets in the control namespace and rebuild the cached provider cluster clients as soon as their credentials are rotated")
+	pflag.CommandLine.StringSliceVar(&validationOptions.AllowedMachineTypes, "allowed-machine-types", validationOptions.AllowedMachineTypes,
+		"QEMU machine types that can be specified in the provider spec of machine classes")
+	pflag.CommandLine.BoolVar(&inCluster, "in-cluster", inCluster,
+		"Use the in-cluster service account credentials to access the provider cluster if the secret doesn't contain a kubeconfig")
+	pflag.CommandLine.BoolVar(&spiOptions.DeepValidation, "deep-validation", spiOptions.DeepValidation,
+		"Check that the storage classes, network attachment definitions, sysprep ConfigMap or Secret, and priority class referenced by the provider spec exist in the provider cluster before creating a machine")
+	pflag.CommandLine.BoolVar(&spiOptions.NetworkCheck, "network-check", spiOptions.NetworkCheck,
+		"Check that the network attachment definitions referenced by the provider spec exist in the provider cluster, and that those in other namespaces are accessible, before creating a machine, also if deep validation is disabled")
+	pflag.CommandLine.BoolVar(&spiOptions.CapacityCheck, "capacity-check", spiOptions.CapacityCheck,
+		"Check that at least one provider cluster node has enough free resources to fit a machine before creating it, failing fast with a ResourceExhausted error otherwise")
+	pflag.CommandLine.DurationVar(&spiOptions.ImageCacheTTL, "image-cache-ttl", spiOptions.ImageCacheTTL,
+		"Duration after which cached root volume images that have not been used to create a machine are deleted")
+	pflag.CommandLine.DurationVar(&spiOptions.SnapshotTTL, "snapshot-ttl", spiOptions.SnapshotTTL,
+		"Duration after which the VM snapshots taken on machine deletion, if enabled by the provider spec, are deleted")
+	pflag.CommandLine.DurationVar(&spiOptions.DeletionWaitTimeout, "deletion-wait-timeout", spiOptions.DeletionWaitTimeout,
+		"Maximum duration to wait for the VM of a machine to be fully deleted before the deletion is retried")
+	pflag.CommandLine.DurationVar(&spiOptions.StuckDeletionTimeout, "stuck-deletion-timeout", spiOptions.StuckDeletionTimeout,
+		"Duration after which the VM of a machine that is still being deleted is considered stuck, and its VMI and virt-launcher pods are force deleted, 0 means never. "+
+			"Only enable this if the nodes of the provider cluster are fenced, since on a partitioned node the guest may keep running and writing to its volumes, including retained or shared ones")
+	pflag.CommandLine.BoolVar(&spiOptions.ForceRemoveFinalizers, "force-remove-finalizers", spiOptions.ForceRemoveFinalizers,
+		"Also remove the finalizers of VMs stuck in deletion and of their VMIs, so that machines can be removed even if KubeVirt can't complete their deletion")
+	pflag.CommandLine.Float32Var(&clientFactoryOptions.QPS, "kubevirt-client-qps", clientFactoryOptions.QPS,
+		"Maximum QPS of the clients used to access the provider cluster")
+	pflag.CommandLine.IntVar(&clientFactoryOptions.Burst, "kubevirt-client-burst", clientFactoryOptions.Burst,
+		"Maximum burst of the clients used to access the provider cluster")
+	pflag.CommandLine.IntVar(&spiOptions.MaxConcurrentOperations, "max-concurrent-operations", spiOptions.MaxConcurrentOperations,
+		"Maximum number of machine create and delete operations performed concurrently against a single provider cluster, 0 means unlimited")
+	pflag.CommandLine.DurationVar(&spiOptions.OperationWaitTimeout, "operation-wait-timeout", spiOptions.OperationWaitTimeout,
+		"Maximum duration a machine create or delete operation waits for a free slot if the maximum number of concurrent operations is reached")
+	pflag.CommandLine.StringVar(&spiOptions.ResizePolicy, "resize-policy", spiOptions.ResizePolicy,
+		"Policy for resizing the existing VMs of a machine class when its CPU or memory resources change, applied at each maintenance interval: None, Apply (update the VM templates, effective on the next restart), or Restart (update the VM templates and restart the VMs one at a time)")
+	pflag.CommandLine.BoolVar(&spiOptions.ReconcileVMs, "reconcile-vms", spiOptions.ReconcileVMs,
+		"Apply the desired spec of the VMs of all machine classes at each maintenance interval using server-side apply, correcting any drift in their labels, annotations, resources, or affinity")
+	pflag.CommandLine.BoolVar(&spiOptions.VMCache, "vm-cache", spiOptions.VMCache,
+		"Serve machine status and list calls from watch-backed caches of the provider cluster VMs and VMIs, falling back to reading them from the provider cluster if the caches are not synced")
+	pflag.CommandLine.DurationVar(&maintenanceInterval, "maintenance-interval", maintenanceInterval,
+		"Interval at which the VMs of all machine classes are resized according to the resize policy and, if enabled, reconciled, and unused cached images and expired snapshots are deleted, 0 means disabled. "+
+			"If leader election is enabled, only the replica holding the machine-controller-kubevirt-maintenance lock performs the maintenance")
+	pflag.CommandLine.DurationVar(&orphanScanInterval, "orphan-scan-interval", orphanScanInterval,
+		"Interval at which the provider clusters of all machine classes are scanned for VMs without a machine object, which are reported via metrics and events, 0 means disabled. "+
+			"If leader election is enabled, only the replica holding the machine-controller-kubevirt-orphan-reaper lock scans")
+	pflag.CommandLine.DurationVar(&orphanGracePeriod, "orphan-grace-period", orphanGracePeriod,
+		"Duration after which a VM without a machine object found by the orphan scan is deleted, 0 means orphaned VMs are only reported")
 
 	flag.InitFlags()
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
+	spiOptions.InCluster, clientFactoryOptions.InCluster, validationOptions.InCluster = inCluster, inCluster, inCluster
+	if err := spiOptions.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+
+	if providerConfigPath != "" {
+		config, err := core.LoadProviderConfig(providerConfigPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, " %v\n", err)
+			os.Exit(1)
+		}
+		spiOptions.SetProviderConfig(config)
+	}
+
 	if err := cdi.AddToScheme(scheme.Scheme); err != nil {
 		fmt.Fprintf(os.Stderr, " %v\n", err)
 		os.Exit(1)
 	}
 
-	plugin := kubevirt.NewKubevirtPlugin()
+	controlConfig, err := createControlConfig(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+	kubeClient, err := kubernetes.NewForConfig(controlConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+	recorder, err := createRecorder(kubeClient)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+
+	cf := core.NewCachingClientFactory(core.TimerFunc(time.Now), clientFactoryOptions)
+	plugin := kubevirt.NewKubevirtPlugin(cf, spiOptions, validationOptions, recorder)
+
+	if watchSecrets {
+		core.WatchSecrets(kubeClient, s.Namespace, cf, wait.NeverStop)
+	}
+
+	machineClient, err := machineclientset.NewForConfig(controlConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+
+	if maintenanceInterval > 0 {
+		maintainer := &kubevirt.Maintainer{
+			SPI:               plugin.(*kubevirt.MachinePlugin).SPI,
+			MachineClient:     machineClient,
+			KubeClient:        kubeClient,
+			ValidationOptions: validationOptions,
+			Namespace:         s.Namespace,
+		}
+		runLeaderElected(s, kubeClient, recorder, "machine-controller-kubevirt-maintenance", func(stopCh <-chan struct{}) {
+			maintainer.Run(maintenanceInterval, stopCh)
+		})
+	}
+
+	if orphanScanInterval > 0 {
+		reaper := &kubevirt.OrphanReaper{
+			SPI:               plugin.(*kubevirt.MachinePlugin).SPI,
+			MachineClient:     machineClient,
+			KubeClient:        kubeClient,
+			ValidationOptions: validationOptions,
+			Recorder:          recorder,
+			Timer:             core.TimerFunc(time.Now),
+			Namespace:         s.Namespace,
+			GracePeriod:       orphanGracePeriod,
+		}
+		runLeaderElected(s, kubeClient, recorder, "machine-controller-kubevirt-orphan-reaper", func(stopCh <-chan struct{}) {
+			reaper.Run(orphanScanInterval, stopCh)
+		})
+	}
+
+	if healthBindAddress != "" {
+		go serveHealth(healthBindAddress, cf)
+	}
 
 	if err := app.Run(s, plugin); err != nil {
 		fmt.Fprintf(os.Stderr, " %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// serveHealth serves the health and readiness endpoints on the given address, using the given CachingClientFactory
+// to check the connectivity to the provider clusters.
+func serveHealth(addr string, cf *core.CachingClientFactory) {
+	klog.Infof("Serving health endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, health.NewServeMux(cf)); err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runLeaderElected calls the given function in the background while this replica holds the lock with the given name
+// in the control namespace, using the leader election settings of the given MCServer. The given function must return
+// immediately and stop its work when the given stop channel is closed, i.e. when the lock is lost, after which this replica
+// competes for the lock again. If leader election is disabled, the given function is called immediately and never stopped.
+func runLeaderElected(s *options.MCServer, kubeClient kubernetes.Interface, recorder record.EventRecorder, lockName string, run func(stopCh <-chan struct{})) {
+	if !s.LeaderElection.LeaderElect {
+		run(wait.NeverStop)
+		return
+	}
+
+	id, err := os.Hostname()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := resourcelock.New(s.LeaderElection.ResourceLock, s.Namespace, lockName, kubeClient.CoreV1(), kubeClient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: recorder,
+		})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+	config := leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: s.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline: s.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:   s.LeaderElection.RetryPeriod.Duration,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("Acquired lock %s", lockName)
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("Lost lock %s", lockName)
+			},
+		},
+	}
+	go wait.Forever(func() {
+		leaderelection.RunOrDie(context.TODO(), config)
+	}, s.LeaderElection.RetryPeriod.Duration)
+}
+
+// createControlConfig creates a client config for the control cluster, using the control cluster kubeconfig
+// of the given MCServer, or its target cluster kubeconfig if not specified.
+func createControlConfig(s *options.MCServer) (*rest.Config, error) {
+	kubeconfig, err := clientcmd.BuildConfigFromFlags("", s.TargetKubeconfig)
+	if s.ControlKubeconfig == "inClusterConfig" {
+		kubeconfig, err = clientcmd.BuildConfigFromFlags("", "")
+	} else if s.ControlKubeconfig != "" {
+		kubeconfig, err = clientcmd.BuildConfigFromFlags("", s.ControlKubeconfig)
+	}
+	return kubeconfig, err
+}
+
+// createRecorder creates an EventRecorder that records events on the machine objects in the control cluster,
+// using the given control cluster clientset.
+func createRecorder(kubeClient kubernetes.Interface) (record.EventRecorder, error) {
+	if err := machinescheme.AddToScheme(scheme.Scheme); err != nil {
+		return nil, err
+	}
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.V(4).Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "machine-controller-kubevirt"}), nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command validate-machine-class validates a machine class and its secret against the provider cluster without creating
+// any machines, and prints the VirtualMachine that would be created for a machine of the machine class.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/component-base/cli/flag"
+	"k8s.io/component-base/logs"
+	cdi "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+func main() {
+	var machineClassPath, secretPath, machineName string
+	var inCluster bool
+	spiOptions, clientFactoryOptions, validationOptions := core.NewOptions(), core.NewClientFactoryOptions(), validation.NewOptions()
+	pflag.CommandLine.StringVar(&machineClassPath, "machine-class", "", "Path to a YAML file containing the MachineClass to validate")
+	pflag.CommandLine.StringVar(&secretPath, "secret", "", "Path to a YAML file containing the Secret referenced by the MachineClass")
+	pflag.CommandLine.StringVar(&machineName, "machine-name", "", "Name of the machine to validate, defaults to the MachineClass name with a \"-validate\" suffix")
+	pflag.CommandLine.StringSliceVar(&validationOptions.AllowedMachineTypes, "allowed-machine-types", validationOptions.AllowedMachineTypes,
+		"QEMU machine types that can be specified in the provider spec of machine classes")
+	pflag.CommandLine.BoolVar(&inCluster, "in-cluster", inCluster,
+		"Use the in-cluster service account credentials to access the provider cluster if the secret doesn't contain a kubeconfig")
+	pflag.CommandLine.BoolVar(&spiOptions.CapacityCheck, "capacity-check", spiOptions.CapacityCheck,
+		"Check that at least one provider cluster node has enough free resources to fit a machine of the MachineClass")
+
+	flag.InitFlags()
+	logs.InitLogs()
+	defer logs.FlushLogs()
+
+	spiOptions.InCluster, clientFactoryOptions.InCluster, validationOptions.InCluster = inCluster, inCluster, inCluster
+	plugin := kubevirt.NewKubevirtPlugin(core.NewCachingClientFactory(core.TimerFunc(time.Now), clientFactoryOptions), spiOptions, validationOptions, nil).(*kubevirt.MachinePlugin)
+	if err := run(plugin, machineClassPath, secretPath, machineName); err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run validates the MachineClass and Secret read from the given paths for a machine with the given name using the given plugin,
+// and prints the VirtualMachine that would be created as YAML.
+func run(plugin *kubevirt.MachinePlugin, machineClassPath, secretPath, machineName string) error {
+	if machineClassPath == "" || secretPath == "" {
+		return errors.New("both --machine-class and --secret must be specified")
+	}
+
+	if err := cdi.AddToScheme(scheme.Scheme); err != nil {
+		return err
+	}
+
+	machineClass := &v1alpha1.MachineClass{}
+	if err := readYAML(machineClassPath, machineClass); err != nil {
+		return err
+	}
+	secret := &corev1.Secret{}
+	if err := readYAML(secretPath, secret); err != nil {
+		return err
+	}
+	if machineName == "" {
+		machineName = machineClass.Name + "-validate"
+	}
+
+	virtualMachine, err := plugin.ValidateMachineClass(context.Background(), machineClass, secret, machineName)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(virtualMachine)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal VirtualMachine to YAML")
+	}
+	fmt.Print(string(data))
+	return nil
+}
+
+// readYAML reads the YAML file with the given path into the given object.
+func readYAML(path string, obj interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not read file %q", path)
+	}
+	if err := yaml.Unmarshal(data, obj); err != nil {
+		return errors.Wrapf(err, "could not unmarshal file %q from YAML", path)
+	}
+	return nil
+}
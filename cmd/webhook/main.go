@@ -0,0 +1,70 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command webhook serves a validating admission webhook that rejects machine classes with invalid kubevirt provider specs.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/webhook"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"k8s.io/component-base/cli/flag"
+	"k8s.io/component-base/logs"
+	"k8s.io/klog"
+)
+
+func main() {
+	var bindAddress, certFile, keyFile string
+	var port int
+	validationOptions := validation.NewOptions()
+	pflag.CommandLine.StringVar(&bindAddress, "bind-address", "0.0.0.0", "IP address on which to serve the webhook")
+	pflag.CommandLine.IntVar(&port, "port", 9443, "Port on which to serve the webhook")
+	pflag.CommandLine.StringVar(&certFile, "tls-cert-file", "", "Path to the TLS certificate file of the webhook server")
+	pflag.CommandLine.StringVar(&keyFile, "tls-private-key-file", "", "Path to the TLS private key file of the webhook server")
+	pflag.CommandLine.StringSliceVar(&validationOptions.AllowedMachineTypes, "allowed-machine-types", validationOptions.AllowedMachineTypes,
+		"QEMU machine types that can be specified in the provider spec of machine classes")
+
+	flag.InitFlags()
+	logs.InitLogs()
+	defer logs.FlushLogs()
+
+	if err := run(bindAddress, port, certFile, keyFile, validationOptions); err != nil {
+		fmt.Fprintf(os.Stderr, " %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the webhook on the given address and port, using the given TLS certificate and private key files
+// and validation options.
+func run(bindAddress string, port int, certFile, keyFile string, validationOptions *validation.Options) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("both --tls-cert-file and --tls-private-key-file must be specified")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/validate-machineclass", webhook.NewMachineClassValidator(validationOptions))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	addr := fmt.Sprintf("%s:%d", bindAddress, port)
+	klog.Infof("Serving webhook on %s", addr)
+	return http.ListenAndServeTLS(addr, certFile, keyFile, mux)
+}
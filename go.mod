@@ -9,9 +9,10 @@ require (
 	github.com/onsi/ginkgo v1.13.0
 	github.com/onsi/gomega v1.10.1
 	github.com/pkg/errors v0.9.1
-	github.com/prometheus/client_golang v1.5.1 // indirect
+	github.com/prometheus/client_golang v1.5.1
 	github.com/spf13/pflag v1.0.5
 	golang.org/x/lint v0.0.0-20191125180803-fdd1cda4f05f
+	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/api v0.18.2
 	k8s.io/apimachinery v0.18.2
 	k8s.io/client-go v12.0.0+incompatible
@@ -21,6 +22,7 @@ require (
 	kubevirt.io/client-go v0.33.0
 	kubevirt.io/containerized-data-importer v1.10.6
 	sigs.k8s.io/controller-runtime v0.5.5
+	sigs.k8s.io/yaml v1.1.0
 )
 
 replace (
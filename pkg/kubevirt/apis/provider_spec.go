@@ -23,6 +23,61 @@ import (
 // RootDiskName is name of the root disk
 const RootDiskName = "root-disk"
 
+const (
+	// DiskBusVirtio is the virtio disk bus.
+	DiskBusVirtio = "virtio"
+	// DiskBusSATA is the SATA disk bus.
+	DiskBusSATA = "sata"
+	// DiskBusSCSI is the SCSI disk bus.
+	DiskBusSCSI = "scsi"
+
+	// DiskCacheWriteBack is the writeback disk cache mode.
+	DiskCacheWriteBack kubevirtv1.DriverCache = "writeback"
+)
+
+const (
+	// BootloaderBIOS is the BIOS bootloader.
+	BootloaderBIOS = "BIOS"
+	// BootloaderEFI is the EFI bootloader.
+	BootloaderEFI = "EFI"
+
+	// CloudInitTypeNoCloud is the cloud-init NoCloud datasource.
+	CloudInitTypeNoCloud = "noCloud"
+	// CloudInitTypeConfigDrive is the cloud-init ConfigDrive datasource.
+	CloudInitTypeConfigDrive = "configDrive"
+
+	// UserDataFormatCloudInit is the cloud-init userdata format.
+	UserDataFormatCloudInit = "cloudInit"
+	// UserDataFormatIgnition is the Ignition userdata format.
+	UserDataFormatIgnition = "ignition"
+
+	// InterfaceBindingBridge is the bridge network interface binding.
+	InterfaceBindingBridge = "bridge"
+	// InterfaceBindingMasquerade is the masquerade network interface binding.
+	InterfaceBindingMasquerade = "masquerade"
+
+	// VolumeDeletionPolicyDelete means that the data volume of an additional volume is deleted together with the machine.
+	VolumeDeletionPolicyDelete = "Delete"
+	// VolumeDeletionPolicyRetain means that the data volume of an additional volume is retained when the machine is deleted.
+	VolumeDeletionPolicyRetain = "Retain"
+
+	// InputTypeTablet is the tablet input device type.
+	InputTypeTablet = "tablet"
+	// InputBusVirtio is the virtio input device bus.
+	InputBusVirtio = "virtio"
+	// InputBusUSB is the USB input device bus.
+	InputBusUSB = "usb"
+
+	// TopologyLabelsLegacy means that nodes are selected by the beta region and zone labels,
+	// i.e. "failure-domain.beta.kubernetes.io/region" and "failure-domain.beta.kubernetes.io/zone".
+	TopologyLabelsLegacy = "Legacy"
+	// TopologyLabelsGA means that nodes are selected by the GA region and zone labels,
+	// i.e. "topology.kubernetes.io/region" and "topology.kubernetes.io/zone".
+	TopologyLabelsGA = "GA"
+	// TopologyLabelsBoth means that nodes are selected by either the GA or the beta region and zone labels.
+	TopologyLabelsBoth = "Both"
+)
+
 // KubeVirtProviderSpec is the kubevirt provider specification.
 // It contains parameters to be used when creating kubevirt VMs.
 type KubeVirtProviderSpec struct {
@@ -30,29 +85,132 @@ type KubeVirtProviderSpec struct {
 	Region string `json:"region"`
 	// Zone is the VM zone name.
 	Zone string `json:"zone"`
+	// Zones is an optional list of VM zone names, as an alternative to Zone. If specified, the machines are spread across
+	// these zones, choosing the zone of each new machine by a hash of its name. The chosen zone is recorded in the VM label
+	// "kubevirt.io/zone", which determines the zone of the existing machine from then on, so that changing the list
+	// doesn't move existing machines.
+	// +optional
+	Zones []string `json:"zones,omitempty"`
+	// TopologyLabels specifies the region and zone labels of the provider cluster nodes used to schedule the VM
+	// in its region and zone. Valid values are "Legacy", "GA", and "Both". If not specified, the labels are detected
+	// from the Kubernetes version of the provider cluster, i.e. the beta labels are used before 1.17 and the GA labels afterwards.
+	// With "Both", a node matches if it's in the region and zone according to either of them, which is useful for clusters
+	// whose nodes are labeled inconsistently.
+	// +optional
+	TopologyLabels string `json:"topologyLabels,omitempty"`
+	// RegionLabel optionally overrides the key of the region label of the provider cluster nodes.
+	// It cannot be specified if the topology labels are "Both".
+	// +optional
+	RegionLabel string `json:"regionLabel,omitempty"`
+	// ZoneLabel optionally overrides the key of the zone label of the provider cluster nodes.
+	// It cannot be specified if the topology labels are "Both".
+	// +optional
+	ZoneLabel string `json:"zoneLabel,omitempty"`
 	// Resources specifies the requests and limits for VM resources (CPU and memory).
 	Resources kubevirtv1.ResourceRequirements `json:"resources"`
+	// OvercommitGuestOverhead specifies whether the guest-management overhead should be excluded from the VM pod memory requests.
+	// If true, the overhead is only added to the pod memory limits, which allows the VM to request less memory than the guest sees.
+	// +optional
+	OvercommitGuestOverhead bool `json:"overcommitGuestOverhead,omitempty"`
 	// Devices is the specification of disks and additional high performance options
 	Devices *Devices `json:"devices,omitempty"`
+	// IOThreadsPolicy specifies whether disks share IOThreads.
+	// Valid values are "shared" and "auto". If not specified, IOThreads are not used, unless a disk requests a dedicated IOThread.
+	// +optional
+	IOThreadsPolicy *kubevirtv1.IOThreadsPolicy `json:"ioThreadsPolicy,omitempty"`
 	// RootVolume is the specification for the root volume of the VM.
-	RootVolume cdicorev1alpha1.DataVolumeSpec `json:"rootVolume"`
+	RootVolume RootVolumeSpec `json:"rootVolume"`
+	// RootDisk allows tuning the disk the root volume is attached as.
+	// +optional
+	RootDisk *DiskOptions `json:"rootDisk,omitempty"`
 	// AdditionalVolumes is an optional list of additional volumes attached to the VM.
 	// +optional
 	AdditionalVolumes []AdditionalVolumeSpec `json:"additionalVolumes,omitempty"`
-	// SSHKeys is an optional list of SSH public keys added to the VM.
+	// SSHKeys is an optional list of SSH public keys added to the VM. They are added to cloud-config and Ignition userdata only,
+	// other userdata, e.g. shell scripts or multi-part MIME userdata, is passed to the VM unchanged.
 	// +optional
 	SSHKeys []string `json:"sshKeys,omitempty"`
 	// Networks is an optional list of networks for the VM. If any of the networks is specified as "default"
-	// the pod network won't be added, otherwise it will be added as default.
+	// the pod network won't be added, otherwise it will be added as default, unless DisablePodNetwork is set.
 	// +optional
 	Networks []NetworkSpec `json:"networks,omitempty"`
-	// CPU allows specifying the CPU topology of the VM.
+	// DisablePodNetwork is whether the pod network is not added even if none of the networks is specified as "default",
+	// so that the VM is only connected to the specified Multus networks. At least one network must be specified.
+	// +optional
+	DisablePodNetwork bool `json:"disablePodNetwork,omitempty"`
+	// NetworkData is an optional cloud-init network data document that is used instead of the one
+	// generated from the networks. It allows specifying network configurations not supported by the networks.
+	// +optional
+	NetworkData string `json:"networkData,omitempty"`
+	// CloudInitType is the cloud-init datasource used to provide the userdata and network data to the VM.
+	// Defaults to "noCloud" and valid values are "noCloud" or "configDrive".
+	// +optional
+	CloudInitType string `json:"cloudInitType,omitempty"`
+	// Sysprep is an optional reference to a ConfigMap or Secret containing the answer files of Windows setup,
+	// e.g. "autounattend.xml". It's attached to the VM as a CD-ROM, on which Windows setup discovers the answer files.
+	// +optional
+	Sysprep *SysprepSpec `json:"sysprep,omitempty"`
+	// Windows enables the defaults for Windows guests. It attaches the virtio-win drivers container disk to the VM
+	// as a CD-ROM, so that Windows setup can load the virtio drivers, and enables the Hyper-V enlightenments and
+	// the timers recommended for Windows, unless Features or Clock are specified.
+	// +optional
+	Windows *WindowsSpec `json:"windows,omitempty"`
+	// UserDataFormat is the format of the userdata, either "cloudInit" or "ignition".
+	// Ignition userdata is passed to the VM via the Ignition mechanism of KubeVirt instead of a cloud-init disk,
+	// which requires the ExperimentalIgnitionSupport feature gate. If not specified, the format is detected from the userdata.
+	// +optional
+	UserDataFormat string `json:"userDataFormat,omitempty"`
+	// CompressUserData is whether the cloud-init userdata is gzip-compressed, which cloud-init detects and handles automatically.
+	// If not specified, the userdata is compressed only if it's larger than 16 KiB.
+	// +optional
+	CompressUserData *bool `json:"compressUserData,omitempty"`
+	// InjectMachineIdentity is whether a file containing the identity of the machine is added to the cloud-init userdata,
+	// so that the node can identify itself during bootstrap without external lookups. The file "/etc/machine-identity"
+	// contains the shell variables MACHINE_NAME, PROVIDER_ID, ZONE, and the UserDataAdditions, and can be sourced.
+	// It can't be specified with the Ignition userdata format.
+	// +optional
+	InjectMachineIdentity bool `json:"injectMachineIdentity,omitempty"`
+	// UserDataAdditions is an optional map of custom key/values added to the machine identity file, see InjectMachineIdentity.
+	// The keys must be valid shell variable names. The values are templates that can reference the same values as Hostname.
+	// +optional
+	UserDataAdditions map[string]string `json:"userDataAdditions,omitempty"`
+	// CPU allows specifying the CPU topology, model, and features of the VM.
+	// The model can be "host-model", "host-passthrough", or a named CPU model. If a named CPU model or required CPU features
+	// are specified, machine creation fails unless a provider cluster node supports them according to the KubeVirt node labeller.
+	// If cpu.dedicatedCpuPlacement is true, the CPU request must be an integer, and any CPU and memory limits must equal the requests.
 	// +optional
 	CPU *kubevirtv1.CPU `json:"cpu,omitempty"`
 	// Memory allows specifying the VM memory features such as hugepages and guest memory settings.
 	// Each feature might require enabling the appropriate feature gate.
+	// If memory.guest is larger than the requested memory, a memory limit at least as large as memory.guest must be specified.
+	// If memory.hugepages is specified, the guest memory must be a multiple of the page size, and any CPU and memory limits must equal the requests.
 	// +optional
 	Memory *kubevirtv1.Memory `json:"memory,omitempty"`
+	// Tolerations is an optional list of tolerations of the VM pod.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// NodeSelector is an optional map of node labels that must match for the VM pod to be scheduled on a node.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Affinity is an optional affinity specification of the VM pod.
+	// Its node affinity is merged with the node affinity generated from the region and zone.
+	// +optional
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// MachineType is the QEMU machine type (chipset) of the VM, e.g. "q35" or "pc".
+	// Defaults to the default machine type of the KubeVirt cluster.
+	// +optional
+	MachineType string `json:"machineType,omitempty"`
+	// Firmware allows specifying the firmware of the VM, such as the bootloader and secure boot.
+	// +optional
+	Firmware *Firmware `json:"firmware,omitempty"`
+	// Features allows specifying the hypervisor features of the VM, such as ACPI, APIC, and Hyper-V enlightenments.
+	// If secure boot is enabled, System Management Mode (SMM) is always enabled.
+	// +optional
+	Features *kubevirtv1.Features `json:"features,omitempty"`
+	// Clock allows specifying the guest clock, i.e. its UTC offset or timezone, and its timers.
+	// Windows guests usually require the clock to be in the local timezone and the Hyper-V timer.
+	// +optional
+	Clock *kubevirtv1.Clock `json:"clock,omitempty"`
 	// DNSPolicy is the DNS policy of the VM pod.
 	// Defaults to "ClusterFirst" and valid values are "ClusterFirstWithHostNet", "ClusterFirst", "Default" or "None".
 	// +optional
@@ -61,15 +219,123 @@ type KubeVirtProviderSpec struct {
 	// The parameters specified here will be merged with the DNS configuration generated based on DNSPolicy.
 	// +optional
 	DNSConfig *corev1.PodDNSConfig `json:"dnsConfig,omitempty"`
+	// PriorityClassName is the name of an optional priority class of the VM pod.
+	// +optional
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// Hostname is an optional template of the hostname of the VM, e.g. "{{ .MachineName }}-node".
+	// The template can reference the machine name as {{ .MachineName }}, the zone of the machine as {{ .Zone }},
+	// and the last dash-separated part of the machine name as {{ .Index }}. Defaults to the machine name.
+	// +optional
+	Hostname string `json:"hostname,omitempty"`
+	// Subdomain is an optional template of the subdomain of the VM, which can reference the same values as Hostname.
+	// If specified, the fully qualified hostname of the VM is
+	// "<hostname>.<subdomain>.<namespace>.svc.<cluster domain>".
+	// +optional
+	Subdomain string `json:"subdomain,omitempty"`
+	// SchedulerName is the name of an optional custom scheduler that schedules the VM pod.
+	// If not specified, the VM pod is scheduled by the default scheduler.
+	// +optional
+	SchedulerName string `json:"schedulerName,omitempty"`
+	// ShutdownGracePeriodSeconds enables the graceful shutdown of the VM when its machine is deleted.
+	// If specified, the VM is first stopped, which shuts down the guest via ACPI or the guest agent, and only deleted
+	// once it's stopped, or after this grace period has elapsed. It's also used as the termination grace period of the VMI.
+	// If not specified, the VM is deleted right away with a termination grace period of 30 seconds.
+	// +optional
+	ShutdownGracePeriodSeconds *int64 `json:"shutdownGracePeriodSeconds,omitempty"`
+	// SnapshotOnDelete enables taking a kubevirt VM snapshot of the VM, including its root and data volumes,
+	// when its machine is deleted. The VM is only deleted once the snapshot is ready to use.
+	// The snapshot is labeled with the machine name and the labels of the VM, and deleted once it has expired,
+	// see the --snapshot-ttl flag. Requires the kubevirt snapshot feature and volume snapshot support
+	// of the storage classes used by the VM. Combine with ShutdownGracePeriodSeconds for consistent snapshots.
+	// +optional
+	SnapshotOnDelete bool `json:"snapshotOnDelete,omitempty"`
+	// AllowRootDiskExport enables exporting the root disk of a VM via a kubevirt VM export when its machine is annotated
+	// with "kubevirt.io/export-root-disk", e.g. to pull a forensic image of a failed worker. The VM is stopped for the export,
+	// and its deletion is held back for as long as the machine is annotated. Requires KubeVirt v0.55 or later.
+	// +optional
+	AllowRootDiskExport bool `json:"allowRootDiskExport,omitempty"`
+	// LivenessProbe is an optional probe of the VM liveness. If it fails, the VM is restarted.
+	// +optional
+	LivenessProbe *kubevirtv1.Probe `json:"livenessProbe,omitempty"`
+	// ReadinessProbe is an optional probe of the VM readiness. If it fails after the VM has become ready,
+	// the machine is reported as unhealthy.
+	// +optional
+	ReadinessProbe *kubevirtv1.Probe `json:"readinessProbe,omitempty"`
 	// Tags is an optional map of tags that are added to the VM as labels.
+	// The tag values are templates that can reference the same values as Hostname, e.g. "{{ .Zone }}".
 	// +optional
 	Tags map[string]string `json:"tags,omitempty"`
+	// Annotations is an optional map of annotations that are added to the VM.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// VMIAnnotations is an optional map of annotations that are added to the VMI template of the VM.
+	// +optional
+	VMIAnnotations map[string]string `json:"vmiAnnotations,omitempty"`
+	// VMILabels is an optional map of labels that are added to the VMI template of the VM.
+	// +optional
+	VMILabels map[string]string `json:"vmiLabels,omitempty"`
+	// Eviction optionally specifies how the VM is evicted by the descheduler and by node maintenance operators
+	// of the provider cluster.
+	// +optional
+	Eviction *EvictionSpec `json:"eviction,omitempty"`
+}
+
+// EvictionSpec specifies how a VM is evicted by the descheduler and by node maintenance operators.
+type EvictionSpec struct {
+	// Strategy is the eviction strategy of the VMI. If "LiveMigrate", the VMI is live migrated instead of stopped
+	// when its node is drained, e.g. by a node maintenance operator. This requires all volumes of the VM to be shared.
+	// +optional
+	Strategy *kubevirtv1.EvictionStrategy `json:"strategy,omitempty"`
+	// Descheduler is whether the VM pod can be evicted by the descheduler, which otherwise skips pods with local storage
+	// such as VM pods. If true, the "descheduler.alpha.kubernetes.io/evict" annotation is added to the VMI template.
+	// +optional
+	Descheduler bool `json:"descheduler,omitempty"`
+}
+
+// RootVolumeSpec represents the root volume of a VM. It is either a data volume that is created for the VM,
+// or an existing persistent volume claim.
+type RootVolumeSpec struct {
+	// DataVolumeSpec is the specification of the data volume that is created for the VM.
+	// It must be empty if persistentVolumeClaim is specified.
+	cdicorev1alpha1.DataVolumeSpec `json:",inline"`
+	// PersistentVolumeClaim is an optional reference to an existing PersistentVolumeClaim in the same namespace
+	// that is used as the root volume instead of a data volume, e.g. a pre-provisioned golden root disk.
+	// It is not deleted when the VM is deleted.
+	// +optional
+	PersistentVolumeClaim *corev1.PersistentVolumeClaimVolumeSource `json:"persistentVolumeClaim,omitempty"`
+	// Cache is whether the image of an http or registry data volume source is imported only once per namespace
+	// into a cached image data volume, which is then cloned into the root volume of each VM using the same image and storage.
+	// Cached images that have not been used for a while are deleted automatically.
+	// +optional
+	Cache bool `json:"cache,omitempty"`
+}
+
+// SysprepSpec represents the source of the answer files of Windows setup.
+// Exactly one of its members must be specified.
+type SysprepSpec struct {
+	// ConfigMap is a reference to a ConfigMap in the same namespace containing the answer files.
+	// +optional
+	ConfigMap *corev1.LocalObjectReference `json:"configMap,omitempty"`
+	// Secret is a reference to a Secret in the same namespace containing the answer files.
+	// +optional
+	Secret *corev1.LocalObjectReference `json:"secret,omitempty"`
+}
+
+// DefaultVirtioDriversImage is the default virtio-win drivers container disk image.
+const DefaultVirtioDriversImage = "quay.io/kubevirt/virtio-container-disk:v0.33.0"
+
+// WindowsSpec represents the defaults for Windows guests.
+type WindowsSpec struct {
+	// VirtioDriversImage is the virtio-win drivers container disk image attached to the VM as a CD-ROM.
+	// Defaults to DefaultVirtioDriversImage.
+	// +optional
+	VirtioDriversImage string `json:"virtioDriversImage,omitempty"`
 }
 
 // AdditionalVolumeSpec represents an additional volume attached to a VM.
 // Only one of its members may be specified.
 type AdditionalVolumeSpec struct {
-	// Name is the additional volume name
+	// Name is the additional volume name, which is a template that can reference the same values as Hostname.
 	Name string `json:"name"`
 	// DataVolume is an optional specification of an additional data volume.
 	// +optional
@@ -77,6 +343,59 @@ type AdditionalVolumeSpec struct {
 	// VolumeSource is an optional reference to an additional volume source.
 	// +optional
 	VolumeSource *VolumeSource `json:"volumeSource,omitempty"`
+	// EmptyDisk is an optional specification of an additional sparse scratch disk with the given capacity.
+	// It's backed by the VM pod's ephemeral storage, so it neither requires CDI nor a storage class,
+	// and its contents are lost when the VM is stopped.
+	// +optional
+	EmptyDisk *kubevirtv1.EmptyDiskSource `json:"emptyDisk,omitempty"`
+	// DiskOptions allows tuning the disk the additional volume is attached as.
+	DiskOptions `json:",inline"`
+	// Hotpluggable specifies whether the disk of the additional volume should be prepared for hotplugging.
+	// Such disks are attached via the SCSI bus and expose the volume name as serial number, so that they can be
+	// identified in the guest when volumes are later attached or detached without recreating the VM.
+	// +optional
+	Hotpluggable bool `json:"hotpluggable,omitempty"`
+	// Bootable specifies whether the VM can boot from the disk of the additional volume, e.g. a rescue ISO.
+	// If any additional volume or network is bootable, the boot order is root disk first, then PXE boot networks,
+	// then bootable additional volumes, each in the order they are specified.
+	// +optional
+	Bootable bool `json:"bootable,omitempty"`
+	// DeletionPolicy specifies what happens to the data volume of the additional volume when the machine is deleted.
+	// Valid values are "Delete" and "Retain". Defaults to "Delete", meaning that the data volume is created as part of the VM
+	// and deleted together with it. With "Retain", the data volume is created as a standalone object named
+	// "<machine name>-<volume name>", or according to DataVolumeName, that is retained when the machine is deleted,
+	// and attached again to a machine resulting in the same name when it's recreated. It can only be specified for data volumes.
+	// +optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// DataVolumeName is an optional template of the name of the retained data volume, e.g. "{{ .MachineName }}-data".
+	// The template can reference the same values as Hostname. Since machine names are generated, it allows
+	// deriving the name from a stable key instead, so that a recreated machine attaches the data volume of its predecessor,
+	// e.g. "{{ .Zone }}-data" for a machine class with a single machine per zone. Creating a machine fails while
+	// the retained data volume is still used by the VM of another machine. Defaults to "{{ .MachineName }}-<volume name>".
+	// It can only be specified if the deletion policy is "Retain".
+	// +optional
+	DataVolumeName string `json:"dataVolumeName,omitempty"`
+}
+
+// DiskOptions allows tuning the disk a volume is attached as.
+// If a disk with the same name is also specified in devices.disks, these options take precedence.
+type DiskOptions struct {
+	// Bus is the type of disk device to emulate.
+	// Valid values are "virtio", "sata", and "scsi". Defaults to "virtio".
+	// +optional
+	Bus string `json:"bus,omitempty"`
+	// Cache is the disk cache mode.
+	// Valid values are "none", "writethrough", and "writeback".
+	// +optional
+	Cache kubevirtv1.DriverCache `json:"cache,omitempty"`
+	// IO is the disk IO mode.
+	// Valid values are "native" and "threads". The "native" mode can only be used with cache mode "none".
+	// +optional
+	IO kubevirtv1.DriverIO `json:"io,omitempty"`
+	// Serial is the serial number of the disk, which can be used to identify it in the guest.
+	// It must consist of alphanumeric characters, '_', '.', '+', or '-'.
+	// +optional
+	Serial string `json:"serial,omitempty"`
 }
 
 // VolumeSource represents the source of a volume to mount.
@@ -94,6 +413,10 @@ type VolumeSource struct {
 	// More info: https://kubernetes.io/docs/concepts/configuration/secret/
 	// +optional
 	Secret *kubevirtv1.SecretVolumeSource `json:"secret,omitempty"`
+	// ServiceAccount represents a reference to a service account in the same namespace, whose token, CA certificate,
+	// and namespace are attached to the VM as a disk. At most one service account volume can be specified.
+	// +optional
+	ServiceAccount *kubevirtv1.ServiceAccountVolumeSource `json:"serviceAccount,omitempty"`
 }
 
 // Devices allows to fine-tune devices attached to KubeVirt VM
@@ -104,19 +427,99 @@ type Devices struct {
 	// Rng specifies whether to have a random number generator from host.
 	// +optional
 	Rng *kubevirtv1.Rng `json:"rng,omitempty"`
+	// Watchdog is an optional watchdog device, which triggers its action if the guest stops responding.
+	// Only the i6300esb watchdog device is supported, and its action defaults to "reset".
+	// +optional
+	Watchdog *kubevirtv1.Watchdog `json:"watchdog,omitempty"`
 	// BlockMultiQueue specifies whether to enable virtio multi-queue for block devices.
 	// +optional
 	BlockMultiQueue bool `json:"blockMultiQueue,omitempty"`
 	// NetworkInterfaceMultiQueue specifies whether virtual network interfaces configured with a virtio bus will also enable the vhost multi-queue feature.
 	// +optional
 	NetworkInterfaceMultiQueue bool `json:"networkInterfaceMultiqueue,omitempty"`
+	// AutoattachMemBalloon specifies whether to attach the memory balloon device, which allows the provider cluster
+	// to reclaim unused guest memory. It can be disabled for latency-sensitive workloads. Defaults to true.
+	// +optional
+	AutoattachMemBalloon *bool `json:"autoattachMemBalloon,omitempty"`
+	// AutoattachSerialConsole specifies whether to attach the default serial console. Defaults to true.
+	// +optional
+	AutoattachSerialConsole *bool `json:"autoattachSerialConsole,omitempty"`
+	// AutoattachGraphicsDevice specifies whether to attach the default graphics device, which is needed for VNC access.
+	// It can be disabled for headless machines to save resources. Defaults to true.
+	// +optional
+	AutoattachGraphicsDevice *bool `json:"autoattachGraphicsDevice,omitempty"`
+	// Tablet is an optional tablet input device, which improves the mouse pointer handling via VNC.
+	// Its type defaults to "tablet", and its bus can be "virtio" or "usb".
+	// +optional
+	Tablet *kubevirtv1.Input `json:"tablet,omitempty"`
+}
+
+// Firmware contains the firmware configuration of a VM.
+type Firmware struct {
+	// Bootloader is the bootloader used by the VM.
+	// Valid values are "BIOS" and "EFI". Defaults to "BIOS".
+	// +optional
+	Bootloader string `json:"bootloader,omitempty"`
+	// SecureBoot specifies whether secure boot is enabled. It can only be enabled with the "EFI" bootloader.
+	// Enabling secure boot also enables System Management Mode (SMM).
+	// +optional
+	SecureBoot bool `json:"secureBoot,omitempty"`
+	// Serial is the system serial number reported in SMBIOS.
+	// +optional
+	Serial string `json:"serial,omitempty"`
 }
 
 // NetworkSpec contains information about a network.
 type NetworkSpec struct {
-	// Name is the name (in the format <name> or <namespace>/<name>) of the network.
+	// Name is the name (in the format <name> or <namespace>/<name>) of the network, which is a template that can
+	// reference the same values as Hostname, e.g. "nets/{{ .Zone }}".
 	Name string `json:"name"`
 	// Default is whether the network is the default or not.
 	// +optional
 	Default bool `json:"default,omitempty"`
+	// DefaultViaAnnotation specifies whether the default network is set via the "v1.multus-cni.io/default-network"
+	// annotation on the VM pod instead of the Multus network source, as required by some clusters.
+	// In this case, the VM is connected to the pod network, which Multus replaces with this network.
+	// It can only be enabled for the default network.
+	// +optional
+	DefaultViaAnnotation bool `json:"defaultViaAnnotation,omitempty"`
+	// Addresses is an optional list of static IP addresses in CIDR notation (e.g. "10.0.0.10/24") of the network interface.
+	// If not specified, DHCP is used to configure the network interface.
+	// +optional
+	Addresses []string `json:"addresses,omitempty"`
+	// Gateway is the optional IP address of the default gateway of the network interface.
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+	// Nameservers is an optional list of IP addresses of the DNS servers of the network interface.
+	// +optional
+	Nameservers []string `json:"nameservers,omitempty"`
+	// MTU is the optional MTU of the network interface.
+	// +optional
+	MTU int `json:"mtu,omitempty"`
+	// Binding is the binding method of the network interface.
+	// Valid values are "bridge" and "masquerade". Defaults to "bridge".
+	// The "masquerade" binding can only be used for the default network.
+	// +optional
+	Binding string `json:"binding,omitempty"`
+	// Ports is an optional list of ports that are forwarded to the VM if the binding is "masquerade".
+	// If not specified, all ports are forwarded.
+	// +optional
+	Ports []kubevirtv1.Port `json:"ports,omitempty"`
+	// Model is the optional model of the network interface.
+	// Valid values are "virtio", "e1000", "e1000e", "ne2k_pci", "pcnet", and "rtl8139". Defaults to "virtio".
+	// +optional
+	Model string `json:"model,omitempty"`
+	// MACAddress is an optional static MAC address of the network interface.
+	// Since all machines of a machine class share it, it should only be used for machine classes with a single machine.
+	// +optional
+	MACAddress string `json:"macAddress,omitempty"`
+	// MACAddressPrefix is an optional prefix of 1 to 5 octets, e.g. "02:00:5e", of the MAC address of the network interface.
+	// The remaining octets are derived from the machine name, so that each machine keeps the same MAC address across reconciles,
+	// e.g. for DHCP reservations. It cannot be specified together with macAddress.
+	// +optional
+	MACAddressPrefix string `json:"macAddressPrefix,omitempty"`
+	// PXEBoot specifies whether the VM can boot via PXE from the network interface.
+	// PXE boot networks are tried after the root disk, see AdditionalVolumeSpec.Bootable.
+	// +optional
+	PXEBoot bool `json:"pxeBoot,omitempty"`
 }
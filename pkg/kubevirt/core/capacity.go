@@ -0,0 +1,216 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// nodeSelectorOperators maps node selector operators to label selector operators.
+var nodeSelectorOperators = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+// checkCapacity checks that at least one provider cluster node the given virtual machine instance can be scheduled on,
+// according to its node selector, required node affinity, and tolerations, has enough free resources to fit its CPU
+// and memory requests. The free resources of a node are its allocatable resources minus the requests of the pods
+// running on it. If listing pods is forbidden, only the allocatable resources are considered.
+// The check is skipped if listing the provider cluster nodes is forbidden.
+func checkCapacity(ctx context.Context, c client.Client, vmiSpec *kubevirtv1.VirtualMachineInstanceSpec) error {
+	nodeList := &corev1.NodeList{}
+	if err := c.List(ctx, nodeList); err != nil {
+		if apierrors.IsForbidden(err) {
+			logging.InfoS(2, "Listing nodes is forbidden, skipping capacity check", "err", err)
+			return nil
+		}
+		return errors.Wrap(err, "could not list nodes")
+	}
+
+	requested, err := getNodeRequests(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	requests := getVMIRequests(vmiSpec)
+	for i := range nodeList.Items {
+		node := &nodeList.Items[i]
+		if !isSchedulable(node, vmiSpec) {
+			continue
+		}
+		if fits(requests, node.Status.Allocatable, requested[node.Name]) {
+			return nil
+		}
+	}
+	return &ResourceExhaustedError{
+		Err: errors.Errorf("no provider cluster node has enough free resources to fit the requests %s", formatResourceList(requests)),
+	}
+}
+
+// getVMIRequests returns the resource requests of the virt-launcher pod of the given virtual machine instance.
+// These are the requests of the virtual machine instance, plus one CPU if its emulator thread is isolated
+// on a dedicated CPU, since KubeVirt requests an additional CPU for the emulator thread in this case.
+func getVMIRequests(vmiSpec *kubevirtv1.VirtualMachineInstanceSpec) corev1.ResourceList {
+	requests := vmiSpec.Domain.Resources.Requests
+	if cpu := vmiSpec.Domain.CPU; cpu == nil || !cpu.DedicatedCPUPlacement || !cpu.IsolateEmulatorThread {
+		return requests
+	}
+	requests = requests.DeepCopy()
+	quantity := requests[corev1.ResourceCPU]
+	quantity.Add(resource.MustParse("1"))
+	requests[corev1.ResourceCPU] = quantity
+	return requests
+}
+
+// getNodeRequests returns the sum of the resource requests of the non-terminated pods running on each node, by node name.
+// If listing pods is forbidden, it returns an empty map.
+func getNodeRequests(ctx context.Context, c client.Client) (map[string]corev1.ResourceList, error) {
+	requested := make(map[string]corev1.ResourceList)
+
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList); err != nil {
+		if apierrors.IsForbidden(err) {
+			logging.InfoS(2, "Listing pods is forbidden, checking capacity against allocatable resources only", "err", err)
+			return requested, nil
+		}
+		return nil, errors.Wrap(err, "could not list pods")
+	}
+
+	for _, pod := range podList.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if requested[pod.Spec.NodeName] == nil {
+			requested[pod.Spec.NodeName] = corev1.ResourceList{}
+		}
+		for _, container := range pod.Spec.Containers {
+			for name, quantity := range container.Resources.Requests {
+				sum := requested[pod.Spec.NodeName][name]
+				sum.Add(quantity)
+				requested[pod.Spec.NodeName][name] = sum
+			}
+		}
+	}
+	return requested, nil
+}
+
+// isSchedulable returns true if a pod with the node selector, required node affinity, and tolerations
+// of the given virtual machine instance spec can be scheduled on the given node, false otherwise.
+func isSchedulable(node *corev1.Node, vmiSpec *kubevirtv1.VirtualMachineInstanceSpec) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	if !labels.SelectorFromSet(vmiSpec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	if affinity := vmiSpec.Affinity; affinity != nil && affinity.NodeAffinity != nil && affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		if !matchesNodeSelectorTerms(node, affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) {
+			return false
+		}
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		if !toleratesTaint(vmiSpec.Tolerations, taint) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesNodeSelectorTerms returns true if the labels of the given node match any of the given node selector terms, false otherwise.
+func matchesNodeSelectorTerms(node *corev1.Node, terms []corev1.NodeSelectorTerm) bool {
+	for _, term := range terms {
+		selector := labels.NewSelector()
+		valid := len(term.MatchExpressions) > 0
+		for _, expression := range term.MatchExpressions {
+			requirement, err := labels.NewRequirement(expression.Key, nodeSelectorOperators[expression.Operator], expression.Values)
+			if err != nil {
+				valid = false
+				break
+			}
+			selector = selector.Add(*requirement)
+		}
+		if valid && selector.Matches(labels.Set(node.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// toleratesTaint returns true if any of the given tolerations tolerates the given taint, false otherwise.
+func toleratesTaint(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// capacityResources are the resources considered by the capacity check.
+var capacityResources = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+
+// fits returns true if the CPU and memory of the given requests fit into the given allocatable resources minus
+// the given requested resources, false otherwise.
+func fits(requests, allocatable, requested corev1.ResourceList) bool {
+	for _, name := range capacityResources {
+		quantity, ok := requests[name]
+		if !ok {
+			continue
+		}
+		free, ok := allocatable[name]
+		if !ok {
+			return false
+		}
+		free = free.DeepCopy()
+		if used, ok := requested[name]; ok {
+			free.Sub(used)
+		}
+		if free.Cmp(quantity) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// formatResourceList formats the given resource list as a comma-separated list of name=quantity pairs.
+func formatResourceList(resources corev1.ResourceList) string {
+	var pairs []string
+	for _, name := range capacityResources {
+		if quantity, ok := resources[name]; ok {
+			pairs = append(pairs, string(name)+"="+quantity.String())
+		}
+	}
+	return "[" + strings.Join(pairs, ", ") + "]"
+}
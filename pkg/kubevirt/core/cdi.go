@@ -0,0 +1,147 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	// cdiV1beta1GroupVersion is the CDI v1beta1 GroupVersion, served by CDI v1.13 and later.
+	cdiV1beta1GroupVersion = schema.GroupVersion{Group: cdicorev1alpha1.SchemeGroupVersion.Group, Version: "v1beta1"}
+	// cdiGroupVersions are the supported CDI GroupVersions, in order of preference.
+	cdiGroupVersions = []schema.GroupVersion{cdiV1beta1GroupVersion, cdicorev1alpha1.SchemeGroupVersion}
+)
+
+// dataVolumeClient reads and writes data volumes using the most preferred CDI version served by the provider cluster.
+// Since the v1beta1 data volume schema is compatible with the v1alpha1 one, data volumes are represented by
+// the v1alpha1 types, and converted to unstructured objects of the negotiated version when sent to the provider cluster.
+type dataVolumeClient struct {
+	c  client.Client
+	gv *schema.GroupVersion
+}
+
+// newDataVolumeClient creates a new dataVolumeClient using the given client.
+func newDataVolumeClient(c client.Client) *dataVolumeClient {
+	return &dataVolumeClient{
+		c: c,
+	}
+}
+
+// Get gets the data volume with the given key.
+func (dc *dataVolumeClient) Get(ctx context.Context, key client.ObjectKey, dataVolume *cdicorev1alpha1.DataVolume) error {
+	return dc.do(func(gv schema.GroupVersion) error {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gv.WithKind("DataVolume"))
+		if err := dc.c.Get(ctx, key, obj); err != nil {
+			return err
+		}
+		return fromUnstructured(obj, dataVolume)
+	})
+}
+
+// List lists the data volumes matching the given options.
+func (dc *dataVolumeClient) List(ctx context.Context, dataVolumeList *cdicorev1alpha1.DataVolumeList, opts ...client.ListOption) error {
+	return dc.do(func(gv schema.GroupVersion) error {
+		obj := &unstructured.UnstructuredList{}
+		obj.SetGroupVersionKind(gv.WithKind("DataVolumeList"))
+		if err := dc.c.List(ctx, obj, opts...); err != nil {
+			return err
+		}
+		return fromUnstructured(obj, dataVolumeList)
+	})
+}
+
+// Create creates the given data volume.
+func (dc *dataVolumeClient) Create(ctx context.Context, dataVolume *cdicorev1alpha1.DataVolume) error {
+	return dc.write(dataVolume, func(obj *unstructured.Unstructured) error {
+		return dc.c.Create(ctx, obj)
+	})
+}
+
+// Update updates the given data volume.
+func (dc *dataVolumeClient) Update(ctx context.Context, dataVolume *cdicorev1alpha1.DataVolume) error {
+	return dc.write(dataVolume, func(obj *unstructured.Unstructured) error {
+		return dc.c.Update(ctx, obj)
+	})
+}
+
+// Delete deletes the given data volume.
+func (dc *dataVolumeClient) Delete(ctx context.Context, dataVolume *cdicorev1alpha1.DataVolume) error {
+	return dc.do(func(gv schema.GroupVersion) error {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gv.WithKind("DataVolume"))
+		obj.SetNamespace(dataVolume.Namespace)
+		obj.SetName(dataVolume.Name)
+		return dc.c.Delete(ctx, obj)
+	})
+}
+
+// write converts the given data volume to an unstructured object of the negotiated version, calls the given function
+// with it, and updates the given data volume from the result.
+func (dc *dataVolumeClient) write(dataVolume *cdicorev1alpha1.DataVolume, f func(*unstructured.Unstructured) error) error {
+	return dc.do(func(gv schema.GroupVersion) error {
+		obj, err := toUnstructured(dataVolume)
+		if err != nil {
+			return err
+		}
+		obj.SetGroupVersionKind(gv.WithKind("DataVolume"))
+		if err := f(obj); err != nil {
+			return err
+		}
+		return fromUnstructured(obj, dataVolume)
+	})
+}
+
+// do calls the given function with the negotiated CDI version. If the version has not been negotiated yet,
+// the function is called with each supported version in order of preference, until the provider cluster serves it.
+func (dc *dataVolumeClient) do(f func(schema.GroupVersion) error) error {
+	if dc.gv != nil {
+		return f(*dc.gv)
+	}
+	var err error
+	for i := range cdiGroupVersions {
+		if err = f(cdiGroupVersions[i]); !meta.IsNoMatchError(err) {
+			dc.gv = &cdiGroupVersions[i]
+			return err
+		}
+	}
+	return err
+}
+
+// toUnstructured converts the given object to an unstructured object.
+func toUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not convert object to unstructured")
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// fromUnstructured converts the given unstructured object or list to the given object.
+func fromUnstructured(u runtime.Unstructured, obj runtime.Object) error {
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), obj); err != nil {
+		return errors.Wrap(err, "could not convert object from unstructured")
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc" // for OIDC auth provider registration
+	"k8s.io/client-go/rest"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// serverVersionTTL is the duration for which a server version is cached.
+const serverVersionTTL = 10 * time.Minute
+
+// ClientFactoryOptions are the options of a CachingClientFactory.
+type ClientFactoryOptions struct {
+	// InCluster is whether the in-cluster mode is enabled by default for secrets that don't contain a kubeconfig.
+	// In the in-cluster mode, the provider uses its own service account credentials to access the provider cluster.
+	InCluster bool
+	// QPS is the maximum QPS of the provider cluster clients.
+	QPS float32
+	// Burst is the maximum burst of the provider cluster clients.
+	Burst int
+	// ConnectivityCheckTTL is the duration for which the result of checking that a provider cluster can be reached is cached,
+	// see CachingClientFactory.CheckConnectivity.
+	ConnectivityCheckTTL time.Duration
+	// ConnectivityCheckTimeout is the maximum duration of checking that a provider cluster can be reached,
+	// after which the check fails. It must be shorter than the timeout of the probes using the health endpoints.
+	ConnectivityCheckTimeout time.Duration
+}
+
+// NewClientFactoryOptions creates new ClientFactoryOptions with the default values.
+func NewClientFactoryOptions() *ClientFactoryOptions {
+	return &ClientFactoryOptions{
+		QPS:                      rest.DefaultQPS,
+		Burst:                    rest.DefaultBurst,
+		ConnectivityCheckTTL:     30 * time.Second,
+		ConnectivityCheckTimeout: 3 * time.Second,
+	}
+}
+
+// CachingClientFactory is a ClientFactory, ServerVersionFactory, and SubresourceClient that caches the clients created for each secret.
+// Reusing the clients across SPI calls keeps the credentials obtained via exec credential plugins or OIDC auth providers,
+// which are refreshed by the client transport when they expire, instead of obtaining them again for each call.
+// It also caches the server version for serverVersionTTL, to avoid a discovery call for each machine creation.
+// It's also a CachedReaderFactory that keeps informer caches for each secret.
+// Its connectivity check backs the health and readiness endpoints of the machine controller.
+type CachingClientFactory struct {
+	timer   Timer
+	options *ClientFactoryOptions
+	mutex   sync.Mutex
+	entries map[string]*clientCacheEntry
+}
+
+// clientCacheEntry is a cached client, clientset, server version, cached reader, and connectivity check result for a secret.
+type clientCacheEntry struct {
+	hash              string
+	config            *rest.Config
+	client            client.Client
+	clientset         kubernetes.Interface
+	namespace         string
+	serverVersion     string
+	serverVersionTime time.Time
+	reader            *informerReader
+	checker           discovery.ServerVersionInterface
+	connectivityErr   error
+	connectivityTime  time.Time
+}
+
+// NewCachingClientFactory creates a new CachingClientFactory with the given Timer and ClientFactoryOptions.
+func NewCachingClientFactory(timer Timer, options *ClientFactoryOptions) *CachingClientFactory {
+	return &CachingClientFactory{
+		timer:   timer,
+		options: options,
+		entries: make(map[string]*clientCacheEntry),
+	}
+}
+
+// GetClient returns a client created from the kubeconfig saved in the "kubeconfig" field of the given secret,
+// or from the in-cluster service account credentials if the in-cluster mode is enabled for the given secret.
+// It also returns the namespace of the kubeconfig's current context, or the namespace of the service account.
+func (f *CachingClientFactory) GetClient(secret *corev1.Secret) (client.Client, string, error) {
+	entry, err := f.getEntry(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	return entry.client, entry.namespace, nil
+}
+
+// GetServerVersion gets the server version using a clientset created from the kubeconfig saved in the "kubeconfig" field
+// of the given secret, or from the in-cluster service account credentials if the in-cluster mode is enabled for the given secret.
+// The server version is cached for serverVersionTTL. If getting it fails due to an authentication error,
+// the cached entry for the given secret is invalidated.
+func (f *CachingClientFactory) GetServerVersion(secret *corev1.Secret) (string, error) {
+	entry, err := f.getEntry(secret)
+	if err != nil {
+		return "", err
+	}
+
+	f.mutex.Lock()
+	serverVersion, serverVersionTime := entry.serverVersion, entry.serverVersionTime
+	f.mutex.Unlock()
+	now := f.timer.Now()
+	if serverVersion != "" && now.Sub(serverVersionTime) < serverVersionTTL {
+		return serverVersion, nil
+	}
+
+	versionInfo, err := entry.clientset.Discovery().ServerVersion()
+	if err != nil {
+		if IsUnauthenticatedError(err) {
+			f.invalidate(secret, entry)
+		}
+		return "", errors.Wrap(err, "could not get server version")
+	}
+
+	f.mutex.Lock()
+	entry.serverVersion, entry.serverVersionTime = versionInfo.GitVersion, now
+	f.mutex.Unlock()
+	return versionInfo.GitVersion, nil
+}
+
+// CheckConnectivity checks that the provider clusters of all cached entries, i.e. of the last used secrets, can still be reached
+// by getting the server version. The result of each check is cached for ConnectivityCheckTTL. The checks are performed
+// concurrently, and each of them fails after ConnectivityCheckTimeout, so that the health endpoints respond in time
+// even if provider clusters hang. It returns the errors of the failed checks by cache key, i.e. secret namespace and name.
+// Unlike GetServerVersion, it doesn't invalidate the cached entries on authentication errors, so that they keep being reported.
+func (f *CachingClientFactory) CheckConnectivity() map[string]error {
+	f.mutex.Lock()
+	entries := make(map[string]*clientCacheEntry, len(f.entries))
+	for key, entry := range f.entries {
+		entries[key] = entry
+	}
+	f.mutex.Unlock()
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		errs  = make(map[string]error)
+	)
+	for key, entry := range entries {
+		wg.Add(1)
+		go func(key string, entry *clientCacheEntry) {
+			defer wg.Done()
+			if err := f.checkConnectivity(entry); err != nil {
+				mutex.Lock()
+				errs[key] = err
+				mutex.Unlock()
+			}
+		}(key, entry)
+	}
+	wg.Wait()
+	return errs
+}
+
+// checkConnectivity checks that the provider cluster of the given cached entry can be reached, unless it was checked
+// less than ConnectivityCheckTTL ago, in which case the cached result is returned.
+func (f *CachingClientFactory) checkConnectivity(entry *clientCacheEntry) error {
+	f.mutex.Lock()
+	connectivityErr, connectivityTime := entry.connectivityErr, entry.connectivityTime
+	f.mutex.Unlock()
+	now := f.timer.Now()
+	if !connectivityTime.IsZero() && now.Sub(connectivityTime) < f.options.ConnectivityCheckTTL {
+		return connectivityErr
+	}
+
+	versionInfo, err := entry.checker.ServerVersion()
+	if err != nil {
+		err = errors.Wrap(err, "could not get server version")
+	}
+
+	f.mutex.Lock()
+	entry.connectivityErr, entry.connectivityTime = err, now
+	if err == nil {
+		entry.serverVersion, entry.serverVersionTime = versionInfo.GitVersion, now
+	}
+	f.mutex.Unlock()
+	return err
+}
+
+// GetCachedReader returns a reader that serves the kubevirt virtual machines and virtual machine instances in the namespace
+// of the kubeconfig saved in the "kubeconfig" field of the given secret from informer caches, and falls back to the client
+// of the cached entry for the given secret otherwise. The informers are started when the reader is first requested,
+// and stopped when the cached entry is replaced or invalidated.
+func (f *CachingClientFactory) GetCachedReader(secret *corev1.Secret) (client.Reader, error) {
+	entry, err := f.getEntry(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if entry.reader == nil {
+		reader, err := newInformerReader(entry.config, entry.namespace, entry.client)
+		if err != nil {
+			return nil, err
+		}
+		entry.reader = reader
+	}
+	return entry.reader, nil
+}
+
+// RestartVirtualMachine restarts the kubevirt virtual machine with the given namespace and name via the restart subresource,
+// using a clientset created from the kubeconfig saved in the "kubeconfig" field of the given secret, or from the in-cluster
+// service account credentials if the in-cluster mode is enabled for the given secret. If restarting it fails due to
+// an authentication error, the cached entry for the given secret is invalidated.
+func (f *CachingClientFactory) RestartVirtualMachine(ctx context.Context, secret *corev1.Secret, namespace, name string) error {
+	entry, err := f.getEntry(secret)
+	if err != nil {
+		return err
+	}
+
+	return f.putVirtualMachineSubresource(ctx, secret, entry, namespace, name, "restart")
+}
+
+// StopVirtualMachine gracefully stops the kubevirt virtual machine with the given namespace and name via the stop subresource,
+// using a clientset created from the kubeconfig saved in the "kubeconfig" field of the given secret, or from the in-cluster
+// service account credentials if the in-cluster mode is enabled for the given secret. If stopping it fails due to
+// an authentication error, the cached entry for the given secret is invalidated.
+func (f *CachingClientFactory) StopVirtualMachine(ctx context.Context, secret *corev1.Secret, namespace, name string) error {
+	entry, err := f.getEntry(secret)
+	if err != nil {
+		return err
+	}
+	return f.putVirtualMachineSubresource(ctx, secret, entry, namespace, name, "stop")
+}
+
+// putVirtualMachineSubresource calls the given subresource of the kubevirt virtual machine with the given namespace and name,
+// using the clientset of the given cached entry. If the call fails due to an authentication error, the given cached entry
+// for the given secret is invalidated.
+func (f *CachingClientFactory) putVirtualMachineSubresource(ctx context.Context, secret *corev1.Secret, entry *clientCacheEntry, namespace, name, subresource string) error {
+	err := entry.clientset.Discovery().RESTClient().Put().
+		AbsPath("/apis", kubevirtv1.SubresourceStorageGroupVersion.String(), "namespaces", namespace, "virtualmachines", name, subresource).
+		Context(ctx).
+		Do().
+		Error()
+	if err != nil {
+		if IsUnauthenticatedError(err) {
+			f.invalidate(secret, entry)
+		}
+		return err
+	}
+	return nil
+}
+
+// getEntry returns the cached entry for the given secret, creating it if it doesn't exist or if the credentials
+// in the secret have changed since it was created. The entry is created without holding the lock of the factory,
+// since creating its client performs API discovery, which can hang if the provider cluster can't be reached
+// or an exec credential plugin is slow, and must not block the calls for other secrets or the connectivity check.
+func (f *CachingClientFactory) getEntry(secret *corev1.Secret) (*clientCacheEntry, error) {
+	key := getCacheKey(secret)
+	hash := hashCredentials(secret)
+
+	f.mutex.Lock()
+	oldEntry, ok := f.entries[key]
+	f.mutex.Unlock()
+	if ok && oldEntry.hash == hash {
+		return oldEntry, nil
+	}
+
+	entry, err := f.newEntry(secret, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Use the entry created by a concurrent call for the same credentials, if any
+	if oldEntry, ok := f.entries[key]; ok {
+		if oldEntry.hash == hash {
+			return oldEntry, nil
+		}
+		oldEntry.stop()
+	}
+	f.entries[key] = entry
+	return entry, nil
+}
+
+// newEntry creates a new cache entry with the given credentials hash for the given secret.
+func (f *CachingClientFactory) newEntry(secret *corev1.Secret, hash string) (*clientCacheEntry, error) {
+	config, namespace, err := getRESTConfig(secret, f.options)
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(config, client.Options{})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create client from REST config")
+	}
+	cs, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create clientset from REST config")
+	}
+	checkConfig := rest.CopyConfig(config)
+	checkConfig.Timeout = f.options.ConnectivityCheckTimeout
+	checker, err := discovery.NewDiscoveryClientForConfig(checkConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create discovery client from REST config")
+	}
+
+	return &clientCacheEntry{
+		hash:      hash,
+		config:    config,
+		client:    c,
+		clientset: cs,
+		checker:   checker,
+		namespace: namespace,
+	}, nil
+}
+
+// UpdateSecret updates the cached entries of the provider clusters of the given changed secret, i.e. of the default
+// provider cluster and of the provider clusters of all zones. Entries whose credentials have changed are rebuilt,
+// and entries the given secret no longer contains credentials for are invalidated. This way, rotated credentials
+// are used from the next call on, also by the cached readers and the connectivity check.
+func (f *CachingClientFactory) UpdateSecret(secret *corev1.Secret) {
+	clusterSecrets := make(map[string]*corev1.Secret)
+	for _, clusterSecret := range getClusterSecrets(secret, f.options.InCluster) {
+		clusterSecrets[getCacheKey(clusterSecret)] = clusterSecret
+	}
+
+	for key, entry := range f.getSecretEntries(secret) {
+		clusterSecret, ok := clusterSecrets[key]
+		if !ok {
+			logging.InfoS(2, "Secret no longer contains the credentials of cached client, invalidating it", "secret", getCacheKey(secret), "client", key)
+			f.invalidateKey(key, entry)
+			continue
+		}
+		if entry.hash == hashCredentials(clusterSecret) {
+			continue
+		}
+		logging.InfoS(2, "Credentials of cached client have changed, rebuilding it", "secret", getCacheKey(secret), "client", key)
+		if _, err := f.getEntry(clusterSecret); err != nil {
+			logging.WarningS(err, "Could not rebuild cached client, invalidating it", "secret", getCacheKey(secret), "client", key)
+			f.invalidateKey(key, entry)
+		}
+	}
+}
+
+// DeleteSecret invalidates the cached entries of the provider clusters of the given deleted secret.
+func (f *CachingClientFactory) DeleteSecret(secret *corev1.Secret) {
+	for key, entry := range f.getSecretEntries(secret) {
+		logging.InfoS(2, "Secret has been deleted, invalidating cached client", "secret", getCacheKey(secret), "client", key)
+		f.invalidateKey(key, entry)
+	}
+}
+
+// getSecretEntries returns the cached entries of the provider clusters of the given secret, by cache key.
+func (f *CachingClientFactory) getSecretEntries(secret *corev1.Secret) map[string]*clientCacheEntry {
+	key := getCacheKey(secret)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	entries := make(map[string]*clientCacheEntry)
+	for entryKey, entry := range f.entries {
+		if entryKey == key || strings.HasPrefix(entryKey, key+"/") {
+			entries[entryKey] = entry
+		}
+	}
+	return entries
+}
+
+// invalidate removes the given cached entry for the given secret, if it's still cached.
+func (f *CachingClientFactory) invalidate(secret *corev1.Secret, entry *clientCacheEntry) {
+	f.invalidateKey(getCacheKey(secret), entry)
+}
+
+// invalidateKey removes the given cached entry with the given cache key, if it's still cached.
+func (f *CachingClientFactory) invalidateKey(key string, entry *clientCacheEntry) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.entries[key] == entry {
+		entry.stop()
+		delete(f.entries, key)
+	}
+}
+
+// stop stops the cached reader of this entry, if any.
+func (e *clientCacheEntry) stop() {
+	if e.reader != nil {
+		e.reader.Stop()
+		e.reader = nil
+	}
+}
+
+// getCacheKey returns the cache key of the given secret.
+func getCacheKey(secret *corev1.Secret) string {
+	return secret.Namespace + "/" + secret.Name
+}
+
+// hashCredentials returns a hash of the credentials in the given secret.
+func hashCredentials(secret *corev1.Secret) string {
+	sum := sha256.New()
+	sum.Write(secret.Data[InClusterField])
+	sum.Write([]byte{0})
+	sum.Write(secret.Data["kubeconfig"])
+	return hex.EncodeToString(sum.Sum(nil))
+}
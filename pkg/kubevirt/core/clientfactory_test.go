@@ -0,0 +1,544 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+)
+
+// virtualMachinesPath is the path of the kubevirt virtual machines in the test namespace.
+var virtualMachinesPath = "/apis/" + kubevirtv1.GroupVersion.String() + "/namespaces/" + namespace + "/virtualmachines"
+
+// fakeAPIServer is a fake provider cluster API server that serves the discovery endpoints used by the clients,
+// and gets, lists, and watches of kubevirt virtual machines. Watches don't send any events.
+type fakeAPIServer struct {
+	*httptest.Server
+
+	mutex            sync.Mutex
+	gitVersion       string
+	status           int
+	versionCalls     int
+	versionBlocked   chan struct{}
+	discoveryCalls   int
+	discoveryBlocked chan struct{}
+	virtualMachines  map[string]*kubevirtv1.VirtualMachine
+	listFails        bool
+	lastToken        string
+	userAgents       map[string]bool
+	getCalls         int
+	watches          int
+	closing          chan struct{}
+}
+
+// newFakeAPIServer starts a new fakeAPIServer with the given git version.
+func newFakeAPIServer(gitVersion string) *fakeAPIServer {
+	s := &fakeAPIServer{
+		gitVersion:      gitVersion,
+		status:          http.StatusOK,
+		virtualMachines: make(map[string]*kubevirtv1.VirtualMachine),
+		userAgents:      make(map[string]bool),
+		closing:         make(chan struct{}),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *fakeAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	status, gitVersion, blocked, discoveryBlocked := s.status, s.gitVersion, s.versionBlocked, s.discoveryBlocked
+	s.userAgents[r.UserAgent()] = true
+	if r.URL.Path == "/version" {
+		s.versionCalls++
+		s.lastToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if r.URL.Path == "/api" || r.URL.Path == "/apis" {
+		s.discoveryCalls++
+	}
+	s.mutex.Unlock()
+
+	if discoveryBlocked != nil && (r.URL.Path == "/api" || r.URL.Path == "/apis") {
+		<-discoveryBlocked
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api":
+		fmt.Fprint(w, `{"kind":"APIVersions","versions":["v1"]}`)
+	case r.URL.Path == "/api/v1":
+		fmt.Fprint(w, `{"kind":"APIResourceList","groupVersion":"v1","resources":[]}`)
+	case r.URL.Path == "/apis":
+		fmt.Fprintf(w, `{"kind":"APIGroupList","groups":[{"name":%q,"versions":[{"groupVersion":%q,"version":%q}]}]}`,
+			kubevirtv1.GroupVersion.Group, kubevirtv1.GroupVersion.String(), kubevirtv1.GroupVersion.Version)
+	case r.URL.Path == "/apis/"+kubevirtv1.GroupVersion.String():
+		fmt.Fprintf(w, `{"kind":"APIResourceList","groupVersion":%q,"resources":[`+
+			`{"name":"virtualmachines","namespaced":true,"kind":"VirtualMachine","verbs":["get","list","watch"]},`+
+			`{"name":"virtualmachineinstances","namespaced":true,"kind":"VirtualMachineInstance","verbs":["get","list","watch"]}]}`,
+			kubevirtv1.GroupVersion.String())
+	case r.URL.Path == "/version":
+		if blocked != nil {
+			<-blocked
+		}
+		fmt.Fprintf(w, `{"gitVersion":%q}`, gitVersion)
+	case r.URL.Path == virtualMachinesPath && r.URL.Query().Get("watch") == "true":
+		s.serveWatch(w, r)
+	case r.URL.Path == virtualMachinesPath:
+		s.serveList(w, r)
+	case strings.HasPrefix(r.URL.Path, virtualMachinesPath+"/"):
+		s.serveGet(w, strings.TrimPrefix(r.URL.Path, virtualMachinesPath+"/"))
+	case strings.HasSuffix(r.URL.Path, "/virtualmachineinstances"):
+		if r.URL.Query().Get("watch") == "true" {
+			s.serveWatch(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"kind":"VirtualMachineInstanceList","apiVersion":"`+kubevirtv1.GroupVersion.String()+`","metadata":{"resourceVersion":"1"},"items":[]}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveGet serves a get of the kubevirt virtual machine with the given name.
+func (s *fakeAPIServer) serveGet(w http.ResponseWriter, name string) {
+	s.mutex.Lock()
+	s.getCalls++
+	virtualMachine, ok := s.virtualMachines[name]
+	s.mutex.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404,`+
+			`"details":{"name":%q,"group":%q,"kind":"virtualmachines"}}`, name, kubevirtv1.GroupVersion.Group)
+		return
+	}
+	Expect(json.NewEncoder(w).Encode(virtualMachine)).To(Succeed())
+}
+
+// serveList serves a list of the kubevirt virtual machines that have the label in the label selector, if any.
+func (s *fakeAPIServer) serveList(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listFails {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	list := &kubevirtv1.VirtualMachineList{
+		TypeMeta: metav1.TypeMeta{APIVersion: kubevirtv1.GroupVersion.String(), Kind: "VirtualMachineList"},
+		ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+	}
+	labelKey := r.URL.Query().Get("labelSelector")
+	for _, virtualMachine := range s.virtualMachines {
+		if _, ok := virtualMachine.Labels[labelKey]; ok || labelKey == "" {
+			list.Items = append(list.Items, *virtualMachine)
+		}
+	}
+	Expect(json.NewEncoder(w).Encode(list)).To(Succeed())
+}
+
+// serveWatch serves a watch without events until the client or the server closes it.
+func (s *fakeAPIServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.watches++
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.watches--
+		s.mutex.Unlock()
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	select {
+	case <-r.Context().Done():
+	case <-s.closing:
+	}
+}
+
+// addVirtualMachine adds a kubevirt virtual machine with the given name and labels to the server.
+func (s *fakeAPIServer) addVirtualMachine(name string, labels map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.virtualMachines[name] = &kubevirtv1.VirtualMachine{
+		TypeMeta:   metav1.TypeMeta{APIVersion: kubevirtv1.GroupVersion.String(), Kind: "VirtualMachine"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels, ResourceVersion: "1"},
+	}
+}
+
+// setListFails makes lists of kubevirt virtual machines fail.
+func (s *fakeAPIServer) setListFails(listFails bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listFails = listFails
+}
+
+// getLastToken returns the bearer token of the last request for the server version.
+func (s *fakeAPIServer) getLastToken() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastToken
+}
+
+// getUserAgents returns the user agents of the requests served so far.
+func (s *fakeAPIServer) getUserAgents() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var userAgents []string
+	for userAgent := range s.userAgents {
+		userAgents = append(userAgents, userAgent)
+	}
+	return userAgents
+}
+
+// getGetCalls returns the number of gets of kubevirt virtual machines served so far.
+func (s *fakeAPIServer) getGetCalls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.getCalls
+}
+
+// getWatches returns the number of open watches.
+func (s *fakeAPIServer) getWatches() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.watches
+}
+
+// setStatus makes the server respond to all requests with the given status code.
+func (s *fakeAPIServer) setStatus(status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+}
+
+// setGitVersion makes the server respond with the given git version.
+func (s *fakeAPIServer) setGitVersion(gitVersion string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gitVersion = gitVersion
+}
+
+// blockVersion makes the server hang on requests for the server version until unblockVersion is called.
+func (s *fakeAPIServer) blockVersion() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.versionBlocked = make(chan struct{})
+}
+
+// unblockVersion releases the requests for the server version blocked by blockVersion.
+func (s *fakeAPIServer) unblockVersion() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.versionBlocked != nil {
+		close(s.versionBlocked)
+		s.versionBlocked = nil
+	}
+}
+
+// blockDiscovery makes the server hang on API discovery requests until unblockDiscovery is called.
+func (s *fakeAPIServer) blockDiscovery() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.discoveryBlocked = make(chan struct{})
+}
+
+// unblockDiscovery releases the API discovery requests blocked by blockDiscovery.
+func (s *fakeAPIServer) unblockDiscovery() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.discoveryBlocked != nil {
+		close(s.discoveryBlocked)
+		s.discoveryBlocked = nil
+	}
+}
+
+// getDiscoveryCalls returns the number of API discovery requests received so far.
+func (s *fakeAPIServer) getDiscoveryCalls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.discoveryCalls
+}
+
+// getVersionCalls returns the number of requests for the server version served so far.
+func (s *fakeAPIServer) getVersionCalls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.versionCalls
+}
+
+// close unblocks the blocked requests, closes the open watches, and shuts down the server.
+func (s *fakeAPIServer) close() {
+	s.unblockVersion()
+	s.unblockDiscovery()
+	close(s.closing)
+	s.Close()
+}
+
+// newKubeconfigSecret creates a new secret with the given name and a kubeconfig for the given server and token.
+func newKubeconfigSecret(name, server, token string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string][]byte{
+			"kubeconfig": []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: provider
+  cluster:
+    server: %s
+    insecure-skip-tls-verify: true
+contexts:
+- name: provider
+  context:
+    cluster: provider
+    user: provider
+    namespace: %s
+current-context: provider
+users:
+- name: provider
+  user:
+    token: %s
+`, server, namespace, token)),
+		},
+	}
+}
+
+var _ = Describe("CachingClientFactory", func() {
+	var (
+		server  *fakeAPIServer
+		now     time.Time
+		options *ClientFactoryOptions
+		f       *CachingClientFactory
+	)
+
+	BeforeEach(func() {
+		server = newFakeAPIServer("v1.18.6")
+		now = time.Now()
+		options = NewClientFactoryOptions()
+		f = NewCachingClientFactory(TimerFunc(func() time.Time { return now }), options)
+	})
+
+	AfterEach(func() {
+		server.close()
+	})
+
+	Describe("#GetClient", func() {
+		It("should return the cached client for the same secret", func() {
+			c, ns, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ns).To(Equal(namespace))
+
+			again, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).To(BeIdenticalTo(c))
+		})
+
+		It("should return different clients for different secrets", func() {
+			c, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+
+			other, _, err := f.GetClient(newKubeconfigSecret("secret-2", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other).NotTo(BeIdenticalTo(c))
+		})
+
+		It("should create a new client if the credentials in the secret have been rotated", func() {
+			c, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+
+			rotated, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "rotated"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rotated).NotTo(BeIdenticalTo(c))
+
+			again, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "rotated"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).To(BeIdenticalTo(rotated))
+		})
+
+		It("should fail if the secret contains no kubeconfig", func() {
+			secret := newKubeconfigSecret("secret-1", server.URL, "token")
+			delete(secret.Data, "kubeconfig")
+
+			_, _, err := f.GetClient(secret)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should identify itself with the user agent of the provider", func() {
+			_, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(server.getUserAgents()).To(ConsistOf(UserAgent))
+		})
+
+		It("should not block the clients of other secrets while creating a client for a hanging provider cluster", func() {
+			hanging := newFakeAPIServer("v1.18.6")
+			defer hanging.close()
+			hanging.blockDiscovery()
+
+			done := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				_, _, err := f.GetClient(newKubeconfigSecret("secret-1", hanging.URL, "token"))
+				done <- err
+			}()
+			Eventually(hanging.getDiscoveryCalls).Should(BeNumerically(">", 0))
+
+			_, _, err := f.GetClient(newKubeconfigSecret("secret-2", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = f.GetServerVersion(newKubeconfigSecret("secret-2", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.CheckConnectivity()).To(BeEmpty())
+			Consistently(done).ShouldNot(Receive())
+
+			hanging.unblockDiscovery()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("should rate limit the requests of a client according to QPS and Burst", func() {
+			options.QPS, options.Burst = 10, 1
+			server.addVirtualMachine(machineName, nil)
+
+			c, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+
+			start := time.Now()
+			for i := 0; i < 4; i++ {
+				Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: machineName}, &kubevirtv1.VirtualMachine{})).To(Succeed())
+			}
+			Expect(time.Since(start)).To(BeNumerically(">=", 250*time.Millisecond))
+		})
+	})
+
+	Describe("#GetServerVersion", func() {
+		It("should cache the server version for 10 minutes", func() {
+			secret := newKubeconfigSecret("secret-1", server.URL, "token")
+			version, err := f.GetServerVersion(secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal("v1.18.6"))
+
+			server.setGitVersion("v1.19.2")
+			now = now.Add(10*time.Minute - time.Second)
+			version, err = f.GetServerVersion(secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal("v1.18.6"))
+			Expect(server.getVersionCalls()).To(Equal(1))
+
+			now = now.Add(time.Second)
+			version, err = f.GetServerVersion(secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal("v1.19.2"))
+			Expect(server.getVersionCalls()).To(Equal(2))
+		})
+
+		It("should get the server version again if the credentials in the secret have been rotated", func() {
+			_, err := f.GetServerVersion(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+
+			server.setGitVersion("v1.19.2")
+			version, err := f.GetServerVersion(newKubeconfigSecret("secret-1", server.URL, "rotated"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal("v1.19.2"))
+			Expect(server.getLastToken()).To(Equal("rotated"))
+		})
+
+		It("should invalidate the cached client if the authentication fails", func() {
+			secret := newKubeconfigSecret("secret-1", server.URL, "token")
+			c, _, err := f.GetClient(secret)
+			Expect(err).NotTo(HaveOccurred())
+
+			server.setStatus(http.StatusUnauthorized)
+			_, err = f.GetServerVersion(secret)
+			Expect(err).To(HaveOccurred())
+			Expect(IsUnauthenticatedError(err)).To(BeTrue())
+
+			server.setStatus(http.StatusOK)
+			again, _, err := f.GetClient(secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).NotTo(BeIdenticalTo(c))
+		})
+	})
+
+	Describe("#CheckConnectivity", func() {
+		BeforeEach(func() {
+			options.ConnectivityCheckTimeout = 200 * time.Millisecond
+		})
+
+		It("should return no errors if the provider clusters can be reached", func() {
+			_, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(f.CheckConnectivity()).To(BeEmpty())
+		})
+
+		It("should cache the result for ConnectivityCheckTTL", func() {
+			_, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(f.CheckConnectivity()).To(BeEmpty())
+			Expect(f.CheckConnectivity()).To(BeEmpty())
+			Expect(server.getVersionCalls()).To(Equal(1))
+
+			now = now.Add(options.ConnectivityCheckTTL)
+			Expect(f.CheckConnectivity()).To(BeEmpty())
+			Expect(server.getVersionCalls()).To(Equal(2))
+		})
+
+		It("should return an unauthenticated error if the authentication to a provider cluster fails", func() {
+			_, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			server.setStatus(http.StatusUnauthorized)
+
+			errs := f.CheckConnectivity()
+			Expect(errs).To(HaveKey(namespace + "/secret-1"))
+			Expect(IsUnauthenticatedError(errs[namespace+"/secret-1"])).To(BeTrue())
+		})
+
+		It("should fail the checks of hanging provider clusters after ConnectivityCheckTimeout, concurrently", func() {
+			_, _, err := f.GetClient(newKubeconfigSecret("secret-1", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = f.GetClient(newKubeconfigSecret("secret-2", server.URL, "token"))
+			Expect(err).NotTo(HaveOccurred())
+			server.blockVersion()
+
+			start := time.Now()
+			errs := f.CheckConnectivity()
+			Expect(time.Since(start)).To(BeNumerically("<", 2*options.ConnectivityCheckTimeout))
+			Expect(errs).To(HaveLen(2))
+			Expect(errs).To(HaveKey(namespace + "/secret-1"))
+			Expect(errs).To(HaveKey(namespace + "/secret-2"))
+			Expect(IsUnauthenticatedError(errs[namespace+"/secret-1"])).To(BeFalse())
+		})
+	})
+})
@@ -16,29 +16,92 @@ package core
 
 import (
 	"context"
-	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/state"
 
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/retry"
-	"k8s.io/klog"
 	"k8s.io/utils/pointer"
 	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
 	// ProviderName is the kubevirt provider name.
 	ProviderName = "kubevirt"
+	// FieldManager is the field manager used when applying kubevirt virtual machines with server-side apply.
+	FieldManager = "machine-controller-manager-provider-kubevirt"
+	// UserAgent is the user agent of the provider cluster clients.
+	UserAgent = "machine-controller-manager-provider-kubevirt"
+
+	// MultusDefaultNetworkAnnotation is the VMI annotation that replaces the pod network of the VM pod
+	// with the given Multus network.
+	MultusDefaultNetworkAnnotation = "v1.multus-cni.io/default-network"
+	// DeschedulerEvictAnnotation is the VMI annotation allowing the descheduler to evict the VM pod.
+	DeschedulerEvictAnnotation = "descheduler.alpha.kubernetes.io/evict"
+
+	// machineLabel is the label containing the machine name that is added to the VM, its VMI, and its data volumes.
+	machineLabel = "kubevirt.io/vm"
+	// managedByLabel is the label identifying the provider that created the VM. It's added to the VM on creation.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	// deletionPolicyLabel is the label containing the deletion policy of a retained data volume.
+	deletionPolicyLabel = "kubevirt.io/deletion-policy"
+	// machineZoneLabel is the label containing the zone chosen for the machine, if the provider spec specifies multiple zones.
+	machineZoneLabel = "kubevirt.io/zone"
+	// machineClassLabel is the label containing a hash of the name of the machine class of the machine.
+	// It's added to the VM on creation and never changed afterwards.
+	machineClassLabel = "kubevirt.io/machine-class"
+	// clusterTag is the tag containing the name of the cluster of the machine, which is set by Gardener.
+	clusterTag = "mcm.gardener.cloud/cluster"
+
+	// machineNamespaceAnnotation is the VM annotation containing the namespace of the machine object, e.g. the shoot namespace.
+	machineNamespaceAnnotation = "kubevirt.io/machine-namespace"
+	// machineSetAnnotation is the VM annotation containing the name of the machine set of the machine object.
+	machineSetAnnotation = "kubevirt.io/machine-set"
+	// machineDeploymentAnnotation is the VM annotation containing the name of the machine deployment of the machine object.
+	machineDeploymentAnnotation = "kubevirt.io/machine-deployment"
+
+	// InClusterField is the secret field that enables the in-cluster mode if set to "true".
+	InClusterField = "inCluster"
+	// ZoneKubeconfigFieldPrefix is the prefix of the secret fields containing the kubeconfigs of the provider clusters
+	// of specific zones, e.g. "kubeconfig-zone-1" for the zone "zone-1".
+	ZoneKubeconfigFieldPrefix = "kubeconfig-"
+	// serviceAccountNamespaceFile is the file containing the namespace of the service account in the in-cluster mode.
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
+// identityLabels are the labels identifying the machine of a VM, which are not changed when reconciling its labels with the tags.
+var identityLabels = sets.NewString(machineLabel, managedByLabel, machineZoneLabel, machineClassLabel)
+
+// deletionPollInterval is the interval at which DeleteMachine checks whether the kubevirt virtual machine is fully deleted.
+const deletionPollInterval = 2 * time.Second
+
+// listPageSize is the maximum number of kubevirt virtual machines listed per request by ListMachines.
+const listPageSize = 500
+
+// MachineMetadata contains metadata of a machine object that is recorded in the annotations of its kubevirt virtual machine,
+// so that provider cluster operators can map the kubevirt virtual machine back to the machine object and its worker pool.
+type MachineMetadata struct {
+	// Namespace is the namespace of the machine object, e.g. the shoot namespace.
+	Namespace string
+	// MachineSet is the name of the machine set of the machine object, if any.
+	MachineSet string
+	// MachineDeployment is the name of the machine deployment of the machine object, if any.
+	MachineDeployment string
+}
+
 // ClientFactory creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret.
 type ClientFactory interface {
 	// GetClient creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret.
@@ -69,6 +132,17 @@ func (f ServerVersionFactoryFunc) GetServerVersion(secret *corev1.Secret) (strin
 	return f(secret)
 }
 
+// SubresourceClient calls kubevirt virtual machine subresources, using the kubeconfig saved in the "kubeconfig" field
+// of the given secret.
+type SubresourceClient interface {
+	// RestartVirtualMachine restarts the kubevirt virtual machine with the given namespace and name via the restart subresource,
+	// using the kubeconfig saved in the "kubeconfig" field of the given secret.
+	RestartVirtualMachine(ctx context.Context, secret *corev1.Secret, namespace, name string) error
+	// StopVirtualMachine gracefully stops the kubevirt virtual machine with the given namespace and name via the stop subresource,
+	// using the kubeconfig saved in the "kubeconfig" field of the given secret.
+	StopVirtualMachine(ctx context.Context, secret *corev1.Secret, namespace, name string) error
+}
+
 // Timer returns the current local time.
 type Timer interface {
 	// Now returns the current local time.
@@ -85,124 +159,231 @@ func (f TimerFunc) Now() time.Time {
 
 // PluginSPIImpl is the implementation of PluginSPI interface.
 type PluginSPIImpl struct {
-	cf    ClientFactory
-	svf   ServerVersionFactory
-	timer Timer
+	cf      ClientFactory
+	svf     ServerVersionFactory
+	sc      SubresourceClient
+	timer   Timer
+	options *Options
+	limiter *operationLimiter
 }
 
-// NewPluginSPIImpl creates a new PluginSPIImpl with the given ClientFactory, ServerVersionFactory, and Timer.
-func NewPluginSPIImpl(cf ClientFactory, svf ServerVersionFactory, timer Timer) *PluginSPIImpl {
+// NewPluginSPIImpl creates a new PluginSPIImpl with the given ClientFactory, ServerVersionFactory, SubresourceClient, Timer, and Options.
+func NewPluginSPIImpl(cf ClientFactory, svf ServerVersionFactory, sc SubresourceClient, timer Timer, options *Options) *PluginSPIImpl {
 	return &PluginSPIImpl{
-		cf:    cf,
-		svf:   svf,
-		timer: timer,
+		cf:      cf,
+		svf:     svf,
+		sc:      sc,
+		timer:   timer,
+		options: options,
+		limiter: newOperationLimiter(options.MaxConcurrentOperations, options.OperationWaitTimeout),
 	}
 }
 
-// CreateMachine creates a machine with the given name, using the given provider spec and secret.
-// Here it creates a kubevirt virtual machine and a secret containing the userdata (cloud-init).
-func (p PluginSPIImpl) CreateMachine(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerID string, err error) {
-	// Generate a unique name for the userdata secret
-	userDataSecretName := fmt.Sprintf("userdata-%s-%s", machineName, strconv.Itoa(int(p.timer.Now().Unix())))
+// CreateMachine creates a machine with the given name and machine class name, using the given provider spec and secret.
+// Here it creates a secret containing the userdata (cloud-init), and, if there is any network data, a secret containing
+// the network data, then a kubevirt virtual machine labeled as owned by the given machine class, and finally makes
+// the kubevirt virtual machine the owner of the secrets. The secrets are created first, so that the kubevirt virtual machine
+// never boots without its userdata, even if the creation is interrupted. Secrets created by an interrupted creation
+// are reused by the next attempt, or deleted by DeleteMachine.
+// Ignition userdata is passed to the kubevirt virtual machine directly, so no secrets are created in this case.
+// The given machine state is updated as the creation progresses. If it indicates that a previous attempt already
+// created the secrets or the kubevirt virtual machine, the creation is resumed from there.
+// If a kubevirt virtual machine with the given name already exists, it's reused only if it's owned by the given machine class.
+// The given machine metadata, if any, is recorded in the annotations of the kubevirt virtual machine.
+// If the kubevirt virtual machine already existed, its boot progress is recorded in the given machine state.
+// If MaxConcurrentOperations is set and no operation slot of the provider cluster becomes free in time,
+// an OperationLimitExceededError is returned.
+func (p PluginSPIImpl) CreateMachine(ctx context.Context, machineName, machineClassName string, machineMetadata *MachineMetadata, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, machineState *state.State) (providerID string, err error) {
+	now := p.timer.Now()
+
+	// Determine whether a previous attempt already created the secrets, and whether it also created the VM
+	resumeSecrets := (machineState.Is(state.OperationCreate, state.PhaseSecretsCreated) || machineState.Is(state.OperationCreate, state.PhaseVirtualMachineCreated)) &&
+		machineState.UserDataSecretName != ""
+	resume := resumeSecrets && machineState.Is(state.OperationCreate, state.PhaseVirtualMachineCreated)
+
+	// Generate unique names for the userdata and networkdata secrets, unless a previous attempt already generated them
+	userDataSecretName := buildChildName("userdata-", machineName, "-"+strconv.Itoa(int(now.Unix())))
+	networkDataSecretName := buildChildName("networkdata-", machineName, "-"+strconv.Itoa(int(now.Unix())))
+	if resumeSecrets {
+		userDataSecretName = machineState.UserDataSecretName
+		networkDataSecretName = machineState.NetworkDataSecretName
+	}
 
-	// Get client and namespace from secret
+	// Pin the provider spec to the zone of the existing VM, if any
+	if providerSpec, err = p.resolveMachineZone(ctx, machineName, providerSpec, secret); err != nil {
+		return "", err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	secret = getZoneSecret(secret, getMachineZone(machineName, providerSpec))
 	c, namespace, err := p.cf.GetClient(secret)
 	if err != nil {
 		return "", errors.Wrap(err, "could not create client")
 	}
 
-	// Build interfaces and networks
-	interfaces, networks, networkData := buildNetworks(providerSpec.Networks)
-
-	var devices api.Devices
-	if providerSpec.Devices != nil {
-		devices = *providerSpec.Devices
+	// Wait for a free operation slot of the provider cluster
+	release, err := p.limiter.acquire(ctx, secret, operationCreate)
+	if err != nil {
+		return "", err
 	}
-	// Build disks, volumes, and data volumes
-	disks, volumes, dataVolumes := buildVolumes(machineName, namespace, userDataSecretName, networkData, providerSpec.RootVolume, providerSpec.AdditionalVolumes, devices.Disks)
-	// Get Kubernetes version
-	k8sVersion, err := p.svf.GetServerVersion(secret)
+	defer release()
+
+	// Apply the provider config defaults, resolve the templates in the provider spec for the machine, and check the policy
+	providerSpec, err = prepareProviderSpec(machineName, providerSpec, p.options.ProviderConfig)
 	if err != nil {
-		return "", errors.Wrap(err, "could not get server version")
+		return "", err
+	}
+	if err := checkPolicy(namespace, providerSpec, p.options.ProviderConfig); err != nil {
+		return "", err
 	}
 
-	// Build affinity
-	affinity := buildAffinity(providerSpec.Region, providerSpec.Zone, k8sVersion)
+	// Build user data, adding SSH keys
+	userData, ignition, err := buildUserData(machineName, providerSpec, secret)
+	if err != nil {
+		return "", err
+	}
+	if ignition {
+		userDataSecretName, networkDataSecretName = "", ""
+	}
 
-	// Add SSH keys to user data
-	userData, err := addUserSSHKeysToUserData(string(secret.Data["userData"]), providerSpec.SSHKeys)
+	// Build the VM
+	virtualMachine, networkData, err := p.buildVM(machineName, namespace, userData, userDataSecretName, networkDataSecretName, providerSpec, secret)
 	if err != nil {
 		return "", err
 	}
+	if networkData == "" {
+		networkDataSecretName = ""
+	}
+	for k, v := range getOwnershipLabels(machineClassName) {
+		virtualMachine.Labels[k] = v
+	}
+	virtualMachine.Annotations = mergeStringMaps(virtualMachine.Annotations, getMachineMetadataAnnotations(machineMetadata))
 
-	// Initialize VM labels
-	vmLabels := make(map[string]string)
-	if len(providerSpec.Tags) > 0 {
-		vmLabels = providerSpec.Tags
+	// Get the VM created by a previous attempt, if any
+	var existing bool
+	if resume {
+		existingVirtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+		switch {
+		case err == nil && existingVirtualMachine.UID == machineState.VirtualMachineUID:
+			logging.InfoS(2, "VirtualMachine already created, resuming creation", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "CreateMachine")
+			virtualMachine, existing = existingVirtualMachine, true
+		case err == nil || IsMachineNotFoundError(err):
+			resume = false
+		default:
+			return "", err
+		}
 	}
-	vmLabels["kubevirt.io/vm"] = machineName
 
-	// Build the VM
-	virtualMachine := &kubevirtv1.VirtualMachine{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      machineName,
-			Namespace: namespace,
-			Labels:    vmLabels,
-		},
-		Spec: kubevirtv1.VirtualMachineSpec{
-			Running: pointer.BoolPtr(true),
-			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"kubevirt.io/vm": machineName,
-					},
-				},
-				Spec: kubevirtv1.VirtualMachineInstanceSpec{
-					Domain: kubevirtv1.DomainSpec{
-						Resources: providerSpec.Resources,
-						CPU:       providerSpec.CPU,
-						Memory:    providerSpec.Memory,
-						Devices: kubevirtv1.Devices{
-							Disks:                      disks,
-							Interfaces:                 interfaces,
-							Rng:                        devices.Rng,
-							BlockMultiQueue:            &devices.BlockMultiQueue,
-							NetworkInterfaceMultiQueue: &devices.NetworkInterfaceMultiQueue,
-						},
-					},
-					Affinity:                      affinity,
-					TerminationGracePeriodSeconds: pointer.Int64Ptr(30),
-					Volumes:                       volumes,
-					Networks:                      networks,
-					DNSPolicy:                     providerSpec.DNSPolicy,
-					DNSConfig:                     providerSpec.DNSConfig,
-				},
-			},
-			DataVolumeTemplates: dataVolumes,
-		},
+	// Validate the provider spec against the provider cluster and prepare the volumes, unless the VM already exists
+	if !resume {
+		if err := checkCPUModel(ctx, c, providerSpec.CPU); err != nil {
+			return "", err
+		}
+		if p.options.CapacityCheck {
+			if err := checkCapacity(ctx, c, &virtualMachine.Spec.Template.Spec); err != nil {
+				return "", err
+			}
+		}
+		ipamTypes := make(map[string]string)
+		if p.options.DeepValidation {
+			if err := validateProviderClusterResources(ctx, c, namespace, providerSpec, ipamTypes); err != nil {
+				return "", err
+			}
+		} else if p.options.NetworkCheck {
+			if err := checkNetworkAttachmentDefinitions(ctx, c, namespace, providerSpec.Networks, ipamTypes); err != nil {
+				return "", err
+			}
+		}
+		if len(ipamTypes) > 0 {
+			machineState.NetworkIPAMTypes = ipamTypes
+		}
+		if providerSpec.RootVolume.Cache {
+			if err := NewImageCache(c).Ensure(ctx, namespace, &providerSpec.RootVolume.DataVolumeSpec, now); err != nil {
+				return "", err
+			}
+		}
+		retainedDataVolumes := buildRetainedDataVolumes(machineName, namespace, providerSpec.AdditionalVolumes)
+		if err := NewDataVolumeManager(c).EnsureRetained(ctx, retainedDataVolumes); err != nil {
+			return "", err
+		}
+		machineState.SetPhase(state.OperationCreate, state.PhasePending, now)
 	}
-	// Create the VM
-	if err := c.Create(ctx, virtualMachine); err != nil {
-		return "", errors.Wrapf(err, "could not create VirtualMachine %q", machineName)
+
+	// Create the userdata and networkdata secrets before the VM, unless they already exist
+	dataSecrets, err := buildDataSecrets(machineName, namespace, userDataSecretName, networkDataSecretName, userData, networkData, providerSpec.CompressUserData)
+	if err != nil {
+		return "", err
+	}
+	if dataSecrets, err = createSecrets(ctx, c, dataSecrets); err != nil {
+		return "", err
 	}
 
-	// Build the userdata secret
-	userDataSecret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      userDataSecretName,
-			Namespace: virtualMachine.Namespace,
-			OwnerReferences: []metav1.OwnerReference{
-				*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind),
-			},
-		},
-		Data: map[string][]byte{
-			"userdata": []byte(userData),
-		},
+	// Create the VM, or adopt it if it already exists and matches the machine
+	if !resume {
+		machineState.UserDataSecretName = userDataSecretName
+		machineState.NetworkDataSecretName = networkDataSecretName
+		machineState.SetPhase(state.OperationCreate, state.PhaseSecretsCreated, now)
+
+		if err := c.Create(ctx, virtualMachine); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return "", wrapCreateError(err, "could not create VirtualMachine %q", machineName)
+			}
+			existingVirtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+			if err != nil {
+				return "", err
+			}
+			if existingVirtualMachine.Labels[machineLabel] != machineName || !isOwnedBy(existingVirtualMachine, machineClassName, providerSpec) {
+				return "", errors.Errorf("VirtualMachine %q already exists and is not owned by machine class %q", machineName, machineClassName)
+			}
+			logging.InfoS(2, "VirtualMachine already exists, adopting it", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "CreateMachine")
+			virtualMachine, existing = existingVirtualMachine, true
+			if err := p.applyVM(ctx, c, virtualMachine, providerSpec, secret); err != nil {
+				return "", err
+			}
+
+			// Replace the secrets created above if the adopted VM references different ones
+			adoptedUserDataSecretName, adoptedNetworkDataSecretName := userDataSecretName, getNetworkDataSecretName(virtualMachine)
+			if name := getUserDataSecretName(virtualMachine); name != "" {
+				adoptedUserDataSecretName = name
+			}
+			if adoptedUserDataSecretName != userDataSecretName || adoptedNetworkDataSecretName != networkDataSecretName {
+				if err := deleteSecrets(ctx, c, dataSecrets); err != nil {
+					return "", err
+				}
+				userDataSecretName, networkDataSecretName = adoptedUserDataSecretName, adoptedNetworkDataSecretName
+				if dataSecrets, err = buildDataSecrets(machineName, namespace, userDataSecretName, networkDataSecretName, userData, networkData, providerSpec.CompressUserData); err != nil {
+					return "", err
+				}
+				if dataSecrets, err = createSecrets(ctx, c, dataSecrets); err != nil {
+					return "", err
+				}
+			}
+		}
 	}
 
-	// Create the userdata secret
-	if err := c.Create(ctx, userDataSecret); err != nil {
-		return "", errors.Wrapf(err, "could not create userdata secret %q", userDataSecretName)
+	// Update the machine state
+	machineState.ProviderID = encodeProviderID(machineName)
+	machineState.VirtualMachineUID = virtualMachine.UID
+	machineState.UserDataSecretName = userDataSecretName
+	machineState.NetworkDataSecretName = networkDataSecretName
+	machineState.DataVolumes = make(map[string]cdicorev1alpha1.DataVolumePhase, len(virtualMachine.Spec.DataVolumeTemplates))
+	for _, dataVolume := range virtualMachine.Spec.DataVolumeTemplates {
+		machineState.DataVolumes[dataVolume.Name] = cdicorev1alpha1.PhaseUnset
+	}
+	machineState.SetPhase(state.OperationCreate, state.PhaseVirtualMachineCreated, now)
+
+	// Make the VM the owner of the userdata and networkdata secrets, so that they are deleted together with it
+	for _, dataSecret := range dataSecrets {
+		if err := setSecretOwner(ctx, c, dataSecret, virtualMachine); err != nil {
+			return "", err
+		}
+	}
+	machineState.SetPhase(state.OperationCreate, state.PhaseCreated, now)
+
+	// Record the boot progress of the VM in the machine state if it already existed, e.g. because this is a retry
+	machineState.BootStage, machineState.BootMessage = "", ""
+	if existing {
+		p.updateBootProgress(ctx, c, virtualMachine, namespace, machineState)
 	}
 
 	// Return the VM provider ID
@@ -210,37 +391,119 @@ func (p PluginSPIImpl) CreateMachine(ctx context.Context, machineName string, pr
 }
 
 // DeleteMachine deletes the machine with the given name and provider id, using the given provider spec and secret.
-// Here it deletes the kubevirt virtual machine with the given name.
-func (p PluginSPIImpl) DeleteMachine(ctx context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
-	// Get client and namespace from secret
+// If the provider spec specifies a shutdown grace period, it first stops the kubevirt virtual machine with the given name
+// via the stop subresource and waits until it's stopped, or until the shutdown grace period has elapsed.
+// If the provider spec enables snapshotOnDelete, it then snapshots the kubevirt virtual machine and waits for up to
+// DeletionWaitTimeout until the snapshot is ready to use, returning a DeletionInProgressError if it's not ready in time.
+// Here it deletes the kubevirt virtual machine with the given name using foreground cascading deletion, waits for up to
+// DeletionWaitTimeout until it's fully deleted together with its virtual machine instance, pods, and data volumes,
+// and then deletes any leftover data volumes and persistent volume claims labeled with the machine name,
+// except for retained data volumes, as well as any userdata and networkdata secrets left over by an interrupted creation.
+// If the kubevirt virtual machine is not fully deleted in time, a DeletionInProgressError is returned. Once its deletion
+// has been requested for StuckDeletionTimeout, its virtual machine instance and pods are force deleted, see forceDeleteVM.
+// The given machine state is updated as the deletion progresses. If MaxConcurrentOperations is set and no operation slot
+// of the provider cluster becomes free in time, an OperationLimitExceededError is returned.
+func (p PluginSPIImpl) DeleteMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, machineState *state.State) (foundProviderID string, err error) {
+	now := p.timer.Now()
+
+	// Pin the provider spec to the zone of the existing VM, if any
+	if providerSpec, err = p.resolveMachineZone(ctx, machineName, providerSpec, secret); err != nil {
+		return "", err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	secret = getZoneSecret(secret, getMachineZone(machineName, providerSpec))
 	c, namespace, err := p.cf.GetClient(secret)
 	if err != nil {
 		return "", errors.Wrap(err, "could not create client")
 	}
 
+	// Wait for a free operation slot of the provider cluster
+	release, err := p.limiter.acquire(ctx, secret, operationDelete)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
 	// Get the VM by name
 	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
 	if err != nil {
 		if IsMachineNotFoundError(err) {
-			klog.V(2).Infof("VirtualMachine %q not found", machineName)
+			logging.InfoS(2, "VirtualMachine not found", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "DeleteMachine")
+			if err := NewDataVolumeManager(c).DeleteAll(ctx, machineName, namespace); err != nil {
+				return "", err
+			}
+			if err := deleteMachineSecrets(ctx, c, machineName, namespace); err != nil {
+				return "", err
+			}
+			machineState.SetPhase(state.OperationDelete, state.PhaseDeleted, now)
 			return "", nil
 		}
 		return "", err
 	}
 
-	// Delete the VM
-	if err := client.IgnoreNotFound(c.Delete(ctx, virtualMachine)); err != nil {
-		return "", errors.Wrapf(err, "could not delete VirtualMachine %q", machineName)
+	// Stop the VM gracefully before deleting it, if requested and not already done by a previous attempt
+	if providerSpec.ShutdownGracePeriodSeconds != nil && virtualMachine.DeletionTimestamp == nil &&
+		!machineState.Is(state.OperationDelete, state.PhaseSnapshotting) && !machineState.Is(state.OperationDelete, state.PhaseDeleting) {
+		if err := p.stopVM(ctx, c, machineName, namespace, time.Duration(*providerSpec.ShutdownGracePeriodSeconds)*time.Second, secret, machineState, now); err != nil {
+			return "", err
+		}
 	}
 
+	// Snapshot the VM before deleting it, if requested and not already deleting it
+	if providerSpec.SnapshotOnDelete && virtualMachine.DeletionTimestamp == nil && !machineState.Is(state.OperationDelete, state.PhaseDeleting) {
+		machineState.SetPhase(state.OperationDelete, state.PhaseSnapshotting, now)
+		if err := p.snapshotVM(ctx, c, virtualMachine, now); err != nil {
+			return "", err
+		}
+	}
+
+	// Delete the VM with foreground cascading deletion, unless a previous attempt already requested its deletion
+	machineState.SetPhase(state.OperationDelete, state.PhaseDeleting, now)
+	if virtualMachine.DeletionTimestamp == nil {
+		if err := client.IgnoreNotFound(c.Delete(ctx, virtualMachine, client.PropagationPolicy(metav1.DeletePropagationForeground))); err != nil {
+			return "", errors.Wrapf(err, "could not delete VirtualMachine %q", machineName)
+		}
+	}
+
+	// Force delete the VMI and pods of the VM if its deletion is stuck, e.g. because their node is down
+	if isDeletionStuck(virtualMachine, now, p.options.StuckDeletionTimeout) {
+		if err := p.forceDeleteVM(ctx, c, virtualMachine); err != nil {
+			return "", err
+		}
+	}
+
+	// Wait until the VM and its dependents are fully deleted
+	if err := p.waitForVMDeleted(ctx, c, machineName, namespace); err != nil {
+		return "", err
+	}
+	machineState.SetPhase(state.OperationDelete, state.PhaseVirtualMachineDeleted, now)
+
+	// Delete leftover data volumes, persistent volume claims, and secrets
+	if err := NewDataVolumeManager(c).DeleteAll(ctx, machineName, namespace); err != nil {
+		return "", err
+	}
+	if err := deleteMachineSecrets(ctx, c, machineName, namespace); err != nil {
+		return "", err
+	}
+	machineState.SetPhase(state.OperationDelete, state.PhaseDeleted, now)
+
 	// Return the VM provider ID
 	return encodeProviderID(virtualMachine.Name), nil
 }
 
-// GetMachineStatus returns the provider id of the machine with the given name and provider id, using the given provider spec and secret.
-// Here it returns the provider id of the kubevirt virtual machine with the given name.
-func (p PluginSPIImpl) GetMachineStatus(ctx context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
-	// Get client and namespace from secret
+// UpdateMachine updates the machine with the given name and provider id, using the given provider spec and secret.
+// Here it applies the desired spec of the kubevirt virtual machine with the given name using server-side apply,
+// so that any drift of the existing kubevirt virtual machine, e.g. in its labels, resources, or affinity, is corrected.
+// If ReconcileVMs is set, MaintainMachines does the same for all kubevirt virtual machines of a machine class.
+func (p PluginSPIImpl) UpdateMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	// Pin the provider spec to the zone of the existing VM, if any
+	if providerSpec, err = p.resolveMachineZone(ctx, machineName, providerSpec, secret); err != nil {
+		return "", err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	secret = getZoneSecret(secret, getMachineZone(machineName, providerSpec))
 	c, namespace, err := p.cf.GetClient(secret)
 	if err != nil {
 		return "", errors.Wrap(err, "could not create client")
@@ -252,44 +515,301 @@ func (p PluginSPIImpl) GetMachineStatus(ctx context.Context, machineName, _ stri
 		return "", err
 	}
 
+	// Apply the desired VM spec
+	if err := p.applyVM(ctx, c, virtualMachine, providerSpec, secret); err != nil {
+		return "", err
+	}
+
 	// Return the VM provider ID
 	return encodeProviderID(virtualMachine.Name), nil
 }
 
-// ListMachines lists all machines matching the given provider spec and secret.
-// Here it lists all kubevirt virtual machines matching the tags of the given provider spec.
-func (p PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerIDList map[string]string, err error) {
-	// Get client and namespace from secret
-	c, namespace, err := p.cf.GetClient(secret)
+// GetMachineStatus returns the status of the machine with the given name and provider id, using the given provider spec and secret.
+// Here it returns the status of the kubevirt virtual machine with the given name and its virtual machine instance.
+// If the status indicates that the machine is unschedulable, has failed, or is unhealthy, the problem is set in the returned status,
+// instead of being returned as an error, see MachineStatus.Problem.
+// If the virtual machine instance doesn't exist yet, the status also contains the data volumes that are still being populated.
+// It also updates the labels of the kubevirt virtual machine that differ from the tags of the given provider spec, see reconcileVMLabels,
+// and reports whether it did in the returned status.
+func (p PluginSPIImpl) GetMachineStatus(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (status *MachineStatus, err error) {
+	// Pin the provider spec to the zone of the existing VM, if any
+	if providerSpec, err = p.resolveMachineZone(ctx, machineName, providerSpec, secret); err != nil {
+		return nil, err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	c, namespace, err := p.cf.GetClient(getZoneSecret(secret, getMachineZone(machineName, providerSpec)))
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create client")
 	}
 
-	// Initialize VM labels
-	var vmLabels = map[string]string{}
-	if len(providerSpec.Tags) > 0 {
-		vmLabels = providerSpec.Tags
+	// Get the VM by name
+	r := p.getReader(c, getZoneSecret(secret, getMachineZone(machineName, providerSpec)))
+	virtualMachine, err := p.getVM(ctx, r, machineName, namespace)
+	if err != nil {
+		return nil, err
 	}
 
-	// List all VMs matching the labels
-	virtualMachineList, err := p.listVMs(ctx, c, namespace, vmLabels)
+	// Get the VMI by name, it doesn't exist if the VM is not running
+	virtualMachineInstance, err := p.getVMI(ctx, r, machineName, namespace)
 	if err != nil {
 		return nil, err
 	}
 
-	// Return a map containing the provider IDs and names of all found VMs
-	var providerIDs = make(map[string]string, len(virtualMachineList.Items))
-	for _, virtualMachine := range virtualMachineList.Items {
-		providerIDs[encodeProviderID(virtualMachine.Name)] = virtualMachine.Name
+	// Reconcile the VM labels with the tags of the provider spec
+	labelsUpdated := reconcileVMLabels(ctx, c, virtualMachine, providerSpec, p.options.ProviderConfig)
+
+	// Build the machine status
+	status = buildMachineStatus(machineName, virtualMachine, virtualMachineInstance)
+	status.LabelsUpdated = labelsUpdated
+
+	// If the VMI doesn't exist yet, add the statuses of the data volumes that are still being populated
+	if virtualMachineInstance == nil && len(virtualMachine.Spec.DataVolumeTemplates) > 0 {
+		dataVolumes, err := NewDataVolumeManager(c).List(ctx, machineName, namespace)
+		if err != nil {
+			logging.WarningS(err, "Could not get data volume statuses", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "GetMachineStatus")
+		} else {
+			status.DataVolumes = getDataVolumeStatuses(dataVolumes)
+		}
+	}
+	return status, nil
+}
+
+// reconcileVMLabels patches the labels of the given kubevirt virtual machine that differ from the tags of the given provider spec,
+// with its templates resolved for the virtual machine, so that tag changes are propagated to existing virtual machines.
+// The machine identity labels are never changed, and labels that are no longer tags are kept, since they can't be told apart
+// from labels set by others. The virtual machine is only patched if its labels differ, and it returns true if it was patched.
+// Since the machine status doesn't depend on the labels, failures are logged and otherwise ignored.
+func reconcileVMLabels(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, providerSpec *api.KubeVirtProviderSpec, config *ProviderConfig) bool {
+	machineName := virtualMachine.Name
+	resolved, err := prepareProviderSpec(machineName, providerSpec, config)
+	if err != nil {
+		logging.WarningS(err, "Could not reconcile VirtualMachine labels", logging.KeyMachine, machineName, logging.KeyNamespace, virtualMachine.Namespace, logging.KeyOperation, "GetMachineStatus")
+		return false
+	}
+
+	patched, changed := virtualMachine.DeepCopy(), false
+	for k, v := range resolved.Tags {
+		if current, ok := virtualMachine.Labels[k]; identityLabels.Has(k) || (ok && current == v) {
+			continue
+		}
+		if patched.Labels == nil {
+			patched.Labels = make(map[string]string)
+		}
+		patched.Labels[k], changed = v, true
+	}
+	if !changed {
+		return false
+	}
+
+	logging.InfoS(2, "Updating VirtualMachine labels", logging.KeyMachine, machineName, logging.KeyNamespace, virtualMachine.Namespace, logging.KeyOperation, "GetMachineStatus")
+	if err := c.Patch(ctx, patched, client.MergeFrom(virtualMachine)); err != nil {
+		logging.WarningS(err, "Could not reconcile VirtualMachine labels", logging.KeyMachine, machineName, logging.KeyNamespace, virtualMachine.Namespace, logging.KeyOperation, "GetMachineStatus")
+		return false
+	}
+	return true
+}
+
+// updateBootProgress updates the boot stage and message, as well as the data volume phases, of the given machine state
+// from the virtual machine instance and the data volumes of the given kubevirt virtual machine. Since the boot progress
+// is only informational, failures to get them are logged and otherwise ignored.
+func (p PluginSPIImpl) updateBootProgress(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, namespace string, machineState *state.State) {
+	machineName := virtualMachine.Name
+	virtualMachineInstance, err := p.getVMI(ctx, c, machineName, namespace)
+	if err != nil {
+		logging.WarningS(err, "Could not get boot progress", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "CreateMachine")
+		return
+	}
+
+	var dataVolumeStatuses []DataVolumeStatus
+	if virtualMachineInstance == nil && len(virtualMachine.Spec.DataVolumeTemplates) > 0 {
+		dataVolumes, err := NewDataVolumeManager(c).List(ctx, machineName, namespace)
+		if err != nil {
+			logging.WarningS(err, "Could not get boot progress", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "CreateMachine")
+			return
+		}
+		for _, dataVolume := range dataVolumes {
+			if _, ok := machineState.DataVolumes[dataVolume.Name]; ok {
+				machineState.DataVolumes[dataVolume.Name] = dataVolume.Status.Phase
+			}
+		}
+		dataVolumeStatuses = getDataVolumeStatuses(dataVolumes)
+	}
+
+	stage, message := getBootProgress(virtualMachineInstance, dataVolumeStatuses)
+	machineState.BootStage, machineState.BootMessage = string(stage), message
+}
+
+// ListMachines lists all machines of the machine class with the given name, using the given provider spec and secret.
+// Here it lists all kubevirt virtual machines owned by the given machine class in all provider clusters of the given secret,
+// see isOwnedBy, as well as the kubevirt virtual machines of the machines of the same cluster, see isSameClusterMachine,
+// so that the kubevirt virtual machines of a renamed machine class are not treated as orphans.
+func (p PluginSPIImpl) ListMachines(ctx context.Context, machineClassName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerIDList map[string]string, err error) {
+	// List all VMs owned by the machine class in all provider clusters,
+	// and return a map containing the provider IDs and names of all found VMs
+	var providerIDs = make(map[string]string)
+	for _, clusterSecret := range getClusterSecrets(secret, p.options.InCluster) {
+		// Get client and namespace from the secret of the provider cluster
+		c, namespace, err := p.cf.GetClient(clusterSecret)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create client")
+		}
+
+		if err := p.forEachVM(ctx, p.getReader(c, clusterSecret), namespace, func(virtualMachine *kubevirtv1.VirtualMachine) {
+			if isOwnedBy(virtualMachine, machineClassName, providerSpec) || isSameClusterMachine(virtualMachine, providerSpec) {
+				providerIDs[encodeProviderID(virtualMachine.Name)] = virtualMachine.Name
+			}
+		}); err != nil {
+			return nil, err
+		}
 	}
 	return providerIDs, nil
 }
 
+// MaintainMachines performs the periodic maintenance of the machines of the machine class with the given name,
+// using the given provider spec and secret. Here it deletes the cached images in all provider clusters of the given secret
+// that have not been used for ImageCacheTTL, and, if the provider spec enables snapshotOnDelete, the expired snapshots
+// taken on machine deletion. If ResizePolicy is not None, it also resizes the kubevirt virtual machines owned by the given
+// machine class whose resources differ from the provider spec, see resizeVMs, and if ReconcileVMs is set, it applies
+// the desired spec of all of them, see reconcileVMs. Since it modifies the provider clusters,
+// it must only be called by a single replica. Failures of the individual maintenance tasks are logged and otherwise ignored.
+func (p PluginSPIImpl) MaintainMachines(ctx context.Context, machineClassName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) error {
+	now := p.timer.Now()
+
+	for _, clusterSecret := range getClusterSecrets(secret, p.options.InCluster) {
+		// Get client and namespace from the secret of the provider cluster
+		c, namespace, err := p.cf.GetClient(clusterSecret)
+		if err != nil {
+			return errors.Wrap(err, "could not create client")
+		}
+		keysAndValues := []interface{}{logging.KeyMachineClass, machineClassName, logging.KeyNamespace, namespace, logging.KeyOperation, "MaintainMachines"}
+
+		// Resize the VMs whose resources differ from the provider spec, and correct the drift of all VMs, if enabled
+		if p.options.ResizePolicy != ResizePolicyNone || p.options.ReconcileVMs {
+			r := p.getReader(c, clusterSecret)
+			var virtualMachines []*kubevirtv1.VirtualMachine
+			if err := p.forEachVM(ctx, r, namespace, func(virtualMachine *kubevirtv1.VirtualMachine) {
+				if isOwnedBy(virtualMachine, machineClassName, providerSpec) {
+					virtualMachines = append(virtualMachines, virtualMachine)
+				}
+			}); err != nil {
+				logging.WarningS(err, "Could not list VirtualMachines for maintenance", keysAndValues...)
+			} else {
+				if p.options.ResizePolicy != ResizePolicyNone {
+					p.resizeVMs(ctx, c, r, namespace, virtualMachines, providerSpec, clusterSecret)
+				}
+				if p.options.ReconcileVMs {
+					p.reconcileVMs(ctx, c, namespace, virtualMachines, providerSpec, clusterSecret)
+				}
+			}
+		}
+
+		// Delete cached images that are no longer used, e.g. because their machine class was deleted
+		if err := NewImageCache(c).DeleteUnused(ctx, namespace, now, p.options.ImageCacheTTL); err != nil {
+			logging.WarningS(err, "Could not delete unused cached images", keysAndValues...)
+		}
+
+		// Delete expired snapshots of the deleted VMs, if enabled
+		if providerSpec.SnapshotOnDelete {
+			if err := deleteExpiredSnapshots(ctx, c, namespace, now); err != nil {
+				logging.WarningS(err, "Could not delete expired snapshots", keysAndValues...)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateMachine validates the creation of a machine with the given name and machine class name, using the given provider spec
+// and secret, without creating it. Here it builds the kubevirt virtual machine that CreateMachine would create, checks the CPU model,
+// the provider cluster resources referenced by the given provider spec, and, if CapacityCheck is set, the provider cluster capacity,
+// and finally creates the kubevirt virtual machine in server-side dry-run mode. It returns the kubevirt virtual machine
+// as it would be created by the provider cluster, including the defaults set by it.
+func (p PluginSPIImpl) ValidateMachine(ctx context.Context, machineName, machineClassName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*kubevirtv1.VirtualMachine, error) {
+	now := p.timer.Now()
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	secret = getZoneSecret(secret, getMachineZone(machineName, providerSpec))
+	c, namespace, err := p.cf.GetClient(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create client")
+	}
+
+	// Apply the provider config defaults, resolve the templates in the provider spec for the machine, and check the policy
+	providerSpec, err = prepareProviderSpec(machineName, providerSpec, p.options.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPolicy(namespace, providerSpec, p.options.ProviderConfig); err != nil {
+		return nil, err
+	}
+
+	// Build user data, adding SSH keys
+	userData, ignition, err := buildUserData(machineName, providerSpec, secret)
+	if err != nil {
+		return nil, err
+	}
+	userDataSecretName := buildChildName("userdata-", machineName, "-"+strconv.Itoa(int(now.Unix())))
+	networkDataSecretName := buildChildName("networkdata-", machineName, "-"+strconv.Itoa(int(now.Unix())))
+	if ignition {
+		userDataSecretName, networkDataSecretName = "", ""
+	}
+
+	// Build the VM
+	virtualMachine, _, err := p.buildVM(machineName, namespace, userData, userDataSecretName, networkDataSecretName, providerSpec, secret)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range getOwnershipLabels(machineClassName) {
+		virtualMachine.Labels[k] = v
+	}
+
+	// Check the provider cluster
+	if err := checkCPUModel(ctx, c, providerSpec.CPU); err != nil {
+		return nil, err
+	}
+	if p.options.CapacityCheck {
+		if err := checkCapacity(ctx, c, &virtualMachine.Spec.Template.Spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateProviderClusterResources(ctx, c, namespace, providerSpec, nil); err != nil {
+		return nil, err
+	}
+
+	// Create the VM in dry-run mode
+	if err := c.Create(ctx, virtualMachine, client.DryRunAll); err != nil {
+		return nil, wrapCreateError(err, "could not create VirtualMachine %q in dry-run mode", machineName)
+	}
+	return virtualMachine, nil
+}
+
+// GetDataVolumeManager returns a DataVolumeManager for the provider cluster of the zone of the machine with the given name,
+// using the client created by the ClientFactory from the given secret. It also returns the namespace of the provider cluster.
+func (p PluginSPIImpl) GetDataVolumeManager(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*DataVolumeManager, string, error) {
+	// Pin the provider spec to the zone of the existing VM, if any
+	providerSpec, err := p.resolveMachineZone(ctx, machineName, providerSpec, secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	c, namespace, err := p.cf.GetClient(getZoneSecret(secret, getMachineZone(machineName, providerSpec)))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not create client")
+	}
+	return NewDataVolumeManager(c), namespace, nil
+}
+
 // ShutDownMachine shuts down the machine with the given name and provider id, using the given provider spec and secret.
 // Here it shuts down the kubevirt virtual machine with the given name by setting its spec.running field to false.
-func (p PluginSPIImpl) ShutDownMachine(ctx context.Context, machineName, _ string, _ *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
-	// Get client and namespace from secret
-	c, namespace, err := p.cf.GetClient(secret)
+func (p PluginSPIImpl) ShutDownMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	// Pin the provider spec to the zone of the existing VM, if any
+	if providerSpec, err = p.resolveMachineZone(ctx, machineName, providerSpec, secret); err != nil {
+		return "", err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	c, namespace, err := p.cf.GetClient(getZoneSecret(secret, getMachineZone(machineName, providerSpec)))
 	if err != nil {
 		return "", errors.Wrap(err, "could not create client")
 	}
@@ -312,7 +832,283 @@ func (p PluginSPIImpl) ShutDownMachine(ctx context.Context, machineName, _ strin
 	return encodeProviderID(virtualMachine.Name), nil
 }
 
-func (p PluginSPIImpl) getVM(ctx context.Context, c client.Client, machineName, namespace string) (*kubevirtv1.VirtualMachine, error) {
+// RestartMachine restarts the machine with the given name and provider id, using the given provider spec and secret.
+// Here it restarts the kubevirt virtual machine with the given name via the kubevirt restart subresource, which stops
+// and starts its virtual machine instance. Unlike deleting and recreating the machine, this keeps its data volumes.
+func (p PluginSPIImpl) RestartMachine(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error) {
+	// Pin the provider spec to the zone of the existing VM, if any
+	if providerSpec, err = p.resolveMachineZone(ctx, machineName, providerSpec, secret); err != nil {
+		return "", err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	secret = getZoneSecret(secret, getMachineZone(machineName, providerSpec))
+	c, namespace, err := p.cf.GetClient(secret)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create client")
+	}
+
+	// Get the VM by name
+	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	// Restart the VM
+	if err := p.sc.RestartVirtualMachine(ctx, secret, namespace, machineName); err != nil {
+		return "", errors.Wrapf(err, "could not restart VirtualMachine %q", machineName)
+	}
+
+	// Return the VM provider ID
+	return encodeProviderID(virtualMachine.Name), nil
+}
+
+// buildVM builds the kubevirt virtual machine for the machine with the given name in the given namespace,
+// using the given userdata, userdata and networkdata secret names, provider spec, and secret.
+// It also returns the network data of the kubevirt virtual machine, which is referenced via the networkdata secret
+// if its name is not empty, or inlined otherwise.
+// If the userdata is Ignition userdata, it is passed via the Ignition annotation and no cloud-init disk is added.
+func (p PluginSPIImpl) buildVM(machineName, namespace, userData, userDataSecretName, networkDataSecretName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*kubevirtv1.VirtualMachine, string, error) {
+	ignition := isIgnition(providerSpec.UserDataFormat, userData)
+
+	// Build interfaces, networks, and network data
+	interfaces, networks, networkData, err := buildNetworks(machineName, providerSpec.Networks, providerSpec.DisablePodNetwork)
+	if err != nil {
+		return nil, "", err
+	}
+	if providerSpec.NetworkData != "" {
+		networkData = providerSpec.NetworkData
+	}
+
+	// Build the cloud-init volume, unless the userdata is Ignition userdata
+	var cloudInitVolume *kubevirtv1.Volume
+	if ignition {
+		networkData = ""
+	} else {
+		volume := buildCloudInitVolume("cloudinitdisk", providerSpec.CloudInitType, userDataSecretName, networkDataSecretName, networkData)
+		cloudInitVolume = &volume
+	}
+
+	var devices api.Devices
+	if providerSpec.Devices != nil {
+		devices = *providerSpec.Devices
+	}
+	// Clone the root volume from the cached image, if enabled
+	rootVolume := providerSpec.RootVolume
+	if rootVolume.Cache {
+		rootVolume.DataVolumeSpec = buildImageCloneSpec(namespace, &rootVolume.DataVolumeSpec)
+	}
+	// Build disks, volumes, and data volumes
+	disks, volumes, dataVolumes, err := buildVolumes(machineName, namespace, cloudInitVolume, rootVolume, providerSpec.RootDisk, providerSpec.AdditionalVolumes, devices.Disks)
+	if err != nil {
+		return nil, "", err
+	}
+	if providerSpec.Sysprep != nil {
+		disk, volume := buildSysprepVolume("sysprepdisk", providerSpec.Sysprep)
+		disks, volumes = append(disks, disk), append(volumes, volume)
+	}
+	if providerSpec.Windows != nil {
+		disk, volume := buildVirtioDriversVolume("virtiodriversdisk", providerSpec.Windows)
+		disks, volumes = append(disks, disk), append(volumes, volume)
+	}
+	applyBootOrder(disks, interfaces, providerSpec.Networks, providerSpec.AdditionalVolumes)
+
+	// Get Kubernetes version
+	k8sVersion, err := p.svf.GetServerVersion(secret)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not get server version")
+	}
+
+	// Build the VMI termination grace period, which is also the shutdown grace period if specified
+	terminationGracePeriodSeconds := pointer.Int64Ptr(30)
+	if providerSpec.ShutdownGracePeriodSeconds != nil {
+		terminationGracePeriodSeconds = providerSpec.ShutdownGracePeriodSeconds
+	}
+
+	// Build resources
+	resources := buildResources(providerSpec.Resources, providerSpec.OvercommitGuestOverhead)
+
+	// Build firmware and features
+	firmware, features := buildFirmware(providerSpec.Firmware)
+	clock := providerSpec.Clock
+	if providerSpec.Windows != nil {
+		features = applyWindowsFeatures(features)
+		if clock == nil {
+			clock = buildWindowsClock()
+		}
+	}
+	features = mergeFeatures(features, providerSpec.Features)
+
+	// Build affinity
+	zone := getMachineZone(machineName, providerSpec)
+	affinity := mergeAffinity(buildAffinity(providerSpec.Region, zone, getRegionAndZoneLabels(providerSpec, k8sVersion)), providerSpec.Affinity)
+
+	// Initialize VM labels
+	vmLabels := getVMLabels(machineName, providerSpec)
+
+	// Initialize VMI labels
+	vmiLabels := make(map[string]string, len(providerSpec.VMILabels)+1)
+	for k, v := range providerSpec.VMILabels {
+		vmiLabels[k] = v
+	}
+	vmiLabels[machineLabel] = machineName
+
+	// Initialize VMI annotations, adding the Ignition userdata, the Multus default network,
+	// and the descheduler eviction annotation if any
+	vmiAnnotations := providerSpec.VMIAnnotations
+	defaultNetwork := getDefaultNetworkAnnotation(providerSpec.Networks)
+	var evictionStrategy *kubevirtv1.EvictionStrategy
+	var deschedulerEvict bool
+	if providerSpec.Eviction != nil {
+		evictionStrategy = providerSpec.Eviction.Strategy
+		deschedulerEvict = providerSpec.Eviction.Descheduler
+	}
+	if ignition || defaultNetwork != "" || deschedulerEvict {
+		vmiAnnotations = make(map[string]string, len(providerSpec.VMIAnnotations)+3)
+		for k, v := range providerSpec.VMIAnnotations {
+			vmiAnnotations[k] = v
+		}
+		if ignition {
+			vmiAnnotations[kubevirtv1.IgnitionAnnotation] = userData
+		}
+		if defaultNetwork != "" {
+			vmiAnnotations[MultusDefaultNetworkAnnotation] = defaultNetwork
+		}
+		if deschedulerEvict {
+			vmiAnnotations[DeschedulerEvictAnnotation] = "true"
+		}
+	}
+
+	// Build the VM
+	return &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        machineName,
+			Namespace:   namespace,
+			Labels:      vmLabels,
+			Annotations: providerSpec.Annotations,
+		},
+		Spec: kubevirtv1.VirtualMachineSpec{
+			Running: pointer.BoolPtr(true),
+			Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      vmiLabels,
+					Annotations: vmiAnnotations,
+				},
+				Spec: kubevirtv1.VirtualMachineInstanceSpec{
+					Domain: kubevirtv1.DomainSpec{
+						Resources: resources,
+						CPU:       providerSpec.CPU,
+						Memory:    providerSpec.Memory,
+						Machine:   kubevirtv1.Machine{Type: providerSpec.MachineType},
+						Firmware:  firmware,
+						Features:  features,
+						Clock:     clock,
+						Devices: kubevirtv1.Devices{
+							Disks:                      disks,
+							Interfaces:                 interfaces,
+							Rng:                        devices.Rng,
+							Watchdog:                   devices.Watchdog,
+							BlockMultiQueue:            &devices.BlockMultiQueue,
+							NetworkInterfaceMultiQueue: &devices.NetworkInterfaceMultiQueue,
+							AutoattachMemBalloon:       devices.AutoattachMemBalloon,
+							AutoattachSerialConsole:    devices.AutoattachSerialConsole,
+							AutoattachGraphicsDevice:   devices.AutoattachGraphicsDevice,
+							Inputs:                     buildInputs(devices.Tablet),
+						},
+						IOThreadsPolicy: providerSpec.IOThreadsPolicy,
+					},
+					Affinity:                      affinity,
+					Tolerations:                   providerSpec.Tolerations,
+					NodeSelector:                  providerSpec.NodeSelector,
+					TerminationGracePeriodSeconds: terminationGracePeriodSeconds,
+					Volumes:                       volumes,
+					Networks:                      networks,
+					DNSPolicy:                     providerSpec.DNSPolicy,
+					DNSConfig:                     providerSpec.DNSConfig,
+					PriorityClassName:             providerSpec.PriorityClassName,
+					SchedulerName:                 providerSpec.SchedulerName,
+					Hostname:                      providerSpec.Hostname,
+					Subdomain:                     providerSpec.Subdomain,
+					LivenessProbe:                 providerSpec.LivenessProbe,
+					ReadinessProbe:                providerSpec.ReadinessProbe,
+					EvictionStrategy:              evictionStrategy,
+				},
+			},
+			DataVolumeTemplates: dataVolumes,
+		},
+	}, networkData, nil
+}
+
+// applyVM applies the desired spec of the given existing kubevirt virtual machine using server-side apply, see buildDesiredVM.
+func (p PluginSPIImpl) applyVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) error {
+	desiredVirtualMachine, err := p.buildDesiredVM(virtualMachine, providerSpec, secret)
+	if err != nil {
+		return err
+	}
+	return patchVM(ctx, c, desiredVirtualMachine)
+}
+
+// reconcileVMs applies the desired spec of the given kubevirt virtual machines in the given namespace using server-side apply,
+// see applyVM, so that any drift, e.g. in their labels, annotations, resources, or affinity, is corrected. Virtual machines
+// that are being deleted are skipped. Failures are logged and otherwise ignored, since they must not fail the other
+// maintenance tasks, and are retried the next time.
+func (p PluginSPIImpl) reconcileVMs(ctx context.Context, c client.Client, namespace string, virtualMachines []*kubevirtv1.VirtualMachine, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) {
+	for _, virtualMachine := range virtualMachines {
+		if virtualMachine.DeletionTimestamp != nil {
+			continue
+		}
+		keysAndValues := []interface{}{logging.KeyMachine, virtualMachine.Name, logging.KeyNamespace, namespace, logging.KeyOperation, "MaintainMachines"}
+		if err := p.applyVM(ctx, c, virtualMachine, providerSpec, secret); err != nil {
+			logging.WarningS(err, "Could not reconcile VirtualMachine", keysAndValues...)
+		}
+	}
+}
+
+// buildDesiredVM builds the desired spec of the given existing kubevirt virtual machine from the given provider spec and secret.
+// The userdata and networkdata secret references, the running state, and the ownership labels of the existing kubevirt virtual machine
+// are preserved, and the given provider spec is pinned to the zone recorded in the labels of the existing kubevirt virtual machine.
+func (p PluginSPIImpl) buildDesiredVM(virtualMachine *kubevirtv1.VirtualMachine, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*kubevirtv1.VirtualMachine, error) {
+	providerSpec, err := prepareProviderSpec(virtualMachine.Name, pinMachineZone(providerSpec, virtualMachine.Labels[machineZoneLabel]), p.options.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+	userData, _, err := buildUserData(virtualMachine.Name, providerSpec, secret)
+	if err != nil {
+		return nil, err
+	}
+	desiredVirtualMachine, _, err := p.buildVM(virtualMachine.Name, virtualMachine.Namespace, userData, getUserDataSecretName(virtualMachine), getNetworkDataSecretName(virtualMachine), providerSpec, secret)
+	if err != nil {
+		return nil, err
+	}
+	desiredVirtualMachine.TypeMeta = metav1.TypeMeta{
+		APIVersion: kubevirtv1.GroupVersion.String(),
+		Kind:       kubevirtv1.VirtualMachineGroupVersionKind.Kind,
+	}
+	desiredVirtualMachine.Spec.Running = virtualMachine.Spec.Running
+	for _, k := range []string{managedByLabel, machineClassLabel} {
+		if v, ok := virtualMachine.Labels[k]; ok {
+			desiredVirtualMachine.Labels[k] = v
+		}
+	}
+	metadataAnnotations := make(map[string]string)
+	for _, k := range []string{machineNamespaceAnnotation, machineSetAnnotation, machineDeploymentAnnotation} {
+		if v, ok := virtualMachine.Annotations[k]; ok {
+			metadataAnnotations[k] = v
+		}
+	}
+	desiredVirtualMachine.Annotations = mergeStringMaps(desiredVirtualMachine.Annotations, metadataAnnotations)
+	return desiredVirtualMachine, nil
+}
+
+// patchVM applies the given desired kubevirt virtual machine using server-side apply.
+func patchVM(ctx context.Context, c client.Client, desiredVirtualMachine *kubevirtv1.VirtualMachine) error {
+	if err := c.Patch(ctx, desiredVirtualMachine, client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership); err != nil {
+		return errors.Wrapf(err, "could not apply VirtualMachine %q", desiredVirtualMachine.Name)
+	}
+	return nil
+}
+
+func (p PluginSPIImpl) getVM(ctx context.Context, c client.Reader, machineName, namespace string) (*kubevirtv1.VirtualMachine, error) {
 	virtualMachine := &kubevirtv1.VirtualMachine{}
 	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: machineName}, virtualMachine); err != nil {
 		if apierrors.IsNotFound(err) {
@@ -325,14 +1121,226 @@ func (p PluginSPIImpl) getVM(ctx context.Context, c client.Client, machineName,
 	return virtualMachine, nil
 }
 
-func (p PluginSPIImpl) listVMs(ctx context.Context, c client.Client, namespace string, vmLabels map[string]string) (*kubevirtv1.VirtualMachineList, error) {
-	virtualMachineList := &kubevirtv1.VirtualMachineList{}
-	opts := []client.ListOption{client.InNamespace(namespace)}
-	if len(vmLabels) > 0 {
-		opts = append(opts, client.MatchingLabels(vmLabels))
+// resolveMachineZone returns the given provider spec pinned to the zone of the existing kubevirt virtual machine
+// with the given name, see pinMachineZone, so that changing the zones of the provider spec doesn't move existing machines.
+// The kubevirt virtual machine is looked up in the provider cluster of the zone chosen by getMachineZone first, and then
+// in the provider clusters of the other zones of the given provider spec and secret. If it doesn't exist, the zone
+// chosen by getMachineZone is used. If the given provider spec doesn't specify multiple zones, it's returned unchanged.
+func (p PluginSPIImpl) resolveMachineZone(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*api.KubeVirtProviderSpec, error) {
+	if len(providerSpec.Zones) == 0 {
+		return providerSpec, nil
+	}
+
+	// Determine the zones to look up the VM in, starting with the one chosen by the hash
+	zones := []string{getMachineZone(machineName, providerSpec)}
+	zones = append(zones, providerSpec.Zones...)
+	for _, key := range sets.StringKeySet(secret.Data).List() {
+		if zone := strings.TrimPrefix(key, ZoneKubeconfigFieldPrefix); zone != key && zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+
+	// Look up the VM in the provider cluster of each zone, skipping provider clusters already searched
+	searched := sets.NewString()
+	for _, zone := range zones {
+		zoneSecret := getZoneSecret(secret, zone)
+		if searched.Has(zoneSecret.Name) {
+			continue
+		}
+		searched.Insert(zoneSecret.Name)
+		c, namespace, err := p.cf.GetClient(zoneSecret)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create client")
+		}
+		virtualMachine, err := p.getVM(ctx, p.getReader(c, zoneSecret), machineName, namespace)
+		if err != nil {
+			if IsMachineNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		if recordedZone := virtualMachine.Labels[machineZoneLabel]; recordedZone != "" {
+			zone = recordedZone
+		}
+		return pinMachineZone(providerSpec, zone), nil
+	}
+	return pinMachineZone(providerSpec, zones[0]), nil
+}
+
+// getReader returns the reader to use for reading kubevirt virtual machines and virtual machine instances with the given secret.
+// If VMCache is set and the client factory supports it, it's a reader backed by informer caches, otherwise it's the given client.
+func (p PluginSPIImpl) getReader(c client.Client, secret *corev1.Secret) client.Reader {
+	if !p.options.VMCache {
+		return c
 	}
-	if err := c.List(ctx, virtualMachineList, opts...); err != nil {
-		return nil, errors.Wrapf(err, "could not list VirtualMachines in namespace %q", namespace)
+	crf, ok := p.cf.(CachedReaderFactory)
+	if !ok {
+		return c
+	}
+	r, err := crf.GetCachedReader(secret)
+	if err != nil {
+		logging.WarningS(err, "Could not get cached reader, reading from the provider cluster")
+		return c
+	}
+	return r
+}
+
+// stopVM stops the kubevirt virtual machine with the given name via the stop subresource, unless a previous attempt
+// already did so, and waits until its virtual machine instance is gone, or until the given shutdown grace period has elapsed
+// since the stop was requested. If the grace period has not elapsed after waiting for up to DeletionWaitTimeout,
+// it returns a DeletionInProgressError.
+func (p PluginSPIImpl) stopVM(ctx context.Context, c client.Client, machineName, namespace string, gracePeriod time.Duration, secret *corev1.Secret, machineState *state.State, now time.Time) error {
+	// Request the stop, unless a previous attempt already did so, or the VM is not running
+	if !machineState.Is(state.OperationDelete, state.PhaseStopping) {
+		virtualMachineInstance, err := p.getVMI(ctx, c, machineName, namespace)
+		if err != nil {
+			return err
+		}
+		if virtualMachineInstance == nil {
+			return nil
+		}
+		logging.InfoS(2, "Stopping VirtualMachine", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "DeleteMachine")
+		if err := p.sc.StopVirtualMachine(ctx, secret, namespace, machineName); err != nil && !apierrors.IsConflict(err) {
+			return errors.Wrapf(err, "could not stop VirtualMachine %q", machineName)
+		}
+		machineState.SetPhase(state.OperationDelete, state.PhaseStopping, now)
+	}
+
+	// Wait until the VMI is gone, or the grace period has elapsed
+	remaining := gracePeriod - now.Sub(machineState.LastUpdateTime.Time)
+	timeout := remaining
+	if timeout > p.options.DeletionWaitTimeout {
+		timeout = p.options.DeletionWaitTimeout
+	}
+	if err := waitForDeletion(ctx, machineName, timeout, func() (bool, error) {
+		virtualMachineInstance, err := p.getVMI(ctx, c, machineName, namespace)
+		return virtualMachineInstance == nil, err
+	}); err != nil {
+		if !IsDeletionInProgressError(err) || remaining > p.options.DeletionWaitTimeout {
+			return err
+		}
+		logging.InfoS(2, "VirtualMachine not stopped within its shutdown grace period, deleting it", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "DeleteMachine")
+	}
+	return nil
+}
+
+// waitForVMDeleted waits for up to DeletionWaitTimeout until the kubevirt virtual machine with the given name is deleted.
+// If it still exists afterwards, it returns a DeletionInProgressError.
+func (p PluginSPIImpl) waitForVMDeleted(ctx context.Context, c client.Client, machineName, namespace string) error {
+	return waitForDeletion(ctx, machineName, p.options.DeletionWaitTimeout, func() (bool, error) {
+		if _, err := p.getVM(ctx, c, machineName, namespace); err != nil {
+			if IsMachineNotFoundError(err) {
+				return true, nil
+			}
+			return false, err
+		}
+		logging.InfoS(2, "Waiting for VirtualMachine to be deleted", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "DeleteMachine")
+		return false, nil
+	})
+}
+
+// createSecrets creates the given secrets, unless they already exist, and returns them as they exist in the provider cluster.
+func createSecrets(ctx context.Context, c client.Client, secrets []*corev1.Secret) ([]*corev1.Secret, error) {
+	var result []*corev1.Secret
+	for _, secret := range secrets {
+		if err := c.Create(ctx, secret); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return nil, wrapCreateError(err, "could not create secret %q", secret.Name)
+			}
+			existingSecret := &corev1.Secret{}
+			if err := c.Get(ctx, types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}, existingSecret); err != nil {
+				return nil, errors.Wrapf(err, "could not get secret %q", secret.Name)
+			}
+			secret = existingSecret
+		}
+		result = append(result, secret)
+	}
+	return result, nil
+}
+
+// deleteSecrets deletes the given secrets, ignoring secrets that don't exist.
+func deleteSecrets(ctx context.Context, c client.Client, secrets []*corev1.Secret) error {
+	for _, secret := range secrets {
+		logging.InfoS(2, "Deleting secret", "secret", secret.Name, logging.KeyNamespace, secret.Namespace)
+		if err := client.IgnoreNotFound(c.Delete(ctx, secret)); err != nil {
+			return errors.Wrapf(err, "could not delete secret %q", secret.Name)
+		}
+	}
+	return nil
+}
+
+// deleteMachineSecrets deletes the secrets labeled with the given machine name in the given namespace,
+// i.e. the userdata and networkdata secrets created for the machine. This includes secrets that are not owned
+// by the kubevirt virtual machine of the machine, because its creation was interrupted after creating them.
+func deleteMachineSecrets(ctx context.Context, c client.Client, machineName, namespace string) error {
+	secretList := &corev1.SecretList{}
+	if err := c.List(ctx, secretList, client.InNamespace(namespace), client.MatchingLabels{machineLabel: machineName}); err != nil {
+		return errors.Wrapf(err, "could not list secrets of machine %q", machineName)
+	}
+	var secrets []*corev1.Secret
+	for i := range secretList.Items {
+		secrets = append(secrets, &secretList.Items[i])
+	}
+	return deleteSecrets(ctx, c, secrets)
+}
+
+// setSecretOwner makes the given kubevirt virtual machine the only owner of the given secret, unless it already is its controller owner.
+// Any previous owner is replaced, since it can only be a kubevirt virtual machine of the same machine that has been deleted.
+func setSecretOwner(ctx context.Context, c client.Client, secret *corev1.Secret, virtualMachine *kubevirtv1.VirtualMachine) error {
+	if metav1.IsControlledBy(secret, virtualMachine) {
+		return nil
+	}
+	secret.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind)}
+	if err := c.Update(ctx, secret); err != nil {
+		return errors.Wrapf(err, "could not set owner of secret %q", secret.Name)
+	}
+	return nil
+}
+
+// waitForDeletion waits for up to the given timeout, or until the given context is done, until the given condition is true.
+// If it's still false afterwards, it returns a DeletionInProgressError for the machine with the given name.
+func waitForDeletion(ctx context.Context, machineName string, timeout time.Duration, condition wait.ConditionFunc) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := wait.PollImmediateUntil(deletionPollInterval, condition, timeoutCtx.Done()); err != nil {
+		if err == wait.ErrWaitTimeout {
+			return &DeletionInProgressError{Name: machineName}
+		}
+		return err
+	}
+	return nil
+}
+
+func (p PluginSPIImpl) getVMI(ctx context.Context, c client.Reader, machineName, namespace string) (*kubevirtv1.VirtualMachineInstance, error) {
+	virtualMachineInstance := &kubevirtv1.VirtualMachineInstance{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: machineName}, virtualMachineInstance); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "could not get VirtualMachineInstance %q", machineName)
+	}
+	return virtualMachineInstance, nil
+}
+
+// forEachVM calls the given function with each kubevirt virtual machine labeled with a machine name in the given namespace.
+// The kubevirt virtual machines are listed in pages of at most listPageSize, so that only one page is held in memory at a time.
+func (p PluginSPIImpl) forEachVM(ctx context.Context, c client.Reader, namespace string, f func(*kubevirtv1.VirtualMachine)) error {
+	var continueToken string
+	for {
+		opts := []client.ListOption{client.InNamespace(namespace), client.HasLabels{machineLabel}, client.Limit(listPageSize)}
+		if continueToken != "" {
+			opts = append(opts, client.Continue(continueToken))
+		}
+		virtualMachineList := &kubevirtv1.VirtualMachineList{}
+		if err := c.List(ctx, virtualMachineList, opts...); err != nil {
+			return errors.Wrapf(err, "could not list VirtualMachines in namespace %q", namespace)
+		}
+		for i := range virtualMachineList.Items {
+			f(&virtualMachineList.Items[i])
+		}
+		if continueToken = virtualMachineList.Continue; continueToken == "" {
+			return nil
+		}
 	}
-	return virtualMachineList, nil
 }
@@ -16,23 +16,34 @@ package core_test
 
 import (
 	"context"
+	"errors"
+	"io/ioutil"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
 	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/state"
 	mockclient "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/mock/client"
 	mockcore "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/mock/kubevirt/core"
 
 	"github.com/golang/mock/gomock"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/utils/pointer"
 	kubevirtv1 "kubevirt.io/client-go/api/v1"
 	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
@@ -45,6 +56,7 @@ const (
 	machineName       = "machine-1"
 	clusterName       = "shoot--dev--kubevirt"
 	machineClassName  = "machine-class-1"
+	machineClassHash  = "229965c9990fae26f9de2bf9f08ae79c"
 	region            = "local"
 	zone              = "local-1"
 	storageClassName  = "standard"
@@ -52,6 +64,7 @@ const (
 	networkName       = "default/net-conf"
 	sshPublicKey      = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQDdOIhYmzCK5DSVLu3b"
 	machineProviderID = ProviderName + "://" + machineName
+	hostNodeName      = "node-1"
 )
 
 var _ = Describe("PluginSPIImpl", func() {
@@ -61,12 +74,22 @@ var _ = Describe("PluginSPIImpl", func() {
 		c     *mockclient.MockClient
 		cf    *mockcore.MockClientFactory
 		svf   *mockcore.MockServerVersionFactory
+		sc    *mockcore.MockSubresourceClient
 		timer *mockcore.MockTimer
 
-		spi *PluginSPIImpl
+		options *Options
+		spi     *PluginSPIImpl
 
-		t                  = time.Now()
-		userDataSecretName = "userdata-" + machineName + "-" + strconv.Itoa(int(t.Unix()))
+		t                     = time.Now()
+		userDataSecretName    = "userdata-" + machineName + "-" + strconv.Itoa(int(t.Unix()))
+		networkDataSecretName = "networkdata-" + machineName + "-" + strconv.Itoa(int(t.Unix()))
+		networkData           = `version: 2
+ethernets:
+  id0:
+    match:
+      name: "e*"
+    dhcp4: true
+`
 
 		tags = map[string]string{
 			"mcm.gardener.cloud/cluster":      clusterName,
@@ -108,23 +131,34 @@ var _ = Describe("PluginSPIImpl", func() {
 						DedicatedIOThread: pointer.BoolPtr(true),
 					},
 				},
+				Rng: &kubevirtv1.Rng{},
+				Watchdog: &kubevirtv1.Watchdog{
+					Name: "watchdog",
+					WatchdogDevice: kubevirtv1.WatchdogDevice{
+						I6300ESB: &kubevirtv1.I6300ESBWatchdog{
+							Action: kubevirtv1.WatchdogActionPoweroff,
+						},
+					},
+				},
 				BlockMultiQueue: true,
 			},
-			RootVolume: cdicorev1alpha1.DataVolumeSpec{
-				PVC: &corev1.PersistentVolumeClaimSpec{
-					AccessModes: []corev1.PersistentVolumeAccessMode{
-						"ReadWriteOnce",
-					},
-					Resources: corev1.ResourceRequirements{
-						Requests: corev1.ResourceList{
-							corev1.ResourceStorage: resource.MustParse("8Gi"),
+			RootVolume: api.RootVolumeSpec{
+				DataVolumeSpec: cdicorev1alpha1.DataVolumeSpec{
+					PVC: &corev1.PersistentVolumeClaimSpec{
+						AccessModes: []corev1.PersistentVolumeAccessMode{
+							"ReadWriteOnce",
+						},
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceStorage: resource.MustParse("8Gi"),
+							},
 						},
+						StorageClassName: pointer.StringPtr(storageClassName),
 					},
-					StorageClassName: pointer.StringPtr(storageClassName),
-				},
-				Source: cdicorev1alpha1.DataVolumeSource{
-					HTTP: &cdicorev1alpha1.DataVolumeSourceHTTP{
-						URL: imageSourceURL,
+					Source: cdicorev1alpha1.DataVolumeSource{
+						HTTP: &cdicorev1alpha1.DataVolumeSourceHTTP{
+							URL: imageSourceURL,
+						},
 					},
 				},
 			},
@@ -192,6 +226,15 @@ var _ = Describe("PluginSPIImpl", func() {
 				Nameservers: []string{"8.8.8.8"},
 			},
 			Tags: tags,
+			Annotations: map[string]string{
+				"example.com/vm-annotation": "vm",
+			},
+			VMIAnnotations: map[string]string{
+				"example.com/vmi-annotation": "vmi",
+			},
+			VMILabels: map[string]string{
+				"example.com/vmi-label": "vmi",
+			},
 		}
 
 		secret = &corev1.Secret{
@@ -209,6 +252,11 @@ var _ = Describe("PluginSPIImpl", func() {
 					"mcm.gardener.cloud/role":         "node",
 					"mcm.gardener.cloud/machineclass": machineClassName,
 					"kubevirt.io/vm":                  machineName,
+					"app.kubernetes.io/managed-by":    FieldManager,
+					"kubevirt.io/machine-class":       machineClassHash,
+				},
+				Annotations: map[string]string{
+					"example.com/vm-annotation": "vm",
 				},
 			},
 			Spec: kubevirtv1.VirtualMachineSpec{
@@ -216,7 +264,11 @@ var _ = Describe("PluginSPIImpl", func() {
 				Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
 					ObjectMeta: metav1.ObjectMeta{
 						Labels: map[string]string{
-							"kubevirt.io/vm": machineName,
+							"example.com/vmi-label": "vmi",
+							"kubevirt.io/vm":        machineName,
+						},
+						Annotations: map[string]string{
+							"example.com/vmi-annotation": "vmi",
 						},
 					},
 					Spec: kubevirtv1.VirtualMachineInstanceSpec{
@@ -261,6 +313,8 @@ var _ = Describe("PluginSPIImpl", func() {
 										},
 									},
 								},
+								Rng:                        providerSpec.Devices.Rng,
+								Watchdog:                   providerSpec.Devices.Watchdog,
 								BlockMultiQueue:            pointer.BoolPtr(true),
 								NetworkInterfaceMultiQueue: pointer.BoolPtr(false),
 								Interfaces: []kubevirtv1.Interface{
@@ -318,13 +372,9 @@ var _ = Describe("PluginSPIImpl", func() {
 										UserDataSecretRef: &corev1.LocalObjectReference{
 											Name: userDataSecretName,
 										},
-										NetworkData: `version: 2
-ethernets:
-  id0:
-    match:
-      name: "e*"
-    dhcp4: true
-`,
+										NetworkDataSecretRef: &corev1.LocalObjectReference{
+											Name: networkDataSecretName,
+										},
 									},
 								},
 							},
@@ -370,13 +420,19 @@ ethernets:
 						ObjectMeta: metav1.ObjectMeta{
 							Name:      machineName,
 							Namespace: namespace,
+							Labels: map[string]string{
+								"kubevirt.io/vm": machineName,
+							},
 						},
-						Spec: providerSpec.RootVolume,
+						Spec: providerSpec.RootVolume.DataVolumeSpec,
 					},
 					{
 						ObjectMeta: metav1.ObjectMeta{
 							Name:      machineName + "-0",
 							Namespace: namespace,
+							Labels: map[string]string{
+								"kubevirt.io/vm": machineName,
+							},
 						},
 						Spec: *providerSpec.AdditionalVolumes[0].DataVolume,
 					},
@@ -384,6 +440,9 @@ ethernets:
 						ObjectMeta: metav1.ObjectMeta{
 							Name:      machineName + "-1",
 							Namespace: namespace,
+							Labels: map[string]string{
+								"kubevirt.io/vm": machineName,
+							},
 						},
 						Spec: *providerSpec.AdditionalVolumes[1].DataVolume,
 					},
@@ -391,10 +450,24 @@ ethernets:
 			},
 		}
 
+		virtualMachineInstance = &kubevirtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      machineName,
+				Namespace: namespace,
+			},
+			Status: kubevirtv1.VirtualMachineInstanceStatus{
+				NodeName: hostNodeName,
+				Phase:    kubevirtv1.Running,
+			},
+		}
+
 		userDataSecret = &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      userDataSecretName,
 				Namespace: namespace,
+				Labels: map[string]string{
+					"kubevirt.io/vm": machineName,
+				},
 				OwnerReferences: []metav1.OwnerReference{
 					*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind),
 				},
@@ -403,6 +476,22 @@ ethernets:
 				"userdata": []byte("#cloud-config\nchpasswd:\nexpire: false\npassword: pass\nuser: test\nssh_authorized_keys:\n- " + sshPublicKey + "\n"),
 			},
 		}
+
+		networkDataSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      networkDataSecretName,
+				Namespace: namespace,
+				Labels: map[string]string{
+					"kubevirt.io/vm": machineName,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind),
+				},
+			},
+			Data: map[string][]byte{
+				"networkdata": []byte(networkData),
+			},
+		}
 	)
 
 	BeforeEach(func() {
@@ -411,11 +500,13 @@ ethernets:
 		c = mockclient.NewMockClient(ctrl)
 		cf = mockcore.NewMockClientFactory(ctrl)
 		svf = mockcore.NewMockServerVersionFactory(ctrl)
+		sc = mockcore.NewMockSubresourceClient(ctrl)
 		timer = mockcore.NewMockTimer(ctrl)
 
 		cf.EXPECT().GetClient(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(c, namespace, nil)
 
-		spi = NewPluginSPIImpl(cf, svf, timer)
+		options = NewOptions()
+		spi = NewPluginSPIImpl(cf, svf, sc, timer, options)
 	})
 
 	AfterEach(func() {
@@ -423,121 +514,2859 @@ ethernets:
 	})
 
 	Describe("#CreateMachine", func() {
-		It("should create the kubevirt virtual machine and the userdata secret", func() {
+		It("should create the kubevirt virtual machine and the userdata and networkdata secrets", func() {
 			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
 			timer.EXPECT().Now().Return(t)
 
 			c.EXPECT().Create(context.TODO(), virtualMachine).Return(nil)
-			c.EXPECT().Create(context.TODO(), userDataSecret).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
 
-			providerID, err := spi.CreateMachine(context.TODO(), machineName, providerSpec, secret)
+			machineState := state.New()
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, machineState)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(providerID).To(Equal(machineProviderID))
+			Expect(machineState.Is(state.OperationCreate, state.PhaseCreated)).To(BeTrue())
+			Expect(machineState.UserDataSecretName).To(Equal(userDataSecretName))
+			Expect(machineState.NetworkDataSecretName).To(Equal(networkDataSecretName))
 		})
-	})
 
-	Describe("#DeleteMachine", func() {
-		It("should delete the kubevirt virtual machine if it exists", func() {
-			expectGetVirtualMachine(c, virtualMachine, nil)
-			c.EXPECT().Delete(context.TODO(), virtualMachine).Return(nil)
+		It("should only create the userdata and networkdata secrets if a previous attempt already created the kubevirt virtual machine", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t.Add(time.Minute))
+
+			vm := virtualMachine.DeepCopy()
+			vm.UID = "vm-uid"
+			expectGetVirtualMachine(c, vm, nil)
+			uds := userDataSecret.DeepCopy()
+			uds.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(vm, kubevirtv1.VirtualMachineGroupVersionKind)}
+			expectCreateSecret(c, uds)
+			nds := networkDataSecret.DeepCopy()
+			nds.OwnerReferences = uds.OwnerReferences
+			expectCreateSecret(c, nds)
+			expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
 
-			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			machineState := state.New()
+			machineState.VirtualMachineUID = vm.UID
+			machineState.UserDataSecretName = userDataSecretName
+			machineState.NetworkDataSecretName = networkDataSecretName
+			machineState.SetPhase(state.OperationCreate, state.PhaseVirtualMachineCreated, t)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, machineState)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(providerID).To(Equal(machineProviderID))
+			Expect(machineState.Is(state.OperationCreate, state.PhaseCreated)).To(BeTrue())
+			Expect(machineState.BootStage).To(Equal(string(BootStageRunning)))
+			Expect(machineState.BootMessage).To(Equal("waiting for the guest agent to connect"))
 		})
 
-		It("should not fail if the kubevirt virtual machine does not exist", func() {
-			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+		It("should reuse the userdata and networkdata secrets if a previous attempt already created them", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t.Add(time.Minute))
+
+			unownedUserDataSecret := userDataSecret.DeepCopy()
+			unownedUserDataSecret.OwnerReferences = nil
+			unownedNetworkDataSecret := networkDataSecret.DeepCopy()
+			unownedNetworkDataSecret.OwnerReferences = nil
+			expectCreateExistingSecret(c, userDataSecret, unownedUserDataSecret)
+			c.EXPECT().Update(context.TODO(), userDataSecret).Return(nil)
+			expectCreateExistingSecret(c, networkDataSecret, unownedNetworkDataSecret)
+			c.EXPECT().Update(context.TODO(), networkDataSecret).Return(nil)
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(nil)
 
-			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			machineState := state.New()
+			machineState.UserDataSecretName = userDataSecretName
+			machineState.NetworkDataSecretName = networkDataSecretName
+			machineState.SetPhase(state.OperationCreate, state.PhaseSecretsCreated, t)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, machineState)
 			Expect(err).NotTo(HaveOccurred())
-			Expect(providerID).To(BeEmpty())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(machineState.Is(state.OperationCreate, state.PhaseCreated)).To(BeTrue())
+			Expect(machineState.UserDataSecretName).To(Equal(userDataSecretName))
 		})
-	})
 
-	Describe("#GetMachineStatus", func() {
-		It("should return the provider id of the kubevirt virtual machine if it exists", func() {
-			expectGetVirtualMachine(c, virtualMachine, nil)
+		It("should create the kubevirt virtual machine with overcommitted guest overhead if requested", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
 
-			providerID, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			spec := *providerSpec
+			spec.OvercommitGuestOverhead = true
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Resources.OvercommitGuestOverhead = true
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
 			Expect(err).NotTo(HaveOccurred())
 			Expect(providerID).To(Equal(machineProviderID))
 		})
 
-		It("should return a MachineNotFoundError if the kubevirt virtual machine does not exist", func() {
-			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+		It("should annotate the kubevirt virtual machine with the machine metadata", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
 
-			providerID, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
-			Expect(err).To(Equal(&MachineNotFoundError{Name: machineName}))
-			Expect(providerID).To(BeEmpty())
+			machineMetadata := &MachineMetadata{
+				Namespace:         "shoot--dev--kubevirt",
+				MachineSet:        "shoot--dev--kubevirt-worker-z1-5b6c8f",
+				MachineDeployment: "shoot--dev--kubevirt-worker-z1",
+			}
+			vm := virtualMachine.DeepCopy()
+			vm.Annotations = map[string]string{
+				"example.com/vm-annotation":      "vm",
+				"kubevirt.io/machine-namespace":  "shoot--dev--kubevirt",
+				"kubevirt.io/machine-set":        "shoot--dev--kubevirt-worker-z1-5b6c8f",
+				"kubevirt.io/machine-deployment": "shoot--dev--kubevirt-worker-z1",
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, machineMetadata, providerSpec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(providerSpec.Annotations).To(Equal(map[string]string{"example.com/vm-annotation": "vm"}))
 		})
-	})
 
-	Describe("#ListMachines", func() {
-		It("should list the provider ids of all kubevirt virtual machines matching the provider spec", func() {
-			expectListVirtualMachines(c, virtualMachine, tags)
+		It("should merge the custom affinity, tolerations, and node selector into the kubevirt virtual machine", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			customNodeSelectorRequirement := corev1.NodeSelectorRequirement{
+				Key:      "node-role.kubernetes.io/virt",
+				Operator: corev1.NodeSelectorOpExists,
+			}
+			spec := *providerSpec
+			spec.Affinity = &corev1.Affinity{
+				NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+						NodeSelectorTerms: []corev1.NodeSelectorTerm{
+							{
+								MatchExpressions: []corev1.NodeSelectorRequirement{customNodeSelectorRequirement},
+							},
+						},
+					},
+				},
+			}
+			spec.Tolerations = []corev1.Toleration{
+				{
+					Key:      "dedicated",
+					Operator: corev1.TolerationOpEqual,
+					Value:    "virt",
+					Effect:   corev1.TaintEffectNoSchedule,
+				},
+			}
+			spec.NodeSelector = map[string]string{
+				"kubevirt.io/schedulable": "true",
+			}
+
+			vm := virtualMachine.DeepCopy()
+			terms := vm.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			terms[0].MatchExpressions = append([]corev1.NodeSelectorRequirement{customNodeSelectorRequirement}, terms[0].MatchExpressions...)
+			vm.Spec.Template.Spec.Tolerations = spec.Tolerations
+			vm.Spec.Template.Spec.NodeSelector = spec.NodeSelector
 
-			providerIDs, err := spi.ListMachines(context.TODO(), providerSpec, secret)
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
 			Expect(err).NotTo(HaveOccurred())
-			Expect(providerIDs).To(Equal(map[string]string{
-				machineProviderID: machineName,
-			}))
+			Expect(providerID).To(Equal(machineProviderID))
 		})
+		It("should select nodes by either the GA or the beta region and zone labels if requested", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
 
-		It("should return an empty map if no kubevirt virtual machines matching the provider spec exist", func() {
-			expectListVirtualMachines(c, nil, tags)
+			spec := *providerSpec
+			spec.TopologyLabels = api.TopologyLabelsBoth
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = []corev1.NodeSelectorTerm{
+				{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{Key: "topology.kubernetes.io/region", Operator: corev1.NodeSelectorOpIn, Values: []string{region}},
+						{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{zone}},
+					},
+				},
+				{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{Key: "failure-domain.beta.kubernetes.io/region", Operator: corev1.NodeSelectorOpIn, Values: []string{region}},
+						{Key: "failure-domain.beta.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{zone}},
+					},
+				},
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
 
-			providerIDs, err := spi.ListMachines(context.TODO(), providerSpec, secret)
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
 			Expect(err).NotTo(HaveOccurred())
-			Expect(providerIDs).To(BeEmpty())
+			Expect(providerID).To(Equal(machineProviderID))
 		})
-	})
 
-	Describe("#ShutDownMachine", func() {
-		It("should set the spec.running field of the kubevirt virtual machine to false", func() {
-			expectGetVirtualMachine(c, virtualMachine, nil)
-			c.EXPECT().Update(context.TODO(), withRunning(virtualMachine, false)).Return(nil)
+		It("should choose the zone by the machine name if multiple zones are specified, and record it in a label", func() {
+			cf.EXPECT().GetClient(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(c, namespace, nil).Times(3)
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, machineName))
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, machineName))
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil).Times(2)
+			timer.EXPECT().Now().Return(t).Times(2)
 
-			providerID, err := spi.ShutDownMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			spec := *providerSpec
+			spec.Zone = ""
+			spec.Zones = []string{"zone-a", "zone-b", "zone-c"}
+
+			var zones []string
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{})).
+				DoAndReturn(func(_ context.Context, vm *kubevirtv1.VirtualMachine, _ ...client.CreateOption) error {
+					zone := vm.Labels["kubevirt.io/zone"]
+					Expect(spec.Zones).To(ContainElement(zone))
+					Expect(vm.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions).To(ContainElement(
+						corev1.NodeSelectorRequirement{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{zone}},
+					))
+					zones = append(zones, zone)
+					return nil
+				}).Times(2)
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(4)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(4)
+
+			for i := 0; i < 2; i++ {
+				providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(providerID).To(Equal(machineProviderID))
+			}
+			Expect(zones[1]).To(Equal(zones[0]))
+		})
+
+		It("should use the overridden region and zone labels, and the GA labels for unparsable server versions", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return("v1.16.2.1-custom", nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.ZoneLabel = "example.com/zone"
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[1].Key = "example.com/zone"
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
 			Expect(err).NotTo(HaveOccurred())
 			Expect(providerID).To(Equal(machineProviderID))
 		})
 
-		It("should return a MachineNotFoundError if the kubevirt virtual machine does not exist", func() {
-			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+		It("should create the kubevirt virtual machine with EFI firmware and secure boot if requested", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
 
-			providerID, err := spi.ShutDownMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
-			Expect(err).To(Equal(&MachineNotFoundError{Name: machineName}))
-			Expect(providerID).To(BeEmpty())
+			spec := *providerSpec
+			spec.Firmware = &api.Firmware{
+				Bootloader: api.BootloaderEFI,
+				SecureBoot: true,
+			}
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Firmware = &kubevirtv1.Firmware{
+				Bootloader: &kubevirtv1.Bootloader{
+					EFI: &kubevirtv1.EFI{
+						SecureBoot: pointer.BoolPtr(true),
+					},
+				},
+			}
+			vm.Spec.Template.Spec.Domain.Features = &kubevirtv1.Features{
+				SMM: &kubevirtv1.FeatureState{
+					Enabled: pointer.BoolPtr(true),
+				},
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
 		})
-	})
-})
+		It("should create the kubevirt virtual machine with the specified features, enabling SMM for secure boot", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
 
-func expectGetVirtualMachine(c *mockclient.MockClient, virtualMachine *kubevirtv1.VirtualMachine, err error) {
-	c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: machineName}, &kubevirtv1.VirtualMachine{}).
-		DoAndReturn(func(_ context.Context, _ client.ObjectKey, vm *kubevirtv1.VirtualMachine) error {
-			if err != nil {
-				return err
+			spec := *providerSpec
+			spec.Firmware = &api.Firmware{
+				Bootloader: api.BootloaderEFI,
+				SecureBoot: true,
 			}
-			*vm = *virtualMachine.DeepCopy()
-			return nil
+			spec.Features = &kubevirtv1.Features{
+				ACPI: kubevirtv1.FeatureState{},
+				Hyperv: &kubevirtv1.FeatureHyperv{
+					Relaxed: &kubevirtv1.FeatureState{},
+					VAPIC:   &kubevirtv1.FeatureState{},
+				},
+			}
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Firmware = &kubevirtv1.Firmware{
+				Bootloader: &kubevirtv1.Bootloader{
+					EFI: &kubevirtv1.EFI{
+						SecureBoot: pointer.BoolPtr(true),
+					},
+				},
+			}
+			vm.Spec.Template.Spec.Domain.Features = &kubevirtv1.Features{
+				ACPI: kubevirtv1.FeatureState{},
+				Hyperv: &kubevirtv1.FeatureHyperv{
+					Relaxed: &kubevirtv1.FeatureState{},
+					VAPIC:   &kubevirtv1.FeatureState{},
+				},
+				SMM: &kubevirtv1.FeatureState{
+					Enabled: pointer.BoolPtr(true),
+				},
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
 		})
-}
+		It("should create the kubevirt virtual machine with the specified clock", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
 
-func expectListVirtualMachines(c *mockclient.MockClient, virtualMachine *kubevirtv1.VirtualMachine, labels map[string]string) {
-	c.EXPECT().List(context.TODO(), &kubevirtv1.VirtualMachineList{}, client.InNamespace(namespace), client.MatchingLabels(labels)).
-		DoAndReturn(func(_ context.Context, vmList *kubevirtv1.VirtualMachineList, _ ...client.ListOption) error {
-			if virtualMachine != nil {
-				vmList.Items = []kubevirtv1.VirtualMachine{*virtualMachine.DeepCopy()}
-			} else {
-				vmList.Items = []kubevirtv1.VirtualMachine{}
+			timezone := kubevirtv1.ClockOffsetTimezone("Europe/Berlin")
+			clock := &kubevirtv1.Clock{
+				ClockOffset: kubevirtv1.ClockOffset{Timezone: &timezone},
+				Timer: &kubevirtv1.Timer{
+					HPET:   &kubevirtv1.HPETTimer{Enabled: pointer.BoolPtr(false)},
+					RTC:    &kubevirtv1.RTCTimer{TickPolicy: kubevirtv1.RTCTickPolicyCatchup},
+					Hyperv: &kubevirtv1.HypervTimer{},
+				},
 			}
-			return nil
+			spec := *providerSpec
+			spec.Clock = clock
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Clock = clock
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
 		})
-}
 
-func withRunning(virtualMachine *kubevirtv1.VirtualMachine, running bool) *kubevirtv1.VirtualMachine {
-	vm := virtualMachine.DeepCopy()
-	vm.Spec.Running = pointer.BoolPtr(false)
-	return vm
+		It("should create the kubevirt virtual machine if a provider cluster node supports the CPU model and required features", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.CPU = providerSpec.CPU.DeepCopy()
+			spec.CPU.Model = "Haswell"
+			spec.CPU.Features = []kubevirtv1.CPUFeature{{Name: "avx2"}, {Name: "vmx", Policy: "optional"}}
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.CPU = spec.CPU
+
+			expectListNodes(c, map[string]string{
+				"feature.node.kubernetes.io/cpu-model-Haswell": "true",
+				"feature.node.kubernetes.io/cpu-feature-avx2":  "true",
+			}, []corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: hostNodeName}}})
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should fail if no provider cluster node supports the CPU model", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.CPU = providerSpec.CPU.DeepCopy()
+			spec.CPU.Model = "Haswell"
+
+			expectListNodes(c, map[string]string{
+				"feature.node.kubernetes.io/cpu-model-Haswell": "true",
+			}, nil)
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).To(HaveOccurred())
+		})
+		Context("with the capacity check enabled", func() {
+			var nodes []corev1.Node
+
+			BeforeEach(func() {
+				options.CapacityCheck = true
+				allocatable := corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("2"),
+					corev1.ResourceMemory: resource.MustParse("8Gi"),
+				}
+				nodes = []corev1.Node{
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:   "node-1",
+							Labels: map[string]string{"topology.kubernetes.io/region": region, "topology.kubernetes.io/zone": zone},
+						},
+						Status: corev1.NodeStatus{Allocatable: allocatable},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:   "node-2",
+							Labels: map[string]string{"topology.kubernetes.io/region": region, "topology.kubernetes.io/zone": "other-zone"},
+						},
+						Status: corev1.NodeStatus{Allocatable: allocatable},
+					},
+				}
+			})
+
+			expectListPods := func(cpu string) {
+				c.EXPECT().List(context.TODO(), &corev1.PodList{}).
+					DoAndReturn(func(_ context.Context, podList *corev1.PodList, _ ...client.ListOption) error {
+						podList.Items = []corev1.Pod{
+							{
+								Spec: corev1.PodSpec{
+									NodeName: "node-1",
+									Containers: []corev1.Container{
+										{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}}},
+									},
+								},
+							},
+						}
+						return nil
+					})
+			}
+
+			It("should create the kubevirt virtual machine if a node in its zone can fit it", func() {
+				svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+				timer.EXPECT().Now().Return(t)
+
+				expectListNodes(c, nil, nodes)
+				expectListPods("500m")
+				c.EXPECT().Create(context.TODO(), virtualMachine).Return(nil)
+				expectCreateSecret(c, userDataSecret)
+				expectCreateSecret(c, networkDataSecret)
+
+				providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(providerID).To(Equal(machineProviderID))
+			})
+
+			It("should return a ResourceExhaustedError if no node in its zone can fit it", func() {
+				svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+				timer.EXPECT().Now().Return(t)
+
+				expectListNodes(c, nil, nodes)
+				expectListPods("1500m")
+
+				_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+				Expect(err).To(HaveOccurred())
+				Expect(IsResourceExhaustedError(err)).To(BeTrue())
+			})
+
+			It("should account for the additional CPU of an isolated emulator thread", func() {
+				svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+				timer.EXPECT().Now().Return(t)
+
+				spec := *providerSpec
+				spec.CPU = &kubevirtv1.CPU{DedicatedCPUPlacement: true, IsolateEmulatorThread: true}
+
+				expectListNodes(c, nil, nodes)
+				expectListPods("500m")
+
+				_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+				Expect(err).To(HaveOccurred())
+				Expect(IsResourceExhaustedError(err)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("cpu=2"))
+			})
+		})
+
+		It("should fail if deep validation is enabled and the provider spec references missing provider cluster resources", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			options.DeepValidation = true
+
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Name: storageClassName}, &storagev1.StorageClass{}).Return(nil)
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "net-conf"}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				Return(apierrors.NewNotFound(schema.GroupResource{Group: "k8s.cni.cncf.io", Resource: "network-attachment-definitions"}, "net-conf"))
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+			Expect(err).To(MatchError(`provider spec references resources that don't exist in the provider cluster: NetworkAttachmentDefinition "default/net-conf"`))
+			Expect(err).To(BeAssignableToTypeOf(&InvalidProviderSpecError{}))
+		})
+		It("should fail if the network check is enabled and a network attachment definition doesn't exist", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			options.NetworkCheck = true
+
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "net-conf"}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				Return(apierrors.NewNotFound(schema.GroupResource{Group: "k8s.cni.cncf.io", Resource: "network-attachment-definitions"}, "net-conf"))
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+			Expect(err).To(MatchError(`provider spec references resources that don't exist in the provider cluster: NetworkAttachmentDefinition "default/net-conf"`))
+			Expect(err).To(BeAssignableToTypeOf(&InvalidProviderSpecError{}))
+		})
+		It("should fail if the network check is enabled and a network attachment definition in another namespace is not accessible", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			options.NetworkCheck = true
+
+			spec := *providerSpec
+			spec.Networks = []api.NetworkSpec{{Name: "infra/net-conf"}}
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&authorizationv1.SelfSubjectAccessReview{})).
+				DoAndReturn(func(_ context.Context, review *authorizationv1.SelfSubjectAccessReview, _ ...client.CreateOption) error {
+					Expect(review.Spec.ResourceAttributes).To(Equal(&authorizationv1.ResourceAttributes{
+						Namespace: "infra",
+						Verb:      "get",
+						Group:     "k8s.cni.cncf.io",
+						Resource:  "network-attachment-definitions",
+						Name:      "net-conf",
+					}))
+					review.Status.Reason = "no RBAC policy matched"
+					return nil
+				})
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).To(HaveOccurred())
+			var statusErr *apierrors.StatusError
+			Expect(errors.As(err, &statusErr)).To(BeTrue())
+			Expect(apierrors.IsForbidden(statusErr)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("not allowed to use network attachment definitions in namespace infra: no RBAC policy matched"))
+		})
+		It("should record the IPAM types of the network attachment definitions in the machine state", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			options.NetworkCheck = true
+
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "net-conf"}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				DoAndReturn(func(_ context.Context, _ client.ObjectKey, obj *unstructured.Unstructured) error {
+					return unstructured.SetNestedField(obj.Object, `{"cniVersion":"0.3.1","type":"bridge","ipam":{"type":"whereabouts"}}`, "spec", "config")
+				})
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			machineState := state.New()
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(machineState.NetworkIPAMTypes).To(Equal(map[string]string{networkName: "whereabouts"}))
+		})
+		It("should create the kubevirt virtual machine with an existing persistent volume claim as root volume", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.RootVolume = api.RootVolumeSpec{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: "golden-root-disk",
+				},
+			}
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Volumes[0].VolumeSource = kubevirtv1.VolumeSource{
+				PersistentVolumeClaim: spec.RootVolume.PersistentVolumeClaim,
+			}
+			vm.Spec.DataVolumeTemplates = vm.Spec.DataVolumeTemplates[1:]
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should create the cached image and clone it into the root volume if the image cache is enabled", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.RootVolume = providerSpec.RootVolume
+			spec.RootVolume.Cache = true
+
+			cachedImage := &cdicorev1alpha1.DataVolume{}
+			c.EXPECT().Get(context.TODO(), gomock.Any(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				Return(apierrors.NewNotFound(schema.GroupResource{}, ""))
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				DoAndReturn(func(_ context.Context, dv *unstructured.Unstructured, _ ...client.CreateOption) error {
+					Expect(dv.GetAPIVersion()).To(Equal("cdi.kubevirt.io/v1beta1"))
+					return runtime.DefaultUnstructuredConverter.FromUnstructured(dv.Object, cachedImage)
+				})
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{})).
+				DoAndReturn(func(_ context.Context, vm *kubevirtv1.VirtualMachine, _ ...client.CreateOption) error {
+					Expect(vm.Spec.DataVolumeTemplates[0].Spec.Source).To(Equal(cdicorev1alpha1.DataVolumeSource{
+						PVC: &cdicorev1alpha1.DataVolumeSourcePVC{Namespace: namespace, Name: cachedImage.Name},
+					}))
+					Expect(vm.Spec.DataVolumeTemplates[0].Spec.PVC).To(Equal(providerSpec.RootVolume.PVC))
+					return nil
+				})
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(cachedImage.Namespace).To(Equal(namespace))
+			Expect(cachedImage.Labels).To(HaveKeyWithValue("kubevirt.io/image-cache", "true"))
+			Expect(cachedImage.Annotations).To(HaveKeyWithValue("kubevirt.io/image-cache-last-used", t.UTC().Format(time.RFC3339)))
+			Expect(cachedImage.Spec).To(Equal(providerSpec.RootVolume.DataVolumeSpec))
+		})
+		It("should create retained data volumes as standalone objects and reuse existing ones", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[0].DeletionPolicy = api.VolumeDeletionPolicyRetain
+			spec.AdditionalVolumes[1].DeletionPolicy = api.VolumeDeletionPolicyRetain
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Volumes[2].DataVolume.Name = machineName + "-volume-1"
+			vm.Spec.Template.Spec.Volumes[3].DataVolume.Name = machineName + "-volume-2"
+			vm.Spec.DataVolumeTemplates = vm.Spec.DataVolumeTemplates[:1]
+
+			var retainedDataVolumes []*cdicorev1alpha1.DataVolume
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				DoAndReturn(func(_ context.Context, obj *unstructured.Unstructured, _ ...client.CreateOption) error {
+					dataVolume := &cdicorev1alpha1.DataVolume{}
+					Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, dataVolume)).To(Succeed())
+					retainedDataVolumes = append(retainedDataVolumes, dataVolume)
+					if len(retainedDataVolumes) == 1 {
+						return apierrors.NewAlreadyExists(schema.GroupResource{}, dataVolume.Name)
+					}
+					return nil
+				}).Times(2)
+			expectGetRetainedDataVolume(c, machineName+"-"+spec.AdditionalVolumes[0].Name, machineName)
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(retainedDataVolumes).To(HaveLen(2))
+			for i, dataVolume := range retainedDataVolumes {
+				Expect(dataVolume.Name).To(Equal(machineName + "-" + spec.AdditionalVolumes[i].Name))
+				Expect(dataVolume.Labels).To(Equal(map[string]string{
+					"kubevirt.io/vm":              machineName,
+					"kubevirt.io/deletion-policy": "Retain",
+				}))
+				Expect(dataVolume.Spec).To(Equal(*spec.AdditionalVolumes[i].DataVolume))
+			}
+		})
+		It("should adopt an existing retained data volume of a machine whose VM no longer exists", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[1].DeletionPolicy = api.VolumeDeletionPolicyRetain
+			spec.AdditionalVolumes[1].DataVolumeName = "data"
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Volumes[3].DataVolume.Name = "data"
+			vm.Spec.DataVolumeTemplates = vm.Spec.DataVolumeTemplates[:2]
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				Return(apierrors.NewAlreadyExists(schema.GroupResource{}, "data"))
+			expectGetRetainedDataVolume(c, "data", "machine-0")
+			c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: "machine-0"}, &kubevirtv1.VirtualMachine{}).
+				Return(apierrors.NewNotFound(schema.GroupResource{}, "machine-0"))
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				DoAndReturn(func(_ context.Context, obj *unstructured.Unstructured, _ ...client.UpdateOption) error {
+					Expect(obj.GetName()).To(Equal("data"))
+					Expect(obj.GetLabels()).To(HaveKeyWithValue("kubevirt.io/vm", machineName))
+					return nil
+				})
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should fail if an existing retained data volume is still used by the VM of another machine", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[1].DeletionPolicy = api.VolumeDeletionPolicyRetain
+			spec.AdditionalVolumes[1].DataVolumeName = "data"
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				Return(apierrors.NewAlreadyExists(schema.GroupResource{}, "data"))
+			expectGetRetainedDataVolume(c, "data", "machine-0")
+			c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: "machine-0"}, &kubevirtv1.VirtualMachine{}).Return(nil)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).To(MatchError(`retained DataVolume "data" is already used by VirtualMachine "machine-0"`))
+			Expect(providerID).To(BeEmpty())
+		})
+
+		It("should derive the names of retained data volumes from their data volume name templates", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[1].DeletionPolicy = api.VolumeDeletionPolicyRetain
+			spec.AdditionalVolumes[1].DataVolumeName = "data-{{ .MachineName }}"
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Volumes[3].DataVolume.Name = "data-" + machineName
+			vm.Spec.DataVolumeTemplates = vm.Spec.DataVolumeTemplates[:2]
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				DoAndReturn(func(_ context.Context, obj *unstructured.Unstructured, _ ...client.CreateOption) error {
+					Expect(obj.GetName()).To(Equal("data-" + machineName))
+					return nil
+				})
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should apply the disk options of the root disk and the additional volumes", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.RootDisk = &api.DiskOptions{
+				Cache: kubevirtv1.CacheNone,
+				IO:    kubevirtv1.IONative,
+			}
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[1].DiskOptions = api.DiskOptions{
+				Bus:   api.DiskBusSCSI,
+				Cache: kubevirtv1.CacheWriteThrough,
+			}
+			vm := virtualMachine.DeepCopy()
+			disks := vm.Spec.Template.Spec.Domain.Devices.Disks
+			disks[0].Cache = kubevirtv1.CacheNone
+			disks[0].IO = kubevirtv1.IONative
+			disks[3].Disk.Bus = api.DiskBusSCSI
+			disks[3].Cache = kubevirtv1.CacheWriteThrough
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(providerSpec.Devices.Disks[0].Cache).To(BeEmpty())
+		})
+		It("should attach the sysprep ConfigMap as a cdrom disk", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Sysprep = &api.SysprepSpec{
+				ConfigMap: &corev1.LocalObjectReference{Name: "sysprep"},
+			}
+			vm := virtualMachine.DeepCopy()
+			vmiSpec := &vm.Spec.Template.Spec
+			vmiSpec.Domain.Devices.Disks = append(vmiSpec.Domain.Devices.Disks, kubevirtv1.Disk{
+				Name: "sysprepdisk",
+				DiskDevice: kubevirtv1.DiskDevice{
+					CDRom: &kubevirtv1.CDRomTarget{Bus: api.DiskBusSATA},
+				},
+			})
+			vmiSpec.Volumes = append(vmiSpec.Volumes, kubevirtv1.Volume{
+				Name: "sysprepdisk",
+				VolumeSource: kubevirtv1.VolumeSource{
+					ConfigMap: &kubevirtv1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "sysprep"},
+					},
+				},
+			})
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should attach the virtio drivers as a cdrom disk and enable the Windows defaults", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Windows = &api.WindowsSpec{
+				VirtioDriversImage: "registry.example.com/virtio-win:latest",
+			}
+			vm := virtualMachine.DeepCopy()
+			vmiSpec := &vm.Spec.Template.Spec
+			vmiSpec.Domain.Devices.Disks = append(vmiSpec.Domain.Devices.Disks, kubevirtv1.Disk{
+				Name: "virtiodriversdisk",
+				DiskDevice: kubevirtv1.DiskDevice{
+					CDRom: &kubevirtv1.CDRomTarget{Bus: api.DiskBusSATA},
+				},
+			})
+			vmiSpec.Volumes = append(vmiSpec.Volumes, kubevirtv1.Volume{
+				Name: "virtiodriversdisk",
+				VolumeSource: kubevirtv1.VolumeSource{
+					ContainerDisk: &kubevirtv1.ContainerDiskSource{Image: "registry.example.com/virtio-win:latest"},
+				},
+			})
+			enabled := &kubevirtv1.FeatureState{Enabled: pointer.BoolPtr(true)}
+			spinlockRetries := uint32(8191)
+			vmiSpec.Domain.Features = &kubevirtv1.Features{
+				ACPI: *enabled,
+				APIC: &kubevirtv1.FeatureAPIC{Enabled: pointer.BoolPtr(true)},
+				Hyperv: &kubevirtv1.FeatureHyperv{
+					Relaxed:    enabled,
+					VAPIC:      enabled,
+					Spinlocks:  &kubevirtv1.FeatureSpinlocks{Enabled: pointer.BoolPtr(true), Retries: &spinlockRetries},
+					VPIndex:    enabled,
+					Runtime:    enabled,
+					SyNIC:      enabled,
+					SyNICTimer: enabled,
+					Reset:      enabled,
+				},
+			}
+			vmiSpec.Domain.Clock = &kubevirtv1.Clock{
+				ClockOffset: kubevirtv1.ClockOffset{UTC: &kubevirtv1.ClockOffsetUTC{}},
+				Timer: &kubevirtv1.Timer{
+					HPET:   &kubevirtv1.HPETTimer{Enabled: pointer.BoolPtr(false)},
+					PIT:    &kubevirtv1.PITTimer{TickPolicy: kubevirtv1.PITTickPolicyDelay},
+					RTC:    &kubevirtv1.RTCTimer{TickPolicy: kubevirtv1.RTCTickPolicyCatchup},
+					Hyperv: &kubevirtv1.HypervTimer{},
+				},
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should attach additional volumes as lun and cdrom disks", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Devices = &api.Devices{
+				Disks: []kubevirtv1.Disk{
+					{
+						Name: "volume-1",
+						DiskDevice: kubevirtv1.DiskDevice{
+							LUN: &kubevirtv1.LunTarget{},
+						},
+					},
+					{
+						Name: "volume-2",
+						DiskDevice: kubevirtv1.DiskDevice{
+							CDRom: &kubevirtv1.CDRomTarget{Bus: api.DiskBusSATA},
+						},
+					},
+				},
+				Rng:             providerSpec.Devices.Rng,
+				Watchdog:        providerSpec.Devices.Watchdog,
+				BlockMultiQueue: true,
+			}
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[1] = api.AdditionalVolumeSpec{
+				Name: "volume-2",
+				VolumeSource: &api.VolumeSource{
+					ConfigMap: &kubevirtv1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "oem-iso"},
+					},
+				},
+			}
+			vm := virtualMachine.DeepCopy()
+			disks := vm.Spec.Template.Spec.Domain.Devices.Disks
+			disks[0].DedicatedIOThread = nil
+			disks[2] = kubevirtv1.Disk{
+				Name: "disk0",
+				DiskDevice: kubevirtv1.DiskDevice{
+					LUN: &kubevirtv1.LunTarget{},
+				},
+			}
+			disks[3] = kubevirtv1.Disk{
+				Name: "disk1",
+				DiskDevice: kubevirtv1.DiskDevice{
+					CDRom: &kubevirtv1.CDRomTarget{Bus: api.DiskBusSATA},
+				},
+			}
+			vm.Spec.Template.Spec.Volumes[3].VolumeSource = kubevirtv1.VolumeSource{
+				ConfigMap: spec.AdditionalVolumes[1].VolumeSource.ConfigMap,
+			}
+			vm.Spec.DataVolumeTemplates = vm.Spec.DataVolumeTemplates[:2]
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should attach service account and empty disk additional volumes", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.AdditionalVolumes = []api.AdditionalVolumeSpec{
+				{
+					Name: "volume-1",
+					VolumeSource: &api.VolumeSource{
+						ServiceAccount: &kubevirtv1.ServiceAccountVolumeSource{ServiceAccountName: "worker"},
+					},
+				},
+				{
+					Name:      "volume-2",
+					EmptyDisk: &kubevirtv1.EmptyDiskSource{Capacity: resource.MustParse("50Gi")},
+				},
+			}
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Volumes[2].VolumeSource = kubevirtv1.VolumeSource{
+				ServiceAccount: spec.AdditionalVolumes[0].VolumeSource.ServiceAccount,
+			}
+			vm.Spec.Template.Spec.Volumes[3].VolumeSource = kubevirtv1.VolumeSource{
+				EmptyDisk: spec.AdditionalVolumes[1].EmptyDisk,
+			}
+			vm.Spec.DataVolumeTemplates = vm.Spec.DataVolumeTemplates[:1]
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should set the disk serial numbers and the boot order of the root disk, PXE boot networks, and bootable volumes", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Networks = append([]api.NetworkSpec{}, providerSpec.Networks...)
+			spec.Networks[0].PXEBoot = true
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[0].Serial = "data-0"
+			spec.AdditionalVolumes[1].Bootable = true
+			vm := virtualMachine.DeepCopy()
+			disks := vm.Spec.Template.Spec.Domain.Devices.Disks
+			disks[0].BootOrder = uintPtr(1)
+			disks[2].Serial = "data-0"
+			disks[3].BootOrder = uintPtr(3)
+			vm.Spec.Template.Spec.Domain.Devices.Interfaces[1].BootOrder = uintPtr(2)
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should set the priority class and scheduler name of the kubevirt virtual machine instance", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.PriorityClassName = "worker-vms"
+			spec.SchedulerName = "vm-scheduler"
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.PriorityClassName = "worker-vms"
+			vm.Spec.Template.Spec.SchedulerName = "vm-scheduler"
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should set the hostname and subdomain of the kubevirt virtual machine instance from their templates", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Hostname = "{{ .MachineName }}-node"
+			spec.Subdomain = "workers"
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Hostname = machineName + "-node"
+			vm.Spec.Template.Spec.Subdomain = "workers"
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should resolve the templates in the tags and network names", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Tags = map[string]string{"example.com/slot": "{{ .Zone }}-{{ .Index }}"}
+			for k, v := range tags {
+				spec.Tags[k] = v
+			}
+			spec.Networks = []api.NetworkSpec{{Name: "default/net-{{ .Zone }}"}}
+			vm := virtualMachine.DeepCopy()
+			vm.Labels["example.com/slot"] = zone + "-1"
+			vm.Spec.Template.Spec.Networks[1].Multus.NetworkName = "default/net-" + zone
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(spec.Networks[0].Name).To(Equal("default/net-{{ .Zone }}"))
+		})
+		It("should apply the defaults of the provider config", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			options.SetProviderConfig(&ProviderConfig{
+				DefaultStorageClassName: "fast",
+				DefaultDiskBus:          "sata",
+				ImageRegistryMirrors:    map[string]string{"quay.io": "mirror.local"},
+				DefaultAnnotations: map[string]string{
+					"example.com/vm-annotation":       "default",
+					"maintenance.example.com/managed": "true",
+				},
+				DefaultVMIAnnotations: map[string]string{DeschedulerEvictAnnotation: "true"},
+				DefaultTags: map[string]string{
+					"mcm.gardener.cloud/role": "default",
+					"example.com/environment": "{{ .Zone }}",
+				},
+				EnforcedTags: map[string]string{"example.com/cost-center": "1234"},
+			})
+
+			spec := *providerSpec
+			spec.RootVolume.DataVolumeSpec = *providerSpec.RootVolume.DataVolumeSpec.DeepCopy()
+			spec.RootVolume.PVC.StorageClassName = nil
+			spec.RootVolume.Source = cdicorev1alpha1.DataVolumeSource{
+				Registry: &cdicorev1alpha1.DataVolumeSourceRegistry{URL: "docker://quay.io/containerdisks/ubuntu:20.04"},
+			}
+			spec.Tags = map[string]string{"example.com/cost-center": "5678"}
+			for k, v := range providerSpec.Tags {
+				spec.Tags[k] = v
+			}
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{})).
+				DoAndReturn(func(_ context.Context, vm *kubevirtv1.VirtualMachine, _ ...client.CreateOption) error {
+					rootDataVolumeSpec := vm.Spec.DataVolumeTemplates[0].Spec
+					Expect(rootDataVolumeSpec.PVC.StorageClassName).To(Equal(pointer.StringPtr("fast")))
+					Expect(rootDataVolumeSpec.Source.Registry.URL).To(Equal("docker://mirror.local/containerdisks/ubuntu:20.04"))
+					Expect(vm.Spec.DataVolumeTemplates[1].Spec.PVC.StorageClassName).To(Equal(pointer.StringPtr(storageClassName)))
+					for _, disk := range vm.Spec.Template.Spec.Domain.Devices.Disks {
+						if disk.Name != "cloudinitdisk" && disk.Disk != nil {
+							Expect(disk.Disk.Bus).To(Equal("sata"), disk.Name)
+						}
+					}
+					Expect(vm.Annotations).To(HaveKeyWithValue("example.com/vm-annotation", "vm"))
+					Expect(vm.Annotations).To(HaveKeyWithValue("maintenance.example.com/managed", "true"))
+					Expect(vm.Spec.Template.ObjectMeta.Annotations).To(HaveKeyWithValue("example.com/vmi-annotation", "vmi"))
+					Expect(vm.Spec.Template.ObjectMeta.Annotations).To(HaveKeyWithValue(DeschedulerEvictAnnotation, "true"))
+					Expect(vm.Labels).To(HaveKeyWithValue("mcm.gardener.cloud/role", "node"))
+					Expect(vm.Labels).To(HaveKeyWithValue("example.com/environment", zone))
+					Expect(vm.Labels).To(HaveKeyWithValue("example.com/cost-center", "1234"))
+					return nil
+				})
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerSpec.RootVolume.PVC.StorageClassName).To(Equal(pointer.StringPtr(storageClassName)))
+		})
+
+		It("should set the eviction strategy and the descheduler eviction annotation", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			liveMigrate := kubevirtv1.EvictionStrategyLiveMigrate
+			spec := *providerSpec
+			spec.Eviction = &api.EvictionSpec{
+				Strategy:    &liveMigrate,
+				Descheduler: true,
+			}
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.EvictionStrategy = &liveMigrate
+			vm.Spec.Template.ObjectMeta.Annotations[DeschedulerEvictAnnotation] = "true"
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should fail if the namespace is not allowed by the provider policy", func() {
+			timer.EXPECT().Now().Return(t)
+
+			options.SetProviderConfig(&ProviderConfig{AllowedNamespaces: []string{"machines"}})
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+			Expect(err).To(MatchError(`provider spec violates the provider policy: namespace "default" is not allowed by rule allowedNamespaces, allowed values are machines`))
+			Expect(err).To(BeAssignableToTypeOf(&InvalidProviderSpecError{}))
+		})
+
+		It("should fail if a storage class is not allowed by the provider policy", func() {
+			timer.EXPECT().Now().Return(t)
+
+			options.SetProviderConfig(&ProviderConfig{AllowedStorageClassNames: []string{"fast", "slow"}})
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+			Expect(err).To(MatchError(`provider spec violates the provider policy: storage class "standard" is not allowed by rule allowedStorageClassNames, allowed values are fast, slow`))
+			Expect(err).To(BeAssignableToTypeOf(&InvalidProviderSpecError{}))
+		})
+		It("should not add the pod network if it's disabled", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.DisablePodNetwork = true
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Devices.Interfaces = vm.Spec.Template.Spec.Domain.Devices.Interfaces[1:]
+			vm.Spec.Template.Spec.Networks = vm.Spec.Template.Spec.Networks[1:]
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should inject the machine identity into the userdata if specified", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.InjectMachineIdentity = true
+			spec.UserDataAdditions = map[string]string{"SLOT": "{{ .Index }}"}
+			secretWithIdentity := userDataSecret.DeepCopy()
+			secretWithIdentity.Data["userdata"] = append(secretWithIdentity.Data["userdata"], []byte("write_files:\n"+
+				"- path: /etc/machine-identity\n  permissions: \"0644\"\n  content: |\n"+
+				"    MACHINE_NAME='"+machineName+"'\n    PROVIDER_ID='"+machineProviderID+"'\n    ZONE='"+zone+"'\n    SLOT='1'\n")...)
+
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(nil)
+			expectCreateSecret(c, secretWithIdentity)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should fail if the hostname template is invalid", func() {
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Hostname = "{{ .Name }}"
+
+			_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).To(HaveOccurred())
+		})
+		It("should set the model and a stable MAC address with the given prefix of the network interfaces", func() {
+			cf.EXPECT().GetClient(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(c, namespace, nil)
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil).Times(2)
+			timer.EXPECT().Now().Return(t).Times(2)
+
+			spec := *providerSpec
+			spec.Networks = append([]api.NetworkSpec{}, providerSpec.Networks...)
+			spec.Networks[0].Model = "e1000"
+			spec.Networks[0].MACAddressPrefix = "02:00:5e"
+
+			var macAddresses []string
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{})).
+				DoAndReturn(func(_ context.Context, vm *kubevirtv1.VirtualMachine, _ ...client.CreateOption) error {
+					iface := vm.Spec.Template.Spec.Domain.Devices.Interfaces[1]
+					Expect(iface.Model).To(Equal("e1000"))
+					Expect(iface.MacAddress).To(MatchRegexp(`^02:00:5e(:[0-9a-f]{2}){3}$`))
+					macAddresses = append(macAddresses, iface.MacAddress)
+					return nil
+				}).Times(2)
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(4)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(4)
+
+			for i := 0; i < 2; i++ {
+				_, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(macAddresses[1]).To(Equal(macAddresses[0]))
+		})
+		It("should use the masquerade binding and forward only the given ports for the default network", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			ports := []kubevirtv1.Port{{Name: "ssh", Port: 22}}
+			spec := *providerSpec
+			spec.Networks = []api.NetworkSpec{
+				{
+					Name:    networkName,
+					Default: true,
+					Binding: api.InterfaceBindingMasquerade,
+					Ports:   ports,
+				},
+			}
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{})).
+				DoAndReturn(func(_ context.Context, vm *kubevirtv1.VirtualMachine, _ ...client.CreateOption) error {
+					Expect(vm.Spec.Template.Spec.Domain.Devices.Interfaces).To(Equal([]kubevirtv1.Interface{
+						{
+							Name: "net0",
+							InterfaceBindingMethod: kubevirtv1.InterfaceBindingMethod{
+								Masquerade: &kubevirtv1.InterfaceMasquerade{},
+							},
+							Ports: ports,
+						},
+					}))
+					return nil
+				})
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should set the default network via the Multus default network annotation if requested", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Networks = []api.NetworkSpec{
+				{
+					Name:                 networkName,
+					Default:              true,
+					DefaultViaAnnotation: true,
+				},
+			}
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{})).
+				DoAndReturn(func(_ context.Context, vm *kubevirtv1.VirtualMachine, _ ...client.CreateOption) error {
+					Expect(vm.Spec.Template.ObjectMeta.Annotations).To(Equal(map[string]string{
+						"example.com/vmi-annotation":       "vmi",
+						"v1.multus-cni.io/default-network": networkName,
+					}))
+					Expect(vm.Spec.Template.Spec.Networks).To(Equal([]kubevirtv1.Network{
+						{
+							Name: "net0",
+							NetworkSource: kubevirtv1.NetworkSource{
+								Pod: &kubevirtv1.PodNetwork{},
+							},
+						},
+					}))
+					return nil
+				})
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(providerSpec.VMIAnnotations).NotTo(HaveKey("v1.multus-cni.io/default-network"))
+		})
+		It("should set the IOThreads policy of the kubevirt virtual machine if requested", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			ioThreadsPolicy := kubevirtv1.IOThreadsPolicyAuto
+			spec := *providerSpec
+			spec.IOThreadsPolicy = &ioThreadsPolicy
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.IOThreadsPolicy = &ioThreadsPolicy
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should not attach the memory balloon device if disabled", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			devices := *providerSpec.Devices
+			devices.AutoattachMemBalloon = pointer.BoolPtr(false)
+			spec := *providerSpec
+			spec.Devices = &devices
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Devices.AutoattachMemBalloon = pointer.BoolPtr(false)
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should set the autoattach options and the tablet input device if requested", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			devices := *providerSpec.Devices
+			devices.AutoattachSerialConsole = pointer.BoolPtr(false)
+			devices.AutoattachGraphicsDevice = pointer.BoolPtr(true)
+			devices.Tablet = &kubevirtv1.Input{Name: "tablet", Bus: api.InputBusUSB}
+			spec := *providerSpec
+			spec.Devices = &devices
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Devices.AutoattachSerialConsole = pointer.BoolPtr(false)
+			vm.Spec.Template.Spec.Domain.Devices.AutoattachGraphicsDevice = pointer.BoolPtr(true)
+			vm.Spec.Template.Spec.Domain.Devices.Inputs = []kubevirtv1.Input{
+				{Name: "tablet", Type: "tablet", Bus: "usb"},
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should attach hotpluggable additional volumes via the SCSI bus with the volume name as serial", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec{}, providerSpec.AdditionalVolumes...)
+			spec.AdditionalVolumes[1].Hotpluggable = true
+			vm := virtualMachine.DeepCopy()
+			disks := vm.Spec.Template.Spec.Domain.Devices.Disks
+			disks[3].Disk.Bus = api.DiskBusSCSI
+			disks[3].Serial = "volume-2"
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should return a ResourceExhaustedError if the resource quota is exceeded", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(apierrors.NewForbidden(schema.GroupResource{Resource: "virtualmachines"}, machineName,
+				errors.New("exceeded quota: compute-resources, requested: requests.memory=4Gi, used: requests.memory=60Gi, limited: requests.memory=64Gi")))
+
+			machineState := state.New()
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, machineState)
+			Expect(IsResourceExhaustedError(err)).To(BeTrue())
+			Expect(providerID).To(BeEmpty())
+			Expect(machineState.Is(state.OperationCreate, state.PhaseSecretsCreated)).To(BeTrue())
+		})
+		It("should adopt the kubevirt virtual machine if it already exists and matches the machine", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil).Times(2)
+			timer.EXPECT().Now().Return(t)
+
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(apierrors.NewAlreadyExists(schema.GroupResource{}, machineName))
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			c.EXPECT().Patch(context.TODO(), withApplyTypeMeta(virtualMachine), client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership).Return(nil)
+			expectCreateExistingSecret(c, userDataSecret, userDataSecret)
+			expectCreateExistingSecret(c, networkDataSecret, networkDataSecret)
+			expectGetVirtualMachineInstance(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, []cdicorev1alpha1.DataVolume{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace},
+					Status:     cdicorev1alpha1.DataVolumeStatus{Phase: cdicorev1alpha1.ImportInProgress, Progress: "42.00%"},
+				},
+			})
+
+			machineState := state.New()
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(machineState.BootStage).To(Equal(string(BootStageImportingImage)))
+			Expect(machineState.BootMessage).To(Equal(`waiting for image import of DataVolume "machine-1": 42.00%`))
+			Expect(machineState.DataVolumes).To(HaveKeyWithValue(machineName, cdicorev1alpha1.ImportInProgress))
+		})
+
+		It("should fail if the kubevirt virtual machine already exists and does not match the machine", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			vm := virtualMachine.DeepCopy()
+			vm.Labels = map[string]string{"kubevirt.io/vm": machineName}
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(apierrors.NewAlreadyExists(schema.GroupResource{}, machineName))
+			expectGetVirtualMachine(c, vm, nil)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+			Expect(err).To(HaveOccurred())
+			Expect(providerID).To(BeEmpty())
+		})
+		It("should fail if the kubevirt virtual machine already exists and is owned by a different machine class", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			vm := virtualMachine.DeepCopy()
+			vm.Labels["kubevirt.io/machine-class"] = "e2c4a3dd5d4bfa9c1ca0e0a5b58e8b1f"
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil).Times(2)
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(apierrors.NewAlreadyExists(schema.GroupResource{}, machineName))
+			expectGetVirtualMachine(c, vm, nil)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, secret, state.New())
+			Expect(err).To(MatchError(ContainSubstring("is not owned by machine class")))
+			Expect(providerID).To(BeEmpty())
+		})
+		It("should generate network data with the static network configuration of the networks", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.Networks = []api.NetworkSpec{
+				{
+					Name:        networkName,
+					Addresses:   []string{"10.0.0.10/24"},
+					Gateway:     "10.0.0.1",
+					Nameservers: []string{"10.0.0.2"},
+					MTU:         1450,
+				},
+			}
+			vm := virtualMachine.DeepCopy()
+			interfaces := vm.Spec.Template.Spec.Domain.Devices.Interfaces
+			interfaces[0].MacAddress = "02:4e:36:2f:71:cc"
+			interfaces[1].MacAddress = "02:38:bb:99:99:fd"
+			nds := networkDataSecret.DeepCopy()
+			nds.Data["networkdata"] = []byte(`ethernets:
+  default:
+    dhcp4: true
+    match:
+      macaddress: 02:4e:36:2f:71:cc
+  net0:
+    addresses:
+    - 10.0.0.10/24
+    gateway4: 10.0.0.1
+    match:
+      macaddress: 02:38:bb:99:99:fd
+    mtu: 1450
+    nameservers:
+      addresses:
+      - 10.0.0.2
+version: 2
+`)
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, nds)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should use the custom network data if specified", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			customNetworkData := `version: 1
+config:
+- type: physical
+  name: eth0
+  subnets:
+  - type: dhcp
+`
+			spec := *providerSpec
+			spec.NetworkData = customNetworkData
+			nds := networkDataSecret.DeepCopy()
+			nds.Data["networkdata"] = []byte(customNetworkData)
+
+			c.EXPECT().Create(context.TODO(), virtualMachine).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, nds)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should use the ConfigDrive datasource for cloud-init if requested", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			spec := *providerSpec
+			spec.CloudInitType = api.CloudInitTypeConfigDrive
+			vm := virtualMachine.DeepCopy()
+			noCloud := vm.Spec.Template.Spec.Volumes[1].CloudInitNoCloud
+			vm.Spec.Template.Spec.Volumes[1].CloudInitNoCloud = nil
+			vm.Spec.Template.Spec.Volumes[1].CloudInitConfigDrive = &kubevirtv1.CloudInitConfigDriveSource{
+				UserDataSecretRef:    noCloud.UserDataSecretRef,
+				NetworkDataSecretRef: noCloud.NetworkDataSecretRef,
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+			expectCreateSecret(c, userDataSecret)
+			expectCreateSecret(c, networkDataSecret)
+
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, &spec, secret, state.New())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+		It("should pass Ignition userdata via the Ignition annotation instead of a cloud-init disk", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+
+			ignitionSecret := secret.DeepCopy()
+			ignitionSecret.Data["userData"] = []byte(`{"ignition":{"version":"2.2.0"}}`)
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Devices.Disks = append(vm.Spec.Template.Spec.Domain.Devices.Disks[:1], vm.Spec.Template.Spec.Domain.Devices.Disks[2:]...)
+			vm.Spec.Template.Spec.Volumes = append(vm.Spec.Template.Spec.Volumes[:1], vm.Spec.Template.Spec.Volumes[2:]...)
+			vm.Spec.Template.ObjectMeta.Annotations = map[string]string{
+				"example.com/vmi-annotation":  "vmi",
+				kubevirtv1.IgnitionAnnotation: `{"ignition":{"version":"2.2.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["` + sshPublicKey + `"]}]}}`,
+			}
+
+			c.EXPECT().Create(context.TODO(), vm).Return(nil)
+
+			machineState := state.New()
+			providerID, err := spi.CreateMachine(context.TODO(), machineName, machineClassName, nil, providerSpec, ignitionSecret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(machineState.Is(state.OperationCreate, state.PhaseCreated)).To(BeTrue())
+			Expect(machineState.UserDataSecretName).To(BeEmpty())
+		})
+	})
+
+	Describe("#DeleteMachine", func() {
+		var machineState *state.State
+
+		BeforeEach(func() {
+			machineState = state.New()
+			timer.EXPECT().Now().Return(t)
+		})
+
+		It("should delete the kubevirt virtual machine if it exists", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			c.EXPECT().Delete(context.TODO(), virtualMachine, client.PropagationPolicy(metav1.DeletePropagationForeground)).Return(nil)
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, nil)
+			expectListPersistentVolumeClaims(c, nil)
+			expectListSecrets(c, nil)
+
+			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+			Expect(machineState.Is(state.OperationDelete, state.PhaseDeleted)).To(BeTrue())
+		})
+
+		It("should delete the secrets left over by an interrupted creation if the kubevirt virtual machine doesn't exist", func() {
+			unownedUserDataSecret := userDataSecret.DeepCopy()
+			unownedUserDataSecret.OwnerReferences = nil
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, nil)
+			expectListPersistentVolumeClaims(c, nil)
+			expectListSecrets(c, []corev1.Secret{*unownedUserDataSecret})
+			c.EXPECT().Delete(context.TODO(), unownedUserDataSecret).Return(nil)
+
+			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(BeEmpty())
+			Expect(machineState.Is(state.OperationDelete, state.PhaseDeleted)).To(BeTrue())
+		})
+
+		It("should return a DeletionInProgressError if the kubevirt virtual machine is not fully deleted in time", func() {
+			options.DeletionWaitTimeout = 0
+
+			vm := virtualMachine.DeepCopy()
+			vm.DeletionTimestamp = &metav1.Time{Time: t}
+			expectGetVirtualMachine(c, vm, nil)
+			expectGetVirtualMachine(c, vm, nil)
+
+			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).To(Equal(&DeletionInProgressError{Name: machineName}))
+			Expect(providerID).To(BeEmpty())
+			Expect(machineState.Is(state.OperationDelete, state.PhaseDeleting)).To(BeTrue())
+		})
+
+		It("should stop waiting for the kubevirt virtual machine to be deleted when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.TODO())
+			cancel()
+
+			vm := virtualMachine.DeepCopy()
+			vm.DeletionTimestamp = &metav1.Time{Time: t}
+			c.EXPECT().Get(ctx, types.NamespacedName{Namespace: namespace, Name: machineName}, &kubevirtv1.VirtualMachine{}).
+				DoAndReturn(func(_ context.Context, _ client.ObjectKey, obj *kubevirtv1.VirtualMachine) error {
+					*obj = *vm.DeepCopy()
+					return nil
+				}).Times(2)
+
+			done := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				_, err := spi.DeleteMachine(ctx, machineName, machineProviderID, providerSpec, secret, machineState)
+				done <- err
+			}()
+			Eventually(done, time.Second).Should(Receive(Equal(&DeletionInProgressError{Name: machineName})))
+		})
+
+		Context("with a kubevirt virtual machine stuck in deletion", func() {
+			var (
+				vm  *kubevirtv1.VirtualMachine
+				vmi *kubevirtv1.VirtualMachineInstance
+				pod *corev1.Pod
+			)
+
+			BeforeEach(func() {
+				options.StuckDeletionTimeout = 10 * time.Minute
+				vm = virtualMachine.DeepCopy()
+				vm.DeletionTimestamp = &metav1.Time{Time: t.Add(-options.StuckDeletionTimeout)}
+				vm.Finalizers = []string{metav1.FinalizerDeleteDependents}
+				vmi = virtualMachineInstance.DeepCopy()
+				vmi.Finalizers = []string{"foregroundDeleteVirtualMachine"}
+				pod = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "virt-launcher-" + machineName + "-abcde", Namespace: namespace}}
+			})
+
+			expectForceDelete := func() {
+				expectGetVirtualMachine(c, vm, nil)
+				expectGetVirtualMachineInstance(c, vmi, nil)
+				c.EXPECT().Delete(context.TODO(), vmi, client.GracePeriodSeconds(0)).Return(nil)
+				c.EXPECT().List(context.TODO(), &corev1.PodList{}, client.InNamespace(namespace), client.MatchingLabels{"kubevirt.io/vm": machineName, "kubevirt.io": "virt-launcher"}).
+					DoAndReturn(func(_ context.Context, podList *corev1.PodList, _ ...client.ListOption) error {
+						podList.Items = []corev1.Pod{*pod}
+						return nil
+					})
+				c.EXPECT().Delete(context.TODO(), pod, client.GracePeriodSeconds(0)).Return(nil)
+			}
+
+			It("should force delete its virtual machine instance and virt-launcher pods", func() {
+				expectForceDelete()
+				expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+				expectListDataVolumes(c, nil)
+				expectListPersistentVolumeClaims(c, nil)
+				expectListSecrets(c, nil)
+
+				providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(providerID).To(Equal(machineProviderID))
+				Expect(machineState.Is(state.OperationDelete, state.PhaseDeleted)).To(BeTrue())
+			})
+
+			It("should also remove the finalizers if enabled", func() {
+				options.ForceRemoveFinalizers = true
+
+				expectForceDelete()
+				c.EXPECT().Patch(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachineInstance{}), gomock.Any()).
+					DoAndReturn(func(_ context.Context, obj *kubevirtv1.VirtualMachineInstance, _ client.Patch, _ ...client.PatchOption) error {
+						Expect(obj.Finalizers).To(BeEmpty())
+						return nil
+					})
+				c.EXPECT().Patch(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{}), gomock.Any()).
+					DoAndReturn(func(_ context.Context, obj *kubevirtv1.VirtualMachine, _ client.Patch, _ ...client.PatchOption) error {
+						Expect(obj.Finalizers).To(BeEmpty())
+						return nil
+					})
+				expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+				expectListDataVolumes(c, nil)
+				expectListPersistentVolumeClaims(c, nil)
+				expectListSecrets(c, nil)
+
+				_, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		Context("with a shutdown grace period", func() {
+			var spec api.KubeVirtProviderSpec
+
+			BeforeEach(func() {
+				spec = *providerSpec
+				spec.ShutdownGracePeriodSeconds = pointer.Int64Ptr(60)
+			})
+
+			It("should stop the kubevirt virtual machine before deleting it", func() {
+				expectGetVirtualMachine(c, virtualMachine, nil)
+				expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+				sc.EXPECT().StopVirtualMachine(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{}), namespace, machineName).Return(nil)
+				expectGetVirtualMachineInstance(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+				c.EXPECT().Delete(context.TODO(), virtualMachine, client.PropagationPolicy(metav1.DeletePropagationForeground)).Return(nil)
+				expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+				expectListDataVolumes(c, nil)
+				expectListPersistentVolumeClaims(c, nil)
+				expectListSecrets(c, nil)
+
+				providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, &spec, secret, machineState)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(providerID).To(Equal(machineProviderID))
+				Expect(machineState.Is(state.OperationDelete, state.PhaseDeleted)).To(BeTrue())
+			})
+
+			It("should return a DeletionInProgressError if the kubevirt virtual machine is not stopped yet", func() {
+				options.DeletionWaitTimeout = 0
+
+				expectGetVirtualMachine(c, virtualMachine, nil)
+				expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+				sc.EXPECT().StopVirtualMachine(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{}), namespace, machineName).Return(nil)
+				expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+
+				providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, &spec, secret, machineState)
+				Expect(err).To(Equal(&DeletionInProgressError{Name: machineName}))
+				Expect(providerID).To(BeEmpty())
+				Expect(machineState.Is(state.OperationDelete, state.PhaseStopping)).To(BeTrue())
+			})
+
+			It("should delete the kubevirt virtual machine if it's not stopped within the shutdown grace period", func() {
+				machineState.SetPhase(state.OperationDelete, state.PhaseStopping, t.Add(-2*time.Minute))
+				expectGetVirtualMachine(c, virtualMachine, nil)
+				expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+				c.EXPECT().Delete(context.TODO(), virtualMachine, client.PropagationPolicy(metav1.DeletePropagationForeground)).Return(nil)
+				expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+				expectListDataVolumes(c, nil)
+				expectListPersistentVolumeClaims(c, nil)
+				expectListSecrets(c, nil)
+
+				providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, &spec, secret, machineState)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(providerID).To(Equal(machineProviderID))
+				Expect(machineState.Is(state.OperationDelete, state.PhaseDeleted)).To(BeTrue())
+			})
+		})
+
+		Context("with snapshotOnDelete", func() {
+			const snapshotName = machineName + "-e3b0c442"
+			var spec api.KubeVirtProviderSpec
+
+			BeforeEach(func() {
+				spec = *providerSpec
+				spec.SnapshotOnDelete = true
+			})
+
+			It("should snapshot the kubevirt virtual machine before deleting it", func() {
+				expectGetVirtualMachine(c, virtualMachine, nil)
+				c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: snapshotName}, snapshotRef(snapshotName)).
+					Return(apierrors.NewNotFound(schema.GroupResource{}, ""))
+				c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+					DoAndReturn(func(_ context.Context, snapshot *unstructured.Unstructured, _ ...client.CreateOption) error {
+						Expect(snapshot.GetKind()).To(Equal("VirtualMachineSnapshot"))
+						Expect(snapshot.GetName()).To(Equal(snapshotName))
+						Expect(snapshot.GetLabels()).To(HaveKeyWithValue("kubevirt.io/vm", machineName))
+						Expect(snapshot.GetLabels()).To(HaveKeyWithValue("kubevirt.io/machine-snapshot", "true"))
+						Expect(snapshot.GetAnnotations()).To(HaveKeyWithValue("kubevirt.io/snapshot-expiration", t.Add(options.SnapshotTTL).UTC().Format(time.RFC3339)))
+						source, _, _ := unstructured.NestedStringMap(snapshot.Object, "spec", "source")
+						Expect(source).To(Equal(map[string]string{"apiGroup": "kubevirt.io", "kind": "VirtualMachine", "name": machineName}))
+						return nil
+					})
+				expectGetSnapshot(c, snapshotName, true)
+				c.EXPECT().Delete(context.TODO(), virtualMachine, client.PropagationPolicy(metav1.DeletePropagationForeground)).Return(nil)
+				expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+				expectListDataVolumes(c, nil)
+				expectListPersistentVolumeClaims(c, nil)
+				expectListSecrets(c, nil)
+
+				providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, &spec, secret, machineState)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(providerID).To(Equal(machineProviderID))
+				Expect(machineState.Is(state.OperationDelete, state.PhaseDeleted)).To(BeTrue())
+			})
+
+			It("should return a DeletionInProgressError if the snapshot is not ready yet", func() {
+				options.DeletionWaitTimeout = 0
+
+				expectGetVirtualMachine(c, virtualMachine, nil)
+				c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: snapshotName}, snapshotRef(snapshotName)).Return(nil)
+				expectGetSnapshot(c, snapshotName, false)
+
+				providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, &spec, secret, machineState)
+				Expect(err).To(Equal(&DeletionInProgressError{Name: machineName}))
+				Expect(providerID).To(BeEmpty())
+				Expect(machineState.Is(state.OperationDelete, state.PhaseSnapshotting)).To(BeTrue())
+			})
+		})
+
+		It("should not fail if the kubevirt virtual machine does not exist", func() {
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, nil)
+			expectListPersistentVolumeClaims(c, nil)
+			expectListSecrets(c, nil)
+
+			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(BeEmpty())
+		})
+
+		It("should delete leftover data volumes and persistent volume claims labeled with the machine name", func() {
+			dataVolume := &cdicorev1alpha1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      machineName + "-0",
+					Namespace: namespace,
+				},
+			}
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      machineName + "-hotplug",
+					Namespace: namespace,
+				},
+			}
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, []cdicorev1alpha1.DataVolume{*dataVolume})
+			c.EXPECT().Delete(context.TODO(), dataVolumeRef(dataVolume.Name, "v1beta1")).Return(nil)
+			expectListPersistentVolumeClaims(c, []corev1.PersistentVolumeClaim{*pvc})
+			c.EXPECT().Delete(context.TODO(), pvc).Return(nil)
+			expectListSecrets(c, nil)
+
+			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(BeEmpty())
+		})
+
+		It("should not delete retained data volumes and their persistent volume claims", func() {
+			dataVolume := &cdicorev1alpha1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      machineName + "-volume-1",
+					Namespace: namespace,
+					Labels:    map[string]string{"kubevirt.io/vm": machineName, "kubevirt.io/deletion-policy": "Retain"},
+				},
+			}
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      machineName + "-volume-1",
+					Namespace: namespace,
+					Labels:    map[string]string{"kubevirt.io/vm": machineName},
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: "DataVolume", Name: dataVolume.Name},
+					},
+				},
+			}
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, []cdicorev1alpha1.DataVolume{*dataVolume})
+			expectListPersistentVolumeClaims(c, []corev1.PersistentVolumeClaim{*pvc})
+			expectListSecrets(c, nil)
+
+			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(BeEmpty())
+		})
+
+		It("should fall back to CDI v1alpha1 if the provider cluster doesn't serve CDI v1beta1", func() {
+			dataVolume := &cdicorev1alpha1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      machineName + "-0",
+					Namespace: namespace,
+				},
+			}
+			labels := map[string]string{"kubevirt.io/vm": machineName}
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumesWithLabels(c, "v1beta1", labels, nil, &meta.NoKindMatchError{})
+			expectListDataVolumesWithLabels(c, "v1alpha1", labels, []cdicorev1alpha1.DataVolume{*dataVolume}, nil)
+			c.EXPECT().Delete(context.TODO(), dataVolumeRef(dataVolume.Name, "v1alpha1")).Return(nil)
+			expectListPersistentVolumeClaims(c, nil)
+			expectListSecrets(c, nil)
+
+			providerID, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(BeEmpty())
+		})
+
+		It("should return an OperationLimitExceededError if the maximum number of concurrent operations is reached", func() {
+			options.MaxConcurrentOperations, options.OperationWaitTimeout = 1, 0
+			spi = NewPluginSPIImpl(cf, svf, sc, timer, options)
+
+			started, unblock, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+			c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: machineName}, &kubevirtv1.VirtualMachine{}).
+				DoAndReturn(func(context.Context, client.ObjectKey, *kubevirtv1.VirtualMachine) error {
+					close(started)
+					<-unblock
+					return apierrors.NewNotFound(schema.GroupResource{}, "")
+				})
+			expectListDataVolumes(c, nil)
+			expectListPersistentVolumeClaims(c, nil)
+			expectListSecrets(c, nil)
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, state.New())
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			<-started
+
+			timer.EXPECT().Now().Return(t)
+			cf.EXPECT().GetClient(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(c, namespace, nil)
+			_, err := spi.DeleteMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret, machineState)
+			Expect(err).To(BeAssignableToTypeOf(&OperationLimitExceededError{}))
+
+			close(unblock)
+			<-done
+		})
+	})
+
+	Describe("#UpdateMachine", func() {
+		It("should apply the desired spec of the kubevirt virtual machine", func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+
+			vm := virtualMachine.DeepCopy()
+			vm.Labels = map[string]string{
+				"kubevirt.io/vm":               machineName,
+				"app.kubernetes.io/managed-by": FieldManager,
+				"kubevirt.io/machine-class":    machineClassHash,
+			}
+			vm.Spec.Running = pointer.BoolPtr(false)
+			expectGetVirtualMachine(c, vm, nil)
+			c.EXPECT().Patch(context.TODO(), withApplyTypeMeta(withRunning(virtualMachine, false)), client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership).Return(nil)
+
+			providerID, err := spi.UpdateMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should return a MachineNotFoundError if the kubevirt virtual machine does not exist", func() {
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+
+			providerID, err := spi.UpdateMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).To(Equal(&MachineNotFoundError{Name: machineName}))
+			Expect(providerID).To(BeEmpty())
+		})
+	})
+
+	Describe("#GetMachineStatus", func() {
+		It("should return the status of the kubevirt virtual machine if it exists", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(&MachineStatus{
+				ProviderID:   machineProviderID,
+				NodeName:     machineName,
+				HostNodeName: hostNodeName,
+				Phase:        kubevirtv1.Running,
+			}))
+		})
+
+		It("should return the status of the kubevirt virtual machine in the zone recorded in its label, even if the zones have changed", func() {
+			c2 := mockclient.NewMockClient(ctrl)
+			cf.EXPECT().GetClient(gomock.AssignableToTypeOf(&corev1.Secret{})).
+				DoAndReturn(func(secret *corev1.Secret) (client.Client, string, error) {
+					Expect(secret.Name).To(HaveSuffix("/zone-b"))
+					return c2, namespace, nil
+				}).Times(2)
+
+			// The zone chosen for the machine by its name is zone-a, but the VM was created in zone-b
+			spec := *providerSpec
+			spec.Zone = ""
+			spec.Zones = []string{"zone-a", "zone-b"}
+			zoneSecret := secret.DeepCopy()
+			zoneSecret.Data[ZoneKubeconfigFieldPrefix+"zone-a"] = []byte("kubeconfig-zone-a")
+			zoneSecret.Data[ZoneKubeconfigFieldPrefix+"zone-b"] = []byte("kubeconfig-zone-b")
+			vm := virtualMachine.DeepCopy()
+			vm.Labels["kubevirt.io/zone"] = "zone-b"
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, machineName))
+			expectGetVirtualMachine(c2, vm, nil)
+			expectGetVirtualMachine(c2, vm, nil)
+			expectGetVirtualMachineInstance(c2, virtualMachineInstance, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, &spec, zoneSecret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.ProviderID).To(Equal(machineProviderID))
+			Expect(status.HostNodeName).To(Equal(hostNodeName))
+		})
+
+		It("should return the addresses of the kubevirt virtual machine instance", func() {
+			vmi := virtualMachineInstance.DeepCopy()
+			vmi.Status.Interfaces = []kubevirtv1.VirtualMachineInstanceNetworkInterface{
+				{Name: "default", IP: "10.0.0.10", IPs: []string{"10.0.0.10", "fd00::10"}},
+				{Name: "net0", IP: "192.168.0.10"},
+				{Name: "net1"},
+			}
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, vmi, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(&MachineStatus{
+				ProviderID:   machineProviderID,
+				NodeName:     machineName,
+				HostNodeName: hostNodeName,
+				Phase:        kubevirtv1.Running,
+				Addresses:    []string{"10.0.0.10", "fd00::10", "192.168.0.10"},
+			}))
+		})
+
+		It("should return the status of the kubevirt virtual machine if its virtual machine instance does not exist", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(&MachineStatus{
+				ProviderID: machineProviderID,
+				NodeName:   machineName,
+			}))
+		})
+
+		It("should return the data volumes that are still being populated if the virtual machine instance does not exist", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectListDataVolumes(c, []cdicorev1alpha1.DataVolume{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: machineName, Namespace: namespace},
+					Status:     cdicorev1alpha1.DataVolumeStatus{Phase: cdicorev1alpha1.ImportInProgress, Progress: "42.00%"},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: machineName + "-0", Namespace: namespace},
+					Status:     cdicorev1alpha1.DataVolumeStatus{Phase: cdicorev1alpha1.Succeeded, Progress: "100.0%"},
+				},
+			})
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(&MachineStatus{
+				ProviderID: machineProviderID,
+				NodeName:   machineName,
+				DataVolumes: []DataVolumeStatus{
+					{Name: machineName, Phase: cdicorev1alpha1.ImportInProgress, Progress: "42.00%"},
+				},
+			}))
+		})
+
+		It("should update the labels of the kubevirt virtual machine if the tags of the provider spec changed", func() {
+			spec := *providerSpec
+			spec.Tags = map[string]string{
+				"mcm.gardener.cloud/role": "worker",
+				"example.com/pool":        "{{ .Zone }}",
+				"kubevirt.io/vm":          "other",
+			}
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			c.EXPECT().Patch(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{}), gomock.Any()).
+				DoAndReturn(func(_ context.Context, vm *kubevirtv1.VirtualMachine, _ client.Patch, _ ...client.PatchOption) error {
+					Expect(vm.Labels).To(HaveKeyWithValue("mcm.gardener.cloud/role", "worker"))
+					Expect(vm.Labels).To(HaveKeyWithValue("example.com/pool", zone))
+					Expect(vm.Labels).To(HaveKeyWithValue("mcm.gardener.cloud/cluster", clusterName))
+					Expect(vm.Labels).To(HaveKeyWithValue("kubevirt.io/vm", machineName))
+					return nil
+				})
+			expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, &spec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.LabelsUpdated).To(BeTrue())
+		})
+
+		It("should not update the labels of the kubevirt virtual machine if they already match the tags of the provider spec", func() {
+			spec := *providerSpec
+			spec.Tags = map[string]string{
+				"mcm.gardener.cloud/role": "worker",
+				"example.com/pool":        "{{ .Zone }}",
+			}
+			vm := virtualMachine.DeepCopy()
+			vm.Labels["mcm.gardener.cloud/role"] = "worker"
+			vm.Labels["example.com/pool"] = zone
+			expectGetVirtualMachine(c, vm, nil)
+			expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, &spec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.LabelsUpdated).To(BeFalse())
+		})
+
+		It("should return the status with a problem if the kubevirt virtual machine instance is unschedulable", func() {
+			vmi := virtualMachineInstance.DeepCopy()
+			vmi.Status.Phase = kubevirtv1.Pending
+			vmi.Status.Conditions = []kubevirtv1.VirtualMachineInstanceCondition{
+				{
+					Type:    "PodScheduled",
+					Status:  corev1.ConditionFalse,
+					Reason:  "Unschedulable",
+					Message: "0/3 nodes are available: 3 Insufficient memory.",
+				},
+			}
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, vmi, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.ProviderID).To(Equal(machineProviderID))
+			Expect(status.Problem).To(Equal(&MachineStatusError{
+				Name:    machineName,
+				Reason:  MachineStatusReasonUnschedulable,
+				Message: "0/3 nodes are available: 3 Insufficient memory.",
+			}))
+		})
+
+		It("should return the status with a problem if the readiness probe of the kubevirt virtual machine instance has failed after it has become ready", func() {
+			vmi := virtualMachineInstance.DeepCopy()
+			vmi.CreationTimestamp = metav1.NewTime(t)
+			vmi.Spec.ReadinessProbe = &kubevirtv1.Probe{
+				Handler: kubevirtv1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(22)},
+				},
+				InitialDelaySeconds: 60,
+			}
+			vmi.Status.Conditions = []kubevirtv1.VirtualMachineInstanceCondition{
+				{
+					Type:               kubevirtv1.VirtualMachineInstanceReady,
+					Status:             corev1.ConditionFalse,
+					LastTransitionTime: metav1.NewTime(t.Add(10 * time.Minute)),
+					Message:            "containers with unready status: [compute]",
+				},
+			}
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, vmi, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Problem).To(Equal(&MachineStatusError{
+				Name:    machineName,
+				Reason:  MachineStatusReasonUnhealthy,
+				Message: "containers with unready status: [compute]",
+			}))
+		})
+
+		It("should return the status of the kubevirt virtual machine if its virtual machine instance is not ready yet", func() {
+			vmi := virtualMachineInstance.DeepCopy()
+			vmi.CreationTimestamp = metav1.NewTime(t)
+			vmi.Spec.ReadinessProbe = &kubevirtv1.Probe{
+				Handler: kubevirtv1.Handler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(22)},
+				},
+				InitialDelaySeconds: 60,
+			}
+			vmi.Status.Conditions = []kubevirtv1.VirtualMachineInstanceCondition{
+				{
+					Type:               kubevirtv1.VirtualMachineInstanceReady,
+					Status:             corev1.ConditionFalse,
+					LastTransitionTime: metav1.NewTime(t.Add(5 * time.Second)),
+				},
+			}
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, vmi, nil)
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(&MachineStatus{
+				ProviderID:   machineProviderID,
+				NodeName:     machineName,
+				HostNodeName: hostNodeName,
+				Phase:        kubevirtv1.Running,
+			}))
+		})
+
+		It("should return a MachineNotFoundError if the kubevirt virtual machine does not exist", func() {
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+
+			status, err := spi.GetMachineStatus(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).To(Equal(&MachineNotFoundError{Name: machineName}))
+			Expect(status).To(BeNil())
+		})
+	})
+
+	Describe("#ListMachines", func() {
+		It("should list the provider ids of all kubevirt virtual machines matching the provider spec", func() {
+			expectListVirtualMachines(c, virtualMachine)
+
+			providerIDs, err := spi.ListMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerIDs).To(Equal(map[string]string{
+				machineProviderID: machineName,
+			}))
+		})
+
+		It("should list the provider ids of all kubevirt virtual machines in all provider clusters", func() {
+			c2 := mockclient.NewMockClient(ctrl)
+			cf.EXPECT().GetClient(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(c2, namespace, nil)
+			virtualMachine2 := virtualMachine.DeepCopy()
+			virtualMachine2.Name = "machine-2"
+			expectListVirtualMachines(c, virtualMachine)
+			expectListVirtualMachines(c2, virtualMachine2)
+
+			zoneSecret := secret.DeepCopy()
+			zoneSecret.Data["kubeconfig"] = []byte("kubeconfig")
+			zoneSecret.Data[ZoneKubeconfigFieldPrefix+zone] = []byte("kubeconfig-" + zone)
+
+			providerIDs, err := spi.ListMachines(context.TODO(), machineClassName, providerSpec, zoneSecret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerIDs).To(Equal(map[string]string{
+				machineProviderID:             machineName,
+				ProviderName + "://machine-2": "machine-2",
+			}))
+		})
+
+		It("should list only the kubevirt virtual machines owned by the machine class, or matching the tags if created without ownership labels", func() {
+			otherClassVM := virtualMachine.DeepCopy()
+			otherClassVM.Name = "machine-2"
+			otherClassVM.Labels["kubevirt.io/machine-class"] = "e2c4a3dd5d4bfa9c1ca0e0a5b58e8b1f"
+			otherClassVM.Labels["mcm.gardener.cloud/cluster"] = "other-cluster"
+			legacyVM := virtualMachine.DeepCopy()
+			legacyVM.Name = "machine-3"
+			delete(legacyVM.Labels, "app.kubernetes.io/managed-by")
+			delete(legacyVM.Labels, "kubevirt.io/machine-class")
+			otherLegacyVM := legacyVM.DeepCopy()
+			otherLegacyVM.Name = "machine-4"
+			otherLegacyVM.Labels["mcm.gardener.cloud/machineclass"] = "machine-class-2"
+			otherLegacyVM.Labels["mcm.gardener.cloud/cluster"] = "other-cluster"
+			expectListVirtualMachines(c, virtualMachine, otherClassVM, legacyVM, otherLegacyVM)
+
+			providerIDs, err := spi.ListMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerIDs).To(Equal(map[string]string{
+				machineProviderID:             machineName,
+				ProviderName + "://machine-3": "machine-3",
+			}))
+		})
+
+		It("should also list the kubevirt virtual machines of the same cluster owned by another machine class", func() {
+			renamedClassVM := virtualMachine.DeepCopy()
+			renamedClassVM.Name = "machine-2"
+			renamedClassVM.Labels["kubevirt.io/vm"] = "machine-2"
+			renamedClassVM.Labels["kubevirt.io/machine-class"] = "e2c4a3dd5d4bfa9c1ca0e0a5b58e8b1f"
+			renamedClassVM.Labels["mcm.gardener.cloud/machineclass"] = "machine-class-old"
+			foreignVM := renamedClassVM.DeepCopy()
+			foreignVM.Name = "machine-3"
+			foreignVM.Labels["kubevirt.io/vm"] = "machine-4"
+			expectListVirtualMachines(c, virtualMachine, renamedClassVM, foreignVM)
+
+			providerIDs, err := spi.ListMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerIDs).To(Equal(map[string]string{
+				machineProviderID:             machineName,
+				ProviderName + "://machine-2": "machine-2",
+			}))
+		})
+
+		It("should list the kubevirt virtual machines in pages", func() {
+			virtualMachine2 := virtualMachine.DeepCopy()
+			virtualMachine2.Name = "machine-2"
+			c.EXPECT().List(context.TODO(), &kubevirtv1.VirtualMachineList{}, client.InNamespace(namespace), client.HasLabels{"kubevirt.io/vm"}, client.Limit(500)).
+				DoAndReturn(func(_ context.Context, vmList *kubevirtv1.VirtualMachineList, _ ...client.ListOption) error {
+					vmList.Items = []kubevirtv1.VirtualMachine{*virtualMachine.DeepCopy()}
+					vmList.Continue = "page-2"
+					return nil
+				})
+			c.EXPECT().List(context.TODO(), &kubevirtv1.VirtualMachineList{}, client.InNamespace(namespace), client.HasLabels{"kubevirt.io/vm"}, client.Limit(500), client.Continue("page-2")).
+				DoAndReturn(func(_ context.Context, vmList *kubevirtv1.VirtualMachineList, _ ...client.ListOption) error {
+					vmList.Items = []kubevirtv1.VirtualMachine{*virtualMachine2}
+					return nil
+				})
+
+			providerIDs, err := spi.ListMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerIDs).To(Equal(map[string]string{
+				machineProviderID:             machineName,
+				ProviderName + "://machine-2": "machine-2",
+			}))
+		})
+
+		It("should return an empty map if no kubevirt virtual machines matching the provider spec exist", func() {
+			expectListVirtualMachines(c)
+
+			providerIDs, err := spi.ListMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerIDs).To(BeEmpty())
+		})
+	})
+
+	Describe("#MaintainMachines", func() {
+		It("should delete the expired snapshots taken on machine deletion if snapshotOnDelete is enabled", func() {
+			spec := *providerSpec
+			spec.SnapshotOnDelete = true
+			expired := snapshotRef(machineName + "-expired")
+			expired.SetAnnotations(map[string]string{"kubevirt.io/snapshot-expiration": t.Add(-time.Minute).Format(time.RFC3339)})
+			unexpired := snapshotRef(machineName + "-unexpired")
+			unexpired.SetAnnotations(map[string]string{"kubevirt.io/snapshot-expiration": t.Add(time.Minute).Format(time.RFC3339)})
+			snapshotList := &unstructured.UnstructuredList{}
+			snapshotList.SetAPIVersion("snapshot.kubevirt.io/v1alpha1")
+			snapshotList.SetKind("VirtualMachineSnapshotList")
+
+			timer.EXPECT().Now().Return(t)
+			expectListCachedImages(c, nil)
+			c.EXPECT().List(context.TODO(), snapshotList, client.InNamespace(namespace), client.MatchingLabels{"kubevirt.io/machine-snapshot": "true"}).
+				DoAndReturn(func(_ context.Context, list *unstructured.UnstructuredList, _ ...client.ListOption) error {
+					list.Items = []unstructured.Unstructured{*expired, *unexpired}
+					return nil
+				})
+			c.EXPECT().Delete(context.TODO(), expired).Return(nil)
+
+			err := spi.MaintainMachines(context.TODO(), machineClassName, &spec, secret)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should resize and restart the kubevirt virtual machines whose resources differ from the provider spec if the resize policy is Restart", func() {
+			options.ResizePolicy = ResizePolicyRestart
+
+			vm := virtualMachine.DeepCopy()
+			vm.Status.Ready = true
+			vm.Spec.Template.Spec.Domain.Resources.Requests[corev1.ResourceMemory] = resource.MustParse("2048M")
+			vmi := virtualMachineInstance.DeepCopy()
+			vmi.Spec.Domain = *vm.Spec.Template.Spec.Domain.DeepCopy()
+
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+			expectListVirtualMachines(c, vm)
+			c.EXPECT().Patch(context.TODO(), withApplyTypeMeta(virtualMachine), client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership).Return(nil)
+			expectGetVirtualMachineInstance(c, vmi, nil)
+			sc.EXPECT().RestartVirtualMachine(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{}), namespace, machineName).Return(nil)
+			expectListCachedImages(c, nil)
+
+			err := spi.MaintainMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should only resize the kubevirt virtual machines whose resources differ from the provider spec if the resize policy is Apply", func() {
+			options.ResizePolicy = ResizePolicyApply
+
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Resources.Requests[corev1.ResourceMemory] = resource.MustParse("2048M")
+
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+			expectListVirtualMachines(c, vm)
+			c.EXPECT().Patch(context.TODO(), withApplyTypeMeta(virtualMachine), client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership).Return(nil)
+			expectListCachedImages(c, nil)
+
+			err := spi.MaintainMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should apply the desired spec of the kubevirt virtual machines if ReconcileVMs is set", func() {
+			options.ReconcileVMs = true
+
+			vm := virtualMachine.DeepCopy()
+			vm.Spec.Template.Spec.Domain.Resources.Requests[corev1.ResourceMemory] = resource.MustParse("2048M")
+			deleting := virtualMachine.DeepCopy()
+			deleting.Name = machineName + "-deleting"
+			deleting.DeletionTimestamp = &metav1.Time{Time: t}
+
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+			expectListVirtualMachines(c, vm, deleting)
+			c.EXPECT().Patch(context.TODO(), withApplyTypeMeta(virtualMachine), client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership).Return(nil)
+			expectListCachedImages(c, nil)
+
+			err := spi.MaintainMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should delete the cached images that have not been used for the image cache TTL", func() {
+			timer.EXPECT().Now().Return(t)
+			unusedImage := cdicorev1alpha1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "image-unused",
+					Namespace:   namespace,
+					Annotations: map[string]string{"kubevirt.io/image-cache-last-used": t.Add(-options.ImageCacheTTL).Format(time.RFC3339)},
+				},
+			}
+			usedImage := cdicorev1alpha1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "image-used",
+					Namespace:   namespace,
+					Annotations: map[string]string{"kubevirt.io/image-cache-last-used": t.Add(-time.Hour).Format(time.RFC3339)},
+				},
+			}
+			expectListCachedImages(c, []cdicorev1alpha1.DataVolume{unusedImage, usedImage})
+			c.EXPECT().Delete(context.TODO(), dataVolumeRef(unusedImage.Name, "v1beta1")).Return(nil)
+
+			err := spi.MaintainMachines(context.TODO(), machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("#GetDataVolumeManager", func() {
+		It("should return a DataVolumeManager using the client of the provider cluster", func() {
+			dataVolume := cdicorev1alpha1.DataVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "image",
+					Namespace: namespace,
+				},
+			}
+			expectListDataVolumesWithLabels(c, "v1beta1", map[string]string{"app": "images"}, []cdicorev1alpha1.DataVolume{dataVolume}, nil)
+
+			m, ns, err := spi.GetDataVolumeManager(context.TODO(), machineName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ns).To(Equal(namespace))
+			dataVolumes, err := m.ListInNamespace(context.TODO(), ns, client.MatchingLabels{"app": "images"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataVolumes).To(HaveLen(1))
+			Expect(dataVolumes[0].Name).To(Equal("image"))
+		})
+
+		It("should return a DataVolumeManager using the client of the provider cluster of the zone of the machine", func() {
+			c2 := mockclient.NewMockClient(ctrl)
+			cf.EXPECT().GetClient(gomock.AssignableToTypeOf(&corev1.Secret{})).
+				DoAndReturn(func(secret *corev1.Secret) (client.Client, string, error) {
+					Expect(secret.Name).To(HaveSuffix("/zone-b"))
+					return c2, namespace, nil
+				}).Times(2)
+
+			// The zone chosen for the machine by its name is zone-a, but the VM was created in zone-b
+			spec := *providerSpec
+			spec.Zone = ""
+			spec.Zones = []string{"zone-a", "zone-b"}
+			zoneSecret := secret.DeepCopy()
+			zoneSecret.Data[ZoneKubeconfigFieldPrefix+"zone-a"] = []byte("kubeconfig-zone-a")
+			zoneSecret.Data[ZoneKubeconfigFieldPrefix+"zone-b"] = []byte("kubeconfig-zone-b")
+			vm := virtualMachine.DeepCopy()
+			vm.Labels["kubevirt.io/zone"] = "zone-b"
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, machineName))
+			expectGetVirtualMachine(c2, vm, nil)
+			expectListDataVolumes(c2, nil)
+
+			m, ns, err := spi.GetDataVolumeManager(context.TODO(), machineName, &spec, zoneSecret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ns).To(Equal(namespace))
+			dataVolumes, err := m.List(context.TODO(), machineName, ns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataVolumes).To(BeEmpty())
+		})
+	})
+
+	Describe("#ValidateMachine", func() {
+		BeforeEach(func() {
+			svf.EXPECT().GetServerVersion(gomock.AssignableToTypeOf(&corev1.Secret{})).Return(serverVersion, nil)
+			timer.EXPECT().Now().Return(t)
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Name: storageClassName}, &storagev1.StorageClass{}).Return(nil)
+		})
+
+		It("should create the kubevirt virtual machine in dry-run mode and return it", func() {
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "net-conf"}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).Return(nil)
+			c.EXPECT().Create(context.TODO(), virtualMachine, client.DryRunAll).Return(nil)
+
+			vm, err := spi.ValidateMachine(context.TODO(), machineName, machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vm).To(Equal(virtualMachine))
+		})
+
+		It("should fail if the provider spec references resources that don't exist in the provider cluster", func() {
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "net-conf"}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				Return(apierrors.NewNotFound(schema.GroupResource{Group: "k8s.cni.cncf.io", Resource: "network-attachment-definitions"}, "net-conf"))
+
+			_, err := spi.ValidateMachine(context.TODO(), machineName, machineClassName, providerSpec, secret)
+			Expect(err).To(MatchError(`provider spec references resources that don't exist in the provider cluster: NetworkAttachmentDefinition "default/net-conf"`))
+		})
+
+		It("should fail if creating the kubevirt virtual machine in dry-run mode fails", func() {
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "net-conf"}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).Return(nil)
+			c.EXPECT().Create(context.TODO(), virtualMachine, client.DryRunAll).
+				Return(apierrors.NewInvalid(schema.GroupKind{Group: "kubevirt.io", Kind: "VirtualMachine"}, machineName, nil))
+
+			_, err := spi.ValidateMachine(context.TODO(), machineName, machineClassName, providerSpec, secret)
+			Expect(err).To(MatchError(ContainSubstring("could not create VirtualMachine %q in dry-run mode", machineName)))
+		})
+
+		It("should bound the names of the child resources of machines with long names", func() {
+			longMachineName := strings.Repeat("kubevirt-machine-", 4)[:63]
+			c.EXPECT().Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "net-conf"}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).Return(nil)
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&kubevirtv1.VirtualMachine{}), client.DryRunAll).Return(nil)
+
+			vm, err := spi.ValidateMachine(context.TODO(), longMachineName, machineClassName, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+
+			var names []string
+			for _, volume := range vm.Spec.Template.Spec.Volumes {
+				switch {
+				case volume.DataVolume != nil:
+					names = append(names, volume.DataVolume.Name)
+				case volume.CloudInitNoCloud != nil:
+					names = append(names, volume.CloudInitNoCloud.UserDataSecretRef.Name, volume.CloudInitNoCloud.NetworkDataSecretRef.Name)
+				}
+			}
+			Expect(names).To(HaveLen(5))
+			for _, name := range names {
+				Expect(len(name)).To(BeNumerically("<=", 63), name)
+			}
+			Expect(names).To(ConsistOf(
+				longMachineName,
+				MatchRegexp(`^kubevirt-machine-[a-z-]+-[0-9a-f]{8}-0$`),
+				MatchRegexp(`^kubevirt-machine-[a-z-]+-[0-9a-f]{8}-1$`),
+				MatchRegexp(`^userdata-kubevirt-machine-[a-z-]+-[0-9a-f]{8}-[0-9]+$`),
+				MatchRegexp(`^networkdata-kubevirt-machine-[a-z-]+-[0-9a-f]{8}-[0-9]+$`),
+			))
+		})
+	})
+
+	Describe("#RestartMachine", func() {
+		It("should restart the kubevirt virtual machine via the restart subresource", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			sc.EXPECT().RestartVirtualMachine(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{}), namespace, machineName).Return(nil)
+
+			providerID, err := spi.RestartMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should return a MachineNotFoundError if the kubevirt virtual machine does not exist", func() {
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+
+			providerID, err := spi.RestartMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).To(Equal(&MachineNotFoundError{Name: machineName}))
+			Expect(providerID).To(BeEmpty())
+		})
+
+		It("should fail if restarting the kubevirt virtual machine fails", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			sc.EXPECT().RestartVirtualMachine(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{}), namespace, machineName).
+				Return(apierrors.NewConflict(schema.GroupResource{Resource: "virtualmachines"}, machineName, errors.New("VM is not running")))
+
+			providerID, err := spi.RestartMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).To(MatchError(ContainSubstring("VM is not running")))
+			Expect(providerID).To(BeEmpty())
+		})
+	})
+
+	Describe("#ShutDownMachine", func() {
+		It("should set the spec.running field of the kubevirt virtual machine to false", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			c.EXPECT().Update(context.TODO(), withRunning(virtualMachine, false)).Return(nil)
+
+			providerID, err := spi.ShutDownMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providerID).To(Equal(machineProviderID))
+		})
+
+		It("should return a MachineNotFoundError if the kubevirt virtual machine does not exist", func() {
+			expectGetVirtualMachine(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+
+			providerID, err := spi.ShutDownMachine(context.TODO(), machineName, machineProviderID, providerSpec, secret)
+			Expect(err).To(Equal(&MachineNotFoundError{Name: machineName}))
+			Expect(providerID).To(BeEmpty())
+		})
+	})
+
+	Describe("#ExportRootDisk", func() {
+		const exportName = machineName + "-root-disk"
+		var spec api.KubeVirtProviderSpec
+
+		BeforeEach(func() {
+			spec = *providerSpec
+			spec.AllowRootDiskExport = true
+		})
+
+		expectCreateTokenSecret := func() {
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).
+				DoAndReturn(func(_ context.Context, s *corev1.Secret, _ ...client.CreateOption) error {
+					Expect(s.Name).To(Equal("export-token-" + machineName))
+					Expect(s.Labels).To(Equal(map[string]string{"kubevirt.io/vm": machineName}))
+					Expect(s.Data["token"]).To(HaveLen(64))
+					return nil
+				})
+			c.EXPECT().Update(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{})).Return(nil)
+		}
+
+		It("should stop the kubevirt virtual machine and export its root volume", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, virtualMachineInstance, nil)
+			sc.EXPECT().StopVirtualMachine(context.TODO(), gomock.AssignableToTypeOf(&corev1.Secret{}), namespace, machineName).Return(nil)
+			expectCreateTokenSecret()
+			c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: exportName}, exportRef(exportName)).
+				Return(apierrors.NewNotFound(schema.GroupResource{}, ""))
+			c.EXPECT().Create(context.TODO(), gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+				DoAndReturn(func(_ context.Context, export *unstructured.Unstructured, _ ...client.CreateOption) error {
+					Expect(export.GetKind()).To(Equal("VirtualMachineExport"))
+					Expect(export.GetName()).To(Equal(exportName))
+					Expect(metav1.IsControlledBy(export, virtualMachine)).To(BeTrue())
+					source, _, _ := unstructured.NestedStringMap(export.Object, "spec", "source")
+					Expect(source).To(Equal(map[string]string{"apiGroup": "", "kind": "PersistentVolumeClaim", "name": machineName}))
+					tokenSecretRef, _, _ := unstructured.NestedString(export.Object, "spec", "tokenSecretRef")
+					Expect(tokenSecretRef).To(Equal("export-token-" + machineName))
+					return nil
+				})
+
+			export, err := spi.ExportRootDisk(context.TODO(), machineName, machineProviderID, &spec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(export.Name).To(Equal(exportName))
+			Expect(export.IsReady()).To(BeFalse())
+		})
+
+		It("should return the download URLs of an existing export once it's ready", func() {
+			expectGetVirtualMachine(c, virtualMachine, nil)
+			expectGetVirtualMachineInstance(c, nil, apierrors.NewNotFound(schema.GroupResource{}, ""))
+			expectCreateTokenSecret()
+			c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: exportName}, exportRef(exportName)).
+				DoAndReturn(func(_ context.Context, _ client.ObjectKey, export *unstructured.Unstructured) error {
+					export.Object["status"] = map[string]interface{}{
+						"phase": "Ready",
+						"links": map[string]interface{}{
+							"internal": map[string]interface{}{
+								"volumes": []interface{}{
+									map[string]interface{}{
+										"name": machineName,
+										"formats": []interface{}{
+											map[string]interface{}{"format": "raw", "url": "https://export/disk.img"},
+											map[string]interface{}{"format": "gzip", "url": "https://export/disk.img.gz"},
+										},
+									},
+								},
+							},
+						},
+					}
+					return nil
+				})
+
+			export, err := spi.ExportRootDisk(context.TODO(), machineName, machineProviderID, &spec, secret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(export).To(Equal(&RootDiskExport{
+				Name:            exportName,
+				TokenSecretName: "export-token-" + machineName,
+				Phase:           "Ready",
+				URLs:            []string{"https://export/disk.img", "https://export/disk.img.gz"},
+			}))
+		})
+	})
+})
+
+var _ = Describe("#LoadProviderConfig", func() {
+	var (
+		path string
+	)
+
+	writeConfig := func(content string) {
+		file, err := ioutil.TempFile("", "provider-config-*.yaml")
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		_, err = file.WriteString(content)
+		Expect(err).NotTo(HaveOccurred())
+		path = file.Name()
+	}
+
+	AfterEach(func() {
+		if path != "" {
+			os.Remove(path)
+		}
+	})
+
+	It("should load a valid provider config", func() {
+		writeConfig("defaultStorageClassName: fast\ndefaultDiskBus: scsi\nallowedNamespaces: [default]\nfeatures:\n  capacityCheck: true\n")
+
+		config, err := LoadProviderConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).To(Equal(&ProviderConfig{
+			DefaultStorageClassName: "fast",
+			DefaultDiskBus:          "scsi",
+			AllowedNamespaces:       []string{"default"},
+			Features:                map[string]bool{"capacityCheck": true},
+		}))
+	})
+
+	It("should fail if the provider config contains unknown fields", func() {
+		writeConfig("defaultStorageClass: fast\n")
+
+		_, err := LoadProviderConfig(path)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail if the default disk bus is not supported", func() {
+		writeConfig("defaultDiskBus: ide\n")
+
+		_, err := LoadProviderConfig(path)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail if the default storage class is not allowed", func() {
+		writeConfig("defaultStorageClassName: fast\nallowedStorageClassNames: [standard]\n")
+
+		_, err := LoadProviderConfig(path)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail if a feature is unknown", func() {
+		writeConfig("features:\n  fooCheck: true\n")
+
+		_, err := LoadProviderConfig(path)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func expectGetVirtualMachine(c *mockclient.MockClient, virtualMachine *kubevirtv1.VirtualMachine, err error) {
+	c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: machineName}, &kubevirtv1.VirtualMachine{}).
+		DoAndReturn(func(_ context.Context, _ client.ObjectKey, vm *kubevirtv1.VirtualMachine) error {
+			if err != nil {
+				return err
+			}
+			*vm = *virtualMachine.DeepCopy()
+			return nil
+		})
+}
+
+func expectGetRetainedDataVolume(c *mockclient.MockClient, name, machineName string) {
+	c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, gomock.AssignableToTypeOf(&unstructured.Unstructured{})).
+		DoAndReturn(func(_ context.Context, _ client.ObjectKey, obj *unstructured.Unstructured) error {
+			obj.SetName(name)
+			obj.SetNamespace(namespace)
+			obj.SetLabels(map[string]string{"kubevirt.io/vm": machineName, "kubevirt.io/deletion-policy": "Retain"})
+			return nil
+		})
+}
+
+func expectGetVirtualMachineInstance(c *mockclient.MockClient, virtualMachineInstance *kubevirtv1.VirtualMachineInstance, err error) {
+	c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: machineName}, &kubevirtv1.VirtualMachineInstance{}).
+		DoAndReturn(func(_ context.Context, _ client.ObjectKey, vmi *kubevirtv1.VirtualMachineInstance) error {
+			if err != nil {
+				return err
+			}
+			*vmi = *virtualMachineInstance.DeepCopy()
+			return nil
+		})
+}
+
+func expectListVirtualMachines(c *mockclient.MockClient, virtualMachines ...*kubevirtv1.VirtualMachine) {
+	c.EXPECT().List(context.TODO(), &kubevirtv1.VirtualMachineList{}, client.InNamespace(namespace), client.HasLabels{"kubevirt.io/vm"}, client.Limit(500)).
+		DoAndReturn(func(_ context.Context, vmList *kubevirtv1.VirtualMachineList, _ ...client.ListOption) error {
+			vmList.Items = []kubevirtv1.VirtualMachine{}
+			for _, virtualMachine := range virtualMachines {
+				vmList.Items = append(vmList.Items, *virtualMachine.DeepCopy())
+			}
+			return nil
+		})
+}
+
+func expectListNodes(c *mockclient.MockClient, labels map[string]string, nodes []corev1.Node) {
+	var opts []interface{}
+	if labels != nil {
+		opts = append(opts, client.MatchingLabels(labels))
+	}
+	c.EXPECT().List(context.TODO(), &corev1.NodeList{}, opts...).
+		DoAndReturn(func(_ context.Context, nodeList *corev1.NodeList, _ ...client.ListOption) error {
+			nodeList.Items = nodes
+			return nil
+		})
+}
+
+func expectListDataVolumes(c *mockclient.MockClient, dataVolumes []cdicorev1alpha1.DataVolume) {
+	expectListDataVolumesWithLabels(c, "v1beta1", map[string]string{"kubevirt.io/vm": machineName}, dataVolumes, nil)
+}
+
+func expectListCachedImages(c *mockclient.MockClient, dataVolumes []cdicorev1alpha1.DataVolume) {
+	expectListDataVolumesWithLabels(c, "v1beta1", map[string]string{"kubevirt.io/image-cache": "true"}, dataVolumes, nil)
+}
+
+func expectListDataVolumesWithLabels(c *mockclient.MockClient, version string, labels map[string]string, dataVolumes []cdicorev1alpha1.DataVolume, err error) {
+	dvList := &unstructured.UnstructuredList{}
+	dvList.SetAPIVersion("cdi.kubevirt.io/" + version)
+	dvList.SetKind("DataVolumeList")
+	c.EXPECT().List(context.TODO(), dvList, client.InNamespace(namespace), client.MatchingLabels(labels)).
+		DoAndReturn(func(_ context.Context, dvList *unstructured.UnstructuredList, _ ...client.ListOption) error {
+			if err != nil {
+				return err
+			}
+			for i := range dataVolumes {
+				dvList.Items = append(dvList.Items, *toUnstructuredDataVolume(&dataVolumes[i], version))
+			}
+			return nil
+		})
+}
+
+func toUnstructuredDataVolume(dataVolume *cdicorev1alpha1.DataVolume, version string) *unstructured.Unstructured {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(dataVolume)
+	Expect(err).NotTo(HaveOccurred())
+	dv := &unstructured.Unstructured{Object: content}
+	dv.SetAPIVersion("cdi.kubevirt.io/" + version)
+	dv.SetKind("DataVolume")
+	return dv
+}
+
+func dataVolumeRef(name, version string) *unstructured.Unstructured {
+	dv := &unstructured.Unstructured{}
+	dv.SetAPIVersion("cdi.kubevirt.io/" + version)
+	dv.SetKind("DataVolume")
+	dv.SetNamespace(namespace)
+	dv.SetName(name)
+	return dv
+}
+
+func snapshotRef(name string) *unstructured.Unstructured {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetAPIVersion("snapshot.kubevirt.io/v1alpha1")
+	snapshot.SetKind("VirtualMachineSnapshot")
+	snapshot.SetNamespace(namespace)
+	snapshot.SetName(name)
+	return snapshot
+}
+
+func exportRef(name string) *unstructured.Unstructured {
+	export := &unstructured.Unstructured{}
+	export.SetAPIVersion("export.kubevirt.io/v1alpha1")
+	export.SetKind("VirtualMachineExport")
+	export.SetNamespace(namespace)
+	export.SetName(name)
+	return export
+}
+
+func expectGetSnapshot(c *mockclient.MockClient, name string, ready bool) {
+	c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, snapshotRef(name)).
+		DoAndReturn(func(_ context.Context, _ client.ObjectKey, snapshot *unstructured.Unstructured) error {
+			return unstructured.SetNestedField(snapshot.Object, ready, "status", "readyToUse")
+		})
+}
+
+func expectListPersistentVolumeClaims(c *mockclient.MockClient, pvcs []corev1.PersistentVolumeClaim) {
+	c.EXPECT().List(context.TODO(), &corev1.PersistentVolumeClaimList{}, client.InNamespace(namespace), client.MatchingLabels{"kubevirt.io/vm": machineName}).
+		DoAndReturn(func(_ context.Context, pvcList *corev1.PersistentVolumeClaimList, _ ...client.ListOption) error {
+			pvcList.Items = pvcs
+			return nil
+		})
+}
+
+func expectListSecrets(c *mockclient.MockClient, secrets []corev1.Secret) {
+	c.EXPECT().List(context.TODO(), &corev1.SecretList{}, client.InNamespace(namespace), client.MatchingLabels{"kubevirt.io/vm": machineName}).
+		DoAndReturn(func(_ context.Context, secretList *corev1.SecretList, _ ...client.ListOption) error {
+			secretList.Items = secrets
+			return nil
+		})
+}
+
+func expectCreateSecret(c *mockclient.MockClient, secret *corev1.Secret) {
+	unownedSecret := secret.DeepCopy()
+	unownedSecret.OwnerReferences = nil
+	c.EXPECT().Create(context.TODO(), unownedSecret).Return(nil)
+	c.EXPECT().Update(context.TODO(), secret).Return(nil)
+}
+
+func expectCreateExistingSecret(c *mockclient.MockClient, secret, existingSecret *corev1.Secret) {
+	unownedSecret := secret.DeepCopy()
+	unownedSecret.OwnerReferences = nil
+	c.EXPECT().Create(context.TODO(), unownedSecret).Return(apierrors.NewAlreadyExists(schema.GroupResource{}, secret.Name))
+	c.EXPECT().Get(context.TODO(), types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}, &corev1.Secret{}).
+		DoAndReturn(func(_ context.Context, _ client.ObjectKey, s *corev1.Secret) error {
+			*s = *existingSecret.DeepCopy()
+			return nil
+		})
+}
+
+func withApplyTypeMeta(virtualMachine *kubevirtv1.VirtualMachine) *kubevirtv1.VirtualMachine {
+	vm := virtualMachine.DeepCopy()
+	vm.TypeMeta = metav1.TypeMeta{
+		APIVersion: kubevirtv1.GroupVersion.String(),
+		Kind:       "VirtualMachine",
+	}
+	return vm
+}
+
+func withRunning(virtualMachine *kubevirtv1.VirtualMachine, running bool) *kubevirtv1.VirtualMachine {
+	vm := virtualMachine.DeepCopy()
+	vm.Spec.Running = pointer.BoolPtr(false)
+	return vm
+}
+
+func uintPtr(u uint) *uint {
+	return &u
 }
@@ -0,0 +1,79 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// cpuModelLabelPrefix is the prefix of the node labels added by the KubeVirt node labeller for supported CPU models.
+	cpuModelLabelPrefix = "feature.node.kubernetes.io/cpu-model-"
+	// cpuFeatureLabelPrefix is the prefix of the node labels added by the KubeVirt node labeller for supported CPU features.
+	cpuFeatureLabelPrefix = "feature.node.kubernetes.io/cpu-feature-"
+	// cpuFeaturePolicyRequire is the CPU feature policy that requires the feature to be supported by the host CPU.
+	cpuFeaturePolicyRequire = "require"
+)
+
+// checkCPUModel checks that at least one provider cluster node supports the named CPU model and the required CPU features
+// of the given CPU spec, based on the node labels added by the KubeVirt node labeller.
+// The check is skipped if the CPU spec doesn't specify a named CPU model or required CPU features,
+// or if listing the provider cluster nodes is forbidden.
+func checkCPUModel(ctx context.Context, c client.Client, cpu *kubevirtv1.CPU) error {
+	nodeLabels := getCPUModelNodeLabels(cpu)
+	if len(nodeLabels) == 0 {
+		return nil
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := c.List(ctx, nodeList, client.MatchingLabels(nodeLabels)); err != nil {
+		if apierrors.IsForbidden(err) {
+			logging.InfoS(2, "Listing nodes is forbidden, skipping CPU model check", "err", err)
+			return nil
+		}
+		return errors.Wrap(err, "could not list nodes")
+	}
+	if len(nodeList.Items) == 0 {
+		return errors.Errorf("no provider cluster node supports the CPU model and required CPU features, no node has all of the labels %v", sets.StringKeySet(nodeLabels).List())
+	}
+	return nil
+}
+
+// getCPUModelNodeLabels returns the node labels a node must have in order to support the named CPU model
+// and the required CPU features of the given CPU spec.
+func getCPUModelNodeLabels(cpu *kubevirtv1.CPU) map[string]string {
+	nodeLabels := map[string]string{}
+	if cpu == nil {
+		return nodeLabels
+	}
+	if cpu.Model != "" && cpu.Model != kubevirtv1.CPUModeHostModel && cpu.Model != kubevirtv1.CPUModeHostPassthrough {
+		nodeLabels[cpuModelLabelPrefix+cpu.Model] = "true"
+	}
+	for _, feature := range cpu.Features {
+		if feature.Policy == "" || feature.Policy == cpuFeaturePolicyRequire {
+			nodeLabels[cpuFeatureLabelPrefix+feature.Name] = "true"
+		}
+	}
+	return nodeLabels
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DataVolumeManager manages the data volumes and persistent volume claims of machines,
+// i.e. the ones labeled with the machine name.
+type DataVolumeManager struct {
+	c  client.Client
+	dc *dataVolumeClient
+}
+
+// NewDataVolumeManager creates a new DataVolumeManager using the given client.
+func NewDataVolumeManager(c client.Client) *DataVolumeManager {
+	return &DataVolumeManager{
+		c:  c,
+		dc: newDataVolumeClient(c),
+	}
+}
+
+// List lists the data volumes of the machine with the given name in the given namespace.
+func (m *DataVolumeManager) List(ctx context.Context, machineName, namespace string) ([]cdicorev1alpha1.DataVolume, error) {
+	dataVolumes, err := m.ListInNamespace(ctx, namespace, client.MatchingLabels{machineLabel: machineName})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list DataVolumes of machine %q", machineName)
+	}
+	return dataVolumes, nil
+}
+
+// ListInNamespace lists the data volumes in the given namespace matching the given options, e.g. a label selector.
+func (m *DataVolumeManager) ListInNamespace(ctx context.Context, namespace string, opts ...client.ListOption) ([]cdicorev1alpha1.DataVolume, error) {
+	dataVolumeList := &cdicorev1alpha1.DataVolumeList{}
+	if err := m.dc.List(ctx, dataVolumeList, append([]client.ListOption{client.InNamespace(namespace)}, opts...)...); err != nil {
+		return nil, errors.Wrapf(err, "could not list DataVolumes in namespace %q", namespace)
+	}
+	return dataVolumeList.Items, nil
+}
+
+// ListPVCs lists the persistent volume claims of the machine with the given name in the given namespace.
+func (m *DataVolumeManager) ListPVCs(ctx context.Context, machineName, namespace string) ([]corev1.PersistentVolumeClaim, error) {
+	pvcs, err := m.ListPVCsInNamespace(ctx, namespace, client.MatchingLabels{machineLabel: machineName})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list PersistentVolumeClaims of machine %q", machineName)
+	}
+	return pvcs, nil
+}
+
+// ListPVCsInNamespace lists the persistent volume claims in the given namespace matching the given options, e.g. a label selector.
+func (m *DataVolumeManager) ListPVCsInNamespace(ctx context.Context, namespace string, opts ...client.ListOption) ([]corev1.PersistentVolumeClaim, error) {
+	pvcList := &corev1.PersistentVolumeClaimList{}
+	if err := m.c.List(ctx, pvcList, append([]client.ListOption{client.InNamespace(namespace)}, opts...)...); err != nil {
+		return nil, errors.Wrapf(err, "could not list PersistentVolumeClaims in namespace %q", namespace)
+	}
+	return pvcList.Items, nil
+}
+
+// EnsureRetained creates the given retained data volumes, unless they already exist, e.g. because they were retained
+// when a previous machine with the same name or data volume name was deleted. Existing data volumes are reused only
+// if they are not used by the VM of another machine, see adoptRetained.
+func (m *DataVolumeManager) EnsureRetained(ctx context.Context, dataVolumes []cdicorev1alpha1.DataVolume) error {
+	for i := range dataVolumes {
+		if err := m.dc.Create(ctx, &dataVolumes[i]); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				if err := m.adoptRetained(ctx, &dataVolumes[i]); err != nil {
+					return err
+				}
+				logging.InfoS(2, "Retained DataVolume already exists, reusing it", logging.KeyMachine, dataVolumes[i].Labels[machineLabel], logging.KeyNamespace, dataVolumes[i].Namespace, "dataVolume", dataVolumes[i].Name)
+				continue
+			}
+			return wrapCreateError(err, "could not create retained DataVolume %q", dataVolumes[i].Name)
+		}
+	}
+	return nil
+}
+
+// adoptRetained labels the existing retained data volume with the name and namespace of the given data volume
+// with the machine name of the given data volume. It returns an error if the existing data volume is labeled with
+// the name of another machine whose VM still exists, since attaching it to a second VM would corrupt its contents.
+func (m *DataVolumeManager) adoptRetained(ctx context.Context, dataVolume *cdicorev1alpha1.DataVolume) error {
+	existing := &cdicorev1alpha1.DataVolume{}
+	if err := m.dc.Get(ctx, client.ObjectKey{Namespace: dataVolume.Namespace, Name: dataVolume.Name}, existing); err != nil {
+		return errors.Wrapf(err, "could not get retained DataVolume %q", dataVolume.Name)
+	}
+	machineName, previousMachineName := dataVolume.Labels[machineLabel], existing.Labels[machineLabel]
+	if previousMachineName == machineName {
+		return nil
+	}
+
+	// Check that the VM of the previous machine no longer exists
+	if previousMachineName != "" {
+		err := m.c.Get(ctx, client.ObjectKey{Namespace: dataVolume.Namespace, Name: previousMachineName}, &kubevirtv1.VirtualMachine{})
+		if err == nil {
+			return errors.Errorf("retained DataVolume %q is already used by VirtualMachine %q", dataVolume.Name, previousMachineName)
+		}
+		if !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "could not get VirtualMachine %q", previousMachineName)
+		}
+	}
+
+	logging.InfoS(2, "Adopting retained DataVolume", logging.KeyMachine, machineName, logging.KeyNamespace, dataVolume.Namespace, "dataVolume", dataVolume.Name, "previousMachine", previousMachineName)
+	if existing.Labels == nil {
+		existing.Labels = make(map[string]string)
+	}
+	existing.Labels[machineLabel] = machineName
+	if err := m.dc.Update(ctx, existing); err != nil {
+		return errors.Wrapf(err, "could not update retained DataVolume %q", dataVolume.Name)
+	}
+	return nil
+}
+
+// DeleteAll deletes all data volumes and persistent volume claims of the machine with the given name in the given namespace,
+// except for retained data volumes and their persistent volume claims.
+func (m *DataVolumeManager) DeleteAll(ctx context.Context, machineName, namespace string) error {
+	dataVolumes, err := m.List(ctx, machineName, namespace)
+	if err != nil {
+		return err
+	}
+	for i := range dataVolumes {
+		if isRetained(&dataVolumes[i]) {
+			logging.InfoS(2, "Retaining DataVolume", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, "dataVolume", dataVolumes[i].Name)
+			continue
+		}
+		logging.InfoS(2, "Deleting DataVolume", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, "dataVolume", dataVolumes[i].Name)
+		if err := client.IgnoreNotFound(m.dc.Delete(ctx, &dataVolumes[i])); err != nil {
+			return errors.Wrapf(err, "could not delete DataVolume %q", dataVolumes[i].Name)
+		}
+	}
+
+	pvcs, err := m.ListPVCs(ctx, machineName, namespace)
+	if err != nil {
+		return err
+	}
+	for i := range pvcs {
+		if isRetained(&pvcs[i]) || isOwnedByRetainedDataVolume(&pvcs[i], dataVolumes) {
+			continue
+		}
+		logging.InfoS(2, "Deleting PersistentVolumeClaim", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, "pvc", pvcs[i].Name)
+		if err := client.IgnoreNotFound(m.c.Delete(ctx, &pvcs[i])); err != nil {
+			return errors.Wrapf(err, "could not delete PersistentVolumeClaim %q", pvcs[i].Name)
+		}
+	}
+
+	return nil
+}
+
+// isRetained returns true if the given data volume or persistent volume claim is retained when its machine is deleted.
+func isRetained(obj metav1.Object) bool {
+	return obj.GetLabels()[deletionPolicyLabel] == api.VolumeDeletionPolicyRetain
+}
+
+// isOwnedByRetainedDataVolume returns true if the given persistent volume claim is owned by one of the given data volumes
+// that is retained when its machine is deleted.
+func isOwnedByRetainedDataVolume(pvc *corev1.PersistentVolumeClaim, dataVolumes []cdicorev1alpha1.DataVolume) bool {
+	for i := range dataVolumes {
+		if !isRetained(&dataVolumes[i]) {
+			continue
+		}
+		for _, ref := range pvc.OwnerReferences {
+			if ref.Kind == "DataVolume" && ref.Name == dataVolumes[i].Name {
+				return true
+			}
+		}
+	}
+	return false
+}
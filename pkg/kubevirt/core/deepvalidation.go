@@ -0,0 +1,249 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// networkAttachmentDefinitionGVK is the GroupVersionKind of Multus network attachment definitions.
+var networkAttachmentDefinitionGVK = schema.GroupVersionKind{Group: "k8s.cni.cncf.io", Version: "v1", Kind: "NetworkAttachmentDefinition"}
+
+// networkAttachmentDefinitionResource is the resource name of Multus network attachment definitions.
+const networkAttachmentDefinitionResource = "network-attachment-definitions"
+
+// validateProviderClusterResources checks that the provider cluster resources referenced by the given provider spec exist.
+// It returns an InvalidProviderSpecError listing all missing resources, if any. Resources that cannot be read due to
+// missing permissions are skipped. The IPAM types of the found network attachment definitions are added to the given map,
+// if it's not nil, see checkNetworks.
+func validateProviderClusterResources(ctx context.Context, c client.Client, namespace string, providerSpec *api.KubeVirtProviderSpec, ipamTypes map[string]string) error {
+	var missing []string
+	check := newResourceCheck(ctx, c, &missing)
+
+	for _, storageClassName := range getStorageClassNames(providerSpec) {
+		if _, err := check(client.ObjectKey{Name: storageClassName}, &storagev1.StorageClass{}, fmt.Sprintf("StorageClass %q", storageClassName)); err != nil {
+			return err
+		}
+	}
+
+	if pvc := providerSpec.RootVolume.PersistentVolumeClaim; pvc != nil {
+		key := client.ObjectKey{Namespace: namespace, Name: pvc.ClaimName}
+		if _, err := check(key, &corev1.PersistentVolumeClaim{}, fmt.Sprintf("PersistentVolumeClaim %q", key.String())); err != nil {
+			return err
+		}
+	}
+
+	if err := checkNetworks(ctx, c, check, namespace, providerSpec.Networks, ipamTypes); err != nil {
+		return err
+	}
+
+	if sysprep := providerSpec.Sysprep; sysprep != nil {
+		switch {
+		case sysprep.ConfigMap != nil:
+			key := client.ObjectKey{Namespace: namespace, Name: sysprep.ConfigMap.Name}
+			if _, err := check(key, &corev1.ConfigMap{}, fmt.Sprintf("ConfigMap %q", key.String())); err != nil {
+				return err
+			}
+		case sysprep.Secret != nil:
+			key := client.ObjectKey{Namespace: namespace, Name: sysprep.Secret.Name}
+			if _, err := check(key, &corev1.Secret{}, fmt.Sprintf("Secret %q", key.String())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if providerSpec.PriorityClassName != "" {
+		key := client.ObjectKey{Name: providerSpec.PriorityClassName}
+		if _, err := check(key, &schedulingv1.PriorityClass{}, fmt.Sprintf("PriorityClass %q", providerSpec.PriorityClassName)); err != nil {
+			return err
+		}
+	}
+
+	return missingResourcesError(missing)
+}
+
+// checkNetworkAttachmentDefinitions checks that the Multus network attachment definitions referenced by the given network specs exist.
+// It returns an InvalidProviderSpecError listing all missing network attachment definitions, if any.
+// The IPAM types of the found network attachment definitions are added to the given map, if it's not nil, see checkNetworks.
+func checkNetworkAttachmentDefinitions(ctx context.Context, c client.Client, namespace string, networkSpecs []api.NetworkSpec, ipamTypes map[string]string) error {
+	var missing []string
+	if err := checkNetworks(ctx, c, newResourceCheck(ctx, c, &missing), namespace, networkSpecs, ipamTypes); err != nil {
+		return err
+	}
+	return missingResourcesError(missing)
+}
+
+// resourceCheck gets the object with the given key, recording the given description of the object if it doesn't exist.
+// It returns true if the object was found.
+type resourceCheck func(key client.ObjectKey, obj runtime.Object, description string) (bool, error)
+
+// newResourceCheck returns a resourceCheck that uses the given client and appends the descriptions of missing objects
+// to the given list. Objects that cannot be read due to missing permissions are skipped.
+func newResourceCheck(ctx context.Context, c client.Client, missing *[]string) resourceCheck {
+	return func(key client.ObjectKey, obj runtime.Object, description string) (bool, error) {
+		if err := c.Get(ctx, key, obj); err != nil {
+			switch {
+			case apierrors.IsNotFound(err):
+				*missing = append(*missing, description)
+			case apierrors.IsForbidden(err):
+				logging.InfoS(2, "Reading resource is forbidden, skipping its validation", "resource", description, "err", err)
+			default:
+				return false, errors.Wrapf(err, "could not get %s", description)
+			}
+			return false, nil
+		}
+		return true, nil
+	}
+}
+
+// checkNetworks checks the Multus network attachment definitions referenced by the given network specs with the given
+// resource check. Network names without a namespace refer to the given namespace. For network attachment definitions
+// in other namespaces, it's first checked that the provider cluster credentials are allowed to use them, see checkNetworkAccess.
+// The IPAM type of each found network attachment definition is logged, and added by network name to the given map, if it's not nil.
+func checkNetworks(ctx context.Context, c client.Client, check resourceCheck, namespace string, networkSpecs []api.NetworkSpec, ipamTypes map[string]string) error {
+	for _, networkSpec := range networkSpecs {
+		key := client.ObjectKey{Namespace: namespace, Name: networkSpec.Name}
+		if parts := strings.SplitN(networkSpec.Name, "/", 2); len(parts) == 2 {
+			key = client.ObjectKey{Namespace: parts[0], Name: parts[1]}
+		}
+		if key.Namespace != namespace {
+			if err := checkNetworkAccess(ctx, c, key); err != nil {
+				return err
+			}
+		}
+		nad := &unstructured.Unstructured{}
+		nad.SetGroupVersionKind(networkAttachmentDefinitionGVK)
+		found, err := check(key, nad, fmt.Sprintf("NetworkAttachmentDefinition %q", key.String()))
+		if err != nil {
+			return err
+		}
+		if found {
+			ipamType := getIPAMType(nad)
+			logging.InfoS(2, "Found NetworkAttachmentDefinition", logging.KeyNamespace, key.Namespace, "networkAttachmentDefinition", key.Name, "ipam", ipamType)
+			if ipamTypes != nil {
+				ipamTypes[networkSpec.Name] = ipamType
+			}
+		}
+	}
+	return nil
+}
+
+// checkNetworkAccess checks via a SelfSubjectAccessReview that the provider cluster credentials are allowed to get
+// the network attachment definition with the given key. If they are not, it returns a Forbidden error naming the
+// network attachment definition and the reason, if any. The check is skipped if the access review cannot be created
+// due to missing permissions.
+func checkNetworkAccess(ctx context.Context, c client.Client, key client.ObjectKey) error {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: key.Namespace,
+				Verb:      "get",
+				Group:     networkAttachmentDefinitionGVK.Group,
+				Resource:  networkAttachmentDefinitionResource,
+				Name:      key.Name,
+			},
+		},
+	}
+	if err := c.Create(ctx, review); err != nil {
+		if apierrors.IsForbidden(err) {
+			logging.InfoS(2, "Creating access reviews is forbidden, skipping the access check of NetworkAttachmentDefinition", logging.KeyNamespace, key.Namespace, "networkAttachmentDefinition", key.Name, "err", err)
+			return nil
+		}
+		return errors.Wrapf(err, "could not check access to NetworkAttachmentDefinition %q", key.String())
+	}
+	if review.Status.Allowed {
+		return nil
+	}
+
+	reason := "the provider cluster credentials are not allowed to use network attachment definitions in namespace " + key.Namespace
+	if review.Status.Reason != "" {
+		reason += ": " + review.Status.Reason
+	}
+	groupResource := schema.GroupResource{Group: networkAttachmentDefinitionGVK.Group, Resource: networkAttachmentDefinitionResource}
+	return errors.Wrap(apierrors.NewForbidden(groupResource, key.String(), errors.New(reason)), "could not attach network")
+}
+
+// getIPAMType returns the IPAM type of the CNI config of the given network attachment definition, or "none" if it has no IPAM.
+func getIPAMType(nad *unstructured.Unstructured) string {
+	config, _, _ := unstructured.NestedString(nad.Object, "spec", "config")
+	var cniConfig struct {
+		IPAM struct {
+			Type string `json:"type"`
+		} `json:"ipam"`
+		Plugins []struct {
+			IPAM struct {
+				Type string `json:"type"`
+			} `json:"ipam"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal([]byte(config), &cniConfig); err != nil {
+		return "none"
+	}
+	if cniConfig.IPAM.Type != "" {
+		return cniConfig.IPAM.Type
+	}
+	for _, plugin := range cniConfig.Plugins {
+		if plugin.IPAM.Type != "" {
+			return plugin.IPAM.Type
+		}
+	}
+	return "none"
+}
+
+// missingResourcesError returns an InvalidProviderSpecError listing the given missing resources, or nil if there are none.
+func missingResourcesError(missing []string) error {
+	if len(missing) > 0 {
+		return &InvalidProviderSpecError{
+			Err: errors.Errorf("provider spec references resources that don't exist in the provider cluster: %s", strings.Join(missing, ", ")),
+		}
+	}
+	return nil
+}
+
+// getStorageClassNames returns the unique names of the storage classes explicitly specified
+// for the root volume and the additional data volumes of the given provider spec.
+func getStorageClassNames(providerSpec *api.KubeVirtProviderSpec) []string {
+	names := sets.NewString()
+	if pvc := providerSpec.RootVolume.PVC; pvc != nil && pvc.StorageClassName != nil && *pvc.StorageClassName != "" {
+		names.Insert(*pvc.StorageClassName)
+	}
+	for _, volume := range providerSpec.AdditionalVolumes {
+		if volume.DataVolume == nil {
+			continue
+		}
+		if pvc := volume.DataVolume.PVC; pvc != nil && pvc.StorageClassName != nil && *pvc.StorageClassName != "" {
+			names.Insert(*pvc.StorageClassName)
+		}
+	}
+	return names.List()
+}
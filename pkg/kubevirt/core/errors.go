@@ -16,6 +16,10 @@ package core
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 // MachineNotFoundError represents a "machine not found" error.
@@ -37,3 +41,143 @@ func IsMachineNotFoundError(err error) bool {
 		return false
 	}
 }
+
+// DeletionInProgressError represents an error indicating that the deletion of a machine has been requested,
+// but its VM has not been fully deleted yet.
+type DeletionInProgressError struct {
+	// Name is the machine name
+	Name string
+}
+
+func (e *DeletionInProgressError) Error() string {
+	return fmt.Sprintf("deletion of machine %q is still in progress", e.Name)
+}
+
+// IsDeletionInProgressError returns true if the given error is a DeletionInProgressError, false otherwise.
+func IsDeletionInProgressError(err error) bool {
+	switch err.(type) {
+	case *DeletionInProgressError:
+		return true
+	default:
+		return false
+	}
+}
+
+// OperationLimitExceededError represents an error indicating that an operation could not be performed because
+// the maximum number of concurrent operations against its provider cluster was reached, see Options.MaxConcurrentOperations.
+type OperationLimitExceededError struct {
+	// Operation is the operation
+	Operation string
+	// Cluster is the provider cluster
+	Cluster string
+}
+
+func (e *OperationLimitExceededError) Error() string {
+	return fmt.Sprintf("maximum number of concurrent %s operations against provider cluster %q reached", e.Operation, e.Cluster)
+}
+
+// InvalidProviderSpecError represents an error indicating that the provider spec is not valid for its provider cluster,
+// e.g. because it references resources that don't exist in the provider cluster.
+type InvalidProviderSpecError struct {
+	// Err is the underlying error
+	Err error
+}
+
+func (e *InvalidProviderSpecError) Error() string {
+	return e.Err.Error()
+}
+
+// IsInvalidProviderSpecError returns true if the given error is an InvalidProviderSpecError, false otherwise.
+func IsInvalidProviderSpecError(err error) bool {
+	switch err.(type) {
+	case *InvalidProviderSpecError:
+		return true
+	default:
+		return false
+	}
+}
+
+// MachineStatusReason is the reason of a MachineStatusError.
+type MachineStatusReason string
+
+const (
+	// MachineStatusReasonUnschedulable means that the VM pod could not be scheduled on any provider cluster node.
+	MachineStatusReasonUnschedulable MachineStatusReason = "Unschedulable"
+	// MachineStatusReasonQuotaExceeded means that a resource quota of the provider cluster namespace has been exceeded.
+	MachineStatusReasonQuotaExceeded MachineStatusReason = "QuotaExceeded"
+	// MachineStatusReasonImagePullFailed means that an image required by the VM pod could not be pulled.
+	MachineStatusReasonImagePullFailed MachineStatusReason = "ImagePullFailed"
+	// MachineStatusReasonUnhealthy means that the readiness probe of the VMI has failed after the VMI has become ready.
+	MachineStatusReasonUnhealthy MachineStatusReason = "Unhealthy"
+	// MachineStatusReasonFailed means that the VM or VMI has failed, e.g. because it is crash looping.
+	MachineStatusReasonFailed MachineStatusReason = "Failed"
+	// MachineStatusReasonUnknown means that the state of the VMI could not be obtained, e.g. because its node is unreachable.
+	MachineStatusReasonUnknown MachineStatusReason = "Unknown"
+)
+
+// MachineStatusError represents an error condition reported in the status of a machine's VM or VMI.
+type MachineStatusError struct {
+	// Name is the machine name
+	Name string
+	// Reason is the reason of the error condition
+	Reason MachineStatusReason
+	// Message is a human readable message describing the error condition
+	Message string
+}
+
+func (e *MachineStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("machine %q status is %s", e.Name, e.Reason)
+	}
+	return fmt.Sprintf("machine %q status is %s: %s", e.Name, e.Reason, e.Message)
+}
+
+// ResourceExhaustedError represents an error caused by exhausted provider cluster resources,
+// such as an exceeded resource quota or insufficient capacity.
+type ResourceExhaustedError struct {
+	// Err is the underlying error
+	Err error
+}
+
+func (e *ResourceExhaustedError) Error() string {
+	return e.Err.Error()
+}
+
+// IsResourceExhaustedError returns true if the given error is a ResourceExhaustedError, false otherwise.
+func IsResourceExhaustedError(err error) bool {
+	switch err.(type) {
+	case *ResourceExhaustedError:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsQuotaExceededError returns true if the given error indicates that a resource quota of the provider cluster namespace
+// has been exceeded, i.e. it's a ResourceExhaustedError caused by an exceeded quota, or a MachineStatusError with reason QuotaExceeded.
+func IsQuotaExceededError(err error) bool {
+	switch e := err.(type) {
+	case *ResourceExhaustedError:
+		return isQuotaExceededMessage(e.Error())
+	case *MachineStatusError:
+		return e.Reason == MachineStatusReasonQuotaExceeded
+	default:
+		return false
+	}
+}
+
+// isQuotaExceededMessage returns true if the given message indicates that a resource quota has been exceeded.
+func isQuotaExceededMessage(message string) bool {
+	return strings.Contains(message, "exceeded quota")
+}
+
+// isResourceExhaustedAPIError returns true if the given API error indicates exhausted provider cluster resources.
+func isResourceExhaustedAPIError(err error) bool {
+	return (apierrors.IsForbidden(err) && isQuotaExceededMessage(err.Error())) || apierrors.IsTooManyRequests(err)
+}
+
+// IsUnauthenticatedError returns true if the given error indicates that the authentication to the provider cluster failed,
+// e.g. because the credentials in the kubeconfig are invalid or expired, or an exec credential plugin failed.
+func IsUnauthenticatedError(err error) bool {
+	return apierrors.IsUnauthorized(errors.Cause(err)) || strings.Contains(err.Error(), "getting credentials:")
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+)
+
+// exportGroupVersion is the kubevirt export GroupVersion, served by KubeVirt v0.55 and later.
+// Since the export types are not part of the kubevirt API package, VM exports are represented by unstructured objects.
+var exportGroupVersion = schema.GroupVersion{Group: "export.kubevirt.io", Version: "v1alpha1"}
+
+// RootDiskExport is the export of the root disk of a machine.
+type RootDiskExport struct {
+	// Name is the name of the kubevirt VM export.
+	Name string
+	// TokenSecretName is the name of the provider cluster secret containing the token required to download the export.
+	TokenSecretName string
+	// Phase is the phase of the kubevirt VM export, e.g. "Pending" or "Ready".
+	Phase string
+	// URLs are the URLs the root disk can be downloaded from once the export is ready.
+	URLs []string
+}
+
+// IsReady returns true if the root disk can be downloaded, false otherwise.
+func (e *RootDiskExport) IsReady() bool {
+	return e.Phase == "Ready"
+}
+
+// ExportRootDisk exports the root disk of the machine with the given name and provider id, using the given provider spec and secret.
+// Here it stops the kubevirt virtual machine with the given name via the stop subresource, since only a disk that is not in use
+// can be exported, and creates a kubevirt VM export of its root persistent volume claim, together with the secret containing
+// the export token, unless they already exist. Both are owned by the kubevirt virtual machine, so they are deleted with it.
+// If the provider spec doesn't allow root disk exports, an InvalidProviderSpecError is returned.
+func (p PluginSPIImpl) ExportRootDisk(ctx context.Context, machineName, _ string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*RootDiskExport, error) {
+	if !providerSpec.AllowRootDiskExport {
+		return nil, &InvalidProviderSpecError{Err: errors.New("root disk exports are not allowed by the provider spec")}
+	}
+
+	// Pin the provider spec to the zone of the existing VM, if any
+	providerSpec, err := p.resolveMachineZone(ctx, machineName, providerSpec, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get client and namespace from the secret of the provider cluster of the zone
+	secret = getZoneSecret(secret, getMachineZone(machineName, providerSpec))
+	c, namespace, err := p.cf.GetClient(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create client")
+	}
+
+	// Get the VM by name, and the name of its root persistent volume claim
+	virtualMachine, err := p.getVM(ctx, c, machineName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	claimName := getRootClaimName(virtualMachine)
+	if claimName == "" {
+		return nil, errors.Errorf("could not find the root volume of VirtualMachine %q", machineName)
+	}
+
+	// Stop the VM, if it's running
+	virtualMachineInstance, err := p.getVMI(ctx, c, machineName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if virtualMachineInstance != nil {
+		logging.InfoS(2, "Stopping VirtualMachine to export its root disk", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "ExportRootDisk")
+		if err := p.sc.StopVirtualMachine(ctx, secret, namespace, machineName); err != nil && !apierrors.IsConflict(err) {
+			return nil, errors.Wrapf(err, "could not stop VirtualMachine %q", machineName)
+		}
+	}
+
+	// Create the export token secret, unless it already exists
+	tokenSecret, err := buildExportTokenSecret(machineName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	tokenSecrets, err := createSecrets(ctx, c, []*corev1.Secret{tokenSecret})
+	if err != nil {
+		return nil, err
+	}
+	if err := setSecretOwner(ctx, c, tokenSecrets[0], virtualMachine); err != nil {
+		return nil, err
+	}
+
+	// Get the export, creating it if it doesn't exist
+	name := buildChildName("", machineName, "-root-disk")
+	export := newExport(namespace, name)
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, export); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "could not get VirtualMachineExport %q", name)
+		}
+		logging.InfoS(2, "Creating VirtualMachineExport", logging.KeyMachine, machineName, logging.KeyNamespace, namespace, logging.KeyOperation, "ExportRootDisk", "export", name)
+		export = buildExport(namespace, name, claimName, tokenSecret.Name, virtualMachine)
+		if err := c.Create(ctx, export); err != nil && !apierrors.IsAlreadyExists(err) {
+			if meta.IsNoMatchError(err) {
+				return nil, errors.Wrap(err, "could not create VirtualMachineExport, the provider cluster must run KubeVirt v0.55 or later")
+			}
+			return nil, wrapCreateError(err, "could not create VirtualMachineExport %q", name)
+		}
+	}
+
+	return getRootDiskExport(export, tokenSecret.Name), nil
+}
+
+// getRootClaimName returns the name of the persistent volume claim of the root volume of the given kubevirt virtual machine,
+// i.e. the name of its root data volume or existing persistent volume claim, or an empty string if it has none.
+func getRootClaimName(virtualMachine *kubevirtv1.VirtualMachine) string {
+	if virtualMachine.Spec.Template == nil {
+		return ""
+	}
+	for _, volume := range virtualMachine.Spec.Template.Spec.Volumes {
+		if volume.Name != api.RootDiskName {
+			continue
+		}
+		switch {
+		case volume.DataVolume != nil:
+			return volume.DataVolume.Name
+		case volume.PersistentVolumeClaim != nil:
+			return volume.PersistentVolumeClaim.ClaimName
+		}
+	}
+	return ""
+}
+
+// buildExportTokenSecret builds the secret containing a random token required to download the root disk export
+// of the machine with the given name.
+func buildExportTokenSecret(machineName, namespace string) (*corev1.Secret, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, errors.Wrap(err, "could not generate export token")
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      buildChildName("export-token-", machineName, ""),
+			Namespace: namespace,
+			Labels: map[string]string{
+				machineLabel: machineName,
+			},
+		},
+		Data: map[string][]byte{
+			"token": []byte(hex.EncodeToString(token)),
+		},
+	}, nil
+}
+
+// newExport returns an unstructured VM export with the given namespace and name.
+func newExport(namespace, name string) *unstructured.Unstructured {
+	export := &unstructured.Unstructured{}
+	export.SetGroupVersionKind(exportGroupVersion.WithKind("VirtualMachineExport"))
+	export.SetNamespace(namespace)
+	export.SetName(name)
+	return export
+}
+
+// buildExport builds a VM export of the persistent volume claim with the given name, using the token in the secret
+// with the given name, and owned by the given kubevirt virtual machine.
+func buildExport(namespace, name, claimName, tokenSecretName string, virtualMachine *kubevirtv1.VirtualMachine) *unstructured.Unstructured {
+	export := newExport(namespace, name)
+	export.SetLabels(map[string]string{
+		machineLabel: virtualMachine.Name,
+	})
+	export.SetOwnerReferences([]metav1.OwnerReference{
+		*metav1.NewControllerRef(virtualMachine, kubevirtv1.VirtualMachineGroupVersionKind),
+	})
+	export.Object["spec"] = map[string]interface{}{
+		"source": map[string]interface{}{
+			"apiGroup": "",
+			"kind":     "PersistentVolumeClaim",
+			"name":     claimName,
+		},
+		"tokenSecretRef": tokenSecretName,
+	}
+	return export
+}
+
+// getRootDiskExport returns the RootDiskExport of the given VM export, including the URLs of all volume formats
+// of its internal and external links.
+func getRootDiskExport(export *unstructured.Unstructured, tokenSecretName string) *RootDiskExport {
+	phase, _, _ := unstructured.NestedString(export.Object, "status", "phase")
+	rootDiskExport := &RootDiskExport{
+		Name:            export.GetName(),
+		TokenSecretName: tokenSecretName,
+		Phase:           phase,
+	}
+	for _, link := range []string{"external", "internal"} {
+		volumes, _, _ := unstructured.NestedSlice(export.Object, "status", "links", link, "volumes")
+		for _, volume := range volumes {
+			volume, ok := volume.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			formats, _, _ := unstructured.NestedSlice(volume, "formats")
+			for _, format := range formats {
+				format, ok := format.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if url, _, _ := unstructured.NestedString(format, "url"); url != "" {
+					rootDiskExport.URLs = append(rootDiskExport.URLs, url)
+				}
+			}
+		}
+	}
+	return rootDiskExport
+}
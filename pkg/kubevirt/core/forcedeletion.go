@@ -0,0 +1,95 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// virtLauncherLabel is the label identifying the virt-launcher pods created by KubeVirt.
+const virtLauncherLabel = "kubevirt.io"
+
+// isDeletionStuck returns true if the deletion of the given kubevirt virtual machine has been requested
+// at least the given timeout before the given time, false otherwise. A zero timeout means never.
+func isDeletionStuck(virtualMachine *kubevirtv1.VirtualMachine, now time.Time, timeout time.Duration) bool {
+	return timeout > 0 && virtualMachine.DeletionTimestamp != nil && now.Sub(virtualMachine.DeletionTimestamp.Time) >= timeout
+}
+
+// forceDeleteVM force deletes the virtual machine instance and the virt-launcher pods of the given kubevirt virtual machine
+// that is stuck in deletion, i.e. deletes them with a grace period of zero, so that they are removed from the provider cluster
+// without waiting for the kubelet of their node to confirm it. If ForceRemoveFinalizers is set, it also removes
+// the finalizers of the virtual machine instance and the kubevirt virtual machine.
+func (p PluginSPIImpl) forceDeleteVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine) error {
+	machineName, namespace := virtualMachine.Name, virtualMachine.Namespace
+	logging.InfoS(1, "VirtualMachine stuck in deletion, force deleting its VirtualMachineInstance and pods", logging.KeyMachine, machineName,
+		logging.KeyNamespace, namespace, logging.KeyOperation, "DeleteMachine", "deletionTimestamp", virtualMachine.DeletionTimestamp)
+
+	// Force delete the VMI
+	virtualMachineInstance, err := p.getVMI(ctx, c, machineName, namespace)
+	if err != nil {
+		return err
+	}
+	if virtualMachineInstance != nil {
+		if err := client.IgnoreNotFound(c.Delete(ctx, virtualMachineInstance, client.GracePeriodSeconds(0))); err != nil {
+			return errors.Wrapf(err, "could not force delete VirtualMachineInstance %q", machineName)
+		}
+	}
+
+	// Force delete the virt-launcher pods
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.InNamespace(namespace), client.MatchingLabels{machineLabel: machineName, virtLauncherLabel: "virt-launcher"}); err != nil {
+		return errors.Wrapf(err, "could not list pods of VirtualMachine %q", machineName)
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if err := client.IgnoreNotFound(c.Delete(ctx, pod, client.GracePeriodSeconds(0))); err != nil {
+			return errors.Wrapf(err, "could not force delete pod %q", pod.Name)
+		}
+	}
+
+	if !p.options.ForceRemoveFinalizers {
+		return nil
+	}
+
+	// Remove the finalizers of the VMI and the VM
+	if virtualMachineInstance != nil && len(virtualMachineInstance.Finalizers) > 0 {
+		logging.InfoS(1, "Removing finalizers of VirtualMachineInstance stuck in deletion", logging.KeyMachine, machineName, logging.KeyNamespace, namespace,
+			logging.KeyOperation, "DeleteMachine", "finalizers", virtualMachineInstance.Finalizers)
+		patched := virtualMachineInstance.DeepCopy()
+		patched.Finalizers = nil
+		if err := c.Patch(ctx, patched, client.MergeFrom(virtualMachineInstance)); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "could not remove finalizers of VirtualMachineInstance %q", machineName)
+		}
+	}
+	if len(virtualMachine.Finalizers) > 0 {
+		logging.InfoS(1, "Removing finalizers of VirtualMachine stuck in deletion", logging.KeyMachine, machineName, logging.KeyNamespace, namespace,
+			logging.KeyOperation, "DeleteMachine", "finalizers", virtualMachine.Finalizers)
+		patched := virtualMachine.DeepCopy()
+		patched.Finalizers = nil
+		if err := c.Patch(ctx, patched, client.MergeFrom(virtualMachine)); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "could not remove finalizers of VirtualMachine %q", machineName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// imageCacheLabel is the label of cached image data volumes.
+	imageCacheLabel = "kubevirt.io/image-cache"
+	// imageCacheLastUsedAnnotation is the annotation containing the time a cached image data volume was last used.
+	imageCacheLastUsedAnnotation = "kubevirt.io/image-cache-last-used"
+)
+
+// ImageCache manages cached image data volumes, i.e. data volumes that import an image once per namespace
+// and are then cloned into the root volumes of the machines using the same image and storage.
+type ImageCache struct {
+	dc *dataVolumeClient
+}
+
+// NewImageCache creates a new ImageCache using the given client.
+func NewImageCache(c client.Client) *ImageCache {
+	return &ImageCache{
+		dc: newDataVolumeClient(c),
+	}
+}
+
+// Ensure ensures that the cached image data volume for the given data volume spec exists in the given namespace,
+// creating it if needed, and marks it as used at the given time.
+func (ic *ImageCache) Ensure(ctx context.Context, namespace string, spec *cdicorev1alpha1.DataVolumeSpec, now time.Time) error {
+	name := getImageCacheName(spec)
+	lastUsed := now.UTC().Format(time.RFC3339)
+
+	dataVolume := &cdicorev1alpha1.DataVolume{}
+	if err := ic.dc.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, dataVolume); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "could not get cached image DataVolume %q", name)
+		}
+		logging.InfoS(2, "Creating cached image DataVolume", logging.KeyNamespace, namespace, "dataVolume", name)
+		dataVolume = &cdicorev1alpha1.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      map[string]string{imageCacheLabel: "true"},
+				Annotations: map[string]string{imageCacheLastUsedAnnotation: lastUsed},
+			},
+			Spec: *spec.DeepCopy(),
+		}
+		if err := ic.dc.Create(ctx, dataVolume); err != nil && !apierrors.IsAlreadyExists(err) {
+			return wrapCreateError(err, "could not create cached image DataVolume %q", name)
+		}
+		return nil
+	}
+
+	// Delete the cached image if importing it failed, so that it's recreated by the next attempt
+	if dataVolume.Status.Phase == cdicorev1alpha1.Failed {
+		logging.InfoS(2, "Deleting failed cached image DataVolume", logging.KeyNamespace, namespace, "dataVolume", name)
+		if err := client.IgnoreNotFound(ic.dc.Delete(ctx, dataVolume)); err != nil {
+			return errors.Wrapf(err, "could not delete cached image DataVolume %q", name)
+		}
+		return errors.Errorf("cached image DataVolume %q failed", name)
+	}
+
+	if dataVolume.Annotations == nil {
+		dataVolume.Annotations = make(map[string]string)
+	}
+	dataVolume.Annotations[imageCacheLastUsedAnnotation] = lastUsed
+	if err := ic.dc.Update(ctx, dataVolume); err != nil {
+		return errors.Wrapf(err, "could not update cached image DataVolume %q", name)
+	}
+	return nil
+}
+
+// DeleteUnused deletes the cached image data volumes in the given namespace that have not been used
+// for the given TTL at the given time. Machines already cloned from them are not affected.
+func (ic *ImageCache) DeleteUnused(ctx context.Context, namespace string, now time.Time, ttl time.Duration) error {
+	dataVolumeList := &cdicorev1alpha1.DataVolumeList{}
+	if err := ic.dc.List(ctx, dataVolumeList, client.InNamespace(namespace), client.MatchingLabels{imageCacheLabel: "true"}); err != nil {
+		return errors.Wrapf(err, "could not list cached image DataVolumes in namespace %q", namespace)
+	}
+	for i := range dataVolumeList.Items {
+		dataVolume := &dataVolumeList.Items[i]
+		lastUsed, err := time.Parse(time.RFC3339, dataVolume.Annotations[imageCacheLastUsedAnnotation])
+		if err != nil {
+			lastUsed = dataVolume.CreationTimestamp.Time
+		}
+		if now.Sub(lastUsed) < ttl {
+			continue
+		}
+		logging.InfoS(2, "Deleting unused cached image DataVolume", logging.KeyNamespace, namespace, "dataVolume", dataVolume.Name)
+		if err := client.IgnoreNotFound(ic.dc.Delete(ctx, dataVolume)); err != nil {
+			return errors.Wrapf(err, "could not delete cached image DataVolume %q", dataVolume.Name)
+		}
+	}
+	return nil
+}
+
+// buildImageCloneSpec builds a data volume spec that clones the cached image data volume
+// for the given data volume spec in the given namespace.
+func buildImageCloneSpec(namespace string, spec *cdicorev1alpha1.DataVolumeSpec) cdicorev1alpha1.DataVolumeSpec {
+	cloneSpec := spec.DeepCopy()
+	cloneSpec.Source = cdicorev1alpha1.DataVolumeSource{
+		PVC: &cdicorev1alpha1.DataVolumeSourcePVC{
+			Namespace: namespace,
+			Name:      getImageCacheName(spec),
+		},
+	}
+	return *cloneSpec
+}
+
+// getImageCacheName returns the name of the cached image data volume for the given data volume spec.
+// It's derived from the source and storage of the data volume spec, so that all machines using the same image
+// and storage share the same cached image.
+func getImageCacheName(spec *cdicorev1alpha1.DataVolumeSpec) string {
+	data, _ := json.Marshal(spec)
+	return fmt.Sprintf("image-%x", sha256.Sum256(data))[:22]
+}
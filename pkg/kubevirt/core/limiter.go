@@ -0,0 +1,151 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// operationCreate is the label value of create operations in the operation limiter metrics.
+	operationCreate = "create"
+	// operationDelete is the label value of delete operations in the operation limiter metrics.
+	operationDelete = "delete"
+)
+
+var (
+	operationsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "mcm",
+			Subsystem: "kubevirt",
+			Name:      "operations_in_flight",
+			Help:      "Number of create and delete operations currently performed against a provider cluster",
+		},
+		[]string{"cluster", "operation"},
+	)
+	operationsWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "mcm",
+			Subsystem: "kubevirt",
+			Name:      "operations_waiting",
+			Help:      "Number of create and delete operations currently waiting for a free slot of a provider cluster",
+		},
+		[]string{"cluster", "operation"},
+	)
+	operationsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mcm",
+			Subsystem: "kubevirt",
+			Name:      "operations_rejected_total",
+			Help:      "Total number of create and delete operations that failed because no slot of a provider cluster became free in time",
+		},
+		[]string{"cluster", "operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(operationsInFlight, operationsWaiting, operationsRejected)
+}
+
+// operationLimiter bounds the number of operations performed concurrently against each provider cluster
+// to maxConcurrentOperations, using a semaphore per provider secret and zone.
+type operationLimiter struct {
+	maxConcurrentOperations int
+	waitTimeout             time.Duration
+	mutex                   sync.Mutex
+	semaphores              map[string]chan struct{}
+}
+
+// newOperationLimiter creates a new operationLimiter with the given maximum number of concurrent operations per provider cluster,
+// where zero means unlimited, and the given maximum duration an operation waits for a free slot.
+func newOperationLimiter(maxConcurrentOperations int, waitTimeout time.Duration) *operationLimiter {
+	return &operationLimiter{
+		maxConcurrentOperations: maxConcurrentOperations,
+		waitTimeout:             waitTimeout,
+		semaphores:              make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits for up to the wait timeout until a slot of the provider cluster of the given secret is free
+// and acquires it for the given operation. It returns a function that releases the slot, which must be called once
+// the operation is done. If no slot becomes free in time, or the given context is done, it returns an OperationLimitExceededError.
+// If the maximum number of concurrent operations is zero, it returns immediately.
+func (l *operationLimiter) acquire(ctx context.Context, secret *corev1.Secret, operation string) (func(), error) {
+	if l.maxConcurrentOperations <= 0 {
+		return func() {}, nil
+	}
+
+	cluster := getCacheKey(secret)
+	semaphore := l.getSemaphore(cluster)
+
+	select {
+	case semaphore <- struct{}{}:
+	default:
+		if err := l.wait(ctx, semaphore, cluster, operation); err != nil {
+			return nil, err
+		}
+	}
+
+	inFlight := operationsInFlight.WithLabelValues(cluster, operation)
+	inFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inFlight.Dec()
+			<-semaphore
+		})
+	}, nil
+}
+
+// wait waits for up to the wait timeout until a slot of the given semaphore is free and acquires it.
+// If no slot becomes free in time, or the given context is done, it returns an OperationLimitExceededError.
+func (l *operationLimiter) wait(ctx context.Context, semaphore chan struct{}, cluster, operation string) error {
+	waiting := operationsWaiting.WithLabelValues(cluster, operation)
+	waiting.Inc()
+	defer waiting.Dec()
+
+	timer := time.NewTimer(l.waitTimeout)
+	defer timer.Stop()
+
+	logging.InfoS(2, "Waiting for a free operation slot", logging.KeyOperation, operation, "cluster", cluster)
+	select {
+	case semaphore <- struct{}{}:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	operationsRejected.WithLabelValues(cluster, operation).Inc()
+	return &OperationLimitExceededError{Operation: operation, Cluster: cluster}
+}
+
+// getSemaphore returns the semaphore of the given provider cluster, creating it if it doesn't exist.
+func (l *operationLimiter) getSemaphore(cluster string) chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	semaphore, ok := l.semaphores[cluster]
+	if !ok {
+		semaphore = make(chan struct{}, l.maxConcurrentOperations)
+		l.semaphores[cluster] = semaphore
+	}
+	return semaphore
+}
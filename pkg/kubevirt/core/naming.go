@@ -0,0 +1,53 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxNameLength is the maximum length of generated child resource names. It's the maximum length of a DNS-1123 label,
+	// since the names of data volumes are also used in label values and in the names of the CDI importer pods.
+	maxNameLength = 63
+	// nameHashLength is the length of the hash appended to truncated child resource names.
+	nameHashLength = 8
+)
+
+// buildChildName builds the name of a child resource of the machine with the given name from the given prefix,
+// machine name, and suffix, i.e. "<prefix><machine name><suffix>". If the result is longer than maxNameLength,
+// the machine name is truncated, and a hash of the full name is appended to it, so that the result is deterministic,
+// keeps the prefix and suffix, and doesn't collide with the truncated names of other child resources.
+func buildChildName(prefix, machineName, suffix string) string {
+	name := prefix + machineName + suffix
+	if len(name) <= maxNameLength {
+		return name
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:nameHashLength]
+	available := maxNameLength - len(prefix) - len(suffix) - len(hash) - 1
+	if available <= 0 {
+		// The prefix and suffix alone are too long, so truncate the full name
+		return trimName(name[:maxNameLength-len(hash)-1]) + "-" + hash
+	}
+	return prefix + trimName(machineName[:available]) + "-" + hash + suffix
+}
+
+// trimName trims trailing characters from the given truncated name that are not allowed before the appended hash.
+func trimName(name string) string {
+	return strings.TrimRight(name, "-.")
+}
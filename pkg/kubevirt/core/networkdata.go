@@ -0,0 +1,131 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"github.com/pkg/errors"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/yaml"
+)
+
+// dhcpNetworkData is the network data that enables DHCP for all ethernet interfaces.
+const dhcpNetworkData = `version: 2
+ethernets:
+  id0:
+    match:
+      name: "e*"
+    dhcp4: true
+`
+
+// networkData is a cloud-init network configuration version 2 document.
+type networkData struct {
+	Version   int                 `json:"version"`
+	Ethernets map[string]ethernet `json:"ethernets"`
+}
+
+// ethernet is the configuration of an ethernet interface in a cloud-init network configuration version 2 document.
+type ethernet struct {
+	Match       ethernetMatch `json:"match"`
+	DHCP4       *bool         `json:"dhcp4,omitempty"`
+	Addresses   []string      `json:"addresses,omitempty"`
+	Gateway4    string        `json:"gateway4,omitempty"`
+	Gateway6    string        `json:"gateway6,omitempty"`
+	Nameservers *nameservers  `json:"nameservers,omitempty"`
+	MTU         int           `json:"mtu,omitempty"`
+}
+
+// ethernetMatch selects an ethernet interface by its MAC address.
+type ethernetMatch struct {
+	MACAddress string `json:"macaddress"`
+}
+
+// nameservers is the DNS configuration of an ethernet interface.
+type nameservers struct {
+	Addresses []string `json:"addresses"`
+}
+
+// hasStaticConfig returns true if any of the given network specs contains a static network configuration.
+func hasStaticConfig(networkSpecs []api.NetworkSpec) bool {
+	for _, networkSpec := range networkSpecs {
+		if len(networkSpec.Addresses) > 0 || networkSpec.Gateway != "" || len(networkSpec.Nameservers) > 0 || networkSpec.MTU > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// buildEthernet builds the ethernet interface configuration for the interface with the given MAC address from the given network spec.
+// If the network spec is nil or contains no addresses, DHCP is enabled for the interface.
+func buildEthernet(macAddress string, networkSpec *api.NetworkSpec) ethernet {
+	eth := ethernet{
+		Match: ethernetMatch{MACAddress: macAddress},
+	}
+	if networkSpec == nil || len(networkSpec.Addresses) == 0 {
+		eth.DHCP4 = pointer.BoolPtr(true)
+	}
+	if networkSpec == nil {
+		return eth
+	}
+
+	eth.Addresses = networkSpec.Addresses
+	if ip := net.ParseIP(networkSpec.Gateway); ip != nil {
+		if ip.To4() != nil {
+			eth.Gateway4 = networkSpec.Gateway
+		} else {
+			eth.Gateway6 = networkSpec.Gateway
+		}
+	}
+	if len(networkSpec.Nameservers) > 0 {
+		eth.Nameservers = &nameservers{Addresses: networkSpec.Nameservers}
+	}
+	eth.MTU = networkSpec.MTU
+	return eth
+}
+
+// encodeNetworkData encodes the given network data as YAML.
+func encodeNetworkData(data *networkData) (string, error) {
+	bytes, err := yaml.Marshal(data)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal network data to YAML")
+	}
+	return string(bytes), nil
+}
+
+// defaultMACAddressPrefix is the prefix of generated MAC addresses, which makes them locally administered unicast MAC addresses.
+const defaultMACAddressPrefix = "02"
+
+// generateMACAddress generates a stable MAC address with the given prefix for the interface with the given name
+// of the machine with the given name. If the prefix is empty, a locally administered unicast MAC address is generated.
+func generateMACAddress(prefix, machineName, interfaceName string) (string, error) {
+	if prefix == "" {
+		prefix = defaultMACAddressPrefix
+	}
+	octets := strings.Split(prefix, ":")
+	if len(octets) > 5 {
+		return "", errors.Errorf("MAC address prefix %q has more than 5 octets", prefix)
+	}
+	sum := sha256.Sum256([]byte(machineName + "/" + interfaceName))
+	for i := 0; len(octets) < 6; i++ {
+		octets = append(octets, fmt.Sprintf("%02x", sum[i]))
+	}
+	return strings.ToLower(strings.Join(octets, ":")), nil
+}
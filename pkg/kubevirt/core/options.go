@@ -0,0 +1,113 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Options are the options of a PluginSPIImpl.
+type Options struct {
+	// InCluster is whether the in-cluster mode is enabled by default for secrets that don't contain a kubeconfig.
+	// In the in-cluster mode, the provider uses its own service account credentials to access the provider cluster.
+	// It must match the InCluster option of the ClientFactory.
+	InCluster bool
+	// DeepValidation is whether the provider cluster resources referenced by the provider spec, i.e. its storage classes,
+	// root persistent volume claim, Multus network attachment definitions, sysprep ConfigMap or Secret, and priority class,
+	// are checked to exist before creating a machine. Network attachment definitions in other namespaces are also checked
+	// to be accessible with the provider cluster credentials.
+	DeepValidation bool
+	// NetworkCheck is whether the Multus network attachment definitions referenced by the provider spec are checked to exist
+	// before creating a machine, even if DeepValidation is not set. Network attachment definitions in other namespaces are also
+	// checked to be accessible with the provider cluster credentials. The IPAM type of each network attachment definition is logged
+	// as a hint for troubleshooting network interfaces that don't get an IP address.
+	NetworkCheck bool
+	// CapacityCheck is whether it's checked that at least one provider cluster node can fit the resource requests
+	// of a machine before creating it. If no node can fit them, the creation fails with a ResourceExhaustedError,
+	// instead of leaving the virtual machine instance pending until capacity becomes available.
+	CapacityCheck bool
+	// VMCache is whether GetMachineStatus and ListMachines read kubevirt virtual machines and virtual machine instances
+	// from watch-backed informer caches, kept per provider cluster kubeconfig, instead of reading them from the provider cluster
+	// for each call. Reads fall back to the provider cluster if the caches are not synced or not watching, or if an object is not cached.
+	VMCache bool
+	// ImageCacheTTL is the duration after which a cached image data volume that has not been used
+	// to create a machine is deleted.
+	ImageCacheTTL time.Duration
+	// SnapshotTTL is the duration after which a VM snapshot taken on machine deletion is deleted.
+	SnapshotTTL time.Duration
+	// DeletionWaitTimeout is the maximum duration DeleteMachine waits for the kubevirt virtual machine to be fully deleted.
+	// If it's still not gone afterwards, DeleteMachine returns a DeletionInProgressError, so that the deletion is retried.
+	DeletionWaitTimeout time.Duration
+	// StuckDeletionTimeout is the duration after which a kubevirt virtual machine whose deletion has been requested
+	// but that still exists is considered stuck, e.g. because the node of its virt-launcher pod is down.
+	// DeleteMachine then force deletes its virtual machine instance and virt-launcher pods. Zero, the default, means never.
+	// Force deletion is not fenced: if the node is only partitioned from the provider cluster, the guest may keep running
+	// and writing to its volumes, including retained or shared ones, while they are attached to a new VM.
+	StuckDeletionTimeout time.Duration
+	// ForceRemoveFinalizers is whether DeleteMachine also removes the finalizers of a kubevirt virtual machine
+	// that is stuck in deletion and of its virtual machine instance, so that they are removed even if
+	// the controllers responsible for their finalizers can't complete them.
+	ForceRemoveFinalizers bool
+	// MaxConcurrentOperations is the maximum number of create and delete operations that are performed concurrently
+	// against a single provider cluster, i.e. with the same provider secret and zone. Zero means unlimited.
+	MaxConcurrentOperations int
+	// OperationWaitTimeout is the maximum duration an operation waits for one of the MaxConcurrentOperations slots
+	// of its provider cluster to become free, before it fails with an OperationLimitExceededError.
+	OperationWaitTimeout time.Duration
+	// ResizePolicy is the policy for resizing the existing VMs of a machine class when its CPU or memory resources change,
+	// applied each time MaintainMachines is called for the machine class. See ResizePolicyNone, ResizePolicyApply, and ResizePolicyRestart.
+	// The vendored KubeVirt version doesn't support CPU or memory hotplug, so a restart is always needed for the new resources to take effect.
+	ResizePolicy string
+	// ReconcileVMs is whether MaintainMachines applies the desired spec of the kubevirt virtual machines of a machine class
+	// using server-side apply, see UpdateMachine, so that any drift, e.g. in their labels, annotations, resources, or affinity,
+	// is corrected. Changes to the virtual machine instance template only take effect when the virtual machine is restarted.
+	ReconcileVMs bool
+	// ProviderConfig is the provider config whose defaults and allowlists are applied to all machine classes, see SetProviderConfig.
+	ProviderConfig *ProviderConfig
+}
+
+// NewOptions creates new Options with the default values.
+func NewOptions() *Options {
+	return &Options{
+		ImageCacheTTL:        24 * time.Hour,
+		SnapshotTTL:          7 * 24 * time.Hour,
+		DeletionWaitTimeout:  30 * time.Second,
+		OperationWaitTimeout: 30 * time.Second,
+		ResizePolicy:         ResizePolicyNone,
+		ProviderConfig:       &ProviderConfig{},
+	}
+}
+
+// Validate returns an error if the options are invalid, i.e. if ResizePolicy is not a valid resize policy.
+func (o *Options) Validate() error {
+	switch o.ResizePolicy {
+	case ResizePolicyNone, ResizePolicyApply, ResizePolicyRestart:
+		return nil
+	default:
+		return errors.Errorf("unsupported resize policy %q, must be one of %s, %s, %s", o.ResizePolicy, ResizePolicyNone, ResizePolicyApply, ResizePolicyRestart)
+	}
+}
+
+// SetProviderConfig sets the given provider config, and enables or disables the features toggled in it.
+func (o *Options) SetProviderConfig(config *ProviderConfig) {
+	for name, enabled := range config.Features {
+		if feature, ok := features[name]; ok {
+			*feature(o) = enabled
+		}
+	}
+	o.ProviderConfig = config
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// checkPolicy checks that a machine with the given provider spec can be created in the given provider cluster namespace
+// according to the allowlists of the given provider config. The given provider spec should already have the defaults
+// of the provider config applied. If any of the allowlists is violated, it returns an InvalidProviderSpecError
+// naming the violated rules.
+func checkPolicy(namespace string, providerSpec *api.KubeVirtProviderSpec, config *ProviderConfig) error {
+	var violations []string
+
+	if !isAllowed(namespace, config.AllowedNamespaces) {
+		violations = append(violations, violation("allowedNamespaces", "namespace", namespace, config.AllowedNamespaces))
+	}
+	for _, storageClassName := range getStorageClassNames(providerSpec) {
+		if !isAllowed(storageClassName, config.AllowedStorageClassNames) {
+			violations = append(violations, violation("allowedStorageClassNames", "storage class", storageClassName, config.AllowedStorageClassNames))
+		}
+	}
+
+	if len(violations) > 0 {
+		return &InvalidProviderSpecError{
+			Err: errors.Errorf("provider spec violates the provider policy: %s", strings.Join(violations, "; ")),
+		}
+	}
+	return nil
+}
+
+// isAllowed returns true if the given allowlist is empty or contains the given value, false otherwise.
+func isAllowed(value string, allowed []string) bool {
+	return len(allowed) == 0 || sets.NewString(allowed...).Has(value)
+}
+
+// violation returns a message describing that the given value of the given kind is not in the allowlist of the given rule.
+func violation(rule, kind, value string, allowed []string) string {
+	return fmt.Sprintf("%s %q is not allowed by rule %s, allowed values are %s", kind, value, rule, strings.Join(allowed, ", "))
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+
+	"github.com/pkg/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+// ProviderConfig is the provider-level configuration with which platform operators enforce defaults for all machine classes.
+type ProviderConfig struct {
+	// DefaultStorageClassName is the storage class of the root volume and the additional data volumes
+	// that don't specify one, instead of the default storage class of the provider cluster.
+	DefaultStorageClassName string `json:"defaultStorageClassName,omitempty"`
+	// DefaultDiskBus is the bus of the root disk and the additional disks that don't specify one, instead of "virtio".
+	// It doesn't apply to hotpluggable volumes, which always use the "scsi" bus.
+	DefaultDiskBus string `json:"defaultDiskBus,omitempty"`
+	// AllowedNamespaces is the list of provider cluster namespaces machines can be created in.
+	// If empty, machines can be created in any namespace.
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// AllowedStorageClassNames is the list of storage classes the root volume and the additional data volumes can use.
+	// If empty, any storage class can be used. Volumes that don't specify a storage class and are not defaulted
+	// to DefaultStorageClassName are not restricted.
+	AllowedStorageClassNames []string `json:"allowedStorageClassNames,omitempty"`
+	// ImageRegistryMirrors maps image registry hosts to the hosts of their mirrors, which replace them
+	// in the registry sources of the root volume and the additional data volumes.
+	ImageRegistryMirrors map[string]string `json:"imageRegistryMirrors,omitempty"`
+	// DefaultAnnotations are added to every created VM, unless the provider spec specifies annotations with the same keys,
+	// e.g. annotations required by maintenance controllers of the provider cluster.
+	DefaultAnnotations map[string]string `json:"defaultAnnotations,omitempty"`
+	// DefaultVMIAnnotations are added to the VMI template of every created VM, unless the provider spec specifies
+	// VMI annotations with the same keys, e.g. "descheduler.alpha.kubernetes.io/evict".
+	DefaultVMIAnnotations map[string]string `json:"defaultVMIAnnotations,omitempty"`
+	// DefaultTags are added to the tags of every machine class, unless its provider spec specifies tags with the same keys,
+	// e.g. an environment label used for chargeback in the provider cluster.
+	DefaultTags map[string]string `json:"defaultTags,omitempty"`
+	// EnforcedTags are added to the tags of every machine class, overriding the tags with the same keys of its provider spec,
+	// e.g. a cost center label that machine classes must not be able to change.
+	EnforcedTags map[string]string `json:"enforcedTags,omitempty"`
+	// Features maps feature names to whether they are enabled, overriding the corresponding command line flags.
+	// The supported features are "deepValidation", "capacityCheck", "networkCheck", and "vmCache".
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+// features maps the names of the features that can be toggled in the provider config to their options.
+var features = map[string]func(o *Options) *bool{
+	"deepValidation": func(o *Options) *bool { return &o.DeepValidation },
+	"capacityCheck":  func(o *Options) *bool { return &o.CapacityCheck },
+	"networkCheck":   func(o *Options) *bool { return &o.NetworkCheck },
+	"vmCache":        func(o *Options) *bool { return &o.VMCache },
+}
+
+// LoadProviderConfig loads the provider config from the YAML file with the given path and validates it.
+func LoadProviderConfig(path string) (*ProviderConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read provider config file %q", path)
+	}
+	config := &ProviderConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshal provider config file %q", path)
+	}
+	if err := validateProviderConfig(config); err != nil {
+		return nil, errors.Wrapf(err, "invalid provider config file %q", path)
+	}
+	return config, nil
+}
+
+// validateProviderConfig validates the given provider config.
+func validateProviderConfig(config *ProviderConfig) error {
+	switch config.DefaultDiskBus {
+	case "", api.DiskBusVirtio, api.DiskBusSATA, api.DiskBusSCSI:
+	default:
+		return errors.Errorf("unsupported default disk bus %q, must be one of %s, %s, %s", config.DefaultDiskBus, api.DiskBusVirtio, api.DiskBusSATA, api.DiskBusSCSI)
+	}
+	if config.DefaultStorageClassName != "" && len(config.AllowedStorageClassNames) > 0 &&
+		!sets.NewString(config.AllowedStorageClassNames...).Has(config.DefaultStorageClassName) {
+		return errors.Errorf("default storage class %q is not in the allowed storage classes", config.DefaultStorageClassName)
+	}
+	if errs := apivalidation.ValidateAnnotations(config.DefaultAnnotations, field.NewPath("defaultAnnotations")); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	if errs := apivalidation.ValidateAnnotations(config.DefaultVMIAnnotations, field.NewPath("defaultVMIAnnotations")); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	if errs := metav1validation.ValidateLabels(config.DefaultTags, field.NewPath("defaultTags")); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	if errs := metav1validation.ValidateLabels(config.EnforcedTags, field.NewPath("enforcedTags")); len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+	for key := range config.EnforcedTags {
+		if _, ok := config.DefaultTags[key]; ok {
+			return errors.Errorf("tag %q cannot be both a default and an enforced tag", key)
+		}
+	}
+	for name := range config.Features {
+		if _, ok := features[name]; !ok {
+			return errors.Errorf("unknown feature %q", name)
+		}
+	}
+	return nil
+}
+
+// applyProviderConfig returns a copy of the given provider spec with the defaults of the given provider config applied.
+func applyProviderConfig(providerSpec *api.KubeVirtProviderSpec, config *ProviderConfig) *api.KubeVirtProviderSpec {
+	spec := *providerSpec
+
+	if spec.RootVolume.PersistentVolumeClaim == nil {
+		spec.RootVolume.DataVolumeSpec = *applyDataVolumeDefaults(&spec.RootVolume.DataVolumeSpec, config)
+	}
+	if config.DefaultDiskBus != "" && (spec.RootDisk == nil || spec.RootDisk.Bus == "") {
+		rootDisk := api.DiskOptions{}
+		if spec.RootDisk != nil {
+			rootDisk = *spec.RootDisk
+		}
+		rootDisk.Bus = config.DefaultDiskBus
+		spec.RootDisk = &rootDisk
+	}
+
+	if len(config.DefaultTags) > 0 || len(config.EnforcedTags) > 0 {
+		spec.Tags = mergeStringMaps(config.DefaultTags, providerSpec.Tags, config.EnforcedTags)
+	}
+	if len(config.DefaultAnnotations) > 0 {
+		spec.Annotations = mergeStringMaps(config.DefaultAnnotations, providerSpec.Annotations)
+	}
+	if len(config.DefaultVMIAnnotations) > 0 {
+		spec.VMIAnnotations = mergeStringMaps(config.DefaultVMIAnnotations, providerSpec.VMIAnnotations)
+	}
+
+	spec.AdditionalVolumes = append([]api.AdditionalVolumeSpec(nil), providerSpec.AdditionalVolumes...)
+	for i := range spec.AdditionalVolumes {
+		volume := &spec.AdditionalVolumes[i]
+		if volume.DataVolume != nil {
+			volume.DataVolume = applyDataVolumeDefaults(volume.DataVolume, config)
+		}
+		if config.DefaultDiskBus != "" && volume.Bus == "" && !volume.Hotpluggable {
+			volume.Bus = config.DefaultDiskBus
+		}
+	}
+
+	return &spec
+}
+
+// applyDataVolumeDefaults returns the given data volume spec, or a copy of it with the default storage class
+// and the image registry mirrors of the given provider config applied, if any of them apply.
+func applyDataVolumeDefaults(dataVolumeSpec *cdicorev1alpha1.DataVolumeSpec, config *ProviderConfig) *cdicorev1alpha1.DataVolumeSpec {
+	pvc := dataVolumeSpec.PVC
+	setStorageClass := config.DefaultStorageClassName != "" && pvc != nil && (pvc.StorageClassName == nil || *pvc.StorageClassName == "")
+	var mirrorURL string
+	if registry := dataVolumeSpec.Source.Registry; registry != nil {
+		mirrorURL = getMirrorURL(registry.URL, config.ImageRegistryMirrors)
+	}
+	if !setStorageClass && mirrorURL == "" {
+		return dataVolumeSpec
+	}
+
+	spec := dataVolumeSpec.DeepCopy()
+	if setStorageClass {
+		storageClassName := config.DefaultStorageClassName
+		spec.PVC.StorageClassName = &storageClassName
+	}
+	if mirrorURL != "" {
+		spec.Source.Registry.URL = mirrorURL
+	}
+	return spec
+}
+
+// getMirrorURL returns the given "docker://" registry URL with its host replaced by the host of its mirror
+// according to the given image registry mirrors, or an empty string if the host has no mirror.
+func getMirrorURL(url string, mirrors map[string]string) string {
+	const scheme = "docker://"
+	if !strings.HasPrefix(url, scheme) {
+		return ""
+	}
+	image := strings.TrimPrefix(url, scheme)
+	parts := strings.SplitN(image, "/", 2)
+	mirror, ok := mirrors[parts[0]]
+	if !ok || len(parts) < 2 {
+		return ""
+	}
+	return scheme + mirror + "/" + parts[1]
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ResizePolicyNone means that existing VMs are not resized when the resources of their machine class change.
+	ResizePolicyNone = "None"
+	// ResizePolicyApply means that the templates of existing VMs are updated when the resources of their machine class change,
+	// so that the new resources take effect the next time the VMs are restarted.
+	ResizePolicyApply = "Apply"
+	// ResizePolicyRestart means that the templates of existing VMs are updated when the resources of their machine class change,
+	// and that the VMs are then restarted one at a time, so that the new resources take effect without replacing the machines.
+	ResizePolicyRestart = "Restart"
+)
+
+// resizeVMs updates the templates of the given kubevirt virtual machines in the given namespace whose CPU or memory resources
+// differ from the given provider spec. If ResizePolicy is Restart, it then restarts at most one of the given kubevirt virtual machines
+// whose running virtual machine instance still has the old resources, and only if all of them are ready, so that the resize
+// rolls through the machine class one machine at a time. Failures are logged and otherwise ignored, since they must not fail
+// the other maintenance tasks, and are retried the next time.
+func (p PluginSPIImpl) resizeVMs(ctx context.Context, c client.Client, r client.Reader, namespace string, virtualMachines []*kubevirtv1.VirtualMachine, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) {
+	allReady := true
+	for _, virtualMachine := range virtualMachines {
+		if !virtualMachine.Status.Ready {
+			allReady = false
+		}
+	}
+
+	restarted := false
+	for _, virtualMachine := range virtualMachines {
+		keysAndValues := []interface{}{logging.KeyMachine, virtualMachine.Name, logging.KeyNamespace, namespace, logging.KeyOperation, "MaintainMachines"}
+
+		desiredVirtualMachine, err := p.buildDesiredVM(virtualMachine, providerSpec, secret)
+		if err != nil {
+			logging.WarningS(err, "Could not build desired VirtualMachine for resizing", keysAndValues...)
+			continue
+		}
+		if !hasSameResources(&virtualMachine.Spec.Template.Spec.Domain, &desiredVirtualMachine.Spec.Template.Spec.Domain) {
+			logging.InfoS(2, "Resizing VirtualMachine", keysAndValues...)
+			if err := patchVM(ctx, c, desiredVirtualMachine); err != nil {
+				logging.WarningS(err, "Could not resize VirtualMachine", keysAndValues...)
+				continue
+			}
+		}
+
+		if p.options.ResizePolicy != ResizePolicyRestart || restarted || !allReady {
+			continue
+		}
+		virtualMachineInstance, err := p.getVMI(ctx, r, virtualMachine.Name, namespace)
+		if err != nil {
+			logging.WarningS(err, "Could not check whether VirtualMachine needs a restart to be resized", keysAndValues...)
+			continue
+		}
+		if virtualMachineInstance == nil || hasSameResources(&virtualMachineInstance.Spec.Domain, &desiredVirtualMachine.Spec.Template.Spec.Domain) {
+			continue
+		}
+		logging.InfoS(2, "Restarting VirtualMachine to apply its new resources", keysAndValues...)
+		if err := p.sc.RestartVirtualMachine(ctx, secret, namespace, virtualMachine.Name); err != nil {
+			logging.WarningS(err, "Could not restart VirtualMachine", keysAndValues...)
+			continue
+		}
+		restarted = true
+	}
+}
+
+// hasSameResources returns true if the given domain specs have the same CPU topology, guest memory,
+// and CPU and memory requests and limits, false otherwise.
+func hasSameResources(domain, desiredDomain *kubevirtv1.DomainSpec) bool {
+	return hasSameCPUTopology(domain.CPU, desiredDomain.CPU) &&
+		hasSameGuestMemory(domain.Memory, desiredDomain.Memory) &&
+		hasSameQuantities(domain.Resources.Requests, desiredDomain.Resources.Requests) &&
+		hasSameQuantities(domain.Resources.Limits, desiredDomain.Resources.Limits)
+}
+
+// hasSameCPUTopology returns true if the given CPUs have the same number of cores, sockets, and threads, false otherwise.
+// A nil CPU has no explicit topology.
+func hasSameCPUTopology(cpu, desiredCPU *kubevirtv1.CPU) bool {
+	topology := func(cpu *kubevirtv1.CPU) [3]uint32 {
+		if cpu == nil {
+			return [3]uint32{}
+		}
+		return [3]uint32{cpu.Cores, cpu.Sockets, cpu.Threads}
+	}
+	return topology(cpu) == topology(desiredCPU)
+}
+
+// hasSameGuestMemory returns true if the given memories have the same guest memory, false otherwise.
+func hasSameGuestMemory(memory, desiredMemory *kubevirtv1.Memory) bool {
+	guest := func(memory *kubevirtv1.Memory) *resource.Quantity {
+		if memory == nil {
+			return nil
+		}
+		return memory.Guest
+	}
+	quantity, desiredQuantity := guest(memory), guest(desiredMemory)
+	if quantity == nil || desiredQuantity == nil {
+		return quantity == nil && desiredQuantity == nil
+	}
+	return quantity.Cmp(*desiredQuantity) == 0
+}
+
+// hasSameQuantities returns true if the CPU and memory quantities of the given resource lists are equal, false otherwise.
+func hasSameQuantities(resources, desiredResources corev1.ResourceList) bool {
+	for _, name := range capacityResources {
+		quantity, ok := resources[name]
+		desiredQuantity, desiredOK := desiredResources[name]
+		if ok != desiredOK || (ok && quantity.Cmp(desiredQuantity) != 0) {
+			return false
+		}
+	}
+	return true
+}
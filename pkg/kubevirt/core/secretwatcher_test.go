@@ -0,0 +1,95 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var _ = Describe("WatchSecrets", func() {
+	var (
+		server  *fakeAPIServer
+		now     time.Time
+		options *ClientFactoryOptions
+		f       *CachingClientFactory
+		secret  *corev1.Secret
+		watcher *watch.FakeWatcher
+		stopCh  chan struct{}
+	)
+
+	BeforeEach(func() {
+		server = newFakeAPIServer("v1.18.6")
+		now = time.Now()
+		options = NewClientFactoryOptions()
+		f = NewCachingClientFactory(TimerFunc(func() time.Time { return now }), options)
+		secret = newKubeconfigSecret("secret-1", server.URL, "token")
+		watcher = watch.NewFake()
+		stopCh = make(chan struct{})
+
+		clientset := fake.NewSimpleClientset(secret)
+		clientset.PrependWatchReactor("secrets", k8stesting.DefaultWatchReactor(watcher, nil))
+		WatchSecrets(clientset, namespace, f, stopCh)
+
+		_, _, err := f.GetClient(secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.CheckConnectivity()).To(BeEmpty())
+		Expect(server.getLastToken()).To(Equal("token"))
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+		server.close()
+	})
+
+	It("should rebuild the cached client if the kubeconfig in the secret is rotated", func() {
+		watcher.Modify(newKubeconfigSecret("secret-1", server.URL, "rotated"))
+
+		Eventually(func() string {
+			f.CheckConnectivity()
+			return server.getLastToken()
+		}).Should(Equal("rotated"))
+	})
+
+	It("should invalidate the cached clients of zones the secret no longer contains a kubeconfig for", func() {
+		_, _, err := f.GetClient(newKubeconfigSecret("secret-1/zone-a", server.URL, "token"))
+		Expect(err).NotTo(HaveOccurred())
+		server.setStatus(http.StatusUnauthorized)
+		Expect(f.CheckConnectivity()).To(HaveKey(namespace + "/secret-1/zone-a"))
+
+		watcher.Modify(newKubeconfigSecret("secret-1", server.URL, "token"))
+
+		Eventually(f.CheckConnectivity).ShouldNot(HaveKey(namespace + "/secret-1/zone-a"))
+	})
+
+	It("should invalidate the cached client if the secret is deleted", func() {
+		server.setStatus(http.StatusUnauthorized)
+		now = now.Add(options.ConnectivityCheckTTL)
+		Expect(f.CheckConnectivity()).To(HaveKey(namespace + "/secret-1"))
+
+		watcher.Delete(secret)
+
+		Eventually(f.CheckConnectivity).Should(BeEmpty())
+	})
+})
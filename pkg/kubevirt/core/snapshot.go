@@ -0,0 +1,146 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// snapshotLabel is the label of the VM snapshots taken on machine deletion.
+	snapshotLabel = "kubevirt.io/machine-snapshot"
+	// snapshotExpirationAnnotation is the annotation containing the time after which a VM snapshot taken on machine deletion is deleted.
+	snapshotExpirationAnnotation = "kubevirt.io/snapshot-expiration"
+)
+
+// snapshotGroupVersion is the kubevirt snapshot GroupVersion. Since the snapshot types are not part of the kubevirt API
+// package, VM snapshots are represented by unstructured objects.
+var snapshotGroupVersion = schema.GroupVersion{Group: "snapshot.kubevirt.io", Version: "v1alpha1"}
+
+// snapshotVM ensures that a snapshot of the given kubevirt virtual machine, including all its volumes, exists,
+// creating it if needed, and waits for up to DeletionWaitTimeout until it's ready to use.
+// The snapshot is labeled with the labels of the kubevirt virtual machine and expires SnapshotTTL after the given time.
+// If it's not ready to use in time, a DeletionInProgressError is returned.
+func (p PluginSPIImpl) snapshotVM(ctx context.Context, c client.Client, virtualMachine *kubevirtv1.VirtualMachine, now time.Time) error {
+	name := getSnapshotName(virtualMachine)
+
+	// Create the snapshot, unless a previous attempt already did so
+	if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: name}, newSnapshot(virtualMachine.Namespace, name)); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "could not get VirtualMachineSnapshot %q", name)
+		}
+		logging.InfoS(2, "Creating VirtualMachineSnapshot", logging.KeyMachine, virtualMachine.Name, logging.KeyNamespace, virtualMachine.Namespace,
+			logging.KeyOperation, "DeleteMachine", "snapshot", name)
+		snapshot := newSnapshot(virtualMachine.Namespace, name)
+		snapshot.SetLabels(getSnapshotLabels(virtualMachine))
+		snapshot.SetAnnotations(map[string]string{snapshotExpirationAnnotation: now.Add(p.options.SnapshotTTL).UTC().Format(time.RFC3339)})
+		if err := unstructured.SetNestedStringMap(snapshot.Object, map[string]string{
+			"apiGroup": kubevirtv1.GroupVersion.Group,
+			"kind":     "VirtualMachine",
+			"name":     virtualMachine.Name,
+		}, "spec", "source"); err != nil {
+			return errors.Wrapf(err, "could not build VirtualMachineSnapshot %q", name)
+		}
+		if err := c.Create(ctx, snapshot); err != nil && !apierrors.IsAlreadyExists(err) {
+			return wrapCreateError(err, "could not create VirtualMachineSnapshot %q", name)
+		}
+	}
+
+	// Wait until the snapshot is ready to use
+	return waitForDeletion(ctx, virtualMachine.Name, p.options.DeletionWaitTimeout, func() (bool, error) {
+		snapshot := newSnapshot(virtualMachine.Namespace, name)
+		if err := c.Get(ctx, types.NamespacedName{Namespace: virtualMachine.Namespace, Name: name}, snapshot); err != nil {
+			return false, errors.Wrapf(err, "could not get VirtualMachineSnapshot %q", name)
+		}
+		if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); ready {
+			return true, nil
+		}
+		if message, _, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); message != "" {
+			logging.InfoS(2, "VirtualMachineSnapshot failed, waiting for it to be retried", logging.KeyMachine, virtualMachine.Name,
+				logging.KeyNamespace, virtualMachine.Namespace, logging.KeyOperation, "DeleteMachine", "snapshot", name, "error", message)
+		} else {
+			logging.InfoS(2, "Waiting for VirtualMachineSnapshot to be ready", logging.KeyMachine, virtualMachine.Name,
+				logging.KeyNamespace, virtualMachine.Namespace, logging.KeyOperation, "DeleteMachine", "snapshot", name)
+		}
+		return false, nil
+	})
+}
+
+// deleteExpiredSnapshots deletes the VM snapshots taken on machine deletion in the given namespace that have expired
+// at the given time. If the kubevirt snapshot API is not served by the provider cluster, it does nothing.
+func deleteExpiredSnapshots(ctx context.Context, c client.Client, namespace string, now time.Time) error {
+	snapshotList := &unstructured.UnstructuredList{}
+	snapshotList.SetGroupVersionKind(snapshotGroupVersion.WithKind("VirtualMachineSnapshotList"))
+	if err := c.List(ctx, snapshotList, client.InNamespace(namespace), client.MatchingLabels{snapshotLabel: "true"}); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "could not list VirtualMachineSnapshots in namespace %q", namespace)
+	}
+	for i := range snapshotList.Items {
+		snapshot := &snapshotList.Items[i]
+		expiration, err := time.Parse(time.RFC3339, snapshot.GetAnnotations()[snapshotExpirationAnnotation])
+		if err != nil || now.Before(expiration) {
+			continue
+		}
+		logging.InfoS(2, "Deleting expired VirtualMachineSnapshot", logging.KeyNamespace, namespace, "snapshot", snapshot.GetName())
+		if err := client.IgnoreNotFound(c.Delete(ctx, snapshot)); err != nil {
+			return errors.Wrapf(err, "could not delete VirtualMachineSnapshot %q", snapshot.GetName())
+		}
+	}
+	return nil
+}
+
+// newSnapshot returns an unstructured VM snapshot with the given namespace and name.
+func newSnapshot(namespace, name string) *unstructured.Unstructured {
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(snapshotGroupVersion.WithKind("VirtualMachineSnapshot"))
+	snapshot.SetNamespace(namespace)
+	snapshot.SetName(name)
+	return snapshot
+}
+
+// getSnapshotName returns the name of the snapshot taken when deleting the given kubevirt virtual machine.
+// It's derived from the UID of the kubevirt virtual machine, so that retried deletions reuse the same snapshot,
+// while a machine with the same name that is created and deleted later gets a new one.
+func getSnapshotName(virtualMachine *kubevirtv1.VirtualMachine) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(virtualMachine.UID)))[:nameHashLength]
+	return buildChildName("", virtualMachine.Name, "-"+hash)
+}
+
+// getSnapshotLabels returns the labels of the snapshot of the given kubevirt virtual machine,
+// i.e. the labels of the kubevirt virtual machine, including its machine name, zone, and machine class, and snapshotLabel.
+func getSnapshotLabels(virtualMachine *kubevirtv1.VirtualMachine) map[string]string {
+	labels := make(map[string]string, len(virtualMachine.Labels)+1)
+	for k, v := range virtualMachine.Labels {
+		labels[k] = v
+	}
+	labels[snapshotLabel] = "true"
+	return labels
+}
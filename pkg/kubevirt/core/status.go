@@ -0,0 +1,261 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+// MachineStatus is the status of a machine, as determined from its kubevirt virtual machine and virtual machine instance.
+type MachineStatus struct {
+	// ProviderID is the provider id of the machine.
+	ProviderID string
+	// NodeName is the name of the node the machine registers with, i.e. the hostname of the virtual machine instance.
+	NodeName string
+	// HostNodeName is the name of the provider cluster node the virtual machine instance is running on.
+	HostNodeName string
+	// Phase is the phase of the virtual machine instance, empty if no virtual machine instance exists.
+	Phase kubevirtv1.VirtualMachineInstancePhase
+	// Ready is whether the virtual machine is running and ready.
+	Ready bool
+	// Addresses are the IP addresses of the network interfaces of the virtual machine instance.
+	Addresses []string
+	// DataVolumes are the statuses of the data volumes of the virtual machine that are still being populated,
+	// only set if no virtual machine instance exists yet.
+	DataVolumes []DataVolumeStatus
+	// Problem is the problem reported in the status of the virtual machine or virtual machine instance, e.g. that
+	// the VM pod is unschedulable, nil if there is none. It's not returned as an error, since the machine controller
+	// would then neither drain nor delete the machine.
+	Problem *MachineStatusError
+	// LabelsUpdated is whether the labels of the virtual machine have been updated from the tags of the provider spec.
+	LabelsUpdated bool
+}
+
+// DataVolumeStatus is the status of a data volume of a machine that is still being populated, e.g. by importing an image.
+type DataVolumeStatus struct {
+	// Name is the name of the data volume.
+	Name string
+	// Phase is the phase of the data volume.
+	Phase cdicorev1alpha1.DataVolumePhase
+	// Progress is the progress of the data volume population, e.g. "42.00%".
+	Progress cdicorev1alpha1.DataVolumeProgress
+}
+
+// BootStage is the boot stage of the kubevirt virtual machine of a machine.
+type BootStage string
+
+const (
+	// BootStageImportingImage means that the data volumes of the VM are still being populated, e.g. by importing an image.
+	BootStageImportingImage BootStage = "ImportingImage"
+	// BootStageStarting means that the data volumes of the VM are ready, but its VMI has not been created yet.
+	BootStageStarting BootStage = "Starting"
+	// BootStageScheduling means that the VM pod has not been scheduled yet.
+	BootStageScheduling BootStage = "Scheduling"
+	// BootStageScheduled means that the VM pod has been scheduled, but the VM is not running yet.
+	BootStageScheduled BootStage = "Scheduled"
+	// BootStageRunning means that the VM is running, but its guest agent has not connected yet.
+	BootStageRunning BootStage = "Running"
+	// BootStageGuestAgentConnected means that the VM is running and its guest agent has connected.
+	BootStageGuestAgentConnected BootStage = "GuestAgentConnected"
+)
+
+const (
+	// reasonUnschedulable is the reason of the PodScheduled condition if the VM pod is unschedulable.
+	reasonUnschedulable = "Unschedulable"
+	// conditionPodScheduled is the PodScheduled condition type that is copied from the VM pod to the VMI.
+	conditionPodScheduled kubevirtv1.VirtualMachineInstanceConditionType = "PodScheduled"
+)
+
+// imagePullReasons are the condition reasons indicating that an image could not be pulled.
+var imagePullReasons = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+	"InvalidImageName": true,
+}
+
+// buildMachineStatus builds the status of the machine with the given name from the given virtual machine and virtual machine instance.
+// The virtual machine instance may be nil if it doesn't exist, e.g. because the virtual machine is stopped.
+// If the status indicates that the machine is unschedulable, has failed, or is unhealthy, the problem is set in the returned status.
+func buildMachineStatus(machineName string, vm *kubevirtv1.VirtualMachine, vmi *kubevirtv1.VirtualMachineInstance) *MachineStatus {
+	status := &MachineStatus{
+		ProviderID: encodeProviderID(vm.Name),
+		NodeName:   machineName,
+		Ready:      vm.Status.Ready,
+	}
+	setProblem := func(problem *MachineStatusError) {
+		if status.Problem == nil {
+			status.Problem = problem
+		}
+	}
+
+	// Check the VM conditions for failures
+	for _, condition := range vm.Status.Conditions {
+		if condition.Type == kubevirtv1.VirtualMachineFailure && condition.Status == corev1.ConditionTrue {
+			setProblem(newMachineStatusError(machineName, condition.Reason, condition.Message))
+		}
+	}
+
+	if vmi == nil {
+		return status
+	}
+
+	if vmi.Spec.Hostname != "" {
+		status.NodeName = vmi.Spec.Hostname
+	}
+	status.HostNodeName = vmi.Status.NodeName
+	status.Phase = vmi.Status.Phase
+	status.Addresses = getAddresses(vmi)
+
+	// Check the VMI conditions for scheduling and image pull failures
+	for _, condition := range vmi.Status.Conditions {
+		if condition.Status != corev1.ConditionFalse {
+			continue
+		}
+		if (condition.Type == conditionPodScheduled && condition.Reason == reasonUnschedulable) || imagePullReasons[condition.Reason] {
+			setProblem(newMachineStatusError(machineName, condition.Reason, condition.Message))
+		}
+	}
+
+	switch vmi.Status.Phase {
+	case kubevirtv1.Failed:
+		setProblem(&MachineStatusError{Name: machineName, Reason: MachineStatusReasonFailed, Message: vmi.Status.Reason})
+	case kubevirtv1.Unknown:
+		setProblem(&MachineStatusError{Name: machineName, Reason: MachineStatusReasonUnknown, Message: vmi.Status.Reason})
+	case kubevirtv1.Running:
+		if condition := getReadinessProbeFailure(vmi); condition != nil {
+			setProblem(&MachineStatusError{Name: machineName, Reason: MachineStatusReasonUnhealthy, Message: condition.Message})
+		}
+	}
+
+	return status
+}
+
+// getBootProgress returns the boot stage of a virtual machine with the given virtual machine instance and statuses
+// of the data volumes that are still being populated, and a human readable message describing its progress.
+// The virtual machine instance may be nil if it doesn't exist yet.
+func getBootProgress(vmi *kubevirtv1.VirtualMachineInstance, dataVolumes []DataVolumeStatus) (BootStage, string) {
+	if vmi == nil {
+		if len(dataVolumes) > 0 {
+			dataVolume := dataVolumes[0]
+			progress := string(dataVolume.Progress)
+			if progress == "" || progress == "N/A" {
+				progress = string(dataVolume.Phase)
+			}
+			return BootStageImportingImage, fmt.Sprintf("waiting for image import of DataVolume %q: %s", dataVolume.Name, progress)
+		}
+		return BootStageStarting, "waiting for the VirtualMachineInstance to be created"
+	}
+
+	switch vmi.Status.Phase {
+	case kubevirtv1.Scheduled:
+		return BootStageScheduled, fmt.Sprintf("waiting for the VM to start on node %q", vmi.Status.NodeName)
+	case kubevirtv1.Running:
+		for _, condition := range vmi.Status.Conditions {
+			if condition.Type == kubevirtv1.VirtualMachineInstanceAgentConnected && condition.Status == corev1.ConditionTrue {
+				return BootStageGuestAgentConnected, "guest agent connected"
+			}
+		}
+		return BootStageRunning, "waiting for the guest agent to connect"
+	default:
+		return BootStageScheduling, "waiting for the VM pod to be scheduled"
+	}
+}
+
+// getDataVolumeStatuses returns the statuses of the given data volumes that have not succeeded yet.
+func getDataVolumeStatuses(dataVolumes []cdicorev1alpha1.DataVolume) []DataVolumeStatus {
+	var statuses []DataVolumeStatus
+	for _, dataVolume := range dataVolumes {
+		if dataVolume.Status.Phase == cdicorev1alpha1.Succeeded {
+			continue
+		}
+		statuses = append(statuses, DataVolumeStatus{
+			Name:     dataVolume.Name,
+			Phase:    dataVolume.Status.Phase,
+			Progress: dataVolume.Status.Progress,
+		})
+	}
+	return statuses
+}
+
+// getAddresses returns the unique IP addresses of the network interfaces of the given virtual machine instance.
+func getAddresses(vmi *kubevirtv1.VirtualMachineInstance) []string {
+	var addresses []string
+	found := sets.NewString()
+	for _, iface := range vmi.Status.Interfaces {
+		ips := iface.IPs
+		if len(ips) == 0 && iface.IP != "" {
+			ips = []string{iface.IP}
+		}
+		for _, ip := range ips {
+			if !found.Has(ip) {
+				found.Insert(ip)
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+	return addresses
+}
+
+// getReadinessProbeFailure returns the Ready condition of the given virtual machine instance if it has a readiness probe
+// that has failed after the virtual machine instance has become ready, nil otherwise.
+// Since a readiness probe is not expected to succeed before the guest has booted, the Ready condition only indicates
+// a failure if it has become false later than the earliest time the readiness probe could have succeeded and then failed.
+func getReadinessProbeFailure(vmi *kubevirtv1.VirtualMachineInstance) *kubevirtv1.VirtualMachineInstanceCondition {
+	probe := vmi.Spec.ReadinessProbe
+	if probe == nil {
+		return nil
+	}
+	for i, condition := range vmi.Status.Conditions {
+		if condition.Type != kubevirtv1.VirtualMachineInstanceReady || condition.Status != corev1.ConditionFalse {
+			continue
+		}
+		if condition.LastTransitionTime.Time.After(vmi.CreationTimestamp.Add(getProbeFailureDelay(probe))) {
+			return &vmi.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// getProbeFailureDelay returns the minimum delay after which the given probe can fail, i.e. its initial delay
+// plus the time needed for its failure threshold to be reached, using the Kubernetes probe defaults.
+func getProbeFailureDelay(probe *kubevirtv1.Probe) time.Duration {
+	periodSeconds, failureThreshold := probe.PeriodSeconds, probe.FailureThreshold
+	if periodSeconds <= 0 {
+		periodSeconds = 10
+	}
+	if failureThreshold <= 0 {
+		failureThreshold = 3
+	}
+	return time.Duration(probe.InitialDelaySeconds+periodSeconds*failureThreshold) * time.Second
+}
+
+func newMachineStatusError(machineName, reason, message string) *MachineStatusError {
+	switch {
+	case reason == reasonUnschedulable:
+		return &MachineStatusError{Name: machineName, Reason: MachineStatusReasonUnschedulable, Message: message}
+	case imagePullReasons[reason]:
+		return &MachineStatusError{Name: machineName, Reason: MachineStatusReasonImagePullFailed, Message: message}
+	case isQuotaExceededMessage(message):
+		return &MachineStatusError{Name: machineName, Reason: MachineStatusReasonQuotaExceeded, Message: message}
+	default:
+		return &MachineStatusError{Name: machineName, Reason: MachineStatusReasonFailed, Message: message}
+	}
+}
@@ -15,54 +15,59 @@
 package core
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strings"
+	"text/template"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/userdata"
 
 	"github.com/Masterminds/semver"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/utils/pointer"
 	kubevirtv1 "kubevirt.io/client-go/api/v1"
 	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// GetClient creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret.
-// It also returns the namespace of the kubeconfig's current context.
+// GetClient creates a client from the kubeconfig saved in the "kubeconfig" field of the given secret,
+// or from the in-cluster service account credentials if the in-cluster mode is enabled for the given secret.
+// It also returns the namespace of the kubeconfig's current context, or the namespace of the service account.
+// The client is created with the default ClientFactoryOptions.
 func GetClient(secret *corev1.Secret) (client.Client, string, error) {
-	clientConfig, err := getClientConfig(secret)
+	config, namespace, err := getRESTConfig(secret, NewClientFactoryOptions())
 	if err != nil {
 		return nil, "", err
 	}
-	config, err := clientConfig.ClientConfig()
-	if err != nil {
-		return nil, "", errors.Wrap(err, "could not get REST config from client config")
-	}
 	c, err := client.New(config, client.Options{})
 	if err != nil {
 		return nil, "", errors.Wrap(err, "could not create client from REST config")
 	}
-	namespace, _, err := clientConfig.Namespace()
-	if err != nil {
-		return nil, "", errors.Wrap(err, "could not get namespace from client config")
-	}
 	return c, namespace, nil
 }
 
-// GetServerVersion gets the server version from the kubeconfig saved in the "kubeconfig" field of the given secret.
+// GetServerVersion gets the server version from the kubeconfig saved in the "kubeconfig" field of the given secret,
+// or from the in-cluster service account credentials if the in-cluster mode is enabled for the given secret.
+// The clientset is created with the default ClientFactoryOptions.
 func GetServerVersion(secret *corev1.Secret) (string, error) {
-	clientConfig, err := getClientConfig(secret)
+	config, _, err := getRESTConfig(secret, NewClientFactoryOptions())
 	if err != nil {
 		return "", err
 	}
-	config, err := clientConfig.ClientConfig()
-	if err != nil {
-		return "", errors.Wrap(err, "could not get REST config from client config")
-	}
 	cs, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return "", errors.Wrap(err, "could not create clientset from REST config")
@@ -74,6 +79,92 @@ func GetServerVersion(secret *corev1.Secret) (string, error) {
 	return versionInfo.GitVersion, nil
 }
 
+// IsInCluster returns true if the in-cluster mode is enabled for the given secret, i.e. if its "inCluster" field is "true",
+// or if the given default is true and the secret doesn't contain a kubeconfig.
+func IsInCluster(secret *corev1.Secret, inClusterDefault bool) bool {
+	if inCluster, ok := secret.Data[InClusterField]; ok {
+		return string(inCluster) == "true"
+	}
+	return inClusterDefault && len(secret.Data["kubeconfig"]) == 0
+}
+
+// getZoneSecret returns the secret for accessing the provider cluster of the given zone.
+// If the given secret contains a kubeconfig for the given zone, the result is a copy of it using that kubeconfig.
+// Otherwise, the given secret is returned unchanged.
+func getZoneSecret(secret *corev1.Secret, zone string) *corev1.Secret {
+	kubeconfig, ok := secret.Data[ZoneKubeconfigFieldPrefix+zone]
+	if zone == "" || !ok {
+		return secret
+	}
+	return buildZoneSecret(secret, zone, kubeconfig)
+}
+
+// getClusterSecrets returns the secrets for accessing all provider clusters of the given secret, i.e. the default
+// provider cluster, if any, as well as the provider clusters of all zones the given secret contains a kubeconfig for.
+// If the given secret contains no kubeconfigs and the in-cluster mode is not enabled for it, see IsInCluster, it is returned unchanged.
+func getClusterSecrets(secret *corev1.Secret, inClusterDefault bool) []*corev1.Secret {
+	var secrets []*corev1.Secret
+	if IsInCluster(secret, inClusterDefault) || len(secret.Data["kubeconfig"]) > 0 {
+		secrets = append(secrets, secret)
+	}
+	for _, key := range sets.StringKeySet(secret.Data).List() {
+		if zone := strings.TrimPrefix(key, ZoneKubeconfigFieldPrefix); zone != key && zone != "" {
+			secrets = append(secrets, buildZoneSecret(secret, zone, secret.Data[key]))
+		}
+	}
+	if len(secrets) == 0 {
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+// buildZoneSecret builds a copy of the given secret that uses the given kubeconfig of the provider cluster of the given zone.
+// The name of the copy is unique per zone, so that clients cached per secret are not shared across zones.
+func buildZoneSecret(secret *corev1.Secret, zone string, kubeconfig []byte) *corev1.Secret {
+	zoneSecret := secret.DeepCopy()
+	zoneSecret.Name = secret.Name + "/" + zone
+	zoneSecret.Data["kubeconfig"] = kubeconfig
+	delete(zoneSecret.Data, InClusterField)
+	return zoneSecret
+}
+
+func getRESTConfig(secret *corev1.Secret, options *ClientFactoryOptions) (*rest.Config, string, error) {
+	if IsInCluster(secret, options.InCluster) {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, "", errors.Wrap(err, "could not get in-cluster REST config")
+		}
+		namespace, err := getInClusterNamespace()
+		if err != nil {
+			return nil, "", err
+		}
+		setClientOptions(config, options)
+		return config, namespace, nil
+	}
+
+	clientConfig, err := getClientConfig(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not get REST config from client config")
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not get namespace from client config")
+	}
+	setClientOptions(config, options)
+	return config, namespace, nil
+}
+
+// setClientOptions sets the rate limits of the given options and the user agent of the given REST config.
+func setClientOptions(config *rest.Config, options *ClientFactoryOptions) {
+	config.QPS = options.QPS
+	config.Burst = options.Burst
+	config.UserAgent = UserAgent
+}
+
 func getClientConfig(secret *corev1.Secret) (clientcmd.ClientConfig, error) {
 	kubeconfig, ok := secret.Data["kubeconfig"]
 	if !ok {
@@ -86,6 +177,210 @@ func getClientConfig(secret *corev1.Secret) (clientcmd.ClientConfig, error) {
 	return clientConfig, nil
 }
 
+// getInClusterNamespace returns the namespace specified by the POD_NAMESPACE environment variable,
+// or the namespace of the service account the provider is running as.
+func getInClusterNamespace() (string, error) {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace, nil
+	}
+	data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read service account namespace")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// wrapCreateError wraps the given error returned when creating an object.
+// If the error indicates exhausted provider cluster resources, the result is a ResourceExhaustedError.
+func wrapCreateError(err error, format string, args ...interface{}) error {
+	wrapped := errors.Wrapf(err, format, args...)
+	if isResourceExhaustedAPIError(err) {
+		return &ResourceExhaustedError{Err: wrapped}
+	}
+	return wrapped
+}
+
+// getVMLabels returns the labels of the VM of the machine with the given name, i.e. the tags of the given provider spec
+// and the machine label, as well as the machine zone label if the given provider spec specifies multiple zones.
+func getVMLabels(machineName string, providerSpec *api.KubeVirtProviderSpec) map[string]string {
+	vmLabels := make(map[string]string, len(providerSpec.Tags)+2)
+	for k, v := range providerSpec.Tags {
+		vmLabels[k] = v
+	}
+	vmLabels[machineLabel] = machineName
+	if len(providerSpec.Zones) > 0 {
+		vmLabels[machineZoneLabel] = getMachineZone(machineName, providerSpec)
+	}
+	return vmLabels
+}
+
+// getMachineZone returns the zone of the machine with the given name. If the given provider spec specifies multiple zones,
+// one of them is chosen by a hash of the machine name, so that the machines are spread evenly across the zones.
+// Since the chosen zone changes if the zones are changed, it's only used for new machines, while the provider spec
+// of an existing machine is pinned to the zone recorded in the label of its VM, see pinMachineZone.
+// Otherwise, the zone of the provider spec is returned.
+func getMachineZone(machineName string, providerSpec *api.KubeVirtProviderSpec) string {
+	if len(providerSpec.Zones) == 0 {
+		return providerSpec.Zone
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(machineName))
+	return providerSpec.Zones[hash.Sum32()%uint32(len(providerSpec.Zones))]
+}
+
+// pinMachineZone returns a copy of the given provider spec whose only zone is the given zone, so that getMachineZone
+// returns the given zone, e.g. the zone recorded in the label of an existing VM. If the given provider spec doesn't specify
+// multiple zones, or the given zone is empty, the given provider spec is returned unchanged.
+func pinMachineZone(providerSpec *api.KubeVirtProviderSpec, zone string) *api.KubeVirtProviderSpec {
+	if len(providerSpec.Zones) == 0 || zone == "" {
+		return providerSpec
+	}
+	pinned := *providerSpec
+	pinned.Zones = []string{zone}
+	return &pinned
+}
+
+// getOwnershipLabels returns the labels identifying the VMs created by this provider for the machine class with the given name.
+// The machine class name is hashed, since it may be longer than a label value.
+func getOwnershipLabels(machineClassName string) map[string]string {
+	hash := sha256.Sum256([]byte(machineClassName))
+	return map[string]string{
+		managedByLabel:    FieldManager,
+		machineClassLabel: hex.EncodeToString(hash[:])[:32],
+	}
+}
+
+// isOwnedBy returns true if the given VM is owned by the machine class with the given name, false otherwise.
+// VMs created before the ownership labels were introduced are owned by the machine class if they have the tags
+// of the given provider spec, with their templates resolved for the VM, as before.
+func isOwnedBy(virtualMachine *kubevirtv1.VirtualMachine, machineClassName string, providerSpec *api.KubeVirtProviderSpec) bool {
+	if _, ok := virtualMachine.Labels[machineClassLabel]; !ok {
+		resolved, errs := ResolveTemplates(providerSpec, NewMachineTemplateData(virtualMachine.Name, providerSpec))
+		return len(errs) == 0 && hasLabels(virtualMachine, resolved.Tags)
+	}
+	return hasLabels(virtualMachine, getOwnershipLabels(machineClassName))
+}
+
+// isSameClusterMachine returns true if the given VM is the VM of a machine of the same cluster as the given provider spec,
+// i.e. if its machine label contains its name and its cluster tag matches the cluster tag of the given provider spec,
+// false otherwise. This is the case even if it's owned by another machine class, e.g. after the machine class was renamed.
+func isSameClusterMachine(virtualMachine *kubevirtv1.VirtualMachine, providerSpec *api.KubeVirtProviderSpec) bool {
+	cluster := providerSpec.Tags[clusterTag]
+	return cluster != "" && virtualMachine.Labels[machineLabel] == virtualMachine.Name && virtualMachine.Labels[clusterTag] == cluster
+}
+
+// getMachineMetadataAnnotations returns the VM annotations recording the given machine metadata.
+// Empty fields of the machine metadata are omitted.
+func getMachineMetadataAnnotations(machineMetadata *MachineMetadata) map[string]string {
+	annotations := make(map[string]string)
+	if machineMetadata == nil {
+		return annotations
+	}
+	for k, v := range map[string]string{
+		machineNamespaceAnnotation:  machineMetadata.Namespace,
+		machineSetAnnotation:        machineMetadata.MachineSet,
+		machineDeploymentAnnotation: machineMetadata.MachineDeployment,
+	} {
+		if v != "" {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// mergeStringMaps returns a new map containing the entries of the given maps, with later maps taking precedence.
+// If all given maps are empty, the result is nil.
+func mergeStringMaps(maps ...map[string]string) map[string]string {
+	var result map[string]string
+	for _, m := range maps {
+		for k, v := range m {
+			if result == nil {
+				result = make(map[string]string)
+			}
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// hasLabels returns true if the given object has all of the given labels, false otherwise.
+func hasLabels(obj metav1.Object, labels map[string]string) bool {
+	objLabels := obj.GetLabels()
+	for k, v := range labels {
+		if value, ok := objLabels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// getUserDataSecretName returns the name of the userdata secret referenced by the given VM, or an empty string.
+func getUserDataSecretName(virtualMachine *kubevirtv1.VirtualMachine) string {
+	if virtualMachine.Spec.Template == nil {
+		return ""
+	}
+	for _, volume := range virtualMachine.Spec.Template.Spec.Volumes {
+		switch {
+		case volume.CloudInitNoCloud != nil && volume.CloudInitNoCloud.UserDataSecretRef != nil:
+			return volume.CloudInitNoCloud.UserDataSecretRef.Name
+		case volume.CloudInitConfigDrive != nil && volume.CloudInitConfigDrive.UserDataSecretRef != nil:
+			return volume.CloudInitConfigDrive.UserDataSecretRef.Name
+		}
+	}
+	return ""
+}
+
+func getNetworkDataSecretName(virtualMachine *kubevirtv1.VirtualMachine) string {
+	if virtualMachine.Spec.Template == nil {
+		return ""
+	}
+	for _, volume := range virtualMachine.Spec.Template.Spec.Volumes {
+		switch {
+		case volume.CloudInitNoCloud != nil && volume.CloudInitNoCloud.NetworkDataSecretRef != nil:
+			return volume.CloudInitNoCloud.NetworkDataSecretRef.Name
+		case volume.CloudInitConfigDrive != nil && volume.CloudInitConfigDrive.NetworkDataSecretRef != nil:
+			return volume.CloudInitConfigDrive.NetworkDataSecretRef.Name
+		}
+	}
+	return ""
+}
+
+// buildSecret builds a secret with the given name, namespace, and data, labeled with the given machine name.
+// It's not owned by the kubevirt virtual machine of the machine yet, since it's created before it, see setSecretOwner.
+func buildSecret(name, namespace, machineName string, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				machineLabel: machineName,
+			},
+		},
+		Data: data,
+	}
+}
+
+// buildDataSecrets builds the userdata secret and, if there is any network data, the networkdata secret with the given names
+// for the machine with the given name. Empty names are skipped.
+func buildDataSecrets(machineName, namespace, userDataSecretName, networkDataSecretName, userData, networkData string, compressUserData *bool) ([]*corev1.Secret, error) {
+	var secrets []*corev1.Secret
+	if userDataSecretName != "" {
+		encodedUserData, err := userdata.Encode(userData, compressUserData)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, buildSecret(userDataSecretName, namespace, machineName, map[string][]byte{
+			"userdata": encodedUserData,
+		}))
+	}
+	if networkDataSecretName != "" {
+		secrets = append(secrets, buildSecret(networkDataSecretName, namespace, machineName, map[string][]byte{
+			"networkdata": []byte(networkData),
+		}))
+	}
+	return secrets, nil
+}
+
 func encodeProviderID(machineName string) string {
 	if machineName == "" {
 		return ""
@@ -93,14 +388,15 @@ func encodeProviderID(machineName string) string {
 	return fmt.Sprintf("%s://%s", ProviderName, machineName)
 }
 
-func buildNetworks(networkSpecs []api.NetworkSpec) ([]kubevirtv1.Interface, []kubevirtv1.Network, string) {
+func buildNetworks(machineName string, networkSpecs []api.NetworkSpec, disablePodNetwork bool) ([]kubevirtv1.Interface, []kubevirtv1.Network, string, error) {
 	// If no network specs, return empty lists
 	if len(networkSpecs) == 0 {
-		return nil, nil, ""
+		return nil, nil, "", nil
 	}
 
 	var interfaces []kubevirtv1.Interface
 	var networks []kubevirtv1.Network
+	var interfaceNetworkSpecs []*api.NetworkSpec
 
 	// Determine whether there is a default network
 	hasDefault := false
@@ -111,8 +407,8 @@ func buildNetworks(networkSpecs []api.NetworkSpec) ([]kubevirtv1.Interface, []ku
 		}
 	}
 
-	// If no default network was specified, append an interface and a network for the pod network.
-	if !hasDefault {
+	// If no default network was specified, append an interface and a network for the pod network, unless it's disabled.
+	if !hasDefault && !disablePodNetwork {
 		// Append an interface and a network for the pod network
 		interfaces = append(interfaces, kubevirtv1.Interface{
 			Name: "default",
@@ -126,98 +422,168 @@ func buildNetworks(networkSpecs []api.NetworkSpec) ([]kubevirtv1.Interface, []ku
 				Pod: &kubevirtv1.PodNetwork{},
 			},
 		})
+		interfaceNetworkSpecs = append(interfaceNetworkSpecs, nil)
 	}
 
 	// Append interfaces and networks for all network specs
-	for i, networkSpec := range networkSpecs {
+	for i := range networkSpecs {
+		networkSpec := &networkSpecs[i]
+
 		// Generate a unique name for this network
 		name := fmt.Sprintf("net%d", i)
 
+		// Use the static MAC address, or generate one with the MAC address prefix, if specified
+		macAddress := networkSpec.MACAddress
+		if networkSpec.MACAddressPrefix != "" {
+			var err error
+			if macAddress, err = generateMACAddress(networkSpec.MACAddressPrefix, machineName, name); err != nil {
+				return nil, nil, "", err
+			}
+		}
+
 		// Append an interface and a network for this network spec
 		interfaces = append(interfaces, kubevirtv1.Interface{
-			Name: name,
-			InterfaceBindingMethod: kubevirtv1.InterfaceBindingMethod{
-				Bridge: &kubevirtv1.InterfaceBridge{},
-			},
+			Name:                   name,
+			Model:                  networkSpec.Model,
+			MacAddress:             macAddress,
+			InterfaceBindingMethod: buildInterfaceBindingMethod(networkSpec.Binding),
+			Ports:                  networkSpec.Ports,
 		})
-		networks = append(networks, kubevirtv1.Network{
-			Name: name,
-			NetworkSource: kubevirtv1.NetworkSource{
-				Multus: &kubevirtv1.MultusNetwork{
-					NetworkName: networkSpec.Name,
-					Default:     networkSpec.Default,
-				},
+		networkSource := kubevirtv1.NetworkSource{
+			Multus: &kubevirtv1.MultusNetwork{
+				NetworkName: networkSpec.Name,
+				Default:     networkSpec.Default,
 			},
+		}
+		if networkSpec.Default && networkSpec.DefaultViaAnnotation {
+			// Multus replaces the pod network with the network in the default network annotation
+			networkSource = kubevirtv1.NetworkSource{
+				Pod: &kubevirtv1.PodNetwork{},
+			}
+		}
+		networks = append(networks, kubevirtv1.Network{
+			Name:          name,
+			NetworkSource: networkSource,
 		})
+		interfaceNetworkSpecs = append(interfaceNetworkSpecs, networkSpec)
+	}
+
+	// If there is no static network configuration, enable DHCP for all ethernet interfaces in networkData
+	if !hasStaticConfig(networkSpecs) {
+		return interfaces, networks, dhcpNetworkData, nil
 	}
 
-	// Enable DHCP for all ethernet interfces in networkData
-	networkData := `version: 2
-ethernets:
-  id0:
-    match:
-      name: "e*"
-    dhcp4: true
-`
+	// Otherwise, configure each ethernet interface in networkData separately, matching it by a stable MAC address
+	var err error
+	data := &networkData{
+		Version:   2,
+		Ethernets: make(map[string]ethernet, len(interfaces)),
+	}
+	for i := range interfaces {
+		if interfaces[i].MacAddress == "" {
+			if interfaces[i].MacAddress, err = generateMACAddress("", machineName, interfaces[i].Name); err != nil {
+				return nil, nil, "", err
+			}
+		}
+		data.Ethernets[interfaces[i].Name] = buildEthernet(interfaces[i].MacAddress, interfaceNetworkSpecs[i])
+	}
+	networkData, err := encodeNetworkData(data)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return interfaces, networks, networkData, nil
+}
+
+// getDefaultNetworkAnnotation returns the name of the default network of the given network specs
+// that is set via the Multus default network annotation, if any.
+func getDefaultNetworkAnnotation(networkSpecs []api.NetworkSpec) string {
+	for _, networkSpec := range networkSpecs {
+		if networkSpec.Default && networkSpec.DefaultViaAnnotation {
+			return networkSpec.Name
+		}
+	}
+	return ""
+}
 
-	return interfaces, networks, networkData
+// buildInterfaceBindingMethod builds the network interface binding method for the given binding.
+func buildInterfaceBindingMethod(binding string) kubevirtv1.InterfaceBindingMethod {
+	if binding == api.InterfaceBindingMasquerade {
+		return kubevirtv1.InterfaceBindingMethod{
+			Masquerade: &kubevirtv1.InterfaceMasquerade{},
+		}
+	}
+	return kubevirtv1.InterfaceBindingMethod{
+		Bridge: &kubevirtv1.InterfaceBridge{},
+	}
 }
 
 func buildVolumes(
-	machineName, namespace, userDataSecretName, networkData string,
-	rootVolume cdicorev1alpha1.DataVolumeSpec,
+	machineName, namespace string,
+	cloudInitVolume *kubevirtv1.Volume,
+	rootVolume api.RootVolumeSpec,
+	rootDiskOptions *api.DiskOptions,
 	additionalVolumes []api.AdditionalVolumeSpec,
 	configuredDisks []kubevirtv1.Disk,
-) ([]kubevirtv1.Disk, []kubevirtv1.Volume, []cdicorev1alpha1.DataVolume) {
+) ([]kubevirtv1.Disk, []kubevirtv1.Volume, []cdicorev1alpha1.DataVolume, error) {
 	var disks []kubevirtv1.Disk
 	var volumes []kubevirtv1.Volume
 	var dataVolumes []cdicorev1alpha1.DataVolume
 
-	// Append a disk, a volume, and a data volume for the root disk
+	// Append a disk, a volume, and a data volume, unless an existing persistent volume claim is used, for the root disk
 	var rootDisk kubevirtv1.Disk
 	if d := findDiskByName(api.RootDiskName, configuredDisks); d != nil {
 		rootDisk = *d
+		ensureDiskDevice(&rootDisk)
 	} else {
 		rootDisk = buildDefaultDisk(api.RootDiskName)
 	}
+	if rootDiskOptions != nil {
+		applyDiskOptions(&rootDisk, *rootDiskOptions)
+	}
 
 	disks = append(disks, rootDisk)
-	volumes = append(volumes, kubevirtv1.Volume{
-		Name: api.RootDiskName,
-		VolumeSource: kubevirtv1.VolumeSource{
-			DataVolume: &kubevirtv1.DataVolumeSource{
-				Name: machineName,
+	if rootVolume.PersistentVolumeClaim != nil {
+		// Use the existing persistent volume claim
+		volumes = append(volumes, kubevirtv1.Volume{
+			Name: api.RootDiskName,
+			VolumeSource: kubevirtv1.VolumeSource{
+				PersistentVolumeClaim: rootVolume.PersistentVolumeClaim,
 			},
-		},
-	})
-	dataVolumes = append(dataVolumes, cdicorev1alpha1.DataVolume{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      machineName,
-			Namespace: namespace,
-		},
-		Spec: rootVolume,
-	})
-
-	// Append a disk and a volume for the cloud-init disk
-	disks = append(disks, kubevirtv1.Disk{
-		Name: "cloudinitdisk",
-		DiskDevice: kubevirtv1.DiskDevice{
-			Disk: &kubevirtv1.DiskTarget{
-				Bus: "virtio",
+		})
+	} else {
+		volumes = append(volumes, kubevirtv1.Volume{
+			Name: api.RootDiskName,
+			VolumeSource: kubevirtv1.VolumeSource{
+				DataVolume: &kubevirtv1.DataVolumeSource{
+					Name: machineName,
+				},
 			},
-		},
-	})
-	volumes = append(volumes, kubevirtv1.Volume{
-		Name: "cloudinitdisk",
-		VolumeSource: kubevirtv1.VolumeSource{
-			CloudInitNoCloud: &kubevirtv1.CloudInitNoCloudSource{
-				UserDataSecretRef: &corev1.LocalObjectReference{
-					Name: userDataSecretName,
+		})
+		dataVolumes = append(dataVolumes, cdicorev1alpha1.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      machineName,
+				Namespace: namespace,
+				Labels: map[string]string{
+					machineLabel: machineName,
 				},
-				NetworkData: networkData,
 			},
-		},
-	})
+			Spec: rootVolume.DataVolumeSpec,
+		})
+	}
+
+	// Append a disk and a volume for the cloud-init disk, if any
+	if cloudInitVolume != nil {
+		disks = append(disks, kubevirtv1.Disk{
+			Name: cloudInitVolume.Name,
+			DiskDevice: kubevirtv1.DiskDevice{
+				Disk: &kubevirtv1.DiskTarget{
+					Bus: "virtio",
+				},
+			},
+		})
+		volumes = append(volumes, *cloudInitVolume)
+	}
 
 	// Append disks, volumes, and data volumes for all additional disks
 	for i, volume := range additionalVolumes {
@@ -228,15 +594,34 @@ func buildVolumes(
 		if d := findDiskByName(volume.Name, configuredDisks); d != nil {
 			disk = *d
 			disk.Name = diskName
+			ensureDiskDevice(&disk)
 		} else {
 			disk = buildDefaultDisk(diskName)
 		}
+		if volume.Hotpluggable {
+			applyDiskOptions(&disk, api.DiskOptions{Bus: api.DiskBusSCSI})
+			disk.Serial = volume.Name
+		}
+		applyDiskOptions(&disk, volume.DiskOptions)
 		disks = append(disks, disk)
 
 		switch {
+		case volume.DataVolume != nil && volume.DeletionPolicy == api.VolumeDeletionPolicyRetain:
+			dataVolumeName := getRetainedDataVolumeName(machineName, volume)
+
+			// Append a volume for this additional disk referencing the retained data volume, which is created separately
+			volumes = append(volumes, kubevirtv1.Volume{
+				Name: diskName,
+				VolumeSource: kubevirtv1.VolumeSource{
+					DataVolume: &kubevirtv1.DataVolumeSource{
+						Name: dataVolumeName,
+					},
+				},
+			})
+
 		case volume.DataVolume != nil:
 			// Generate a unique name for this data volume
-			dataVolumeName := fmt.Sprintf("%s-%d", machineName, i)
+			dataVolumeName := buildChildName("", machineName, fmt.Sprintf("-%d", i))
 
 			// Append a volume and a data volume for this additional disk
 			volumes = append(volumes, kubevirtv1.Volume{
@@ -251,6 +636,9 @@ func buildVolumes(
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      dataVolumeName,
 					Namespace: namespace,
+					Labels: map[string]string{
+						machineLabel: machineName,
+					},
 				},
 				Spec: *volume.DataVolume,
 			})
@@ -263,23 +651,88 @@ func buildVolumes(
 					PersistentVolumeClaim: volume.VolumeSource.PersistentVolumeClaim,
 					ConfigMap:             volume.VolumeSource.ConfigMap,
 					Secret:                volume.VolumeSource.Secret,
+					ServiceAccount:        volume.VolumeSource.ServiceAccount,
+				},
+			})
+
+		case volume.EmptyDisk != nil:
+			// Append an empty disk volume for this additional disk
+			volumes = append(volumes, kubevirtv1.Volume{
+				Name: diskName,
+				VolumeSource: kubevirtv1.VolumeSource{
+					EmptyDisk: volume.EmptyDisk,
 				},
 			})
 		}
 	}
 
-	return disks, volumes, dataVolumes
+	return disks, volumes, dataVolumes, nil
+}
+
+// buildRetainedDataVolumes builds the standalone data volumes of the additional volumes with the "Retain" deletion policy
+// for the machine with the given name in the given namespace.
+func buildRetainedDataVolumes(machineName, namespace string, additionalVolumes []api.AdditionalVolumeSpec) []cdicorev1alpha1.DataVolume {
+	var dataVolumes []cdicorev1alpha1.DataVolume
+	for _, volume := range additionalVolumes {
+		if volume.DataVolume == nil || volume.DeletionPolicy != api.VolumeDeletionPolicyRetain {
+			continue
+		}
+		dataVolumeName := getRetainedDataVolumeName(machineName, volume)
+		dataVolumes = append(dataVolumes, cdicorev1alpha1.DataVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      dataVolumeName,
+				Namespace: namespace,
+				Labels: map[string]string{
+					machineLabel:        machineName,
+					deletionPolicyLabel: api.VolumeDeletionPolicyRetain,
+				},
+			},
+			Spec: *volume.DataVolume,
+		})
+	}
+	return dataVolumes
+}
+
+// getRetainedDataVolumeName returns the name of the retained data volume of the given additional volume
+// of the machine with the given name, i.e. its data volume name with its template already resolved, or "<machine name>-<volume name>"
+// if it has none, see buildChildName. It doesn't depend on the position of the volume, so that the data volume is attached again
+// when the machine is recreated, even if other volumes were added or removed in the meantime.
+func getRetainedDataVolumeName(machineName string, volume api.AdditionalVolumeSpec) string {
+	if volume.DataVolumeName == "" {
+		return buildChildName("", machineName, "-"+volume.Name)
+	}
+	return volume.DataVolumeName
+}
+
+// buildInputs builds the input devices of the VM from the given tablet input device, if any.
+func buildInputs(tablet *kubevirtv1.Input) []kubevirtv1.Input {
+	if tablet == nil {
+		return nil
+	}
+	input := *tablet
+	if input.Type == "" {
+		input.Type = api.InputTypeTablet
+	}
+	return []kubevirtv1.Input{input}
 }
 
 func findDiskByName(name string, disks []kubevirtv1.Disk) *kubevirtv1.Disk {
 	for _, disk := range disks {
 		if name == disk.Name {
-			return &disk
+			return disk.DeepCopy()
 		}
 	}
 	return nil
 }
 
+// ensureDiskDevice sets the device type of the given disk to a virtio disk, unless it's already set,
+// so that the disk options can be applied to it.
+func ensureDiskDevice(disk *kubevirtv1.Disk) {
+	if disk.Disk == nil && disk.LUN == nil && disk.CDRom == nil && disk.Floppy == nil {
+		disk.Disk = &kubevirtv1.DiskTarget{Bus: "virtio"}
+	}
+}
+
 func buildDefaultDisk(name string) kubevirtv1.Disk {
 	return kubevirtv1.Disk{
 		Name: name,
@@ -291,6 +744,260 @@ func buildDefaultDisk(name string) kubevirtv1.Disk {
 	}
 }
 
+func buildResources(resources kubevirtv1.ResourceRequirements, overcommitGuestOverhead bool) kubevirtv1.ResourceRequirements {
+	if overcommitGuestOverhead {
+		resources.OvercommitGuestOverhead = true
+	}
+	return resources
+}
+
+func buildFirmware(firmwareSpec *api.Firmware) (*kubevirtv1.Firmware, *kubevirtv1.Features) {
+	if firmwareSpec == nil {
+		return nil, nil
+	}
+
+	firmware := &kubevirtv1.Firmware{
+		Serial: firmwareSpec.Serial,
+	}
+	var features *kubevirtv1.Features
+
+	switch firmwareSpec.Bootloader {
+	case api.BootloaderEFI:
+		firmware.Bootloader = &kubevirtv1.Bootloader{
+			EFI: &kubevirtv1.EFI{
+				SecureBoot: pointer.BoolPtr(firmwareSpec.SecureBoot),
+			},
+		}
+		// Secure boot requires System Management Mode
+		if firmwareSpec.SecureBoot {
+			features = &kubevirtv1.Features{
+				SMM: &kubevirtv1.FeatureState{
+					Enabled: pointer.BoolPtr(true),
+				},
+			}
+		}
+	case api.BootloaderBIOS:
+		firmware.Bootloader = &kubevirtv1.Bootloader{
+			BIOS: &kubevirtv1.BIOS{},
+		}
+	}
+
+	return firmware, features
+}
+
+// buildSysprepVolume builds a CD-ROM disk and a volume with the given name from the given sysprep spec.
+// KubeVirt presents ConfigMap and Secret volumes as ISO images, on which Windows setup discovers the answer files.
+func buildSysprepVolume(name string, sysprep *api.SysprepSpec) (kubevirtv1.Disk, kubevirtv1.Volume) {
+	disk := kubevirtv1.Disk{
+		Name: name,
+		DiskDevice: kubevirtv1.DiskDevice{
+			CDRom: &kubevirtv1.CDRomTarget{
+				Bus: api.DiskBusSATA,
+			},
+		},
+	}
+	volume := kubevirtv1.Volume{
+		Name: name,
+	}
+	switch {
+	case sysprep.ConfigMap != nil:
+		volume.ConfigMap = &kubevirtv1.ConfigMapVolumeSource{
+			LocalObjectReference: *sysprep.ConfigMap,
+		}
+	case sysprep.Secret != nil:
+		volume.Secret = &kubevirtv1.SecretVolumeSource{
+			SecretName: sysprep.Secret.Name,
+		}
+	}
+	return disk, volume
+}
+
+// buildVirtioDriversVolume builds a CD-ROM disk and a container disk volume with the given name
+// for the virtio-win drivers image of the given Windows spec.
+func buildVirtioDriversVolume(name string, windows *api.WindowsSpec) (kubevirtv1.Disk, kubevirtv1.Volume) {
+	image := windows.VirtioDriversImage
+	if image == "" {
+		image = api.DefaultVirtioDriversImage
+	}
+	disk := kubevirtv1.Disk{
+		Name: name,
+		DiskDevice: kubevirtv1.DiskDevice{
+			CDRom: &kubevirtv1.CDRomTarget{
+				Bus: api.DiskBusSATA,
+			},
+		},
+	}
+	volume := kubevirtv1.Volume{
+		Name: name,
+		VolumeSource: kubevirtv1.VolumeSource{
+			ContainerDisk: &kubevirtv1.ContainerDiskSource{
+				Image: image,
+			},
+		},
+	}
+	return disk, volume
+}
+
+// applyWindowsFeatures returns a copy of the given features with ACPI, APIC, and the Hyper-V enlightenments
+// recommended for Windows guests enabled.
+func applyWindowsFeatures(features *kubevirtv1.Features) *kubevirtv1.Features {
+	if features == nil {
+		features = &kubevirtv1.Features{}
+	} else {
+		features = features.DeepCopy()
+	}
+	enabled := func() *kubevirtv1.FeatureState {
+		return &kubevirtv1.FeatureState{Enabled: pointer.BoolPtr(true)}
+	}
+	spinlockRetries := uint32(8191)
+	features.ACPI = *enabled()
+	features.APIC = &kubevirtv1.FeatureAPIC{Enabled: pointer.BoolPtr(true)}
+	features.Hyperv = &kubevirtv1.FeatureHyperv{
+		Relaxed:    enabled(),
+		VAPIC:      enabled(),
+		Spinlocks:  &kubevirtv1.FeatureSpinlocks{Enabled: pointer.BoolPtr(true), Retries: &spinlockRetries},
+		VPIndex:    enabled(),
+		Runtime:    enabled(),
+		SyNIC:      enabled(),
+		SyNICTimer: enabled(),
+		Reset:      enabled(),
+	}
+	return features
+}
+
+// buildWindowsClock builds the clock recommended for Windows guests, i.e. an UTC clock with the Hyper-V timer,
+// the RTC timer catching up on missed ticks, and without the HPET timer.
+func buildWindowsClock() *kubevirtv1.Clock {
+	return &kubevirtv1.Clock{
+		ClockOffset: kubevirtv1.ClockOffset{
+			UTC: &kubevirtv1.ClockOffsetUTC{},
+		},
+		Timer: &kubevirtv1.Timer{
+			HPET:   &kubevirtv1.HPETTimer{Enabled: pointer.BoolPtr(false)},
+			PIT:    &kubevirtv1.PITTimer{TickPolicy: kubevirtv1.PITTickPolicyDelay},
+			RTC:    &kubevirtv1.RTCTimer{TickPolicy: kubevirtv1.RTCTickPolicyCatchup},
+			Hyperv: &kubevirtv1.HypervTimer{},
+		},
+	}
+}
+
+// buildCloudInitVolume builds a cloud-init volume with the given name for the given cloud-init datasource type.
+// The network data is referenced via the networkdata secret if its name is not empty, or inlined otherwise.
+func buildCloudInitVolume(name, cloudInitType, userDataSecretName, networkDataSecretName, networkData string) kubevirtv1.Volume {
+	userDataSecretRef := &corev1.LocalObjectReference{
+		Name: userDataSecretName,
+	}
+	var networkDataSecretRef *corev1.LocalObjectReference
+	var inlineNetworkData string
+	switch {
+	case networkData == "":
+		break
+	case networkDataSecretName != "":
+		networkDataSecretRef = &corev1.LocalObjectReference{Name: networkDataSecretName}
+	default:
+		inlineNetworkData = networkData
+	}
+
+	volume := kubevirtv1.Volume{
+		Name: name,
+	}
+	if cloudInitType == api.CloudInitTypeConfigDrive {
+		volume.CloudInitConfigDrive = &kubevirtv1.CloudInitConfigDriveSource{
+			UserDataSecretRef:    userDataSecretRef,
+			NetworkDataSecretRef: networkDataSecretRef,
+			NetworkData:          inlineNetworkData,
+		}
+	} else {
+		volume.CloudInitNoCloud = &kubevirtv1.CloudInitNoCloudSource{
+			UserDataSecretRef:    userDataSecretRef,
+			NetworkDataSecretRef: networkDataSecretRef,
+			NetworkData:          inlineNetworkData,
+		}
+	}
+	return volume
+}
+
+// mergeFeatures merges the given generated features into the given custom features.
+// The generated features, such as SMM required for secure boot, take precedence.
+func mergeFeatures(generated, custom *kubevirtv1.Features) *kubevirtv1.Features {
+	if custom == nil {
+		return generated
+	}
+	features := custom.DeepCopy()
+	if generated != nil && generated.SMM != nil {
+		features.SMM = generated.SMM
+	}
+	return features
+}
+
+func applyDiskOptions(disk *kubevirtv1.Disk, options api.DiskOptions) {
+	if options.Bus != "" {
+		switch {
+		case disk.Disk != nil:
+			disk.Disk.Bus = options.Bus
+		case disk.LUN != nil:
+			disk.LUN.Bus = options.Bus
+		case disk.CDRom != nil:
+			disk.CDRom.Bus = options.Bus
+		}
+	}
+	if options.Cache != "" {
+		disk.Cache = options.Cache
+	}
+	if options.IO != "" {
+		disk.IO = options.IO
+	}
+	if options.Serial != "" {
+		disk.Serial = options.Serial
+	}
+}
+
+// applyBootOrder assigns the boot order of the root disk, the network interfaces of the PXE boot networks,
+// and the disks of the bootable additional volumes, in this order. If there are no PXE boot networks or bootable
+// additional volumes, no boot order is assigned, so that the VM boots from its first disk.
+func applyBootOrder(disks []kubevirtv1.Disk, interfaces []kubevirtv1.Interface, networkSpecs []api.NetworkSpec, additionalVolumes []api.AdditionalVolumeSpec) {
+	var interfaceNames, diskNames []string
+	for i, networkSpec := range networkSpecs {
+		if networkSpec.PXEBoot {
+			interfaceNames = append(interfaceNames, fmt.Sprintf("net%d", i))
+		}
+	}
+	for i, volume := range additionalVolumes {
+		if volume.Bootable {
+			diskNames = append(diskNames, fmt.Sprintf("disk%d", i))
+		}
+	}
+	if len(interfaceNames) == 0 && len(diskNames) == 0 {
+		return
+	}
+
+	var bootOrder uint
+	next := func() *uint {
+		bootOrder++
+		order := bootOrder
+		return &order
+	}
+	for i := range disks {
+		if disks[i].Name == api.RootDiskName {
+			disks[i].BootOrder = next()
+		}
+	}
+	for _, name := range interfaceNames {
+		for i := range interfaces {
+			if interfaces[i].Name == name {
+				interfaces[i].BootOrder = next()
+			}
+		}
+	}
+	for _, name := range diskNames {
+		for i := range disks {
+			if disks[i].Name == name {
+				disks[i].BootOrder = next()
+			}
+		}
+	}
+}
+
 const (
 	// defaultRegion is the name of the default region.
 	// VMs using this region are scheduled on nodes for which a region failure domain is not specified.
@@ -300,65 +1007,145 @@ const (
 	defaultZone = "default"
 )
 
-func buildAffinity(region, zone, k8sVersion string) *corev1.Affinity {
-	var affinity *corev1.Affinity
-	if region != "" {
-		// Get region and zone labels
-		regionLabel, zoneLabel := getRegionAndZoneLabels(k8sVersion)
+// topologyLabels are the keys of the region and zone labels of the provider cluster nodes.
+type topologyLabels struct {
+	region string
+	zone   string
+}
+
+var (
+	// legacyTopologyLabels are the beta region and zone labels, used by Kubernetes versions before 1.17.
+	legacyTopologyLabels = topologyLabels{region: corev1.LabelZoneRegion, zone: corev1.LabelZoneFailureDomain}
+	// gaTopologyLabels are the GA region and zone labels, used by Kubernetes 1.17 and later.
+	gaTopologyLabels = topologyLabels{region: "topology.kubernetes.io/region", zone: "topology.kubernetes.io/zone"}
+)
+
+// buildAffinity builds a required node affinity that schedules the VM on provider cluster nodes in the given region and zone,
+// identified by the given region and zone labels. If there are multiple label sets, a node matches if it's in the given
+// region and zone according to any of them. If the region or zone is the default one, a node matches
+// only if it has none of the region or zone labels.
+func buildAffinity(region, zone string, labelSets []topologyLabels) *corev1.Affinity {
+	if region == "" {
+		return nil
+	}
 
+	var terms []corev1.NodeSelectorTerm
+	for _, labels := range labelSets {
 		// Add match expression for the region label
 		var matchExpressions []corev1.NodeSelectorRequirement
 		if region != defaultRegion {
 			matchExpressions = append(matchExpressions, corev1.NodeSelectorRequirement{
-				Key:      regionLabel,
+				Key:      labels.region,
 				Operator: corev1.NodeSelectorOpIn,
 				Values:   []string{region},
 			})
 		} else {
-			matchExpressions = append(matchExpressions, corev1.NodeSelectorRequirement{
-				Key:      regionLabel,
-				Operator: corev1.NodeSelectorOpDoesNotExist,
-			})
+			for _, l := range labelSets {
+				matchExpressions = append(matchExpressions, corev1.NodeSelectorRequirement{
+					Key:      l.region,
+					Operator: corev1.NodeSelectorOpDoesNotExist,
+				})
+			}
 		}
 
 		// If there is a zone, add match expression for the zone label
 		if zone != "" {
 			if zone != defaultZone {
 				matchExpressions = append(matchExpressions, corev1.NodeSelectorRequirement{
-					Key:      zoneLabel,
+					Key:      labels.zone,
 					Operator: corev1.NodeSelectorOpIn,
 					Values:   []string{zone},
 				})
 			} else {
-				matchExpressions = append(matchExpressions, corev1.NodeSelectorRequirement{
-					Key:      zoneLabel,
-					Operator: corev1.NodeSelectorOpDoesNotExist,
-				})
+				for _, l := range labelSets {
+					matchExpressions = append(matchExpressions, corev1.NodeSelectorRequirement{
+						Key:      l.zone,
+						Operator: corev1.NodeSelectorOpDoesNotExist,
+					})
+				}
 			}
 		}
 
-		// Build affinity with the match expressions
-		affinity = &corev1.Affinity{
-			NodeAffinity: &corev1.NodeAffinity{
-				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
-					NodeSelectorTerms: []corev1.NodeSelectorTerm{
-						{
-							MatchExpressions: matchExpressions,
-						},
-					},
-				},
+		// Skip the term if it's the same as the previous one, i.e. if only default regions and zones are used
+		term := corev1.NodeSelectorTerm{MatchExpressions: matchExpressions}
+		if len(terms) > 0 && reflect.DeepEqual(terms[len(terms)-1], term) {
+			continue
+		}
+		terms = append(terms, term)
+	}
+
+	// Build affinity with the node selector terms
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: terms,
 			},
+		},
+	}
+}
+
+// mergeAffinity merges the given generated affinity, which only contains required node affinity, with the given custom affinity.
+// Since node selector terms are ORed, the match expressions of the generated affinity are added to each custom node selector term.
+func mergeAffinity(generated, custom *corev1.Affinity) *corev1.Affinity {
+	if custom == nil {
+		return generated
+	}
+	affinity := custom.DeepCopy()
+	if generated == nil || generated.NodeAffinity == nil || generated.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return affinity
+	}
+
+	if affinity.NodeAffinity == nil {
+		affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = generated.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.DeepCopy()
+		return affinity
+	}
+
+	var terms []corev1.NodeSelectorTerm
+	for _, customTerm := range required.NodeSelectorTerms {
+		for _, generatedTerm := range generated.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+			term := customTerm.DeepCopy()
+			term.MatchExpressions = append(term.MatchExpressions, generatedTerm.MatchExpressions...)
+			terms = append(terms, *term)
 		}
 	}
+	required.NodeSelectorTerms = terms
 	return affinity
 }
 
-func getRegionAndZoneLabels(k8sVersion string) (string, string) {
-	c, _ := semver.NewConstraint("< 1.17")
-	if c.Check(semver.MustParse(normalizeVersion(k8sVersion))) {
-		return corev1.LabelZoneRegion, corev1.LabelZoneFailureDomain
+// getRegionAndZoneLabels returns the region and zone label sets to use for the given provider spec.
+// Unless the provider spec specifies the topology labels explicitly, they are detected from the given Kubernetes version
+// of the provider cluster. If the version can't be parsed, the GA labels are used. The region and zone labels
+// of the provider spec, if specified, override the keys of the detected labels.
+func getRegionAndZoneLabels(providerSpec *api.KubeVirtProviderSpec, k8sVersion string) []topologyLabels {
+	var labels topologyLabels
+	switch providerSpec.TopologyLabels {
+	case api.TopologyLabelsBoth:
+		return []topologyLabels{gaTopologyLabels, legacyTopologyLabels}
+	case api.TopologyLabelsLegacy:
+		labels = legacyTopologyLabels
+	case api.TopologyLabelsGA:
+		labels = gaTopologyLabels
+	default:
+		labels = gaTopologyLabels
+		c, _ := semver.NewConstraint("< 1.17")
+		if v, err := semver.NewVersion(normalizeVersion(k8sVersion)); err != nil {
+			logging.WarningS(err, "Could not parse server version, using GA region and zone labels", "serverVersion", k8sVersion)
+		} else if c.Check(v) {
+			labels = legacyTopologyLabels
+		}
+	}
+
+	if providerSpec.RegionLabel != "" {
+		labels.region = providerSpec.RegionLabel
+	}
+	if providerSpec.ZoneLabel != "" {
+		labels.zone = providerSpec.ZoneLabel
 	}
-	return "topology.kubernetes.io/region", "topology.kubernetes.io/zone"
+	return []topologyLabels{labels}
 }
 
 func normalizeVersion(version string) string {
@@ -369,23 +1156,148 @@ func normalizeVersion(version string) string {
 	return v
 }
 
-func addUserSSHKeysToUserData(userData string, sshKeys []string) (string, error) {
-	if len(sshKeys) == 0 {
-		return userData, nil
+// buildUserData builds the userdata of the machine with the given name from the "userData" field, or one of the alternative
+// userdata keys, of the given secret and the SSH keys of the given provider spec, see userdata.Load. If InjectMachineIdentity
+// is set in the given provider spec, the machine identity file is added as well. It also returns whether the userdata is Ignition userdata.
+func buildUserData(machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (string, bool, error) {
+	userData, err := userdata.Load(secret.Data)
+	if err != nil {
+		return "", false, err
+	}
+	if isIgnition(providerSpec.UserDataFormat, userData) {
+		if providerSpec.InjectMachineIdentity {
+			return "", false, errors.New("machine identity can only be injected into cloud-init userdata")
+		}
+		userData, err = userdata.AddSSHKeysToIgnition(userData, providerSpec.SSHKeys)
+		return userData, true, err
+	}
+	if len(providerSpec.SSHKeys) > 0 && !userdata.IsCloudConfig(userData) {
+		logging.WarningS(nil, "Userdata is not cloud-config, not adding SSH keys", logging.KeyMachine, machineName)
+	}
+	if userData, err = userdata.AddSSHKeys(userData, providerSpec.SSHKeys); err != nil {
+		return "", false, err
+	}
+	if providerSpec.InjectMachineIdentity {
+		userData, err = userdata.AddIdentity(userData, &userdata.Identity{
+			MachineName: machineName,
+			ProviderID:  encodeProviderID(machineName),
+			Zone:        getMachineZone(machineName, providerSpec),
+			Additions:   providerSpec.UserDataAdditions,
+		})
+	}
+	return userData, false, err
+}
+
+// isIgnition returns true if the given userdata format is Ignition, or if it is not specified and the given userdata
+// is an Ignition config, i.e. a JSON object with an "ignition" field.
+func isIgnition(userDataFormat, userData string) bool {
+	switch userDataFormat {
+	case api.UserDataFormatIgnition:
+		return true
+	case api.UserDataFormatCloudInit:
+		return false
+	}
+	return userdata.IsIgnition(userData)
+}
+
+// MachineTemplateData is the data available to the templates in the provider spec.
+type MachineTemplateData struct {
+	// MachineName is the name of the machine.
+	MachineName string
+	// Zone is the zone of the machine.
+	Zone string
+	// Index is the last dash-separated part of the machine name, e.g. the random suffix of a machine created by a machine set.
+	Index string
+}
+
+// NewMachineTemplateData creates a new MachineTemplateData for the machine with the given name and provider spec.
+func NewMachineTemplateData(machineName string, providerSpec *api.KubeVirtProviderSpec) *MachineTemplateData {
+	return &MachineTemplateData{
+		MachineName: machineName,
+		Zone:        getMachineZone(machineName, providerSpec),
+		Index:       machineName[strings.LastIndex(machineName, "-")+1:],
 	}
+}
 
-	if strings.Contains(userData, "ssh_authorized_keys:") {
-		return "", errors.New("userData already contains key `ssh_authorized_keys`")
+// ExecuteMachineTemplate executes the given template, e.g. a hostname or subdomain template,
+// with the given template data. An empty template results in an empty string.
+func ExecuteMachineTemplate(text string, data *MachineTemplateData) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not parse template %q", text)
 	}
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, data); err != nil {
+		return "", errors.Wrapf(err, "could not execute template %q", text)
+	}
+	return builder.String(), nil
+}
+
+// ResolveTemplates returns a copy of the given provider spec with the templates in its hostname, subdomain, tag values,
+// userdata addition values, additional volume names, retained data volume names, and network names executed with the given
+// template data.
+// It also returns an error for each template that could not be executed, in which case the field is left unchanged.
+func ResolveTemplates(providerSpec *api.KubeVirtProviderSpec, data *MachineTemplateData) (*api.KubeVirtProviderSpec, field.ErrorList) {
+	errs := field.ErrorList{}
 
-	var userDataBuilder strings.Builder
-	userDataBuilder.WriteString(userData)
-	userDataBuilder.WriteString("\nssh_authorized_keys:\n")
-	for _, sshKey := range sshKeys {
-		userDataBuilder.WriteString("- ")
-		userDataBuilder.WriteString(strings.TrimSpace(sshKey))
-		userDataBuilder.WriteString("\n")
+	// Copy the provider spec, including the fields that contain templates
+	resolved := *providerSpec
+	if providerSpec.Tags != nil {
+		resolved.Tags = make(map[string]string, len(providerSpec.Tags))
+		for k, v := range providerSpec.Tags {
+			resolved.Tags[k] = v
+		}
+	}
+	if providerSpec.UserDataAdditions != nil {
+		resolved.UserDataAdditions = make(map[string]string, len(providerSpec.UserDataAdditions))
+		for k, v := range providerSpec.UserDataAdditions {
+			resolved.UserDataAdditions[k] = v
+		}
 	}
+	resolved.AdditionalVolumes = append([]api.AdditionalVolumeSpec(nil), providerSpec.AdditionalVolumes...)
+	resolved.Networks = append([]api.NetworkSpec(nil), providerSpec.Networks...)
 
-	return userDataBuilder.String(), nil
+	resolve := func(path *field.Path, text *string) {
+		result, err := ExecuteMachineTemplate(*text, data)
+		if err != nil {
+			errs = append(errs, field.Invalid(path, *text, err.Error()))
+			return
+		}
+		*text = result
+	}
+
+	resolve(field.NewPath("hostname"), &resolved.Hostname)
+	resolve(field.NewPath("subdomain"), &resolved.Subdomain)
+	for k, v := range resolved.Tags {
+		resolve(field.NewPath("tags").Key(k), &v)
+		resolved.Tags[k] = v
+	}
+	for k, v := range resolved.UserDataAdditions {
+		resolve(field.NewPath("userDataAdditions").Key(k), &v)
+		resolved.UserDataAdditions[k] = v
+	}
+	for i := range resolved.AdditionalVolumes {
+		volumePath := field.NewPath("additionalVolumes").Index(i)
+		resolve(volumePath.Child("name"), &resolved.AdditionalVolumes[i].Name)
+		resolve(volumePath.Child("dataVolumeName"), &resolved.AdditionalVolumes[i].DataVolumeName)
+	}
+	for i := range resolved.Networks {
+		resolve(field.NewPath("networks").Index(i).Child("name"), &resolved.Networks[i].Name)
+	}
+
+	return &resolved, errs
+}
+
+// prepareProviderSpec returns a copy of the given provider spec with the defaults of the given provider config applied,
+// see applyProviderConfig, and its templates executed for the machine with the given name, see ResolveTemplates.
+func prepareProviderSpec(machineName string, providerSpec *api.KubeVirtProviderSpec, config *ProviderConfig) (*api.KubeVirtProviderSpec, error) {
+	providerSpec = applyProviderConfig(providerSpec, config)
+	resolved, errs := ResolveTemplates(providerSpec, NewMachineTemplateData(machineName, providerSpec))
+	if len(errs) > 0 {
+		return nil, errors.Wrap(errs.ToAggregate(), "could not resolve provider spec templates")
+	}
+	return resolved, nil
 }
@@ -0,0 +1,175 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CachedReaderFactory creates readers that serve kubevirt virtual machines and virtual machine instances from informer caches.
+type CachedReaderFactory interface {
+	// GetCachedReader returns a reader for the namespace of the kubeconfig saved in the "kubeconfig" field of the given secret,
+	// that serves kubevirt virtual machines and virtual machine instances from informer caches.
+	GetCachedReader(secret *corev1.Secret) (client.Reader, error)
+}
+
+// informerReader is a client.Reader that serves the kubevirt virtual machines and virtual machine instances labeled
+// with a machine name in a namespace from informer caches, and falls back to a live reader for everything else.
+type informerReader struct {
+	live      client.Reader
+	namespace string
+	vms       *watchedInformer
+	vmis      *watchedInformer
+	stopCh    chan struct{}
+}
+
+// newInformerReader creates a new informerReader for the given namespace, using a REST client created from the given REST config
+// for the informers, and the given live reader as fallback. The informers are started immediately and run until Stop is called.
+func newInformerReader(config *rest.Config, namespace string, live client.Reader) (*informerReader, error) {
+	restConfig := rest.CopyConfig(config)
+	restConfig.GroupVersion = &kubevirtv1.GroupVersion
+	restConfig.APIPath = "/apis"
+	restConfig.NegotiatedSerializer = kubevirtv1.Codecs.WithoutConversion()
+	restClient, err := rest.RESTClientFor(restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create KubeVirt REST client from REST config")
+	}
+
+	selectMachines := func(options *metav1.ListOptions) {
+		options.LabelSelector = machineLabel
+	}
+	r := &informerReader{
+		live:      live,
+		namespace: namespace,
+		vms:       newWatchedInformer(cache.NewFilteredListWatchFromClient(restClient, "virtualmachines", namespace, selectMachines), &kubevirtv1.VirtualMachine{}),
+		vmis:      newWatchedInformer(cache.NewFilteredListWatchFromClient(restClient, "virtualmachineinstances", namespace, selectMachines), &kubevirtv1.VirtualMachineInstance{}),
+		stopCh:    make(chan struct{}),
+	}
+	go r.vms.informer.Run(r.stopCh)
+	go r.vmis.informer.Run(r.stopCh)
+	return r, nil
+}
+
+// Get gets the object with the given key from the informer cache if it's a cached kubevirt virtual machine
+// or virtual machine instance, and from the live reader otherwise.
+func (r *informerReader) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	var wi *watchedInformer
+	switch obj.(type) {
+	case *kubevirtv1.VirtualMachine:
+		wi = r.vms
+	case *kubevirtv1.VirtualMachineInstance:
+		wi = r.vmis
+	}
+	if wi != nil && key.Namespace == r.namespace && wi.isFresh() {
+		item, exists, err := wi.informer.GetStore().GetByKey(key.String())
+		if err == nil && exists {
+			switch o := obj.(type) {
+			case *kubevirtv1.VirtualMachine:
+				*o = *item.(*kubevirtv1.VirtualMachine).DeepCopy()
+			case *kubevirtv1.VirtualMachineInstance:
+				*o = *item.(*kubevirtv1.VirtualMachineInstance).DeepCopy()
+			}
+			return nil
+		}
+	}
+	return r.live.Get(ctx, key, obj)
+}
+
+// List lists the kubevirt virtual machines matching the given options from the informer cache,
+// and everything else from the live reader. Since all matching kubevirt virtual machines are returned at once,
+// the limit and continue options are ignored when listing from the informer cache.
+func (r *informerReader) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	virtualMachineList, ok := list.(*kubevirtv1.VirtualMachineList)
+	if !ok || listOpts.Namespace != r.namespace || listOpts.Continue != "" || listOpts.FieldSelector != nil || !r.vms.isFresh() {
+		return r.live.List(ctx, list, opts...)
+	}
+
+	selector := listOpts.LabelSelector
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	virtualMachineList.Items = nil
+	for _, item := range r.vms.informer.GetStore().List() {
+		virtualMachine := item.(*kubevirtv1.VirtualMachine)
+		if selector.Matches(labels.Set(virtualMachine.Labels)) {
+			virtualMachineList.Items = append(virtualMachineList.Items, *virtualMachine.DeepCopy())
+		}
+	}
+	return nil
+}
+
+// Stop stops the informers of this informerReader.
+func (r *informerReader) Stop() {
+	close(r.stopCh)
+}
+
+// watchedInformer is an informer that tracks whether its list and watch calls succeed,
+// so that its cache is only considered fresh while it's synced and watching.
+type watchedInformer struct {
+	informer cache.SharedIndexInformer
+	mutex    sync.Mutex
+	watching bool
+}
+
+// newWatchedInformer creates a new watchedInformer for objects of the given type using the given ListerWatcher.
+func newWatchedInformer(lw *cache.ListWatch, objType runtime.Object) *watchedInformer {
+	wi := &watchedInformer{}
+	listFunc, watchFunc := lw.ListFunc, lw.WatchFunc
+	lw.ListFunc = func(options metav1.ListOptions) (runtime.Object, error) {
+		obj, err := listFunc(options)
+		wi.setWatching(err == nil, err)
+		return obj, err
+	}
+	lw.WatchFunc = func(options metav1.ListOptions) (watch.Interface, error) {
+		w, err := watchFunc(options)
+		wi.setWatching(err == nil, err)
+		return w, err
+	}
+	wi.informer = cache.NewSharedIndexInformer(lw, objType, 0, cache.Indexers{})
+	return wi
+}
+
+// setWatching records whether the last list or watch call succeeded.
+func (wi *watchedInformer) setWatching(watching bool, err error) {
+	wi.mutex.Lock()
+	defer wi.mutex.Unlock()
+	if wi.watching && !watching {
+		logging.InfoS(2, "Informer cache is stale, falling back to live reads", "err", err)
+	}
+	wi.watching = watching
+}
+
+// isFresh returns true if the informer has synced and its last list or watch call succeeded, false otherwise.
+func (wi *watchedInformer) isFresh() bool {
+	wi.mutex.Lock()
+	defer wi.mutex.Unlock()
+	return wi.watching && wi.informer.HasSynced()
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("CachedReader", func() {
+	var (
+		server *fakeAPIServer
+		f      *CachingClientFactory
+		secret *corev1.Secret
+	)
+
+	BeforeEach(func() {
+		server = newFakeAPIServer("v1.18.6")
+		server.addVirtualMachine(machineName, map[string]string{"kubevirt.io/vm": machineName})
+		server.addVirtualMachine("vm-1", nil)
+		f = NewCachingClientFactory(TimerFunc(time.Now), NewClientFactoryOptions())
+		secret = newKubeconfigSecret("secret-1", server.URL, "token")
+	})
+
+	AfterEach(func() {
+		f.DeleteSecret(secret)
+		server.close()
+	})
+
+	// getVirtualMachine gets the kubevirt virtual machine with the given name with the given reader,
+	// and returns the number of gets served by the provider cluster for it.
+	getVirtualMachine := func(reader client.Reader, name string) (*kubevirtv1.VirtualMachine, int, error) {
+		calls := server.getGetCalls()
+		virtualMachine := &kubevirtv1.VirtualMachine{}
+		err := reader.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, virtualMachine)
+		return virtualMachine, server.getGetCalls() - calls, err
+	}
+
+	It("should serve machine VMs from the cache once it's synced", func() {
+		reader, err := f.GetCachedReader(secret)
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() int {
+			_, calls, err := getVirtualMachine(reader, machineName)
+			Expect(err).NotTo(HaveOccurred())
+			return calls
+		}).Should(BeZero())
+
+		virtualMachine, _, err := getVirtualMachine(reader, machineName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(virtualMachine.Name).To(Equal(machineName))
+		Expect(virtualMachine.Labels).To(HaveKeyWithValue("kubevirt.io/vm", machineName))
+	})
+
+	It("should fall back to the provider cluster for VMs that are not cached", func() {
+		reader, err := f.GetCachedReader(secret)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() int {
+			_, calls, _ := getVirtualMachine(reader, machineName)
+			return calls
+		}).Should(BeZero())
+
+		virtualMachine, calls, err := getVirtualMachine(reader, "vm-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(1))
+		Expect(virtualMachine.Name).To(Equal("vm-1"))
+
+		_, calls, err = getVirtualMachine(reader, "vm-2")
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should fall back to the provider cluster while the cache is not synced", func() {
+		server.setListFails(true)
+		reader, err := f.GetCachedReader(secret)
+		Expect(err).NotTo(HaveOccurred())
+
+		Consistently(func() int {
+			_, calls, err := getVirtualMachine(reader, machineName)
+			Expect(err).NotTo(HaveOccurred())
+			return calls
+		}, 200*time.Millisecond).Should(Equal(1))
+	})
+
+	It("should keep one cached reader per secret until its credentials change or it's deleted", func() {
+		reader, err := f.GetCachedReader(secret)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(server.getWatches).Should(Equal(2))
+
+		again, err := f.GetCachedReader(secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(BeIdenticalTo(reader))
+
+		rotated, err := f.GetCachedReader(newKubeconfigSecret("secret-1", server.URL, "rotated"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).NotTo(BeIdenticalTo(reader))
+		Eventually(server.getWatches).Should(Equal(2))
+
+		f.DeleteSecret(secret)
+		Eventually(server.getWatches).Should(BeZero())
+
+		recreated, err := f.GetCachedReader(secret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recreated).NotTo(BeIdenticalTo(rotated))
+	})
+})
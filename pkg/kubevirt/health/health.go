@@ -0,0 +1,69 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+)
+
+// ConnectivityChecker checks that the provider clusters of the last used secrets can still be reached.
+type ConnectivityChecker interface {
+	// CheckConnectivity returns the errors of the provider clusters that can't be reached, by secret namespace and name.
+	CheckConnectivity() map[string]error
+}
+
+// NewServeMux creates a new http.ServeMux that serves the health and readiness endpoints of the machine controller
+// using the given ConnectivityChecker.
+// The "/healthz" endpoint fails only if the authentication to a provider cluster fails, e.g. because the credentials
+// have expired, so that the machine controller is restarted and obtains new credentials.
+// The "/readyz" endpoint fails if any provider cluster can't be reached.
+func NewServeMux(checker ConnectivityChecker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeResult(w, checker.CheckConnectivity(), core.IsUnauthenticatedError)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		writeResult(w, checker.CheckConnectivity(), func(error) bool { return true })
+	})
+	return mux
+}
+
+// writeResult writes a 500 response listing the given errors that fail the check according to the given function,
+// or a 200 response if there are none.
+func writeResult(w http.ResponseWriter, errs map[string]error, fails func(error) bool) {
+	var keys []string
+	for key, err := range errs {
+		if fails(err) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	sort.Strings(keys)
+	w.WriteHeader(http.StatusInternalServerError)
+	for _, key := range keys {
+		logging.InfoS(2, "Provider cluster can't be reached", "secret", key, "err", errs[key])
+		fmt.Fprintf(w, "secret %q: %v\n", key, errs[key])
+	}
+}
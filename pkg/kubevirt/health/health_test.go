@@ -0,0 +1,81 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/health"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// fakeChecker is a ConnectivityChecker that returns the given errors.
+type fakeChecker map[string]error
+
+func (c fakeChecker) CheckConnectivity() map[string]error {
+	return c
+}
+
+var _ = Describe("NewServeMux", func() {
+	var (
+		unauthenticatedErr = apierrors.NewUnauthorized("token expired")
+		unreachableErr     = errors.New("dial tcp: i/o timeout")
+	)
+
+	serve := func(checker ConnectivityChecker, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		NewServeMux(checker).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	Context("/healthz", func() {
+		It("should succeed if all provider clusters can be reached", func() {
+			w := serve(fakeChecker(nil), "/healthz")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(Equal("ok\n"))
+		})
+
+		It("should succeed if a provider cluster can't be reached", func() {
+			w := serve(fakeChecker{"default/secret-1": unreachableErr}, "/healthz")
+			Expect(w.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should fail and list only the unauthenticated provider clusters if the authentication to a provider cluster fails", func() {
+			w := serve(fakeChecker{"default/secret-1": unauthenticatedErr, "default/secret-2": unreachableErr}, "/healthz")
+			Expect(w.Code).To(Equal(http.StatusInternalServerError))
+			Expect(w.Body.String()).To(Equal("secret \"default/secret-1\": token expired\n"))
+		})
+	})
+
+	Context("/readyz", func() {
+		It("should succeed if all provider clusters can be reached", func() {
+			w := serve(fakeChecker(nil), "/readyz")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(Equal("ok\n"))
+		})
+
+		It("should fail and list all provider clusters that can't be reached", func() {
+			w := serve(fakeChecker{"default/secret-2": unreachableErr, "default/secret-1": unauthenticatedErr}, "/readyz")
+			Expect(w.Code).To(Equal(http.StatusInternalServerError))
+			Expect(w.Body.String()).To(Equal("secret \"default/secret-1\": token expired\n" +
+				"secret \"default/secret-2\": dial tcp: i/o timeout\n"))
+		})
+	})
+})
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging provides structured logging on top of klog, writing messages followed by key/value pairs
+// in the same format as the structured logging functions of newer klog versions, e.g.
+//
+//	"Machine created" machine="machine-1" namespace="default" providerID="kubevirt://machine-1" operation="CreateMachine"
+//
+// The key/value pairs allow correlating the log messages of a machine, its VM, and an operation.
+package logging
+
+import (
+	"bytes"
+	"fmt"
+
+	"k8s.io/klog"
+)
+
+// Common keys of the key/value pairs.
+const (
+	// KeyMachine is the key of the machine name.
+	KeyMachine = "machine"
+	// KeyMachineClass is the key of the machine class name.
+	KeyMachineClass = "machineClass"
+	// KeyNamespace is the key of the namespace of the machine, or of its VM in the provider cluster.
+	KeyNamespace = "namespace"
+	// KeyProviderID is the key of the provider ID of the machine.
+	KeyProviderID = "providerID"
+	// KeyOperation is the key of the operation, i.e. the name of the driver or SPI method.
+	KeyOperation = "operation"
+)
+
+// InfoS logs the given message and key/value pairs at info level if the given verbosity is enabled.
+func InfoS(level klog.Level, msg string, keysAndValues ...interface{}) {
+	if klog.V(level) {
+		klog.InfoDepth(1, format(msg, nil, keysAndValues))
+	}
+}
+
+// WarningS logs the given message, error, and key/value pairs at warning level. The error may be nil.
+func WarningS(err error, msg string, keysAndValues ...interface{}) {
+	klog.WarningDepth(1, format(msg, err, keysAndValues))
+}
+
+// ErrorS logs the given message, error, and key/value pairs at error level. The error may be nil.
+func ErrorS(err error, msg string, keysAndValues ...interface{}) {
+	klog.ErrorDepth(1, format(msg, err, keysAndValues))
+}
+
+// format formats the given message, error, and key/value pairs. A key without value gets the value "(MISSING)".
+func format(msg string, err error, keysAndValues []interface{}) string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%q", msg)
+	if err != nil {
+		fmt.Fprintf(b, " err=%q", err.Error())
+	}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fmt.Fprintf(b, " %s=", keysAndValues[i])
+		switch v := value.(type) {
+		case string:
+			fmt.Fprintf(b, "%q", v)
+		case error:
+			fmt.Fprintf(b, "%q", v.Error())
+		case fmt.Stringer:
+			fmt.Fprintf(b, "%q", v.String())
+		default:
+			fmt.Fprintf(b, "%+v", v)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"bytes"
+	"flag"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+var _ = Describe("Logging", func() {
+	var (
+		flags  *flag.FlagSet
+		buffer *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		flags = flag.NewFlagSet("klog", flag.ContinueOnError)
+		klog.InitFlags(flags)
+		Expect(flags.Set("logtostderr", "false")).To(Succeed())
+		Expect(flags.Set("alsologtostderr", "false")).To(Succeed())
+		Expect(flags.Set("stderrthreshold", "FATAL")).To(Succeed())
+		Expect(flags.Set("v", "2")).To(Succeed())
+		buffer = &bytes.Buffer{}
+		klog.SetOutput(buffer)
+	})
+
+	AfterEach(func() {
+		Expect(flags.Set("logtostderr", "true")).To(Succeed())
+		Expect(flags.Set("v", "0")).To(Succeed())
+	})
+
+	Describe("#InfoS", func() {
+		It("should log the message followed by the key/value pairs", func() {
+			InfoS(2, "Machine created", KeyMachine, "machine-1", KeyNamespace, "default", "replicas", 3)
+			klog.Flush()
+			Expect(buffer.String()).To(ContainSubstring(`"Machine created" machine="machine-1" namespace="default" replicas=3`))
+		})
+
+		It("should quote errors and stringers", func() {
+			InfoS(2, "Operation failed", "err", errors.New("not found"), "key", types.NamespacedName{Namespace: "default", Name: "machine-1"})
+			klog.Flush()
+			Expect(buffer.String()).To(ContainSubstring(`"Operation failed" err="not found" key="default/machine-1"`))
+		})
+
+		It("should log a key without value as missing", func() {
+			InfoS(2, "Machine created", KeyMachine, "machine-1", KeyNamespace)
+			klog.Flush()
+			Expect(buffer.String()).To(ContainSubstring(`"Machine created" machine="machine-1" namespace="(MISSING)"`))
+		})
+
+		It("should not log if the verbosity is not enabled", func() {
+			InfoS(3, "Machine created", KeyMachine, "machine-1")
+			klog.Flush()
+			Expect(buffer.String()).To(BeEmpty())
+		})
+	})
+
+	Describe("#WarningS", func() {
+		It("should log the message followed by the error and the key/value pairs", func() {
+			WarningS(errors.New("connection refused"), "Could not maintain machines", KeyNamespace, "default")
+			klog.Flush()
+			Expect(buffer.String()).To(HavePrefix("W"))
+			Expect(buffer.String()).To(ContainSubstring(`"Could not maintain machines" err="connection refused" namespace="default"`))
+		})
+
+		It("should omit a nil error", func() {
+			WarningS(nil, "Could not maintain machines", KeyNamespace, "default")
+			klog.Flush()
+			Expect(buffer.String()).To(ContainSubstring(`"Could not maintain machines" namespace="default"`))
+		})
+	})
+})
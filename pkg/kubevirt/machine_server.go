@@ -16,12 +16,14 @@ package kubevirt
 
 import (
 	"context"
-	"fmt"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
 
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/codes"
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
-	"k8s.io/klog"
+	corev1 "k8s.io/api/core/v1"
 )
 
 // CreateMachine handles a machine creation request
@@ -47,23 +49,38 @@ import (
 // This logic is used by safety controller to delete orphan VMs which are not backed by any machine CRD
 //
 func (p *MachinePlugin) CreateMachine(ctx context.Context, req *driver.CreateMachineRequest) (*driver.CreateMachineResponse, error) {
-	klog.V(2).Infof("CreateMachine request received for %q", req.Machine.Name)
-	defer klog.V(2).Infof("CreateMachine request processed for %q", req.Machine.Name)
+	keysAndValues := machineKeysAndValues(req.Machine, "CreateMachine")
+	logging.InfoS(2, "Request received", keysAndValues...)
+	defer logging.InfoS(2, "Request processed", keysAndValues...)
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret, p.ValidationOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	providerID, err := p.SPI.CreateMachine(ctx, req.Machine.Name, providerSpec, req.Secret)
+	machineState := decodeMachineState(req.Machine)
+
+	providerID, err := p.SPI.CreateMachine(ctx, req.Machine.Name, req.MachineClass.Name, getMachineMetadata(req.Machine), providerSpec, req.Secret, machineState)
 	if err != nil {
-		return nil, wrapf(err, "could not create machine %q", req.Machine.Name)
+		if core.IsQuotaExceededError(err) {
+			p.recordEvent(req.Machine, corev1.EventTypeWarning, eventReasonQuotaExceeded, "Could not create VM: %v", err)
+		}
+		return &driver.CreateMachineResponse{
+			LastKnownState: encodeMachineState(machineState),
+		}, wrapf(err, "could not create machine %q", req.Machine.Name)
+	}
+
+	logging.InfoS(2, "Created machine", append(keysAndValues, logging.KeyProviderID, providerID)...)
+	p.recordEvent(req.Machine, corev1.EventTypeNormal, eventReasonVMCreated, "Created VM with provider ID %q", providerID)
+	p.recordNetworkIPAMEvent(req.Machine, machineState)
+	if machineState.BootMessage != "" {
+		p.recordEvent(req.Machine, corev1.EventTypeNormal, eventReasonBootProgress, "VM is in boot stage %s: %s", machineState.BootStage, machineState.BootMessage)
 	}
 
 	return &driver.CreateMachineResponse{
 		ProviderID:     providerID,
 		NodeName:       req.Machine.Name,
-		LastKnownState: fmt.Sprintf("Created %s", providerID),
+		LastKnownState: encodeMachineState(machineState),
 	}, nil
 }
 
@@ -79,21 +96,52 @@ func (p *MachinePlugin) CreateMachine(ctx context.Context, req *driver.CreateMac
 //                                                Could be helpful to continue operations in future requests.
 //
 func (p *MachinePlugin) DeleteMachine(ctx context.Context, req *driver.DeleteMachineRequest) (*driver.DeleteMachineResponse, error) {
-	klog.V(2).Infof("DeleteMachine request received for %q", req.Machine.Name)
-	defer klog.V(2).Infof("DeleteMachine request processed for %q", req.Machine.Name)
+	keysAndValues := machineKeysAndValues(req.Machine, "DeleteMachine")
+	logging.InfoS(2, "Request received", keysAndValues...)
+	defer logging.InfoS(2, "Request processed", keysAndValues...)
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret, p.ValidationOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	providerID, err := p.SPI.DeleteMachine(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, req.Secret)
+	machineState := decodeMachineState(req.Machine)
+
+	// Hold back the deletion while the root disk export is requested, so that the root disk can be downloaded.
+	// If the provider spec doesn't allow root disk exports, the export is skipped, since retrying wouldn't change that.
+	if isRootDiskExportRequested(req.Machine) {
+		export, err := p.SPI.ExportRootDisk(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, req.Secret)
+		switch {
+		case core.IsInvalidProviderSpecError(err):
+			p.recordEvent(req.Machine, corev1.EventTypeWarning, eventReasonRootDiskExport, "Skipping root disk export: %v", err)
+		case err != nil && !core.IsMachineNotFoundError(err):
+			return nil, wrapf(err, "could not export root disk of machine %q", req.Machine.Name)
+		}
+		if export != nil {
+			p.recordRootDiskExportEvent(req.Machine, export)
+			return &driver.DeleteMachineResponse{
+				LastKnownState: encodeMachineState(machineState),
+			}, wrapf(&core.DeletionInProgressError{Name: req.Machine.Name}, "could not delete machine %q, its root disk export is requested", req.Machine.Name)
+		}
+	}
+
+	providerID, err := p.SPI.DeleteMachine(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, req.Secret, machineState)
 	if err != nil {
-		return nil, wrapf(err, "could not delete machine %q", req.Machine.Name)
+		if core.IsDeletionInProgressError(err) {
+			p.recordEvent(req.Machine, corev1.EventTypeWarning, eventReasonVMDeletionBlocked, "VM is not fully deleted yet, e.g. because of finalizers or a stuck shutdown")
+		}
+		return &driver.DeleteMachineResponse{
+			LastKnownState: encodeMachineState(machineState),
+		}, wrapf(err, "could not delete machine %q", req.Machine.Name)
+	}
+
+	if req.Machine.Spec.ProviderID == "" {
+		keysAndValues = append(keysAndValues, logging.KeyProviderID, providerID)
 	}
+	logging.InfoS(2, "Deleted machine", keysAndValues...)
 
 	return &driver.DeleteMachineResponse{
-		LastKnownState: fmt.Sprintf("Deleted %s", providerID),
+		LastKnownState: encodeMachineState(machineState),
 	}, nil
 }
 
@@ -114,24 +162,52 @@ func (p *MachinePlugin) DeleteMachine(ctx context.Context, req *driver.DeleteMac
 //
 // The request should return a NOT_FOUND (5) status errors code if the machine is not existing
 func (p *MachinePlugin) GetMachineStatus(ctx context.Context, req *driver.GetMachineStatusRequest) (*driver.GetMachineStatusResponse, error) {
-	klog.V(2).Infof("GetMachineStatus request received for %q", req.Machine.Name)
-	defer klog.V(2).Infof("GetMachineStatus request processed for %q", req.Machine.Name)
+	keysAndValues := machineKeysAndValues(req.Machine, "GetMachineStatus")
+	logging.InfoS(2, "Request received", keysAndValues...)
+	defer logging.InfoS(2, "Request processed", keysAndValues...)
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret, p.ValidationOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	providerID, err := p.SPI.GetMachineStatus(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, req.Secret)
+	status, err := p.SPI.GetMachineStatus(ctx, req.Machine.Name, req.Machine.Spec.ProviderID, providerSpec, req.Secret)
 	if err != nil {
 		return nil, wrapf(err, "could not get status of machine %q", req.Machine.Name)
 	}
 
-	klog.V(2).Infof("Found machine with provider ID %q for %q", providerID, req.Machine.Name)
+	// Report problems of the VM without failing the request, so that the machine can still be drained and deleted
+	if status.Problem != nil {
+		logging.WarningS(status.Problem, "VM has a problem", append(keysAndValues, "reason", status.Problem.Reason)...)
+		if core.IsQuotaExceededError(status.Problem) {
+			p.recordEvent(req.Machine, corev1.EventTypeWarning, eventReasonQuotaExceeded, "VM could not be started: %v", status.Problem)
+		} else {
+			p.recordEvent(req.Machine, corev1.EventTypeWarning, eventReasonVMProblem, "VM has a problem: %v", status.Problem)
+		}
+	}
+
+	if status.LabelsUpdated {
+		p.recordEvent(req.Machine, corev1.EventTypeNormal, eventReasonVMLabelsUpdated, "Updated VM labels from the tags of the machine class")
+	}
+
+	for _, dataVolume := range status.DataVolumes {
+		p.recordEvent(req.Machine, corev1.EventTypeNormal, eventReasonDataVolumeImportProgress, "DataVolume %q is in phase %s, progress %s",
+			dataVolume.Name, dataVolume.Phase, dataVolume.Progress)
+	}
+
+	if req.Machine.Spec.ProviderID == "" {
+		keysAndValues = append(keysAndValues, logging.KeyProviderID, status.ProviderID)
+	}
+	logging.InfoS(2, "Found machine", append(keysAndValues,
+		"phase", status.Phase, "ready", status.Ready, "hostNode", status.HostNodeName, "addresses", status.Addresses)...)
+	if req.Machine.Status.Node != "" && req.Machine.Status.Node != status.NodeName {
+		logging.WarningS(nil, "Machine registered as a node whose name doesn't match the hostname of its VirtualMachineInstance", append(keysAndValues,
+			"node", req.Machine.Status.Node, "hostname", status.NodeName, "addresses", status.Addresses)...)
+	}
 
 	return &driver.GetMachineStatusResponse{
-		ProviderID: providerID,
-		NodeName:   req.Machine.Name,
+		ProviderID: status.ProviderID,
+		NodeName:   status.NodeName,
 	}, nil
 }
 
@@ -149,20 +225,21 @@ func (p *MachinePlugin) GetMachineStatus(ctx context.Context, req *driver.GetMac
 //                                           for all machine's who where possibilly created by this ProviderSpec
 //
 func (p *MachinePlugin) ListMachines(ctx context.Context, req *driver.ListMachinesRequest) (*driver.ListMachinesResponse, error) {
-	klog.V(2).Infof("ListMachines request received for %q", req.MachineClass.Name)
-	defer klog.V(2).Infof("ListMachines request processed for %q", req.MachineClass.Name)
+	keysAndValues := []interface{}{logging.KeyMachineClass, req.MachineClass.Name, logging.KeyNamespace, req.MachineClass.Namespace, logging.KeyOperation, "ListMachines"}
+	logging.InfoS(2, "Request received", keysAndValues...)
+	defer logging.InfoS(2, "Request processed", keysAndValues...)
 
-	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret)
+	providerSpec, err := decodeProviderSpecAndSecret(req.MachineClass, req.Secret, p.ValidationOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	machineList, err := p.SPI.ListMachines(ctx, providerSpec, req.Secret)
+	machineList, err := p.SPI.ListMachines(ctx, req.MachineClass.Name, providerSpec, req.Secret)
 	if err != nil {
 		return nil, wrapf(err, "could not list machines")
 	}
 
-	klog.V(2).Infof("Found %d machines for %q", len(machineList), req.MachineClass.Name)
+	logging.InfoS(2, "Found machines", append(keysAndValues, "count", len(machineList))...)
 
 	return &driver.ListMachinesResponse{
 		MachineList: machineList,
@@ -178,8 +255,9 @@ func (p *MachinePlugin) ListMachines(ctx context.Context, req *driver.ListMachin
 // VolumeIDs             []string                             VolumeIDs is a repeated list of VolumeIDs.
 //
 func (p *MachinePlugin) GetVolumeIDs(ctx context.Context, req *driver.GetVolumeIDsRequest) (*driver.GetVolumeIDsResponse, error) {
-	klog.V(2).Infof("GetVolumeIDs request received for %q", req.PVSpecs)
-	defer klog.V(2).Infof("GetVolumeIDs request processed for %q", req.PVSpecs)
+	keysAndValues := []interface{}{logging.KeyOperation, "GetVolumeIDs", "pvSpecs", len(req.PVSpecs)}
+	logging.InfoS(2, "Request received", keysAndValues...)
+	defer logging.InfoS(2, "Request processed", keysAndValues...)
 
 	return &driver.GetVolumeIDsResponse{}, status.Error(codes.Unimplemented, "")
 }
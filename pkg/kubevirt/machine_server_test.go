@@ -0,0 +1,397 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubevirt_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt"
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/state"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	machinefake "github.com/gardener/machine-controller-manager/pkg/client/clientset/versioned/fake"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/codes"
+	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	providerSpec = `{"region":"local","zone":"local-1","resources":{"requests":{"cpu":"1","memory":"4096M"}},` +
+		`"rootVolume":{"pvc":{"resources":{"requests":{"storage":"10Gi"}}},"source":{"http":{"url":"http://images/focal.img"}}}}`
+	kubeconfig = `{"apiVersion":"v1","kind":"Config","clusters":[{"name":"c","cluster":{"server":"https://127.0.0.1:6443"}}],` +
+		`"contexts":[{"name":"c","context":{"cluster":"c"}}],"current-context":"c"}`
+	userData = "#cloud-config\npassword: pass\n"
+)
+
+var _ = Describe("MachinePlugin", func() {
+	var (
+		plugin *MachinePlugin
+	)
+
+	BeforeEach(func() {
+		plugin = &MachinePlugin{ValidationOptions: validation.NewOptions()}
+	})
+
+	Describe("#CreateMachine", func() {
+		expectCode := func(spec string, secret *corev1.Secret, code codes.Code) {
+			_, err := plugin.CreateMachine(context.TODO(), &driver.CreateMachineRequest{
+				Machine: &v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{Name: "kubevirt-machine"},
+				},
+				MachineClass: &v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(spec)},
+				},
+				Secret: secret,
+			})
+			Expect(err).To(HaveOccurred())
+			s, ok := status.FromError(err)
+			Expect(ok).To(BeTrue())
+			Expect(s.Code()).To(Equal(code))
+		}
+
+		It("should return InvalidArgument if the provider spec cannot be unmarshaled", func() {
+			expectCode(`{"region":`, newSecret(kubeconfig, userData), codes.InvalidArgument)
+		})
+
+		It("should return InvalidArgument if the provider spec is empty", func() {
+			expectCode("null", newSecret(kubeconfig, userData), codes.InvalidArgument)
+		})
+
+		It("should return InvalidArgument if the provider spec is invalid", func() {
+			expectCode(`{"region":"local"}`, newSecret(kubeconfig, userData), codes.InvalidArgument)
+		})
+
+		It("should return InvalidArgument if the secret is missing", func() {
+			expectCode(providerSpec, nil, codes.InvalidArgument)
+		})
+
+		It("should return InvalidArgument if the secret doesn't contain userdata", func() {
+			expectCode(providerSpec, newSecret(kubeconfig, ""), codes.InvalidArgument)
+		})
+
+		It("should return Unauthenticated if the secret doesn't contain a kubeconfig", func() {
+			expectCode(providerSpec, newSecret("", userData), codes.Unauthenticated)
+		})
+
+		It("should return Unauthenticated if the kubeconfig in the secret is invalid", func() {
+			expectCode(providerSpec, newSecret("{", userData), codes.Unauthenticated)
+		})
+
+		It("should map provider cluster API errors to status codes", func() {
+			groupResource := schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachines"}
+			for apiErr, code := range map[error]codes.Code{
+				apierrors.NewForbidden(groupResource, "kubevirt-machine", errors.New("forbidden")): codes.PermissionDenied,
+				apierrors.NewTimeoutError("timeout", 1):                                            codes.Unavailable,
+				apierrors.NewServerTimeout(groupResource, "create", 1):                             codes.Unavailable,
+				apierrors.NewConflict(groupResource, "kubevirt-machine", errors.New("conflict")):   codes.Aborted,
+				apierrors.NewAlreadyExists(groupResource, "kubevirt-machine"):                      codes.AlreadyExists,
+				apierrors.NewBadRequest("bad request"):                                             codes.Internal,
+			} {
+				plugin.SPI = &fakeSPI{err: errors.Wrap(apiErr, "could not create VirtualMachine")}
+				_, err := plugin.CreateMachine(context.TODO(), &driver.CreateMachineRequest{
+					Machine: &v1alpha1.Machine{
+						ObjectMeta: metav1.ObjectMeta{Name: "kubevirt-machine"},
+					},
+					MachineClass: &v1alpha1.MachineClass{
+						ObjectMeta:   metav1.ObjectMeta{Name: "kubevirt-class"},
+						ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+					},
+					Secret: newSecret(kubeconfig, userData),
+				})
+				s, ok := status.FromError(err)
+				Expect(ok).To(BeTrue())
+				Expect(s.Code()).To(Equal(code), apiErr.Error())
+			}
+		})
+
+		It("should return InvalidArgument if the provider spec is not valid for the provider cluster", func() {
+			plugin.SPI = &fakeSPI{err: &core.InvalidProviderSpecError{Err: errors.New("missing resources")}}
+			expectCode(providerSpec, newSecret(kubeconfig, userData), codes.InvalidArgument)
+		})
+
+		It("should record an event with the IPAM types of the networks found by the network check", func() {
+			recorder := record.NewFakeRecorder(2)
+			plugin.Recorder = recorder
+			plugin.SPI = &fakeSPI{ipamTypes: map[string]string{"net-b": "static", "net-a": "whereabouts"}}
+			_, err := plugin.CreateMachine(context.TODO(), &driver.CreateMachineRequest{
+				Machine: &v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{Name: "kubevirt-machine"},
+				},
+				MachineClass: &v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+				},
+				Secret: newSecret(kubeconfig, userData),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).To(Receive(ContainSubstring("VMCreated")))
+			Expect(recorder.Events).To(Receive(ContainSubstring("NetworkIPAM VM networks use IPAM types net-a=whereabouts, net-b=static")))
+		})
+	})
+
+	Describe("#DeleteMachine", func() {
+		It("should hold back the deletion while the root disk export is requested", func() {
+			plugin.SPI = &fakeSPI{export: &core.RootDiskExport{Name: "kubevirt-machine-root-disk", Phase: "Ready"}}
+			_, err := plugin.DeleteMachine(context.TODO(), &driver.DeleteMachineRequest{
+				Machine: &v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "kubevirt-machine",
+						Annotations: map[string]string{ExportRootDiskAnnotation: "true"},
+					},
+				},
+				MachineClass: &v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+				},
+				Secret: newSecret(kubeconfig, userData),
+			})
+			s, ok := status.FromError(err)
+			Expect(ok).To(BeTrue())
+			Expect(s.Code()).To(Equal(codes.Unavailable))
+		})
+
+		It("should skip the root disk export and delete the machine if the provider spec doesn't allow it", func() {
+			recorder := record.NewFakeRecorder(1)
+			plugin.Recorder = recorder
+			spi := &fakeSPI{exportErr: &core.InvalidProviderSpecError{Err: errors.New("root disk exports are not allowed by the provider spec")}}
+			plugin.SPI = spi
+			_, err := plugin.DeleteMachine(context.TODO(), &driver.DeleteMachineRequest{
+				Machine: &v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "kubevirt-machine",
+						Annotations: map[string]string{ExportRootDiskAnnotation: "true"},
+					},
+				},
+				MachineClass: &v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+				},
+				Secret: newSecret(kubeconfig, userData),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spi.deleted).To(ConsistOf("kubevirt-machine"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("Skipping root disk export")))
+		})
+	})
+
+	Describe("#GetMachineStatus", func() {
+		It("should return the status and record an event if the VM has a problem", func() {
+			recorder := record.NewFakeRecorder(1)
+			plugin.Recorder = recorder
+			plugin.SPI = &fakeSPI{status: &core.MachineStatus{
+				ProviderID: "kubevirt://kubevirt-machine",
+				NodeName:   "kubevirt-machine",
+				Problem: &core.MachineStatusError{
+					Name:    "kubevirt-machine",
+					Reason:  core.MachineStatusReasonUnschedulable,
+					Message: "0/3 nodes are available: 3 Insufficient memory.",
+				},
+			}}
+			resp, err := plugin.GetMachineStatus(context.TODO(), &driver.GetMachineStatusRequest{
+				Machine: &v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{Name: "kubevirt-machine"},
+				},
+				MachineClass: &v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+				},
+				Secret: newSecret(kubeconfig, userData),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp).To(Equal(&driver.GetMachineStatusResponse{ProviderID: "kubevirt://kubevirt-machine", NodeName: "kubevirt-machine"}))
+			Expect(recorder.Events).To(Receive(ContainSubstring("VMProblem")))
+		})
+
+		It("should record an event only if the labels of the VM have been updated", func() {
+			recorder := record.NewFakeRecorder(2)
+			plugin.Recorder = recorder
+			spi := &fakeSPI{status: &core.MachineStatus{ProviderID: "kubevirt://kubevirt-machine", NodeName: "kubevirt-machine", LabelsUpdated: true}}
+			plugin.SPI = spi
+			req := &driver.GetMachineStatusRequest{
+				Machine: &v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{Name: "kubevirt-machine"},
+				},
+				MachineClass: &v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+				},
+				Secret: newSecret(kubeconfig, userData),
+			}
+
+			_, err := plugin.GetMachineStatus(context.TODO(), req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).To(Receive(ContainSubstring("VMLabelsUpdated")))
+
+			spi.status.LabelsUpdated = false
+			_, err = plugin.GetMachineStatus(context.TODO(), req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).NotTo(Receive())
+		})
+	})
+})
+
+var _ = Describe("OrphanReaper", func() {
+	var (
+		spi    *fakeSPI
+		reaper *OrphanReaper
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+		spi = &fakeSPI{machines: map[string]string{
+			"kubevirt://kubevirt-machine":  "kubevirt-machine",
+			"kubevirt://kubevirt-machine2": "kubevirt-machine2",
+			"kubevirt://orphaned-machine":  "orphaned-machine",
+		}}
+		secret := newSecret(kubeconfig, userData)
+		secret.ObjectMeta = metav1.ObjectMeta{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-secret"}
+		reaper = &OrphanReaper{
+			SPI: spi,
+			MachineClient: machinefake.NewSimpleClientset(
+				&v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+					SecretRef:    &corev1.SecretReference{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-secret"},
+				},
+				&v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-machine"},
+				},
+				&v1alpha1.Machine{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-machine-2"},
+					Spec:       v1alpha1.MachineSpec{ProviderID: "kubevirt://kubevirt-machine2"},
+				},
+			),
+			KubeClient:        kubefake.NewSimpleClientset(secret),
+			ValidationOptions: validation.NewOptions(),
+			Timer:             core.TimerFunc(func() time.Time { return now }),
+			Namespace:         "shoot--dev--kubevirt",
+			GracePeriod:       time.Hour,
+		}
+	})
+
+	It("should delete the VMs without a machine object only after the grace period", func() {
+		Expect(reaper.Scan(context.TODO())).To(Succeed())
+		Expect(spi.deleted).To(BeEmpty())
+
+		now = now.Add(time.Hour)
+		Expect(reaper.Scan(context.TODO())).To(Succeed())
+		Expect(spi.deleted).To(ConsistOf("orphaned-machine"))
+	})
+
+	It("should only report the VMs without a machine object if no grace period is set", func() {
+		reaper.GracePeriod = 0
+
+		Expect(reaper.Scan(context.TODO())).To(Succeed())
+		now = now.Add(24 * time.Hour)
+		Expect(reaper.Scan(context.TODO())).To(Succeed())
+		Expect(spi.deleted).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Maintainer", func() {
+	It("should maintain the machines of all machine classes with a readable secret and provider spec", func() {
+		spi := &fakeSPI{}
+		secret := newSecret(kubeconfig, userData)
+		secret.ObjectMeta = metav1.ObjectMeta{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-secret"}
+		maintainer := &Maintainer{
+			SPI: spi,
+			MachineClient: machinefake.NewSimpleClientset(
+				&v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-class"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+					SecretRef:    &corev1.SecretReference{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-secret"},
+				},
+				&v1alpha1.MachineClass{
+					ObjectMeta:   metav1.ObjectMeta{Namespace: "shoot--dev--kubevirt", Name: "kubevirt-class-missing-secret"},
+					ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+					SecretRef:    &corev1.SecretReference{Namespace: "shoot--dev--kubevirt", Name: "missing-secret"},
+				},
+			),
+			KubeClient:        kubefake.NewSimpleClientset(secret),
+			ValidationOptions: validation.NewOptions(),
+			Namespace:         "shoot--dev--kubevirt",
+		}
+
+		Expect(maintainer.Maintain(context.TODO())).To(Succeed())
+		Expect(spi.maintained).To(ConsistOf("kubevirt-class"))
+	})
+})
+
+// fakeSPI is a PluginSPI whose CreateMachine returns a fixed error and sets fixed network IPAM types, whose ExportRootDisk returns a fixed export and error,
+// whose GetMachineStatus returns a fixed status, whose ListMachines returns fixed machines, and whose DeleteMachine
+// and MaintainMachines record the names of the deleted machines and maintained machine classes.
+type fakeSPI struct {
+	PluginSPI
+	err        error
+	export     *core.RootDiskExport
+	exportErr  error
+	ipamTypes  map[string]string
+	machines   map[string]string
+	deleted    []string
+	maintained []string
+	status     *core.MachineStatus
+}
+
+func (f *fakeSPI) CreateMachine(_ context.Context, _, _ string, _ *core.MachineMetadata, _ *api.KubeVirtProviderSpec, _ *corev1.Secret, machineState *state.State) (string, error) {
+	machineState.NetworkIPAMTypes = f.ipamTypes
+	return "", f.err
+}
+
+func (f *fakeSPI) ExportRootDisk(context.Context, string, string, *api.KubeVirtProviderSpec, *corev1.Secret) (*core.RootDiskExport, error) {
+	return f.export, f.exportErr
+}
+
+func (f *fakeSPI) GetMachineStatus(context.Context, string, string, *api.KubeVirtProviderSpec, *corev1.Secret) (*core.MachineStatus, error) {
+	return f.status, f.err
+}
+
+func (f *fakeSPI) ListMachines(context.Context, string, *api.KubeVirtProviderSpec, *corev1.Secret) (map[string]string, error) {
+	return f.machines, f.err
+}
+
+func (f *fakeSPI) DeleteMachine(_ context.Context, machineName, providerID string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret, _ *state.State) (string, error) {
+	f.deleted = append(f.deleted, machineName)
+	return providerID, f.err
+}
+
+func (f *fakeSPI) MaintainMachines(_ context.Context, machineClassName string, _ *api.KubeVirtProviderSpec, _ *corev1.Secret) error {
+	f.maintained = append(f.maintained, machineClassName)
+	return f.err
+}
+
+func newSecret(kubeconfig, userData string) *corev1.Secret {
+	return &corev1.Secret{
+		Data: map[string][]byte{
+			"kubeconfig": []byte(kubeconfig),
+			"userData":   []byte(userData),
+		},
+	}
+}
@@ -2,9 +2,13 @@ package kubevirt
 
 import (
 	"encoding/json"
+	"sort"
+	"strings"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
 	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/state"
 	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
 
 	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
@@ -12,40 +16,179 @@ import (
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/machinecodes/status"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/klog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
-// decodeProviderSpecAndSecret decodes the provider spec from the given machine class and validates it, together with the given secret.
-func decodeProviderSpecAndSecret(machineClass *v1alpha1.MachineClass, secret *corev1.Secret) (*api.KubeVirtProviderSpec, error) {
+// decodeProviderSpecAndSecret decodes the provider spec from the given machine class and validates it, together with the given secret,
+// with the given validation options.
+// Since retrying cannot fix an invalid provider spec or secret, failures are returned as codes.InvalidArgument status errors,
+// except for invalid kubeconfigs, which are returned as codes.Unauthenticated status errors, see secretValidationErrorCode.
+func decodeProviderSpecAndSecret(machineClass *v1alpha1.MachineClass, secret *corev1.Secret, options *validation.Options) (*api.KubeVirtProviderSpec, error) {
 	var spec *api.KubeVirtProviderSpec
 	if err := json.Unmarshal(machineClass.ProviderSpec.Raw, &spec); err != nil {
-		wrapped := errors.Wrap(err, "could not unmarshal provider spec from JSON")
-		klog.V(2).Infof(wrapped.Error())
-		return nil, status.Error(codes.Internal, wrapped.Error())
+		return nil, decodeError(codes.InvalidArgument, errors.Wrap(err, "could not unmarshal provider spec from JSON"))
+	}
+	if spec == nil {
+		return nil, decodeError(codes.InvalidArgument, errors.New("provider spec is empty"))
 	}
 
-	if errs := validation.ValidateKubevirtProviderSpec(spec); len(errs) > 0 {
-		err := errors.Errorf("could not validate provider spec: %v", errs)
-		klog.V(2).Infof(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	if errs := validation.ValidateKubevirtProviderSpec(spec, options); len(errs) > 0 {
+		return nil, decodeError(codes.InvalidArgument, errors.Errorf("could not validate provider spec: %v", errs))
 	}
 
 	if secret == nil {
-		err := errors.New("provider secret is nil")
-		klog.V(2).Infof(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, decodeError(codes.InvalidArgument, errors.New("provider secret is nil"))
 	}
 
-	if errs := validation.ValidateKubevirtProviderSecret(secret); len(errs) > 0 {
-		err := errors.Errorf("could not validate provider secret: %v", errs)
-		klog.V(2).Infof(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	if errs := validation.ValidateKubevirtProviderSecret(secret, options); len(errs) > 0 {
+		return nil, decodeError(secretValidationErrorCode(errs), errors.Errorf("could not validate provider secret: %v", errs))
 	}
 
 	return spec, nil
 }
 
-// wrapf wraps the given error in a status.Error.
+// decodeError logs the given error and returns it as a status.Error with the given code.
+func decodeError(code codes.Code, err error) error {
+	logging.InfoS(2, "Could not decode provider spec and secret", "err", err, "code", code.String())
+	return status.Error(code, err.Error())
+}
+
+// secretValidationErrorCode returns the status code corresponding to the given provider secret validation errors.
+// If any of them concerns a kubeconfig, the provider cluster cannot be authenticated to, so it returns codes.Unauthenticated,
+// otherwise codes.InvalidArgument.
+func secretValidationErrorCode(errs field.ErrorList) codes.Code {
+	for _, err := range errs {
+		if err.Field == "kubeconfig" || strings.HasPrefix(err.Field, core.ZoneKubeconfigFieldPrefix) {
+			return codes.Unauthenticated
+		}
+	}
+	return codes.InvalidArgument
+}
+
+// machineKeysAndValues returns the logging key/value pairs that correlate the log messages of the given operation
+// on the given machine, including its provider ID if it's already known.
+func machineKeysAndValues(machine *v1alpha1.Machine, operation string) []interface{} {
+	keysAndValues := []interface{}{logging.KeyMachine, machine.Name, logging.KeyNamespace, machine.Namespace, logging.KeyOperation, operation}
+	if machine.Spec.ProviderID != "" {
+		keysAndValues = append(keysAndValues, logging.KeyProviderID, machine.Spec.ProviderID)
+	}
+	return keysAndValues
+}
+
+// decodeMachineState decodes the machine state from the last known state of the given machine.
+// If the last known state cannot be decoded, a new empty machine state is returned.
+func decodeMachineState(machine *v1alpha1.Machine) *state.State {
+	machineState, err := state.Decode(machine.Status.LastKnownState)
+	if err != nil {
+		logging.InfoS(2, "Could not decode last known state, ignoring it", "err", err, logging.KeyMachine, machine.Name, logging.KeyNamespace, machine.Namespace)
+		return state.New()
+	}
+	return machineState
+}
+
+// Reasons of the events recorded on machine objects.
+const (
+	// eventReasonVMCreated is the reason of the event recorded when the VM of a machine has been created.
+	eventReasonVMCreated = "VMCreated"
+	// eventReasonDataVolumeImportProgress is the reason of the events recorded while the data volumes of a machine are being populated.
+	eventReasonDataVolumeImportProgress = "DataVolumeImportProgress"
+	// eventReasonBootProgress is the reason of the event recorded when a creation retry finds the VM of a machine still booting.
+	eventReasonBootProgress = "BootProgress"
+	// eventReasonVMDeletionBlocked is the reason of the event recorded when the VM of a machine has not been fully deleted in time.
+	eventReasonVMDeletionBlocked = "VMDeletionBlocked"
+	// eventReasonRootDiskExport is the reason of the event recorded while the deletion of a machine is held back by a root disk export,
+	// or when a requested root disk export is skipped because the provider spec doesn't allow it.
+	eventReasonRootDiskExport = "RootDiskExport"
+	// eventReasonVMProblem is the reason of the event recorded when the status of the VM of a machine reports a problem,
+	// e.g. that its pod is unschedulable or that it has failed.
+	eventReasonVMProblem = "VMProblem"
+	// eventReasonVMLabelsUpdated is the reason of the event recorded when the labels of the VM of a machine have been updated
+	// from changed tags. It's only recorded if the labels differed, not on every status poll.
+	eventReasonVMLabelsUpdated = "VMLabelsUpdated"
+	// eventReasonNetworkIPAM is the reason of the event recorded when the VM of a machine has been created, listing the IPAM types
+	// of the network attachment definitions of its Multus networks, as found by the network check.
+	eventReasonNetworkIPAM = "NetworkIPAM"
+	// eventReasonQuotaExceeded is the reason of the event recorded when a resource quota of the provider cluster namespace has been exceeded.
+	eventReasonQuotaExceeded = "QuotaExceeded"
+)
+
+// recordEvent records an event with the given type, reason, and message on the given machine, if a Recorder is set.
+func (p *MachinePlugin) recordEvent(machine *v1alpha1.Machine, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.Recorder == nil || machine == nil {
+		return
+	}
+	p.Recorder.Eventf(machine, eventType, reason, messageFmt, args...)
+}
+
+// recordNetworkIPAMEvent records an event on the given machine listing the IPAM types of the Multus networks
+// in the given machine state, if any.
+func (p *MachinePlugin) recordNetworkIPAMEvent(machine *v1alpha1.Machine, machineState *state.State) {
+	if len(machineState.NetworkIPAMTypes) == 0 {
+		return
+	}
+	var ipamTypes []string
+	for network, ipamType := range machineState.NetworkIPAMTypes {
+		ipamTypes = append(ipamTypes, network+"="+ipamType)
+	}
+	sort.Strings(ipamTypes)
+	p.recordEvent(machine, corev1.EventTypeNormal, eventReasonNetworkIPAM, "VM networks use IPAM types %s", strings.Join(ipamTypes, ", "))
+}
+
+// ExportRootDiskAnnotation is the machine annotation requesting the export of the root disk of the machine before it's deleted.
+// While it's set to "true", the deletion of the machine is held back, so that the root disk can be downloaded.
+const ExportRootDiskAnnotation = "kubevirt.io/export-root-disk"
+
+// isRootDiskExportRequested returns true if the given machine requests the export of its root disk, false otherwise.
+func isRootDiskExportRequested(machine *v1alpha1.Machine) bool {
+	return machine.Annotations[ExportRootDiskAnnotation] == "true"
+}
+
+// recordRootDiskExportEvent records an event on the given machine with the status of the given root disk export,
+// and, once it's ready, the instructions for downloading it.
+func (p *MachinePlugin) recordRootDiskExportEvent(machine *v1alpha1.Machine, export *core.RootDiskExport) {
+	if !export.IsReady() {
+		p.recordEvent(machine, corev1.EventTypeNormal, eventReasonRootDiskExport, "Root disk export %s is not ready yet, phase: %s", export.Name, export.Phase)
+		return
+	}
+	p.recordEvent(machine, corev1.EventTypeNormal, eventReasonRootDiskExport,
+		"Root disk export %s is ready, download it from %s using the token in secret %s, then remove the %s annotation to continue the deletion",
+		export.Name, strings.Join(export.URLs, ", "), export.TokenSecretName, ExportRootDiskAnnotation)
+}
+
+// machineTemplateHashLabel is the label containing the hash of the machine template of a machine set,
+// which is the suffix of the machine set name appended to the machine deployment name.
+const machineTemplateHashLabel = "machine-template-hash"
+
+// getMachineMetadata returns the metadata of the given machine, i.e. its namespace, the name of its machine set
+// as specified by its controller reference, and the name of its machine deployment derived from the machine set name.
+func getMachineMetadata(machine *v1alpha1.Machine) *core.MachineMetadata {
+	machineMetadata := &core.MachineMetadata{
+		Namespace: machine.Namespace,
+	}
+	if ref := metav1.GetControllerOf(machine); ref != nil && ref.Kind == "MachineSet" {
+		machineMetadata.MachineSet = ref.Name
+		if hash := machine.Labels[machineTemplateHashLabel]; hash != "" && strings.HasSuffix(ref.Name, "-"+hash) {
+			machineMetadata.MachineDeployment = strings.TrimSuffix(ref.Name, "-"+hash)
+		}
+	}
+	return machineMetadata
+}
+
+// encodeMachineState encodes the given machine state as a last known state.
+func encodeMachineState(machineState *state.State) string {
+	lastKnownState, err := machineState.Encode()
+	if err != nil {
+		logging.InfoS(2, "Could not encode machine state", "err", err)
+		return ""
+	}
+	return lastKnownState
+}
+
+// wrapf wraps the given error in a status.Error. The status code is determined by the type of the given error,
+// or, if it's caused by a provider cluster API error, by the type of the API error, see apiErrorCode,
+// so that the backoff of the machine controller matches the failure type.
 func wrapf(err error, format string, args ...interface{}) error {
 	var (
 		code    codes.Code
@@ -55,10 +198,43 @@ func wrapf(err error, format string, args ...interface{}) error {
 	case *core.MachineNotFoundError:
 		code = codes.NotFound
 		wrapped = err
+	case *core.ResourceExhaustedError:
+		code = codes.ResourceExhausted
+		wrapped = errors.Wrapf(err, format, args...)
+	case *core.InvalidProviderSpecError:
+		code = codes.InvalidArgument
+		wrapped = errors.Wrapf(err, format, args...)
+	case *core.DeletionInProgressError, *core.OperationLimitExceededError:
+		code = codes.Unavailable
+		wrapped = errors.Wrapf(err, format, args...)
 	default:
 		code = codes.Internal
 		wrapped = errors.Wrapf(err, format, args...)
+		if apiCode, ok := apiErrorCode(err); ok {
+			code = apiCode
+		} else if core.IsUnauthenticatedError(err) {
+			code = codes.Unauthenticated
+			wrapped = errors.Wrap(wrapped, "could not authenticate to the provider cluster, check the credentials in the provider secret")
+		}
 	}
-	klog.V(2).Infof(wrapped.Error())
+	logging.InfoS(2, "Operation failed", "err", wrapped, "code", code.String())
 	return status.Error(code, wrapped.Error())
 }
+
+// apiErrorCode returns the status code corresponding to the provider cluster API error that caused the given error and true,
+// or false if the given error was not caused by a provider cluster API error with a specific status code.
+func apiErrorCode(err error) (codes.Code, bool) {
+	cause := errors.Cause(err)
+	switch {
+	case apierrors.IsForbidden(cause):
+		return codes.PermissionDenied, true
+	case apierrors.IsTimeout(cause), apierrors.IsServerTimeout(cause), apierrors.IsServiceUnavailable(cause):
+		return codes.Unavailable, true
+	case apierrors.IsConflict(cause):
+		return codes.Aborted, true
+	case apierrors.IsAlreadyExists(cause):
+		return codes.AlreadyExists, true
+	default:
+		return codes.Unknown, false
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubevirt
+
+import (
+	"context"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	machineclientset "github.com/gardener/machine-controller-manager/pkg/client/clientset/versioned"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Maintainer periodically performs the maintenance of the machines of all machine classes in the control namespace
+// via PluginSPI.MaintainMachines, e.g. resizing their VMs or deleting unused cached images and expired snapshots.
+// Since the maintenance modifies the provider clusters, it must only run in a single replica,
+// e.g. the one holding a leader election lock.
+type Maintainer struct {
+	// SPI is an implementation of the PluginSPI interface.
+	SPI PluginSPI
+	// MachineClient is the clientset used to list the machine classes in the control cluster.
+	MachineClient machineclientset.Interface
+	// KubeClient is the clientset used to get the secrets of the machine classes in the control cluster.
+	KubeClient kubernetes.Interface
+	// ValidationOptions are the options of the validation of the provider specs and secrets of the machine classes.
+	ValidationOptions *validation.Options
+	// Namespace is the control namespace containing the machine classes.
+	Namespace string
+}
+
+// Run performs the maintenance every given interval in the background until the given stop channel is closed.
+func (m *Maintainer) Run(interval time.Duration, stopCh <-chan struct{}) {
+	go wait.Until(func() {
+		if err := m.Maintain(context.TODO()); err != nil {
+			logging.WarningS(err, "Could not maintain machines", logging.KeyNamespace, m.Namespace)
+		}
+	}, interval, stopCh)
+}
+
+// Maintain performs the maintenance of the machines of all machine classes once. Machine classes whose provider spec
+// or secret can't be read, or whose maintenance fails, are skipped.
+func (m *Maintainer) Maintain(ctx context.Context) error {
+	return forEachMachineClass(m.MachineClient, m.KubeClient, m.ValidationOptions, m.Namespace, "MaintainMachines",
+		func(machineClass *v1alpha1.MachineClass, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, keysAndValues []interface{}) {
+			if err := m.SPI.MaintainMachines(ctx, machineClass.Name, providerSpec, secret); err != nil {
+				logging.WarningS(err, "Could not maintain machines", keysAndValues...)
+			}
+		})
+}
+
+// forEachMachineClass calls the given function with each machine class in the given namespace that has a secret reference,
+// its provider spec and secret decoded and validated with the given validation options, and the logging key/value pairs
+// for the given operation on it. Machine classes whose secret or provider spec can't be read are logged and skipped.
+func forEachMachineClass(machineClient machineclientset.Interface, kubeClient kubernetes.Interface, validationOptions *validation.Options, namespace, operation string,
+	f func(machineClass *v1alpha1.MachineClass, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, keysAndValues []interface{})) error {
+	machineClassList, err := machineClient.MachineV1alpha1().MachineClasses(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "could not list machine classes in namespace %q", namespace)
+	}
+	for i := range machineClassList.Items {
+		machineClass := &machineClassList.Items[i]
+		keysAndValues := []interface{}{logging.KeyMachineClass, machineClass.Name, logging.KeyNamespace, namespace, logging.KeyOperation, operation}
+		if machineClass.SecretRef == nil {
+			continue
+		}
+		secret, err := kubeClient.CoreV1().Secrets(machineClass.SecretRef.Namespace).Get(machineClass.SecretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			logging.WarningS(err, "Could not get machine class secret", keysAndValues...)
+			continue
+		}
+		providerSpec, err := decodeProviderSpecAndSecret(machineClass, secret, validationOptions)
+		if err != nil {
+			logging.WarningS(err, "Could not decode machine class", keysAndValues...)
+			continue
+		}
+		f(machineClass, providerSpec, secret, keysAndValues)
+	}
+	return nil
+}
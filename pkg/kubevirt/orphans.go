@@ -0,0 +1,175 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubevirt
+
+import (
+	"context"
+	"time"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/state"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	machineclientset "github.com/gardener/machine-controller-manager/pkg/client/clientset/versioned"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events recorded on machine classes.
+const (
+	// eventReasonOrphanedVM is the reason of the event recorded when a VM without a machine object has been found.
+	eventReasonOrphanedVM = "OrphanedVM"
+	// eventReasonOrphanedVMDeleted is the reason of the event recorded when a VM without a machine object has been deleted.
+	eventReasonOrphanedVMDeleted = "OrphanedVMDeleted"
+)
+
+var orphanedVMs = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "mcm",
+		Subsystem: "kubevirt",
+		Name:      "orphaned_vms",
+		Help:      "Number of VMs without a machine object found by the last orphan scan",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(orphanedVMs)
+}
+
+// OrphanReaper periodically scans the provider clusters of the machine classes in the control namespace for VMs
+// without a machine object, i.e. VMs listed by PluginSPI.ListMachines whose name and provider id don't match any machine.
+// It reports them via the orphaned VMs metric and events on their machine classes, and, if GracePeriod is set,
+// deletes them via PluginSPI.DeleteMachine once they have been orphaned for GracePeriod.
+// Since it deletes VMs, it must only run in a single replica, e.g. the one holding a leader election lock.
+// The time a VM was first found orphaned is not persisted, so the grace period starts over in another replica
+// that acquires the lock.
+type OrphanReaper struct {
+	// SPI is an implementation of the PluginSPI interface.
+	SPI PluginSPI
+	// MachineClient is the clientset used to list the machine classes and machines in the control cluster.
+	MachineClient machineclientset.Interface
+	// KubeClient is the clientset used to get the secrets of the machine classes in the control cluster.
+	KubeClient kubernetes.Interface
+	// ValidationOptions are the options of the validation of the provider specs and secrets of the machine classes.
+	ValidationOptions *validation.Options
+	// Recorder records events on the machine classes in the control cluster. If nil, no events are recorded.
+	Recorder record.EventRecorder
+	// Timer returns the current time.
+	Timer core.Timer
+	// Namespace is the control namespace containing the machine classes and machines.
+	Namespace string
+	// GracePeriod is the duration after which a VM without a machine object is deleted. Zero means orphans are only reported.
+	GracePeriod time.Duration
+
+	// firstSeen maps the provider ids of the orphaned VMs to the time they were first found without a machine object.
+	firstSeen map[string]time.Time
+}
+
+// Run scans for orphaned VMs every given interval in the background until the given stop channel is closed.
+func (r *OrphanReaper) Run(interval time.Duration, stopCh <-chan struct{}) {
+	go wait.Until(func() {
+		if err := r.Scan(context.TODO()); err != nil {
+			logging.WarningS(err, "Could not scan for orphaned VMs", logging.KeyNamespace, r.Namespace)
+		}
+	}, interval, stopCh)
+}
+
+// Scan scans the provider clusters of all machine classes for orphaned VMs once. Machine classes whose provider spec,
+// secret, or machines can't be read are skipped, since it can't be decided whether their VMs are orphaned.
+func (r *OrphanReaper) Scan(ctx context.Context) error {
+	now := r.Timer.Now()
+	if r.firstSeen == nil {
+		r.firstSeen = make(map[string]time.Time)
+	}
+
+	// Get the names and provider ids of all machines
+	machineList, err := r.MachineClient.MachineV1alpha1().Machines(r.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "could not list machines in namespace %q", r.Namespace)
+	}
+	machineNames, providerIDs := sets.NewString(), sets.NewString()
+	for _, machine := range machineList.Items {
+		machineNames.Insert(machine.Name)
+		if machine.Spec.ProviderID != "" {
+			providerIDs.Insert(machine.Spec.ProviderID)
+		}
+	}
+
+	// Find and, if the grace period has passed, delete the VMs without a machine of each machine class
+	orphans, handled := sets.NewString(), sets.NewString()
+	if err := forEachMachineClass(r.MachineClient, r.KubeClient, r.ValidationOptions, r.Namespace, "ScanOrphans",
+		func(machineClass *v1alpha1.MachineClass, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, keysAndValues []interface{}) {
+			machines, err := r.SPI.ListMachines(ctx, machineClass.Name, providerSpec, secret)
+			if err != nil {
+				logging.WarningS(err, "Could not list machines", keysAndValues...)
+				return
+			}
+
+			for providerID, machineName := range machines {
+				if machineNames.Has(machineName) || providerIDs.Has(providerID) || handled.Has(providerID) {
+					continue
+				}
+				handled.Insert(providerID)
+				firstSeen, ok := r.firstSeen[providerID]
+				if !ok {
+					firstSeen = now
+					r.firstSeen[providerID] = now
+					logging.InfoS(1, "Found orphaned VM", append(keysAndValues, logging.KeyMachine, machineName)...)
+					r.recordEvent(machineClass, corev1.EventTypeWarning, eventReasonOrphanedVM, "VM %q has no machine object", machineName)
+				}
+				if r.GracePeriod == 0 || now.Sub(firstSeen) < r.GracePeriod {
+					orphans.Insert(providerID)
+					continue
+				}
+
+				logging.InfoS(1, "Deleting orphaned VM", append(keysAndValues, logging.KeyMachine, machineName)...)
+				if _, err := r.SPI.DeleteMachine(ctx, machineName, providerID, providerSpec, secret, state.New()); err != nil {
+					logging.WarningS(err, "Could not delete orphaned VM", append(keysAndValues, logging.KeyMachine, machineName)...)
+					orphans.Insert(providerID)
+					continue
+				}
+				r.recordEvent(machineClass, corev1.EventTypeNormal, eventReasonOrphanedVMDeleted, "Deleted VM %q without a machine object after %s", machineName, r.GracePeriod)
+				delete(r.firstSeen, providerID)
+			}
+		}); err != nil {
+		return err
+	}
+
+	// Forget the VMs that are no longer orphaned, e.g. because they were deleted or adopted by a machine
+	for providerID := range r.firstSeen {
+		if !orphans.Has(providerID) {
+			delete(r.firstSeen, providerID)
+		}
+	}
+	orphanedVMs.Set(float64(orphans.Len()))
+	return nil
+}
+
+// recordEvent records an event with the given type, reason, and message on the given machine class, if a Recorder is set.
+func (r *OrphanReaper) recordEvent(machineClass *v1alpha1.MachineClass, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(machineClass, eventType, reason, messageFmt, args...)
+}
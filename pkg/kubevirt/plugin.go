@@ -20,34 +20,80 @@ import (
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
 	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/state"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
 
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
 	"github.com/gardener/machine-controller-manager/pkg/util/provider/driver"
+	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
 )
 
 // PluginSPI is an interface for provider-specific machine operations.
 type PluginSPI interface {
-	// CreateMachine creates a machine with the given name, using the given provider spec and secret.
-	CreateMachine(ctx context.Context, machineName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerID string, err error)
+	// CreateMachine creates a machine with the given name, machine class name, and machine metadata, using the given provider spec and secret.
+	// The given machine state is updated as the creation progresses.
+	CreateMachine(ctx context.Context, machineName, machineClassName string, machineMetadata *core.MachineMetadata, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, machineState *state.State) (providerID string, err error)
 	// DeleteMachine deletes the machine with the given name and provider id, using the given provider spec and secret.
-	DeleteMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error)
-	// GetMachineStatus returns the provider id of the machine with the given name and provider id, using the given provider spec and secret.
-	GetMachineStatus(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error)
-	// ListMachines lists all machines matching the given provider spec and secret.
-	ListMachines(ctx context.Context, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerIDList map[string]string, err error)
+	// The given machine state is updated as the deletion progresses.
+	DeleteMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret, machineState *state.State) (foundProviderID string, err error)
+	// UpdateMachine updates the machine with the given name and provider id, using the given provider spec and secret.
+	UpdateMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error)
+	// GetMachineStatus returns the status of the machine with the given name and provider id, using the given provider spec and secret.
+	GetMachineStatus(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (status *core.MachineStatus, err error)
+	// ListMachines lists all machines of the machine class with the given name, using the given provider spec and secret.
+	ListMachines(ctx context.Context, machineClassName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (providerIDList map[string]string, err error)
+	// MaintainMachines performs the periodic maintenance of the machines of the machine class with the given name,
+	// using the given provider spec and secret, e.g. resizing them or deleting unused resources.
+	MaintainMachines(ctx context.Context, machineClassName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) error
+	// RestartMachine restarts the machine with the given name and provider id, using the given provider spec and secret.
+	RestartMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error)
 	// ShutDownMachine shuts down the machine with the given name and provider id, using the given provider spec and secret.
 	ShutDownMachine(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (foundProviderID string, err error)
+	// ExportRootDisk exports the root disk of the machine with the given name and provider id, using the given provider spec and secret.
+	// It returns the export, which may not be ready yet.
+	ExportRootDisk(ctx context.Context, machineName, providerID string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*core.RootDiskExport, error)
+	// ValidateMachine validates the creation of a machine with the given name and machine class name, using the given provider spec
+	// and secret, without creating it. It returns the kubevirt virtual machine that would be created.
+	ValidateMachine(ctx context.Context, machineName, machineClassName string, providerSpec *api.KubeVirtProviderSpec, secret *corev1.Secret) (*kubevirtv1.VirtualMachine, error)
 }
 
 // MachinePlugin implements cmi.MachineServer by delegating to a PluginSPI implementation.
 type MachinePlugin struct {
 	// SPI is an implementation of the PluginSPI interface.
 	SPI PluginSPI
+	// ValidationOptions are the options of the validation of the provider specs and secrets of the machine classes.
+	ValidationOptions *validation.Options
+	// Recorder records events on the machine objects in the control cluster. If nil, no events are recorded.
+	Recorder record.EventRecorder
 }
 
-// NewKubevirtPlugin creates a new kubevirt driver.
-func NewKubevirtPlugin() driver.Driver {
+// NewKubevirtPlugin creates a new kubevirt driver that accesses the provider clusters using the given CachingClientFactory
+// and Options, validates the provider specs and secrets of the machine classes with the given validation Options,
+// and records events on the machine objects using the given EventRecorder.
+func NewKubevirtPlugin(cf *core.CachingClientFactory, options *core.Options, validationOptions *validation.Options, recorder record.EventRecorder) driver.Driver {
+	timer := core.TimerFunc(time.Now)
 	return &MachinePlugin{
-		SPI: core.NewPluginSPIImpl(core.ClientFactoryFunc(core.GetClient), core.ServerVersionFactoryFunc(core.GetServerVersion), core.TimerFunc(time.Now)),
+		SPI:               core.NewPluginSPIImpl(cf, cf, cf, timer, options),
+		ValidationOptions: validationOptions,
+		Recorder:          recorder,
 	}
 }
+
+// ValidateMachineClass validates the given machine class and secret by decoding and validating the provider spec,
+// and validating the creation of a machine with the given name without creating it, see PluginSPI.ValidateMachine.
+// It returns the kubevirt virtual machine that would be created for the machine.
+func (p *MachinePlugin) ValidateMachineClass(ctx context.Context, machineClass *v1alpha1.MachineClass, secret *corev1.Secret, machineName string) (*kubevirtv1.VirtualMachine, error) {
+	providerSpec, err := decodeProviderSpecAndSecret(machineClass, secret, p.ValidationOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	virtualMachine, err := p.SPI.ValidateMachine(ctx, machineName, machineClass.Name, providerSpec, secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not validate machine class %q", machineClass.Name)
+	}
+	return virtualMachine, nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+// Version is the current version of the machine state format.
+const Version = "v1"
+
+// Operation is a machine operation.
+type Operation string
+
+const (
+	// OperationCreate is the machine creation operation.
+	OperationCreate Operation = "Create"
+	// OperationDelete is the machine deletion operation.
+	OperationDelete Operation = "Delete"
+)
+
+// Phase is the phase of a machine operation.
+type Phase string
+
+const (
+	// PhasePending means that the operation has not made any progress yet.
+	PhasePending Phase = "Pending"
+	// PhaseSecretsCreated means that the userdata and networkdata secrets have been created,
+	// but the kubevirt virtual machine has not been created yet.
+	PhaseSecretsCreated Phase = "SecretsCreated"
+	// PhaseVirtualMachineCreated means that the userdata and networkdata secrets and the kubevirt virtual machine
+	// have been created, but the kubevirt virtual machine may not be the owner of the secrets yet.
+	PhaseVirtualMachineCreated Phase = "VirtualMachineCreated"
+	// PhaseCreated means that the kubevirt virtual machine and the userdata and networkdata secrets have been created.
+	PhaseCreated Phase = "Created"
+	// PhaseStopping means that the graceful shutdown of the kubevirt virtual machine has been requested before deleting it.
+	PhaseStopping Phase = "Stopping"
+	// PhaseSnapshotting means that a snapshot of the kubevirt virtual machine has been requested before deleting it.
+	PhaseSnapshotting Phase = "Snapshotting"
+	// PhaseDeleting means that the deletion of the kubevirt virtual machine has been requested.
+	PhaseDeleting Phase = "Deleting"
+	// PhaseVirtualMachineDeleted means that the kubevirt virtual machine and its dependents have been fully deleted,
+	// but leftover data volumes and persistent volume claims may not have been deleted yet.
+	PhaseVirtualMachineDeleted Phase = "VirtualMachineDeleted"
+	// PhaseDeleted means that the kubevirt virtual machine has been deleted or was not found.
+	PhaseDeleted Phase = "Deleted"
+)
+
+// State is the last known state of a machine, stored as JSON in the machine status
+// so that subsequent operations can resume where a previous one stopped.
+type State struct {
+	// Version is the version of the state format.
+	Version string `json:"version"`
+	// Operation is the last operation performed on the machine.
+	Operation Operation `json:"operation,omitempty"`
+	// Phase is the phase of the last operation.
+	Phase Phase `json:"phase,omitempty"`
+	// ProviderID is the provider id of the machine.
+	ProviderID string `json:"providerID,omitempty"`
+	// VirtualMachineUID is the UID of the kubevirt virtual machine.
+	VirtualMachineUID types.UID `json:"virtualMachineUID,omitempty"`
+	// UserDataSecretName is the name of the userdata secret referenced by the kubevirt virtual machine.
+	UserDataSecretName string `json:"userDataSecretName,omitempty"`
+	// NetworkDataSecretName is the name of the networkdata secret referenced by the kubevirt virtual machine, if any.
+	NetworkDataSecretName string `json:"networkDataSecretName,omitempty"`
+	// DataVolumes maps the names of the data volumes of the kubevirt virtual machine to their phases.
+	DataVolumes map[string]cdicorev1alpha1.DataVolumePhase `json:"dataVolumes,omitempty"`
+	// BootStage is the boot stage of the kubevirt virtual machine, as last observed by a creation attempt
+	// that found the kubevirt virtual machine already created.
+	BootStage string `json:"bootStage,omitempty"`
+	// BootMessage is a human readable message describing the boot progress of the kubevirt virtual machine,
+	// e.g. "waiting for image import of DataVolume \"machine-1\": 42.00%".
+	BootMessage string `json:"bootMessage,omitempty"`
+	// NetworkIPAMTypes maps the names of the Multus networks of the kubevirt virtual machine to the IPAM types
+	// of their network attachment definitions, as found by the network check of the creation.
+	NetworkIPAMTypes map[string]string `json:"networkIPAMTypes,omitempty"`
+	// LastUpdateTime is the time the state was last updated.
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// New creates a new empty State.
+func New() *State {
+	return &State{
+		Version: Version,
+	}
+}
+
+// Decode decodes a State from the given last known state.
+// An empty or legacy (non-JSON) last known state results in a new empty State.
+func Decode(lastKnownState string) (*State, error) {
+	if !strings.HasPrefix(strings.TrimSpace(lastKnownState), "{") {
+		return New(), nil
+	}
+	s := &State{}
+	if err := json.Unmarshal([]byte(lastKnownState), s); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal last known state from JSON")
+	}
+	if s.Version != Version {
+		return nil, errors.Errorf("unsupported last known state version %q", s.Version)
+	}
+	return s, nil
+}
+
+// Encode encodes this State as a last known state.
+func (s *State) Encode() (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal last known state to JSON")
+	}
+	return string(data), nil
+}
+
+// SetPhase sets the operation and phase of this State and updates its last update time.
+func (s *State) SetPhase(operation Operation, phase Phase, now time.Time) {
+	s.Operation = operation
+	s.Phase = phase
+	s.LastUpdateTime = metav1.NewTime(now)
+}
+
+// Is returns true if the last operation of this State is the given operation and its phase is the given phase.
+func (s *State) Is(operation Operation, phase Phase) bool {
+	return s.Operation == operation && s.Phase == phase
+}
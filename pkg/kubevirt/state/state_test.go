@@ -0,0 +1,106 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state_test
+
+import (
+	"time"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/state"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
+)
+
+var _ = Describe("State", func() {
+	Describe("#Encode and #Decode", func() {
+		It("should round-trip a State", func() {
+			s := New()
+			s.SetPhase(OperationCreate, PhaseVirtualMachineCreated, time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local))
+			s.ProviderID = "kubevirt://machine-1"
+			s.VirtualMachineUID = types.UID("0a1b2c3d")
+			s.UserDataSecretName = "userdata-machine-1-1601553600"
+			s.NetworkDataSecretName = "networkdata-machine-1-1601553600"
+			s.DataVolumes = map[string]cdicorev1alpha1.DataVolumePhase{"machine-1": cdicorev1alpha1.ImportInProgress}
+			s.BootStage = "Importing"
+			s.BootMessage = `waiting for image import of DataVolume "machine-1": 42.00%`
+
+			lastKnownState, err := s.Encode()
+			Expect(err).NotTo(HaveOccurred())
+
+			decoded, err := Decode(lastKnownState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded).To(Equal(s))
+			Expect(decoded.Is(OperationCreate, PhaseVirtualMachineCreated)).To(BeTrue())
+		})
+
+		It("should round-trip a new State", func() {
+			lastKnownState, err := New().Encode()
+			Expect(err).NotTo(HaveOccurred())
+
+			decoded, err := Decode(lastKnownState)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Version).To(Equal(Version))
+			Expect(decoded.Operation).To(BeEmpty())
+		})
+	})
+
+	Describe("#Decode", func() {
+		It("should return a new State for an empty last known state", func() {
+			s, err := Decode("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s).To(Equal(New()))
+		})
+
+		It("should return a new State for a legacy last known state", func() {
+			s, err := Decode("Machine machine-1 created")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s).To(Equal(New()))
+		})
+
+		It("should fail for malformed JSON", func() {
+			_, err := Decode(`{"version":"v1","operation":`)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail for fields of the wrong type", func() {
+			_, err := Decode(`{"version":"v1","dataVolumes":["machine-1"]}`)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should fail for an unsupported version", func() {
+			_, err := Decode(`{"version":"v2","operation":"Create"}`)
+			Expect(err).To(MatchError(ContainSubstring(`unsupported last known state version "v2"`)))
+		})
+
+		It("should fail for a missing version", func() {
+			_, err := Decode(`{"operation":"Create"}`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("#SetPhase", func() {
+		It("should set the operation, phase, and last update time", func() {
+			now := time.Now()
+			s := New()
+			s.SetPhase(OperationDelete, PhaseStopping, now)
+
+			Expect(s.Is(OperationDelete, PhaseStopping)).To(BeTrue())
+			Expect(s.Is(OperationCreate, PhaseStopping)).To(BeFalse())
+			Expect(s.LastUpdateTime.Time).To(Equal(now))
+		})
+	})
+})
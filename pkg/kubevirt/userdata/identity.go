@@ -0,0 +1,161 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userdata
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// IdentityFilePath is the path of the machine identity file written by cloud-init.
+	IdentityFilePath = "/etc/machine-identity"
+	// writeFilesKey is the cloud-config key containing the files written by cloud-init.
+	writeFilesKey = "write_files"
+)
+
+// Identity is the identity of a machine.
+type Identity struct {
+	// MachineName is the name of the machine.
+	MachineName string
+	// ProviderID is the provider ID of the machine.
+	ProviderID string
+	// Zone is the zone of the machine.
+	Zone string
+	// Additions are custom key/values added to the identity of the machine.
+	Additions map[string]string
+}
+
+// IdentityVariables are the shell variables of the machine identity file that are reserved for the built-in identity fields.
+var IdentityVariables = []string{"MACHINE_NAME", "PROVIDER_ID", "ZONE"}
+
+// AddIdentity adds a file containing the given machine identity, written to IdentityFilePath, to the given cloud-init userdata,
+// so that the node can identify itself during bootstrap without external lookups. The file contains shell variable assignments
+// of the built-in identity fields, see IdentityVariables, followed by the additions sorted by key, so that it can be sourced.
+// The userdata can be cloud-config, multi-part MIME, or a shell script, see AddSSHKeys.
+func AddIdentity(userData string, identity *Identity) (string, error) {
+	file := yaml.MapSlice{
+		{Key: "path", Value: IdentityFilePath},
+		{Key: "permissions", Value: "0644"},
+		{Key: "content", Value: buildIdentityFileContent(identity)},
+	}
+	section, err := yaml.Marshal(yaml.MapSlice{{Key: writeFilesKey, Value: []interface{}{file}}})
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal machine identity file")
+	}
+
+	return addToUserData(userData, func(cloudConfig string) (string, error) {
+		return addFileToCloudConfig(cloudConfig, file, string(section))
+	}, cloudConfigHeader+"\n"+string(section))
+}
+
+// addFileToCloudConfig adds the given file to the files written by cloud-init in the given cloud-config.
+// If the cloud-config doesn't contain any files yet, the given section is appended to it as is,
+// preserving its formatting and comments. Otherwise, the file is merged into the existing list,
+// replacing an existing file with the same path.
+func addFileToCloudConfig(cloudConfig string, file yaml.MapSlice, section string) (string, error) {
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(cloudConfig), &config); err != nil {
+		return "", errors.Wrap(err, "could not unmarshal cloud-config")
+	}
+
+	// Find the existing files, if any
+	index := -1
+	for i, item := range config {
+		if key, ok := item.Key.(string); ok && key == writeFilesKey {
+			index = i
+			break
+		}
+	}
+
+	// If there are no existing files, append the section
+	if index < 0 {
+		var builder strings.Builder
+		builder.WriteString(cloudConfig)
+		if !strings.HasSuffix(cloudConfig, "\n") {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(section)
+		return builder.String(), nil
+	}
+
+	// Otherwise, merge the file into the existing list
+	var files []interface{}
+	if config[index].Value != nil {
+		existingFiles, ok := config[index].Value.([]interface{})
+		if !ok {
+			return "", errors.Errorf("cloud-config key %q is not a list", writeFilesKey)
+		}
+		for _, existingFile := range existingFiles {
+			if !hasPath(existingFile, IdentityFilePath) {
+				files = append(files, existingFile)
+			}
+		}
+	}
+	config[index].Value = append(files, file)
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal cloud-config")
+	}
+	return cloudConfigHeader + "\n" + string(data), nil
+}
+
+// hasPath returns true if the given cloud-config file has the given path, false otherwise.
+func hasPath(file interface{}, path string) bool {
+	switch items := file.(type) {
+	case yaml.MapSlice:
+		for _, item := range items {
+			if key, ok := item.Key.(string); ok && key == "path" {
+				return item.Value == path
+			}
+		}
+	case map[interface{}]interface{}:
+		return items["path"] == path
+	}
+	return false
+}
+
+// buildIdentityFileContent builds the content of the machine identity file from the given machine identity.
+func buildIdentityFileContent(identity *Identity) string {
+	var builder strings.Builder
+	writeVariable := func(name, value string) {
+		builder.WriteString(name)
+		builder.WriteString("=")
+		builder.WriteString(quoteShell(value))
+		builder.WriteString("\n")
+	}
+
+	for i, value := range []string{identity.MachineName, identity.ProviderID, identity.Zone} {
+		writeVariable(IdentityVariables[i], value)
+	}
+	keys := make([]string, 0, len(identity.Additions))
+	for key := range identity.Additions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeVariable(key, identity.Additions[key])
+	}
+	return builder.String()
+}
+
+// quoteShell quotes the given value with single quotes, so that it's not interpreted by the shell.
+func quoteShell(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
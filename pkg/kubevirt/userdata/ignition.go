@@ -0,0 +1,80 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userdata
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignitionCoreUser is the user of Ignition based images that the SSH keys are added to.
+const ignitionCoreUser = "core"
+
+// IsIgnition returns true if the given userdata is an Ignition config, i.e. a JSON object with an "ignition" field.
+func IsIgnition(userData string) bool {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(userData), &config); err != nil {
+		return false
+	}
+	_, ok := config["ignition"]
+	return ok
+}
+
+// AddSSHKeysToIgnition adds the given SSH keys to the authorized keys of the "core" user in the given Ignition config.
+func AddSSHKeysToIgnition(userData string, sshKeys []string) (string, error) {
+	if len(sshKeys) == 0 {
+		return userData, nil
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(userData), &config); err != nil {
+		return "", errors.Wrap(err, "could not unmarshal Ignition config")
+	}
+
+	passwd, _ := config["passwd"].(map[string]interface{})
+	if passwd == nil {
+		passwd = map[string]interface{}{}
+	}
+	users, _ := passwd["users"].([]interface{})
+
+	// Find the "core" user, or append it if it doesn't exist
+	var coreUser map[string]interface{}
+	for _, u := range users {
+		if user, ok := u.(map[string]interface{}); ok && user["name"] == ignitionCoreUser {
+			coreUser = user
+			break
+		}
+	}
+	if coreUser == nil {
+		coreUser = map[string]interface{}{"name": ignitionCoreUser}
+		users = append(users, coreUser)
+	}
+
+	keys, _ := coreUser["sshAuthorizedKeys"].([]interface{})
+	for _, sshKey := range sshKeys {
+		keys = append(keys, strings.TrimSpace(sshKey))
+	}
+	coreUser["sshAuthorizedKeys"] = keys
+	passwd["users"] = users
+	config["passwd"] = passwd
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal Ignition config")
+	}
+	return string(data), nil
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// maxDecodingRounds is the maximum number of base64 decoding and gzip decompression rounds applied to userdata,
+// e.g. 2 for base64-encoded gzip-compressed userdata.
+const maxDecodingRounds = 3
+
+// gzipMagic are the first bytes of gzip-compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Keys are the secret keys that userdata is looked up in, in order of precedence.
+var Keys = []string{"userData", "userdata", "user-data", "user_data"}
+
+// Lookup returns the first of Keys that is present in the given secret data with a non-empty value, and that value.
+// If none of them is present with a non-empty value, it returns false.
+func Lookup(data map[string][]byte) (string, []byte, bool) {
+	for _, key := range Keys {
+		if value := data[key]; len(value) > 0 {
+			return key, value, true
+		}
+	}
+	return "", nil, false
+}
+
+// Decode decodes the given userdata if it's base64-encoded, gzip-compressed, or both, and returns it as text.
+// Userdata that is neither is returned as is. It returns an error if the result is empty or not text.
+func Decode(data []byte) (string, error) {
+	for i := 0; i < maxDecodingRounds; i++ {
+		if bytes.HasPrefix(data, gzipMagic) {
+			decompressed, err := gunzip(data)
+			if err != nil {
+				return "", errors.Wrap(err, "could not decompress gzip-compressed userdata")
+			}
+			data = decompressed
+			continue
+		}
+		if decoded, ok := decodeBase64(data); ok {
+			data = decoded
+			continue
+		}
+		break
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return "", errors.New("userdata is empty")
+	}
+	if !utf8.Valid(data) {
+		return "", errors.New("userdata is neither text nor base64-encoded or gzip-compressed text")
+	}
+	return string(data), nil
+}
+
+// Load looks up the userdata in the given secret data, see Lookup, and decodes it, see Decode.
+// It returns an error if none of Keys contains usable userdata.
+func Load(data map[string][]byte) (string, error) {
+	key, value, ok := Lookup(data)
+	if !ok {
+		return "", errors.Errorf("secret doesn't contain userdata in any of the keys %s", strings.Join(Keys, ", "))
+	}
+	userData, err := Decode(value)
+	if err != nil {
+		return "", errors.Wrapf(err, "secret key %q doesn't contain usable userdata", key)
+	}
+	return userData, nil
+}
+
+// decodeBase64 decodes the given data if it's base64-encoded, ignoring whitespace, and if the result is either
+// gzip-compressed or text. Plain userdata is never valid base64, since it contains characters such as '#', '{', ':', or '-'
+// that are not part of the base64 alphabet.
+func decodeBase64(data []byte) ([]byte, bool) {
+	encoded := strings.Join(strings.Fields(string(data)), "")
+	if encoded == "" {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) == 0 {
+		return nil, false
+	}
+	if !bytes.HasPrefix(decoded, gzipMagic) && !utf8.Valid(decoded) {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// gunzip decompresses the given gzip-compressed data.
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package userdata contains functions for manipulating the userdata passed to kubevirt virtual machines.
+package userdata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// cloudConfigHeader is the header of cloud-config userdata.
+	cloudConfigHeader = "#cloud-config"
+	// shellScriptHeader is the header of shell script userdata.
+	shellScriptHeader = "#!"
+	// sshAuthorizedKeysKey is the cloud-config key containing the SSH authorized keys.
+	sshAuthorizedKeysKey = "ssh_authorized_keys"
+
+	contentTypeCloudConfig = "text/cloud-config"
+	contentTypeShellScript = "text/x-shellscript"
+	contentTypeMultipart   = "multipart/mixed"
+)
+
+// mimeHeaderRegex matches the first line of multi-part MIME userdata.
+var mimeHeaderRegex = regexp.MustCompile(`(?i)^(content-type|mime-version):`)
+
+// AddSSHKeys adds the given SSH keys to the authorized keys in the given cloud-config userdata.
+// Any other userdata, e.g. a shell script or multi-part MIME userdata, is returned unchanged, since adding the keys
+// would change how cloud-init processes it, see IsCloudConfig.
+func AddSSHKeys(userData string, sshKeys []string) (string, error) {
+	if len(sshKeys) == 0 || !IsCloudConfig(userData) {
+		return userData, nil
+	}
+	return addSSHKeysToCloudConfig(userData, sshKeys)
+}
+
+// IsCloudConfig returns true if the given cloud-init userdata is cloud-config userdata, false otherwise.
+func IsCloudConfig(userData string) bool {
+	return strings.HasPrefix(userData, cloudConfigHeader)
+}
+
+// addToUserData adds a section to the given cloud-init userdata. Cloud-config userdata and the first cloud-config part
+// of multi-part MIME userdata are extended with the given function. Multi-part MIME userdata without a cloud-config part
+// and shell scripts are extended with a part containing the given cloud-config.
+func addToUserData(userData string, addToCloudConfig func(string) (string, error), cloudConfig string) (string, error) {
+	switch {
+	case strings.HasPrefix(userData, cloudConfigHeader):
+		return addToCloudConfig(userData)
+	case mimeHeaderRegex.MatchString(userData):
+		return addToMultipart(userData, addToCloudConfig, cloudConfig)
+	case strings.HasPrefix(userData, shellScriptHeader):
+		return buildMultipart([]part{
+			{header: partHeader(contentTypeShellScript), body: []byte(userData)},
+			{header: partHeader(contentTypeCloudConfig), body: []byte(cloudConfig)},
+		}, "")
+	default:
+		return "", errors.New("unsupported userdata format, must be cloud-config, multi-part MIME, or a shell script")
+	}
+}
+
+// addSSHKeysToCloudConfig adds the given SSH keys to the given cloud-config.
+// If the cloud-config doesn't contain any SSH authorized keys yet, the keys are appended to it as is,
+// preserving its formatting and comments. Otherwise, the keys are merged into the existing list.
+func addSSHKeysToCloudConfig(cloudConfig string, sshKeys []string) (string, error) {
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(cloudConfig), &config); err != nil {
+		return "", errors.Wrap(err, "could not unmarshal cloud-config")
+	}
+
+	// Find the existing SSH authorized keys, if any
+	index := -1
+	for i, item := range config {
+		if key, ok := item.Key.(string); ok && key == sshAuthorizedKeysKey {
+			index = i
+			break
+		}
+	}
+
+	// If there are no existing SSH authorized keys, append them
+	if index < 0 {
+		var builder strings.Builder
+		builder.WriteString(cloudConfig)
+		if !strings.HasSuffix(cloudConfig, "\n") {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(buildCloudConfig(sshKeys)[len(cloudConfigHeader)+1:])
+		return builder.String(), nil
+	}
+
+	// Otherwise, merge them into the existing list
+	var existingKeys []interface{}
+	if config[index].Value != nil {
+		var ok bool
+		if existingKeys, ok = config[index].Value.([]interface{}); !ok {
+			return "", errors.Errorf("cloud-config key %q is not a list", sshAuthorizedKeysKey)
+		}
+	}
+	config[index].Value = mergeSSHKeys(existingKeys, sshKeys)
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal cloud-config")
+	}
+	return cloudConfigHeader + "\n" + string(data), nil
+}
+
+// mergeSSHKeys appends the given SSH keys that are not yet contained in the given existing keys.
+func mergeSSHKeys(existingKeys []interface{}, sshKeys []string) []interface{} {
+	keys := append([]interface{}{}, existingKeys...)
+	for _, sshKey := range sshKeys {
+		sshKey = strings.TrimSpace(sshKey)
+		found := false
+		for _, existingKey := range existingKeys {
+			if s, ok := existingKey.(string); ok && strings.TrimSpace(s) == sshKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, sshKey)
+		}
+	}
+	return keys
+}
+
+// buildCloudConfig builds a cloud-config containing only the given SSH keys.
+func buildCloudConfig(sshKeys []string) string {
+	var builder strings.Builder
+	builder.WriteString(cloudConfigHeader)
+	builder.WriteString("\n")
+	builder.WriteString(sshAuthorizedKeysKey)
+	builder.WriteString(":\n")
+	for _, sshKey := range sshKeys {
+		builder.WriteString("- ")
+		builder.WriteString(strings.TrimSpace(sshKey))
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// part is a part of multi-part MIME userdata.
+type part struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// addToMultipart extends the first cloud-config part of the given multi-part MIME userdata with the given function.
+// If there is no cloud-config part, a new one containing the given cloud-config is appended.
+func addToMultipart(userData string, addToCloudConfig func(string) (string, error), cloudConfig string) (string, error) {
+	parts, boundary, err := parseMultipart(userData)
+	if err != nil {
+		return "", err
+	}
+
+	found := false
+	for i := range parts {
+		mediaType, _, err := mime.ParseMediaType(parts[i].header.Get("Content-Type"))
+		if err != nil || mediaType != contentTypeCloudConfig {
+			continue
+		}
+
+		// Decode the cloud-config part if it's base64 encoded
+		base64Encoded := strings.EqualFold(parts[i].header.Get("Content-Transfer-Encoding"), "base64")
+		body := parts[i].body
+		if base64Encoded {
+			if body, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), "")); err != nil {
+				return "", errors.Wrap(err, "could not decode cloud-config part")
+			}
+		}
+
+		extended, err := addToCloudConfig(string(body))
+		if err != nil {
+			return "", err
+		}
+
+		parts[i].body = []byte(extended)
+		if base64Encoded {
+			parts[i].body = []byte(base64.StdEncoding.EncodeToString(parts[i].body))
+		}
+		found = true
+		break
+	}
+	if !found {
+		parts = append(parts, part{header: partHeader(contentTypeCloudConfig), body: []byte(cloudConfig)})
+	}
+
+	return buildMultipart(parts, boundary)
+}
+
+// parseMultipart parses the parts and the boundary of the given multi-part MIME userdata.
+func parseMultipart(userData string) ([]part, string, error) {
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(userData)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not read multi-part MIME header")
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not parse multi-part MIME content type")
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, "", errors.Errorf("unsupported MIME content type %q", mediaType)
+	}
+
+	var parts []part
+	multipartReader := multipart.NewReader(reader.R, params["boundary"])
+	for {
+		p, err := multipartReader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "could not read multi-part MIME part")
+		}
+		body, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "could not read multi-part MIME part")
+		}
+		parts = append(parts, part{header: p.Header, body: body})
+	}
+	return parts, params["boundary"], nil
+}
+
+// buildMultipart builds multi-part MIME userdata from the given parts, using the given boundary.
+// If the boundary is empty, a boundary is derived from the contents of the parts, so that the result is stable.
+func buildMultipart(parts []part, boundary string) (string, error) {
+	if boundary == "" {
+		hash := sha256.New()
+		for _, p := range parts {
+			hash.Write(p.body)
+		}
+		boundary = fmt.Sprintf("%x", hash.Sum(nil))[:30]
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return "", errors.Wrap(err, "could not set multi-part MIME boundary")
+	}
+	for _, p := range parts {
+		w, err := writer.CreatePart(p.header)
+		if err != nil {
+			return "", errors.Wrap(err, "could not create multi-part MIME part")
+		}
+		if _, err := w.Write(p.body); err != nil {
+			return "", errors.Wrap(err, "could not write multi-part MIME part")
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", errors.Wrap(err, "could not close multi-part MIME writer")
+	}
+
+	var builder strings.Builder
+	builder.WriteString("Content-Type: " + mime.FormatMediaType(contentTypeMultipart, map[string]string{"boundary": writer.Boundary()}) + "\n")
+	builder.WriteString("MIME-Version: 1.0\n\n")
+	builder.Write(buf.Bytes())
+	return builder.String(), nil
+}
+
+// partHeader returns the header of a multi-part MIME part with the given content type.
+func partHeader(contentType string) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "us-ascii"}))
+	header.Set("MIME-Version", "1.0")
+	return header
+}
+
+// CompressionThreshold is the size in bytes above which userdata is gzip-compressed by default.
+const CompressionThreshold = 16 * 1024
+
+// Encode encodes the given userdata for storing it in the userdata secret. If compress is true, or if it is nil
+// and the userdata is larger than CompressionThreshold, the userdata is gzip-compressed.
+// cloud-init detects and decompresses gzip-compressed userdata automatically.
+func Encode(userData string, compress *bool) ([]byte, error) {
+	if compress != nil && !*compress || compress == nil && len(userData) <= CompressionThreshold {
+		return []byte(userData), nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(userData)); err != nil {
+		return nil, errors.Wrap(err, "could not compress userdata")
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.Wrap(err, "could not compress userdata")
+	}
+	return buf.Bytes(), nil
+}
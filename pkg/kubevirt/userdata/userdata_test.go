@@ -0,0 +1,227 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userdata_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/userdata"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	sshKey1 = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQDdOIhYmzCK5DSVLu3b"
+	sshKey2 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFq2TZJ7Y3P8"
+)
+
+var _ = Describe("UserData", func() {
+	Describe("#AddSSHKeys", func() {
+		It("should return the userdata unchanged if there are no SSH keys", func() {
+			userData, err := AddSSHKeys("#!/bin/bash\necho hello\n", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal("#!/bin/bash\necho hello\n"))
+		})
+
+		It("should append the SSH keys to a cloud-config without SSH keys, preserving comments", func() {
+			userData, err := AddSSHKeys("#cloud-config\n# set the password\npassword: pass\n", []string{sshKey1, sshKey2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal("#cloud-config\n# set the password\npassword: pass\nssh_authorized_keys:\n- " + sshKey1 + "\n- " + sshKey2 + "\n"))
+		})
+
+		It("should merge the SSH keys into the existing SSH keys of a cloud-config", func() {
+			userData, err := AddSSHKeys("#cloud-config\npassword: pass\nssh_authorized_keys:\n- "+sshKey1+"\n", []string{sshKey1, sshKey2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal("#cloud-config\npassword: pass\nssh_authorized_keys:\n- " + sshKey1 + "\n- " + sshKey2 + "\n"))
+		})
+
+		It("should fail if the existing SSH keys of a cloud-config are not a list", func() {
+			_, err := AddSSHKeys("#cloud-config\nssh_authorized_keys: foo\n", []string{sshKey1})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return multi-part MIME userdata unchanged", func() {
+			multipart := "Content-Type: multipart/mixed; boundary=\"BOUNDARY\"\nMIME-Version: 1.0\n\n" +
+				"--BOUNDARY\nContent-Type: text/cloud-config\n\n#cloud-config\npassword: pass\n" +
+				"--BOUNDARY--\n"
+			userData, err := AddSSHKeys(multipart, []string{sshKey1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal(multipart))
+		})
+
+		It("should return a shell script unchanged", func() {
+			userData, err := AddSSHKeys("#!/bin/bash\necho hello\n", []string{sshKey1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal("#!/bin/bash\necho hello\n"))
+		})
+
+		It("should return userdata of an unknown format unchanged", func() {
+			userData, err := AddSSHKeys("password: pass\n", []string{sshKey1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal("password: pass\n"))
+		})
+	})
+
+	Describe("#Encode", func() {
+		It("should not compress small userdata by default", func() {
+			data, err := Encode("#cloud-config\npassword: pass\n", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("#cloud-config\npassword: pass\n"))
+		})
+
+		It("should compress large userdata by default", func() {
+			userData := "#cloud-config\n" + strings.Repeat("# comment\n", CompressionThreshold/10)
+			data, err := Encode(userData, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gunzip(data)).To(Equal(userData))
+		})
+
+		It("should compress small userdata if requested", func() {
+			data, err := Encode("#cloud-config\npassword: pass\n", pointer.BoolPtr(true))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gunzip(data)).To(Equal("#cloud-config\npassword: pass\n"))
+		})
+
+		It("should not compress large userdata if not requested", func() {
+			userData := "#cloud-config\n" + strings.Repeat("# comment\n", CompressionThreshold/10)
+			data, err := Encode(userData, pointer.BoolPtr(false))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(userData))
+		})
+	})
+
+	Describe("#AddSSHKeysToIgnition", func() {
+		It("should add the SSH keys to the existing core user", func() {
+			userData, err := AddSSHKeysToIgnition(`{"ignition":{"version":"2.2.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["`+sshKey1+`"]}]}}`, []string{sshKey2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(MatchJSON(`{"ignition":{"version":"2.2.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["` + sshKey1 + `","` + sshKey2 + `"]}]}}`))
+		})
+	})
+
+	Describe("#Load", func() {
+		const cloudConfig = "#cloud-config\npassword: pass\n"
+
+		It("should load plain userdata from the userData key", func() {
+			userData, err := Load(map[string][]byte{"userData": []byte(cloudConfig)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal(cloudConfig))
+		})
+
+		It("should load userdata from alternative keys", func() {
+			for _, key := range []string{"userdata", "user-data", "user_data"} {
+				userData, err := Load(map[string][]byte{key: []byte(cloudConfig)})
+				Expect(err).NotTo(HaveOccurred(), key)
+				Expect(userData).To(Equal(cloudConfig), key)
+			}
+		})
+
+		It("should prefer the userData key", func() {
+			userData, err := Load(map[string][]byte{"userData": []byte(cloudConfig), "userdata": []byte("#!/bin/sh\n")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal(cloudConfig))
+		})
+
+		It("should decode base64-encoded userdata", func() {
+			userData, err := Load(map[string][]byte{"userData": []byte(base64.StdEncoding.EncodeToString([]byte(cloudConfig)) + "\n")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal(cloudConfig))
+		})
+
+		It("should decompress gzip-compressed userdata, also if it's base64-encoded", func() {
+			compressed, err := Encode(cloudConfig, pointer.BoolPtr(true))
+			Expect(err).NotTo(HaveOccurred())
+
+			userData, err := Load(map[string][]byte{"userData": compressed})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal(cloudConfig))
+
+			userData, err = Load(map[string][]byte{"userData": []byte(base64.StdEncoding.EncodeToString(compressed))})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal(cloudConfig))
+		})
+
+		It("should fail if no key contains userdata", func() {
+			_, err := Load(map[string][]byte{"kubeconfig": []byte("{}"), "userData": nil})
+			Expect(err).To(MatchError("secret doesn't contain userdata in any of the keys userData, userdata, user-data, user_data"))
+		})
+
+		It("should fail if the userdata is not usable", func() {
+			_, err := Load(map[string][]byte{"userData": {0xff, 0xfe, 0x00}})
+			Expect(err).To(MatchError(ContainSubstring(`secret key "userData" doesn't contain usable userdata`)))
+
+			_, err = Load(map[string][]byte{"userData": []byte(" \n")})
+			Expect(err).To(MatchError(ContainSubstring("userdata is empty")))
+		})
+	})
+
+	Describe("#AddIdentity", func() {
+		identity := &Identity{
+			MachineName: "machine-1",
+			ProviderID:  "kubevirt://machine-1",
+			Zone:        "local-1",
+			Additions:   map[string]string{"ROLE": "worker", "CLUSTER": "it's"},
+		}
+		identityFile := "- path: /etc/machine-identity\n  permissions: \"0644\"\n  content: |\n" +
+			"    MACHINE_NAME='machine-1'\n    PROVIDER_ID='kubevirt://machine-1'\n    ZONE='local-1'\n" +
+			"    CLUSTER='it'\"'\"'s'\n    ROLE='worker'\n"
+
+		It("should append the identity file to a cloud-config without files, preserving comments", func() {
+			userData, err := AddIdentity("#cloud-config\n# set the password\npassword: pass\n", identity)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal("#cloud-config\n# set the password\npassword: pass\nwrite_files:\n" + identityFile))
+		})
+
+		It("should merge the identity file into the existing files of a cloud-config, replacing a previous identity file", func() {
+			cloudConfig := "#cloud-config\nwrite_files:\n- path: /etc/foo\n  content: foo\n- path: /etc/machine-identity\n  content: old\n"
+			userData, err := AddIdentity(cloudConfig, identity)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(Equal("#cloud-config\nwrite_files:\n- path: /etc/foo\n  content: foo\n" + identityFile))
+		})
+
+		It("should fail if the existing files of a cloud-config are not a list", func() {
+			_, err := AddIdentity("#cloud-config\nwrite_files: foo\n", identity)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should add a cloud-config part with the identity file to a shell script", func() {
+			userData, err := AddIdentity("#!/bin/bash\necho hello\n", identity)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(userData).To(HavePrefix("Content-Type: multipart/mixed; boundary="))
+			Expect(userData).To(ContainSubstring("#!/bin/bash\necho hello\n"))
+			Expect(userData).To(ContainSubstring("#cloud-config\nwrite_files:\n" + identityFile))
+		})
+	})
+
+	Describe("#IsIgnition", func() {
+		It("should detect Ignition configs", func() {
+			Expect(IsIgnition(`{"ignition":{"version":"2.2.0"}}`)).To(BeTrue())
+			Expect(IsIgnition("#cloud-config\npassword: pass\n")).To(BeFalse())
+		})
+	})
+})
+
+func gunzip(data []byte) string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	Expect(err).NotTo(HaveOccurred())
+	result, err := ioutil.ReadAll(reader)
+	Expect(err).NotTo(HaveOccurred())
+	return string(result)
+}
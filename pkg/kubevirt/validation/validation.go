@@ -16,28 +16,110 @@ package validation
 
 import (
 	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 
 	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/userdata"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
 	"k8s.io/apimachinery/pkg/util/sets"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/tools/clientcmd"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
 	cdicorev1alpha1 "kubevirt.io/containerized-data-importer/pkg/apis/core/v1alpha1"
 )
 
-// ValidateKubevirtProviderSpec validates the given kubevirt provider spec.
-func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorList {
+var (
+	// serialRegex matches valid disk serial numbers.
+	serialRegex = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+	// macAddressPrefixRegex matches valid MAC address prefixes of 1 to 5 octets.
+	macAddressPrefixRegex = regexp.MustCompile(`^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){0,4}$`)
+	// interfaceModels are the supported network interface models.
+	interfaceModels = sets.NewString("virtio", "e1000", "e1000e", "ne2k_pci", "pcnet", "rtl8139")
+)
+
+// cpuFeaturePolicies is the list of valid CPU feature policies.
+var cpuFeaturePolicies = []string{"force", "require", "optional", "disable", "forbid"}
+
+// Options are the options of the validation of kubevirt provider specs and secrets.
+type Options struct {
+	// AllowedMachineTypes is the list of QEMU machine types that can be specified in the provider spec.
+	AllowedMachineTypes []string
+	// InCluster is whether the in-cluster mode is enabled by default for secrets that don't contain a kubeconfig,
+	// in which case the secret doesn't need to contain one.
+	InCluster bool
+}
+
+// NewOptions creates new Options with the default values.
+func NewOptions() *Options {
+	return &Options{
+		AllowedMachineTypes: []string{"q35", "pc"},
+	}
+}
+
+// ValidateKubevirtProviderSpec validates the given kubevirt provider spec with the given options.
+// The fields that can contain templates are validated with their templates resolved for an example machine.
+func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec, options *Options) field.ErrorList {
 	errs := field.ErrorList{}
 
+	spec, templateErrs := core.ResolveTemplates(spec, core.NewMachineTemplateData(exampleMachineName, spec))
+	errs = append(errs, templateErrs...)
+
 	if spec.Region == "" {
 		errs = append(errs, field.Required(field.NewPath("region"), "cannot be empty"))
 	}
 
-	if spec.Zone == "" {
+	switch {
+	case spec.Zone != "" && len(spec.Zones) > 0:
+		errs = append(errs, field.Invalid(field.NewPath("zones"), spec.Zones, "only one of zone or zones can be specified"))
+	case spec.Zone == "" && len(spec.Zones) == 0:
 		errs = append(errs, field.Required(field.NewPath("zone"), "cannot be empty"))
 	}
+	zones := sets.NewString()
+	for i, zone := range spec.Zones {
+		zonePath := field.NewPath("zones").Index(i)
+		switch {
+		case zone == "":
+			errs = append(errs, field.Required(zonePath, "cannot be empty"))
+		case zones.Has(zone):
+			errs = append(errs, field.Duplicate(zonePath, zone))
+		}
+		zones.Insert(zone)
+	}
+
+	switch spec.TopologyLabels {
+	case "", api.TopologyLabelsLegacy, api.TopologyLabelsGA:
+		break
+	case api.TopologyLabelsBoth:
+		if spec.RegionLabel != "" {
+			errs = append(errs, field.Forbidden(field.NewPath("regionLabel"), fmt.Sprintf("cannot be specified if the topology labels are %q", api.TopologyLabelsBoth)))
+		}
+		if spec.ZoneLabel != "" {
+			errs = append(errs, field.Forbidden(field.NewPath("zoneLabel"), fmt.Sprintf("cannot be specified if the topology labels are %q", api.TopologyLabelsBoth)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("topologyLabels"), spec.TopologyLabels,
+			[]string{api.TopologyLabelsLegacy, api.TopologyLabelsGA, api.TopologyLabelsBoth}))
+	}
+	if spec.RegionLabel != "" {
+		for _, msg := range utilvalidation.IsQualifiedName(spec.RegionLabel) {
+			errs = append(errs, field.Invalid(field.NewPath("regionLabel"), spec.RegionLabel, msg))
+		}
+	}
+	if spec.ZoneLabel != "" {
+		for _, msg := range utilvalidation.IsQualifiedName(spec.ZoneLabel) {
+			errs = append(errs, field.Invalid(field.NewPath("zoneLabel"), spec.ZoneLabel, msg))
+		}
+	}
 
 	requestsPath := field.NewPath("resources").Child("requests")
 	if spec.Resources.Requests.Memory().IsZero() {
@@ -47,8 +129,40 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 		errs = append(errs, field.Required(requestsPath.Child("cpu"), "cannot be zero"))
 	}
 
-	errs = append(errs, validateDataVolume(field.NewPath("rootVolume"), &spec.RootVolume)...)
+	// Guest memory larger than the requests is allowed for overcommitting memory, so it's only checked against the limits
+	if spec.Memory != nil && spec.Memory.Guest != nil {
+		guestPath := field.NewPath("memory").Child("guest")
+		limitsMemory := spec.Resources.Limits.Memory()
+
+		switch {
+		case spec.Memory.Guest.Sign() <= 0:
+			errs = append(errs, field.Invalid(guestPath, spec.Memory.Guest.String(), "must be greater than zero"))
+		case !limitsMemory.IsZero() && spec.Memory.Guest.Cmp(*limitsMemory) > 0:
+			errs = append(errs, field.Invalid(guestPath, spec.Memory.Guest.String(), "cannot be larger than resources.limits.memory"))
+		}
+	}
+
+	errs = append(errs, validateCPUAndMemory(spec)...)
+
+	rootVolumePath := field.NewPath("rootVolume")
+	if spec.RootVolume.PersistentVolumeClaim != nil {
+		if spec.RootVolume.PersistentVolumeClaim.ClaimName == "" {
+			errs = append(errs, field.Required(rootVolumePath.Child("persistentVolumeClaim", "claimName"), "cannot be empty"))
+		}
+		if spec.RootVolume.PVC != nil || !reflect.DeepEqual(spec.RootVolume.Source, cdicorev1alpha1.DataVolumeSource{}) {
+			errs = append(errs, field.Forbidden(rootVolumePath, "source and pvc cannot be specified together with persistentVolumeClaim"))
+		}
+	} else {
+		errs = append(errs, validateDataVolume(rootVolumePath, &spec.RootVolume.DataVolumeSpec)...)
+	}
+	if spec.RootVolume.Cache && spec.RootVolume.Source.HTTP == nil && spec.RootVolume.Source.Registry == nil {
+		errs = append(errs, field.Invalid(rootVolumePath.Child("cache"), spec.RootVolume.Cache, "can only be enabled for http or registry sources"))
+	}
+	if spec.RootDisk != nil {
+		errs = append(errs, validateDiskOptions(field.NewPath("rootDisk"), spec.RootDisk)...)
+	}
 
+	serviceAccountVolumes := 0
 	for i, volume := range spec.AdditionalVolumes {
 		volumePath := field.NewPath("additionalVolumes").Index(i)
 
@@ -56,16 +170,179 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 			errs = append(errs, field.Required(volumePath.Child("name"), "cannot be empty"))
 		}
 
+		if countVolumeSources(volume) > 1 {
+			errs = append(errs, field.Invalid(volumePath, volume, "invalid volume, only one of dataVolume, volumeSource, or emptyDisk can be specified"))
+		}
 		switch {
 		case volume.DataVolume != nil:
 			errs = append(errs, validateDataVolume(volumePath.Child("dataVolume"), volume.DataVolume)...)
 		case volume.VolumeSource != nil:
+			errs = append(errs, validateVolumeSource(volumePath.Child("volumeSource"), volume.VolumeSource)...)
+			if volume.VolumeSource.ServiceAccount != nil {
+				if serviceAccountVolumes++; serviceAccountVolumes > 1 {
+					errs = append(errs, field.Forbidden(volumePath.Child("volumeSource", "serviceAccount"), "only one service account volume can be specified"))
+				}
+			}
+		case volume.EmptyDisk != nil:
+			if volume.EmptyDisk.Capacity.Sign() <= 0 {
+				errs = append(errs, field.Invalid(volumePath.Child("emptyDisk", "capacity"), volume.EmptyDisk.Capacity.String(), "must be greater than zero"))
+			}
+		default:
+			errs = append(errs, field.Invalid(volumePath, volume, "invalid volume, either dataVolume, volumeSource, or emptyDisk must be specified"))
+		}
+
+		errs = append(errs, validateDiskOptions(volumePath, &volume.DiskOptions)...)
+
+		if volume.Hotpluggable {
+			if volume.Bus != "" && volume.Bus != api.DiskBusSCSI {
+				errs = append(errs, field.Invalid(volumePath.Child("bus"), volume.Bus, fmt.Sprintf("must be %q for hotpluggable volumes", api.DiskBusSCSI)))
+			}
+			if volume.Name != "" && !serialRegex.MatchString(volume.Name) {
+				errs = append(errs, field.Invalid(volumePath.Child("name"), volume.Name,
+					"must consist of alphanumeric characters, '_', '.', '+', or '-' for hotpluggable volumes"))
+			}
+			if volume.Serial != "" {
+				errs = append(errs, field.Forbidden(volumePath.Child("serial"), "cannot be set for hotpluggable volumes, the volume name is used as serial number"))
+			}
+		}
+
+		switch volume.DeletionPolicy {
+		case "", api.VolumeDeletionPolicyDelete:
+			break
+		case api.VolumeDeletionPolicyRetain:
+			if volume.DataVolume == nil {
+				errs = append(errs, field.Invalid(volumePath.Child("deletionPolicy"), volume.DeletionPolicy, "can only be specified for data volumes"))
+			}
+			if volume.DataVolumeName != "" {
+				errs = append(errs, validateDNSLabelTemplate(volumePath.Child("dataVolumeName"), volume.DataVolumeName)...)
+			} else if volume.Name != "" {
+				for _, msg := range utilvalidation.IsDNS1123Label(volume.Name) {
+					errs = append(errs, field.Invalid(volumePath.Child("name"), volume.Name, fmt.Sprintf("%s, since it's part of the retained data volume name", msg)))
+				}
+			}
+		default:
+			errs = append(errs, field.NotSupported(volumePath.Child("deletionPolicy"), volume.DeletionPolicy,
+				[]string{api.VolumeDeletionPolicyDelete, api.VolumeDeletionPolicyRetain}))
+		}
+		if volume.DataVolumeName != "" && volume.DeletionPolicy != api.VolumeDeletionPolicyRetain {
+			errs = append(errs, field.Forbidden(volumePath.Child("dataVolumeName"), "can only be specified if the deletion policy is \"Retain\""))
+		}
+
+		if volume.Bootable && (volume.VolumeSource != nil && volume.VolumeSource.PersistentVolumeClaim == nil || volume.EmptyDisk != nil) {
+			errs = append(errs, field.Invalid(volumePath.Child("bootable"), volume.Bootable, "can only be enabled for data volumes and persistent volume claims"))
+		}
+	}
+
+	macAddresses := sets.NewString()
+	defaultNetwork := false
+	for i := range spec.Networks {
+		networkPath := field.NewPath("networks").Index(i)
+		errs = append(errs, validateNetwork(networkPath, &spec.Networks[i])...)
+		if spec.Networks[i].Default {
+			if defaultNetwork {
+				errs = append(errs, field.Invalid(networkPath.Child("default"), spec.Networks[i].Default, "only one network can be the default network"))
+			}
+			defaultNetwork = true
+			if _, ok := spec.VMIAnnotations[core.MultusDefaultNetworkAnnotation]; ok && spec.Networks[i].DefaultViaAnnotation {
+				errs = append(errs, field.Forbidden(field.NewPath("vmiAnnotations").Key(core.MultusDefaultNetworkAnnotation),
+					"cannot be specified if the default network is set via annotation"))
+			}
+		}
+		if macAddress := strings.ToLower(spec.Networks[i].MACAddress); macAddress != "" {
+			if macAddresses.Has(macAddress) {
+				errs = append(errs, field.Duplicate(networkPath.Child("macAddress"), spec.Networks[i].MACAddress))
+			}
+			macAddresses.Insert(macAddress)
+		}
+	}
+
+	if spec.DisablePodNetwork && len(spec.Networks) == 0 {
+		errs = append(errs, field.Required(field.NewPath("networks"), "at least one network must be specified if the pod network is disabled"))
+	}
+
+	if spec.Sysprep != nil {
+		errs = append(errs, validateSysprep(field.NewPath("sysprep"), spec.Sysprep)...)
+	}
+
+	if spec.Windows != nil && strings.ContainsAny(spec.Windows.VirtioDriversImage, " \t\n") {
+		errs = append(errs, field.Invalid(field.NewPath("windows", "virtioDriversImage"), spec.Windows.VirtioDriversImage, "must be a valid image reference"))
+	}
+
+	switch spec.CloudInitType {
+	case "", api.CloudInitTypeNoCloud, api.CloudInitTypeConfigDrive:
+		break
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("cloudInitType"), spec.CloudInitType, []string{api.CloudInitTypeNoCloud, api.CloudInitTypeConfigDrive}))
+	}
+
+	switch spec.UserDataFormat {
+	case "", api.UserDataFormatCloudInit:
+		break
+	case api.UserDataFormatIgnition:
+		if spec.CloudInitType != "" {
+			errs = append(errs, field.Forbidden(field.NewPath("cloudInitType"), fmt.Sprintf("cannot be specified with the %s userdata format", api.UserDataFormatIgnition)))
+		}
+		if spec.NetworkData != "" {
+			errs = append(errs, field.Forbidden(field.NewPath("networkData"), fmt.Sprintf("cannot be specified with the %s userdata format", api.UserDataFormatIgnition)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("userDataFormat"), spec.UserDataFormat, []string{api.UserDataFormatCloudInit, api.UserDataFormatIgnition}))
+	}
+
+	if spec.InjectMachineIdentity && spec.UserDataFormat == api.UserDataFormatIgnition {
+		errs = append(errs, field.Forbidden(field.NewPath("injectMachineIdentity"), fmt.Sprintf("cannot be specified with the %s userdata format", api.UserDataFormatIgnition)))
+	}
+	if len(spec.UserDataAdditions) > 0 && !spec.InjectMachineIdentity {
+		errs = append(errs, field.Forbidden(field.NewPath("userDataAdditions"), "can only be specified if injectMachineIdentity is true"))
+	}
+	reservedVariables := sets.NewString(userdata.IdentityVariables...)
+	for key := range spec.UserDataAdditions {
+		keyPath := field.NewPath("userDataAdditions").Key(key)
+		for _, msg := range utilvalidation.IsCIdentifier(key) {
+			errs = append(errs, field.Invalid(keyPath, key, msg))
+		}
+		if reservedVariables.Has(key) {
+			errs = append(errs, field.Invalid(keyPath, key, "is reserved for the built-in identity fields"))
+		}
+	}
+
+	if spec.MachineType != "" && !sets.NewString(options.AllowedMachineTypes...).Has(spec.MachineType) {
+		errs = append(errs, field.NotSupported(field.NewPath("machineType"), spec.MachineType, options.AllowedMachineTypes))
+	}
+
+	if spec.Firmware != nil {
+		firmwarePath := field.NewPath("firmware")
+
+		switch spec.Firmware.Bootloader {
+		case "", api.BootloaderBIOS, api.BootloaderEFI:
 			break
 		default:
-			errs = append(errs, field.Invalid(volumePath, volume, "invalid volume, either dataVolume or volumeSource must be specified"))
+			errs = append(errs, field.NotSupported(firmwarePath.Child("bootloader"), spec.Firmware.Bootloader, []string{api.BootloaderBIOS, api.BootloaderEFI}))
+		}
+
+		if spec.Firmware.SecureBoot && spec.Firmware.Bootloader != api.BootloaderEFI {
+			errs = append(errs, field.Forbidden(firmwarePath.Child("secureBoot"), fmt.Sprintf("can only be enabled with the %s bootloader", api.BootloaderEFI)))
 		}
 	}
 
+	if spec.ShutdownGracePeriodSeconds != nil && *spec.ShutdownGracePeriodSeconds < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("shutdownGracePeriodSeconds"), *spec.ShutdownGracePeriodSeconds, "cannot be negative"))
+	}
+
+	if spec.LivenessProbe != nil {
+		errs = append(errs, validateProbe(field.NewPath("livenessProbe"), spec.LivenessProbe)...)
+	}
+	if spec.ReadinessProbe != nil {
+		errs = append(errs, validateProbe(field.NewPath("readinessProbe"), spec.ReadinessProbe)...)
+	}
+
+	if spec.Features != nil {
+		errs = append(errs, validateFeatures(field.NewPath("features"), spec.Features, spec.Firmware != nil && spec.Firmware.SecureBoot)...)
+	}
+	if spec.Clock != nil {
+		errs = append(errs, validateClock(field.NewPath("clock"), spec.Clock)...)
+	}
+
 	if spec.DNSPolicy != "" {
 		dnsPolicyPath := field.NewPath("dnsPolicy")
 		dnsConfigPath := field.NewPath("dnsConfig")
@@ -86,6 +363,40 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 		}
 	}
 
+	if spec.PriorityClassName != "" {
+		for _, msg := range utilvalidation.IsDNS1123Subdomain(spec.PriorityClassName) {
+			errs = append(errs, field.Invalid(field.NewPath("priorityClassName"), spec.PriorityClassName, msg))
+		}
+	}
+	errs = append(errs, validateDNSLabelTemplate(field.NewPath("hostname"), spec.Hostname)...)
+	errs = append(errs, validateDNSLabelTemplate(field.NewPath("subdomain"), spec.Subdomain)...)
+	if spec.SchedulerName != "" {
+		for _, msg := range utilvalidation.IsDNS1123Subdomain(spec.SchedulerName) {
+			errs = append(errs, field.Invalid(field.NewPath("schedulerName"), spec.SchedulerName, msg))
+		}
+	}
+
+	errs = append(errs, validateTolerations(field.NewPath("tolerations"), spec.Tolerations)...)
+	errs = append(errs, metav1validation.ValidateLabels(spec.NodeSelector, field.NewPath("nodeSelector"))...)
+
+	errs = append(errs, metav1validation.ValidateLabels(spec.Tags, field.NewPath("tags"))...)
+	errs = append(errs, apivalidation.ValidateAnnotations(spec.Annotations, field.NewPath("annotations"))...)
+	errs = append(errs, apivalidation.ValidateAnnotations(spec.VMIAnnotations, field.NewPath("vmiAnnotations"))...)
+	errs = append(errs, metav1validation.ValidateLabels(spec.VMILabels, field.NewPath("vmiLabels"))...)
+	if spec.Eviction != nil && spec.Eviction.Strategy != nil && *spec.Eviction.Strategy != kubevirtv1.EvictionStrategyLiveMigrate {
+		errs = append(errs, field.NotSupported(field.NewPath("eviction", "strategy"), *spec.Eviction.Strategy, []string{string(kubevirtv1.EvictionStrategyLiveMigrate)}))
+	}
+
+	if spec.IOThreadsPolicy != nil {
+		switch *spec.IOThreadsPolicy {
+		case kubevirtv1.IOThreadsPolicyShared, kubevirtv1.IOThreadsPolicyAuto:
+			break
+		default:
+			errs = append(errs, field.NotSupported(field.NewPath("ioThreadsPolicy"), *spec.IOThreadsPolicy,
+				[]string{string(kubevirtv1.IOThreadsPolicyShared), string(kubevirtv1.IOThreadsPolicyAuto)}))
+		}
+	}
+
 	if spec.Devices != nil {
 		disksPath := field.NewPath("devices").Child("disks")
 		disks := sets.NewString()
@@ -99,7 +410,8 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 
 		for i, disk := range spec.Devices.Disks {
 			if disk.BootOrder != nil {
-				errs = append(errs, field.Forbidden(disksPath.Index(i).Child("bootOrder"), "cannot be set"))
+				errs = append(errs, field.Forbidden(disksPath.Index(i).Child("bootOrder"),
+					"cannot be set, the boot order is managed via additionalVolumes[].bootable and networks[].pxeBoot"))
 			}
 
 			if disk.Name == "" {
@@ -111,12 +423,296 @@ func ValidateKubevirtProviderSpec(spec *api.KubeVirtProviderSpec) field.ErrorLis
 				errs = append(errs, field.Invalid(disksPath.Index(i).Child("name"), disk.Name, "no matching volume"))
 			}
 			disks.Insert(disk.Name)
+
+			errs = append(errs, validateDiskDevice(disksPath.Index(i), &disk, spec)...)
+		}
+
+		if spec.Devices.Watchdog != nil {
+			errs = append(errs, validateWatchdog(field.NewPath("devices").Child("watchdog"), spec.Devices.Watchdog)...)
+		}
+
+		if spec.Devices.Tablet != nil {
+			tabletPath := field.NewPath("devices").Child("tablet")
+			errs = append(errs, validateTablet(tabletPath, spec.Devices.Tablet)...)
+			if spec.Devices.AutoattachGraphicsDevice != nil && !*spec.Devices.AutoattachGraphicsDevice {
+				errs = append(errs, field.Forbidden(tabletPath, "cannot be specified if the graphics device is not attached"))
+			}
+		}
+	}
+
+	return errs
+}
+
+func validateFeatures(path *field.Path, features *kubevirtv1.Features, secureBoot bool) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if secureBoot && features.SMM != nil && features.SMM.Enabled != nil && !*features.SMM.Enabled {
+		errs = append(errs, field.Forbidden(path.Child("smm", "enabled"), "cannot be false if secure boot is enabled"))
+	}
+
+	if hyperv := features.Hyperv; hyperv != nil {
+		hypervPath := path.Child("hyperv")
+		if hyperv.Spinlocks != nil && hyperv.Spinlocks.Retries != nil && *hyperv.Spinlocks.Retries < 4096 {
+			errs = append(errs, field.Invalid(hypervPath.Child("spinlocks", "spinlocks"), *hyperv.Spinlocks.Retries, "must be at least 4096"))
+		}
+		if hyperv.VendorID != nil && len(hyperv.VendorID.VendorID) > 12 {
+			errs = append(errs, field.TooLong(hypervPath.Child("vendorid", "vendorid"), hyperv.VendorID.VendorID, 12))
 		}
 	}
 
 	return errs
 }
 
+func validateClock(path *field.Path, clock *kubevirtv1.Clock) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if clock.UTC != nil && clock.Timezone != nil {
+		errs = append(errs, field.Invalid(path, clock, "only one of utc or timezone can be specified"))
+	}
+	if clock.Timezone != nil && *clock.Timezone == "" {
+		errs = append(errs, field.Required(path.Child("timezone"), "cannot be empty"))
+	}
+
+	if timer := clock.Timer; timer != nil {
+		timerPath := path.Child("timer")
+		if timer.HPET != nil {
+			switch timer.HPET.TickPolicy {
+			case "", kubevirtv1.HPETTickPolicyDelay, kubevirtv1.HPETTickPolicyCatchup, kubevirtv1.HPETTickPolicyMerge, kubevirtv1.HPETTickPolicyDiscard:
+				break
+			default:
+				errs = append(errs, field.NotSupported(timerPath.Child("hpet", "tickPolicy"), timer.HPET.TickPolicy,
+					[]string{string(kubevirtv1.HPETTickPolicyDelay), string(kubevirtv1.HPETTickPolicyCatchup), string(kubevirtv1.HPETTickPolicyMerge), string(kubevirtv1.HPETTickPolicyDiscard)}))
+			}
+		}
+		if timer.PIT != nil {
+			switch timer.PIT.TickPolicy {
+			case "", kubevirtv1.PITTickPolicyDelay, kubevirtv1.PITTickPolicyCatchup, kubevirtv1.PITTickPolicyDiscard:
+				break
+			default:
+				errs = append(errs, field.NotSupported(timerPath.Child("pit", "tickPolicy"), timer.PIT.TickPolicy,
+					[]string{string(kubevirtv1.PITTickPolicyDelay), string(kubevirtv1.PITTickPolicyCatchup), string(kubevirtv1.PITTickPolicyDiscard)}))
+			}
+		}
+		if timer.RTC != nil {
+			switch timer.RTC.TickPolicy {
+			case "", kubevirtv1.RTCTickPolicyDelay, kubevirtv1.RTCTickPolicyCatchup:
+				break
+			default:
+				errs = append(errs, field.NotSupported(timerPath.Child("rtc", "tickPolicy"), timer.RTC.TickPolicy,
+					[]string{string(kubevirtv1.RTCTickPolicyDelay), string(kubevirtv1.RTCTickPolicyCatchup)}))
+			}
+			switch timer.RTC.Track {
+			case "", kubevirtv1.TrackGuest, kubevirtv1.TrackWall:
+				break
+			default:
+				errs = append(errs, field.NotSupported(timerPath.Child("rtc", "track"), timer.RTC.Track,
+					[]string{string(kubevirtv1.TrackGuest), string(kubevirtv1.TrackWall)}))
+			}
+		}
+	}
+
+	return errs
+}
+
+func validateProbe(path *field.Path, probe *kubevirtv1.Probe) field.ErrorList {
+	errs := field.ErrorList{}
+
+	switch {
+	case probe.HTTPGet == nil && probe.TCPSocket == nil:
+		errs = append(errs, field.Required(path, "either httpGet or tcpSocket must be specified"))
+	case probe.HTTPGet != nil && probe.TCPSocket != nil:
+		errs = append(errs, field.Forbidden(path, "only one of httpGet or tcpSocket can be specified"))
+	}
+
+	errs = append(errs, apivalidation.ValidateNonnegativeField(int64(probe.InitialDelaySeconds), path.Child("initialDelaySeconds"))...)
+	errs = append(errs, apivalidation.ValidateNonnegativeField(int64(probe.TimeoutSeconds), path.Child("timeoutSeconds"))...)
+	errs = append(errs, apivalidation.ValidateNonnegativeField(int64(probe.PeriodSeconds), path.Child("periodSeconds"))...)
+	errs = append(errs, apivalidation.ValidateNonnegativeField(int64(probe.SuccessThreshold), path.Child("successThreshold"))...)
+	errs = append(errs, apivalidation.ValidateNonnegativeField(int64(probe.FailureThreshold), path.Child("failureThreshold"))...)
+
+	return errs
+}
+
+func validateWatchdog(path *field.Path, watchdog *kubevirtv1.Watchdog) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if watchdog.Name == "" {
+		errs = append(errs, field.Required(path.Child("name"), "cannot be empty"))
+	}
+
+	if watchdog.I6300ESB == nil {
+		errs = append(errs, field.Required(path.Child("i6300esb"), "cannot be empty"))
+	} else {
+		switch watchdog.I6300ESB.Action {
+		case "", kubevirtv1.WatchdogActionPoweroff, kubevirtv1.WatchdogActionReset, kubevirtv1.WatchdogActionShutdown:
+			break
+		default:
+			errs = append(errs, field.NotSupported(path.Child("i6300esb", "action"), watchdog.I6300ESB.Action,
+				[]string{string(kubevirtv1.WatchdogActionPoweroff), string(kubevirtv1.WatchdogActionReset), string(kubevirtv1.WatchdogActionShutdown)}))
+		}
+	}
+
+	return errs
+}
+
+func validateTablet(path *field.Path, tablet *kubevirtv1.Input) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if tablet.Name == "" {
+		errs = append(errs, field.Required(path.Child("name"), "cannot be empty"))
+	}
+
+	switch tablet.Type {
+	case "", api.InputTypeTablet:
+		break
+	default:
+		errs = append(errs, field.NotSupported(path.Child("type"), tablet.Type, []string{api.InputTypeTablet}))
+	}
+
+	switch tablet.Bus {
+	case "", api.InputBusVirtio, api.InputBusUSB:
+		break
+	default:
+		errs = append(errs, field.NotSupported(path.Child("bus"), tablet.Bus, []string{api.InputBusVirtio, api.InputBusUSB}))
+	}
+
+	return errs
+}
+
+// exampleMachineName is the machine name for which templates are resolved before validating their results.
+const exampleMachineName = "shoot--dev--kubevirt-worker-1-5d9f8b7c6-abcde"
+
+func validateDNSLabelTemplate(path *field.Path, result string) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if result != "" {
+		for _, msg := range utilvalidation.IsDNS1123Label(result) {
+			errs = append(errs, field.Invalid(path, result, fmt.Sprintf("must result in a valid DNS label: %s", msg)))
+		}
+	}
+
+	return errs
+}
+
+func validateSysprep(path *field.Path, sysprep *api.SysprepSpec) field.ErrorList {
+	errs := field.ErrorList{}
+
+	switch {
+	case sysprep.ConfigMap != nil && sysprep.Secret != nil:
+		errs = append(errs, field.Invalid(path, sysprep, "only one of configMap or secret can be specified"))
+	case sysprep.ConfigMap != nil:
+		if sysprep.ConfigMap.Name == "" {
+			errs = append(errs, field.Required(path.Child("configMap", "name"), "cannot be empty"))
+		}
+	case sysprep.Secret != nil:
+		if sysprep.Secret.Name == "" {
+			errs = append(errs, field.Required(path.Child("secret", "name"), "cannot be empty"))
+		}
+	default:
+		errs = append(errs, field.Required(path, "either configMap or secret must be specified"))
+	}
+
+	return errs
+}
+
+func validateDiskDevice(path *field.Path, disk *kubevirtv1.Disk, spec *api.KubeVirtProviderSpec) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if disk.Floppy != nil {
+		errs = append(errs, field.Forbidden(path.Child("floppy"), "is not supported"))
+	}
+
+	var deviceTypes []string
+	var bus string
+	if disk.Disk != nil {
+		deviceTypes, bus = append(deviceTypes, "disk"), disk.Disk.Bus
+	}
+	if disk.LUN != nil {
+		deviceTypes, bus = append(deviceTypes, "lun"), disk.LUN.Bus
+	}
+	if disk.CDRom != nil {
+		deviceTypes, bus = append(deviceTypes, "cdrom"), disk.CDRom.Bus
+	}
+	if len(deviceTypes) > 1 {
+		errs = append(errs, field.Invalid(path, strings.Join(deviceTypes, ", "), "only one of disk, lun, or cdrom can be specified"))
+		return errs
+	}
+
+	// The disk options of the root disk or the additional volume override the bus of the disk
+	var volume *api.AdditionalVolumeSpec
+	if disk.Name == api.RootDiskName {
+		if spec.RootDisk != nil && spec.RootDisk.Bus != "" {
+			bus = spec.RootDisk.Bus
+		}
+	} else if volume = findVolumeByName(disk.Name, spec.AdditionalVolumes); volume != nil && volume.Bus != "" {
+		bus = volume.Bus
+	}
+
+	if len(deviceTypes) == 1 {
+		switch bus {
+		case "", api.DiskBusVirtio, api.DiskBusSATA, api.DiskBusSCSI:
+			break
+		default:
+			errs = append(errs, field.NotSupported(path.Child(deviceTypes[0], "bus"), bus, []string{api.DiskBusVirtio, api.DiskBusSATA, api.DiskBusSCSI}))
+		}
+	}
+
+	if disk.CDRom != nil {
+		if disk.Name == api.RootDiskName {
+			errs = append(errs, field.Forbidden(path.Child("cdrom"), "can only be used for additional volumes"))
+		}
+		if bus == api.DiskBusVirtio {
+			errs = append(errs, field.Invalid(path.Child("cdrom", "bus"), bus, fmt.Sprintf("must be %q or %q for cdrom disks", api.DiskBusSATA, api.DiskBusSCSI)))
+		}
+	}
+
+	if disk.LUN != nil && volume != nil && (volume.VolumeSource != nil && volume.VolumeSource.PersistentVolumeClaim == nil || volume.EmptyDisk != nil) {
+		errs = append(errs, field.Invalid(path.Child("lun"), disk.Name, "can only be used for data volumes and persistent volume claims"))
+	}
+
+	return errs
+}
+
+func validateVolumeSource(path *field.Path, source *api.VolumeSource) field.ErrorList {
+	errs := field.ErrorList{}
+
+	sources := 0
+	for _, set := range []bool{
+		source.PersistentVolumeClaim != nil,
+		source.ConfigMap != nil,
+		source.Secret != nil,
+		source.ServiceAccount != nil,
+	} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		errs = append(errs, field.Invalid(path, source, "exactly one of persistentVolumeClaim, configMap, secret, or serviceAccount must be specified"))
+	}
+
+	return errs
+}
+
+func countVolumeSources(volume api.AdditionalVolumeSpec) int {
+	count := 0
+	for _, set := range []bool{volume.DataVolume != nil, volume.VolumeSource != nil, volume.EmptyDisk != nil} {
+		if set {
+			count++
+		}
+	}
+	return count
+}
+
+func findVolumeByName(name string, volumes []api.AdditionalVolumeSpec) *api.AdditionalVolumeSpec {
+	for i := range volumes {
+		if volumes[i].Name == name {
+			return &volumes[i]
+		}
+	}
+	return nil
+}
+
 func hasVolumeWithName(diskName string, volumes []api.AdditionalVolumeSpec) bool {
 	for _, volume := range volumes {
 		if volume.Name == diskName {
@@ -126,18 +722,138 @@ func hasVolumeWithName(diskName string, volumes []api.AdditionalVolumeSpec) bool
 	return false
 }
 
-// ValidateKubevirtProviderSecret validates the given kubevirt provider secret.
-func ValidateKubevirtProviderSecret(secret *corev1.Secret) field.ErrorList {
+// ValidateKubevirtProviderSecret validates the given kubevirt provider secret with the given options.
+func ValidateKubevirtProviderSecret(secret *corev1.Secret, options *Options) field.ErrorList {
 	errs := field.ErrorList{}
 
-	if kubeconfig, ok := secret.Data["kubeconfig"]; !ok || len(kubeconfig) == 0 {
-		errs = append(errs, field.Required(field.NewPath("kubeconfig"), "cannot be empty"))
-	} else if _, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig); err != nil {
-		errs = append(errs, field.Invalid(field.NewPath("kubeconfig"), kubeconfig, fmt.Sprintf("could not get client config: %v", err)))
+	if inCluster, ok := secret.Data[core.InClusterField]; ok {
+		switch string(inCluster) {
+		case "true", "false":
+			break
+		default:
+			errs = append(errs, field.NotSupported(field.NewPath(core.InClusterField), string(inCluster), []string{"true", "false"}))
+		}
+	}
+
+	hasZoneKubeconfigs := false
+	for _, key := range sets.StringKeySet(secret.Data).List() {
+		if strings.HasPrefix(key, core.ZoneKubeconfigFieldPrefix) {
+			hasZoneKubeconfigs = true
+			errs = append(errs, validateKubeconfig(field.NewPath(key), secret.Data[key])...)
+		}
 	}
 
-	if userData, ok := secret.Data["userData"]; !ok || len(userData) == 0 {
+	if !core.IsInCluster(secret, options.InCluster) {
+		if kubeconfig, ok := secret.Data["kubeconfig"]; ok || !hasZoneKubeconfigs {
+			errs = append(errs, validateKubeconfig(field.NewPath("kubeconfig"), kubeconfig)...)
+		}
+	}
+
+	if key, value, ok := userdata.Lookup(secret.Data); !ok {
 		errs = append(errs, field.Required(field.NewPath("userData"), "cannot be empty"))
+	} else if _, err := userdata.Decode(value); err != nil {
+		errs = append(errs, field.Invalid(field.NewPath(key), "", err.Error()))
+	}
+
+	return errs
+}
+
+// validateCPUAndMemory validates the CPU model and features of the given provider spec, as well as
+// its dedicated CPU placement and hugepages settings against its resources, so that VMs that KubeVirt would reject after their creation are not created.
+func validateCPUAndMemory(spec *api.KubeVirtProviderSpec) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if spec.CPU != nil {
+		cpuPath := field.NewPath("cpu")
+		if strings.TrimSpace(spec.CPU.Model) != spec.CPU.Model {
+			errs = append(errs, field.Invalid(cpuPath.Child("model"), spec.CPU.Model, "cannot contain leading or trailing whitespace"))
+		}
+		features := sets.NewString()
+		for i, feature := range spec.CPU.Features {
+			featurePath := cpuPath.Child("features").Index(i)
+			if feature.Name == "" {
+				errs = append(errs, field.Required(featurePath.Child("name"), "cannot be empty"))
+			} else if features.Has(feature.Name) {
+				errs = append(errs, field.Duplicate(featurePath.Child("name"), feature.Name))
+			}
+			features.Insert(feature.Name)
+			if feature.Policy != "" && !sets.NewString(cpuFeaturePolicies...).Has(feature.Policy) {
+				errs = append(errs, field.NotSupported(featurePath.Child("policy"), feature.Policy, cpuFeaturePolicies))
+			}
+		}
+	}
+
+	dedicatedCPUPlacement := spec.CPU != nil && spec.CPU.DedicatedCPUPlacement
+	hugepages := spec.Memory != nil && spec.Memory.Hugepages != nil
+
+	if spec.CPU != nil && spec.CPU.IsolateEmulatorThread && !spec.CPU.DedicatedCPUPlacement {
+		errs = append(errs, field.Forbidden(field.NewPath("cpu").Child("isolateEmulatorThread"), "requires cpu.dedicatedCpuPlacement"))
+	}
+
+	requestsPath := field.NewPath("resources").Child("requests")
+	limitsPath := field.NewPath("resources").Child("limits")
+	if dedicatedCPUPlacement {
+		if cpu := spec.Resources.Requests.Cpu(); cpu.MilliValue()%1000 != 0 {
+			errs = append(errs, field.Invalid(requestsPath.Child("cpu"), cpu.String(), "must be an integer if cpu.dedicatedCpuPlacement is true"))
+		}
+		if vCPUs := getVCPUs(spec.CPU); vCPUs > 0 {
+			if cpu, ok := spec.Resources.Requests[corev1.ResourceCPU]; ok && cpu.MilliValue() != vCPUs*1000 {
+				errs = append(errs, field.Invalid(requestsPath.Child("cpu"), cpu.String(),
+					fmt.Sprintf("must be equal to the number of vCPUs %d given by cpu.cores, cpu.sockets, and cpu.threads if cpu.dedicatedCpuPlacement is true", vCPUs)))
+			}
+		}
+	}
+	if dedicatedCPUPlacement || hugepages {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			request, limit := spec.Resources.Requests[name], spec.Resources.Limits[name]
+			if _, ok := spec.Resources.Limits[name]; ok && request.Cmp(limit) != 0 {
+				errs = append(errs, field.Invalid(limitsPath.Child(string(name)), limit.String(),
+					fmt.Sprintf("must be equal to resources.requests.%s if cpu.dedicatedCpuPlacement is true or memory.hugepages is specified", name)))
+			}
+		}
+	}
+
+	if hugepages {
+		pageSizePath := field.NewPath("memory").Child("hugepages").Child("pageSize")
+		pageSize, err := resource.ParseQuantity(spec.Memory.Hugepages.PageSize)
+		if err != nil || pageSize.Sign() <= 0 {
+			errs = append(errs, field.Invalid(pageSizePath, spec.Memory.Hugepages.PageSize, "must be a valid positive quantity, e.g. 2Mi or 1Gi"))
+		} else {
+			memoryPath, memory := requestsPath.Child("memory"), spec.Resources.Requests.Memory()
+			if spec.Memory.Guest != nil {
+				memoryPath, memory = field.NewPath("memory").Child("guest"), spec.Memory.Guest
+			}
+			if memory.Value()%pageSize.Value() != 0 {
+				errs = append(errs, field.Invalid(memoryPath, memory.String(), fmt.Sprintf("must be a multiple of memory.hugepages.pageSize %s", pageSize.String())))
+			}
+		}
+	}
+
+	return errs
+}
+
+// getVCPUs returns the number of vCPUs given by the cores, sockets, and threads of the given CPU,
+// or 0 if none of them is specified, in which case KubeVirt derives the number of vCPUs from the CPU requests.
+func getVCPUs(cpu *kubevirtv1.CPU) int64 {
+	if cpu == nil || (cpu.Cores == 0 && cpu.Sockets == 0 && cpu.Threads == 0) {
+		return 0
+	}
+	vCPUs := int64(1)
+	for _, n := range []uint32{cpu.Cores, cpu.Sockets, cpu.Threads} {
+		if n > 0 {
+			vCPUs *= int64(n)
+		}
+	}
+	return vCPUs
+}
+
+func validateKubeconfig(path *field.Path, kubeconfig []byte) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if len(kubeconfig) == 0 {
+		errs = append(errs, field.Required(path, "cannot be empty"))
+	} else if _, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig); err != nil {
+		errs = append(errs, field.Invalid(path, kubeconfig, fmt.Sprintf("could not get client config: %v", err)))
 	}
 
 	return errs
@@ -158,6 +874,186 @@ func validateDataVolume(path *field.Path, dataVolume *cdicorev1alpha1.DataVolume
 	return errs
 }
 
+func validateDiskOptions(path *field.Path, options *api.DiskOptions) field.ErrorList {
+	errs := field.ErrorList{}
+
+	switch options.Bus {
+	case "", api.DiskBusVirtio, api.DiskBusSATA, api.DiskBusSCSI:
+		break
+	default:
+		errs = append(errs, field.NotSupported(path.Child("bus"), options.Bus, []string{api.DiskBusVirtio, api.DiskBusSATA, api.DiskBusSCSI}))
+	}
+
+	switch options.Cache {
+	case "", kubevirtv1.CacheNone, kubevirtv1.CacheWriteThrough, api.DiskCacheWriteBack:
+		break
+	default:
+		errs = append(errs, field.NotSupported(path.Child("cache"), options.Cache,
+			[]string{string(kubevirtv1.CacheNone), string(kubevirtv1.CacheWriteThrough), string(api.DiskCacheWriteBack)}))
+	}
+
+	switch options.IO {
+	case "", kubevirtv1.IONative, kubevirtv1.IOThreads:
+		break
+	default:
+		errs = append(errs, field.NotSupported(path.Child("io"), options.IO, []string{string(kubevirtv1.IONative), string(kubevirtv1.IOThreads)}))
+	}
+
+	if options.IO == kubevirtv1.IONative && options.Cache != "" && options.Cache != kubevirtv1.CacheNone {
+		errs = append(errs, field.Invalid(path.Child("io"), options.IO, fmt.Sprintf("cannot be used with cache mode %q", options.Cache)))
+	}
+
+	if options.Serial != "" && !serialRegex.MatchString(options.Serial) {
+		errs = append(errs, field.Invalid(path.Child("serial"), options.Serial, "must consist of alphanumeric characters, '_', '.', '+', or '-'"))
+	}
+
+	return errs
+}
+
+func validateNetwork(path *field.Path, network *api.NetworkSpec) field.ErrorList {
+	errs := field.ErrorList{}
+
+	if network.Name == "" {
+		errs = append(errs, field.Required(path.Child("name"), "cannot be empty"))
+	}
+
+	for i, address := range network.Addresses {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			errs = append(errs, field.Invalid(path.Child("addresses").Index(i), address, "must be an IP address in CIDR notation"))
+		}
+	}
+
+	if network.Gateway != "" {
+		if net.ParseIP(network.Gateway) == nil {
+			errs = append(errs, field.Invalid(path.Child("gateway"), network.Gateway, "must be an IP address"))
+		}
+		if len(network.Addresses) == 0 {
+			errs = append(errs, field.Forbidden(path.Child("gateway"), "can only be specified with addresses"))
+		}
+	}
+
+	for i, nameserver := range network.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			errs = append(errs, field.Invalid(path.Child("nameservers").Index(i), nameserver, "must be an IP address"))
+		}
+	}
+
+	if network.MTU < 0 {
+		errs = append(errs, field.Invalid(path.Child("mtu"), network.MTU, "cannot be negative"))
+	}
+
+	if network.DefaultViaAnnotation && !network.Default {
+		errs = append(errs, field.Invalid(path.Child("defaultViaAnnotation"), network.DefaultViaAnnotation, "can only be enabled for the default network"))
+	}
+
+	switch network.Binding {
+	case "", api.InterfaceBindingBridge:
+		if len(network.Ports) > 0 {
+			errs = append(errs, field.Forbidden(path.Child("ports"), fmt.Sprintf("can only be specified with binding %q", api.InterfaceBindingMasquerade)))
+		}
+	case api.InterfaceBindingMasquerade:
+		if !network.Default {
+			errs = append(errs, field.Invalid(path.Child("binding"), network.Binding, "can only be used for the default network"))
+		}
+		if len(network.Addresses) > 0 {
+			errs = append(errs, field.Forbidden(path.Child("addresses"), fmt.Sprintf("cannot be specified with binding %q", api.InterfaceBindingMasquerade)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(path.Child("binding"), network.Binding, []string{api.InterfaceBindingBridge, api.InterfaceBindingMasquerade}))
+	}
+	errs = append(errs, validatePorts(path.Child("ports"), network.Ports)...)
+
+	if network.Model != "" && !interfaceModels.Has(network.Model) {
+		errs = append(errs, field.NotSupported(path.Child("model"), network.Model, interfaceModels.List()))
+	}
+
+	if network.MACAddress != "" {
+		if mac, err := net.ParseMAC(network.MACAddress); err != nil || len(mac) != 6 {
+			errs = append(errs, field.Invalid(path.Child("macAddress"), network.MACAddress, "must be a MAC-48 address"))
+		} else if mac[0]&1 != 0 {
+			errs = append(errs, field.Invalid(path.Child("macAddress"), network.MACAddress, "must be a unicast MAC address"))
+		}
+		if network.MACAddressPrefix != "" {
+			errs = append(errs, field.Forbidden(path.Child("macAddressPrefix"), "cannot be specified together with macAddress"))
+		}
+	}
+
+	if network.MACAddressPrefix != "" {
+		if !macAddressPrefixRegex.MatchString(network.MACAddressPrefix) {
+			errs = append(errs, field.Invalid(path.Child("macAddressPrefix"), network.MACAddressPrefix,
+				"must consist of 1 to 5 octets of 2 hexadecimal digits separated by ':'"))
+		} else if firstOctet, _ := strconv.ParseUint(network.MACAddressPrefix[:2], 16, 8); firstOctet&1 != 0 {
+			errs = append(errs, field.Invalid(path.Child("macAddressPrefix"), network.MACAddressPrefix, "must be the prefix of a unicast MAC address"))
+		}
+	}
+
+	return errs
+}
+
+func validatePorts(path *field.Path, ports []kubevirtv1.Port) field.ErrorList {
+	errs := field.ErrorList{}
+
+	names := sets.NewString()
+	for i, port := range ports {
+		portPath := path.Index(i)
+		if port.Name != "" {
+			for _, msg := range utilvalidation.IsValidPortName(port.Name) {
+				errs = append(errs, field.Invalid(portPath.Child("name"), port.Name, msg))
+			}
+			if names.Has(port.Name) {
+				errs = append(errs, field.Duplicate(portPath.Child("name"), port.Name))
+			}
+			names.Insert(port.Name)
+		}
+		switch port.Protocol {
+		case "", string(corev1.ProtocolTCP), string(corev1.ProtocolUDP):
+			break
+		default:
+			errs = append(errs, field.NotSupported(portPath.Child("protocol"), port.Protocol, []string{string(corev1.ProtocolTCP), string(corev1.ProtocolUDP)}))
+		}
+		for _, msg := range utilvalidation.IsValidPortNum(int(port.Port)) {
+			errs = append(errs, field.Invalid(portPath.Child("port"), port.Port, msg))
+		}
+	}
+
+	return errs
+}
+
+func validateTolerations(path *field.Path, tolerations []corev1.Toleration) field.ErrorList {
+	errs := field.ErrorList{}
+
+	for i, toleration := range tolerations {
+		tolerationPath := path.Index(i)
+
+		switch toleration.Operator {
+		case corev1.TolerationOpEqual, "":
+			if toleration.Key == "" {
+				errs = append(errs, field.Invalid(tolerationPath.Child("operator"), toleration.Operator, "operator must be Exists when key is empty"))
+			}
+		case corev1.TolerationOpExists:
+			if toleration.Value != "" {
+				errs = append(errs, field.Invalid(tolerationPath.Child("value"), toleration.Value, "value must be empty when operator is Exists"))
+			}
+		default:
+			errs = append(errs, field.NotSupported(tolerationPath.Child("operator"), toleration.Operator, []string{string(corev1.TolerationOpEqual), string(corev1.TolerationOpExists)}))
+		}
+
+		switch toleration.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute, "":
+			break
+		default:
+			errs = append(errs, field.NotSupported(tolerationPath.Child("effect"), toleration.Effect,
+				[]string{string(corev1.TaintEffectNoSchedule), string(corev1.TaintEffectPreferNoSchedule), string(corev1.TaintEffectNoExecute)}))
+		}
+
+		if toleration.TolerationSeconds != nil && toleration.Effect != corev1.TaintEffectNoExecute {
+			errs = append(errs, field.Invalid(tolerationPath.Child("effect"), toleration.Effect, "effect must be NoExecute when tolerationSeconds is set"))
+		}
+	}
+
+	return errs
+}
+
 func storage(resources *corev1.ResourceList) *resource.Quantity {
 	if val, ok := (*resources)[corev1.ResourceStorage]; ok {
 		return &val
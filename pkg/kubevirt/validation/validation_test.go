@@ -0,0 +1,218 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validation_test
+
+import (
+	"encoding/json"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	kubevirtv1 "kubevirt.io/client-go/api/v1"
+)
+
+const providerSpec = `{"region":"local","zone":"local-1","resources":{"requests":{"cpu":"2","memory":"4Gi"}},` +
+	`"rootVolume":{"pvc":{"resources":{"requests":{"storage":"10Gi"}}},"source":{"http":{"url":"http://images/focal.img"}}}}`
+
+var _ = Describe("ValidateKubevirtProviderSpec", func() {
+	newProviderSpec := func() *api.KubeVirtProviderSpec {
+		spec := &api.KubeVirtProviderSpec{}
+		Expect(json.Unmarshal([]byte(providerSpec), spec)).To(Succeed())
+		return spec
+	}
+
+	// errorFields returns the fields of the given errors, along with their types.
+	errorFields := func(errs field.ErrorList) []string {
+		var fields []string
+		for _, err := range errs {
+			fields = append(fields, string(err.Type)+": "+err.Field)
+		}
+		return fields
+	}
+
+	tests := []struct {
+		name     string
+		mutate   func(spec *api.KubeVirtProviderSpec)
+		expected []string
+	}{
+		{
+			name:   "a valid provider spec",
+			mutate: func(*api.KubeVirtProviderSpec) {},
+		},
+		{
+			name:     "a missing region",
+			mutate:   func(spec *api.KubeVirtProviderSpec) { spec.Region = "" },
+			expected: []string{"FieldValueRequired: region"},
+		},
+		{
+			name:     "both zone and zones",
+			mutate:   func(spec *api.KubeVirtProviderSpec) { spec.Zones = []string{"local-1", "local-2"} },
+			expected: []string{"FieldValueInvalid: zones"},
+		},
+		{
+			name: "duplicate zones",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.Zone = ""
+				spec.Zones = []string{"local-1", "local-1"}
+			},
+			expected: []string{"FieldValueDuplicate: zones[1]"},
+		},
+		{
+			name:     "a missing CPU request",
+			mutate:   func(spec *api.KubeVirtProviderSpec) { delete(spec.Resources.Requests, corev1.ResourceCPU) },
+			expected: []string{"FieldValueRequired: resources.requests.cpu"},
+		},
+		{
+			name:     "an unsupported machine type",
+			mutate:   func(spec *api.KubeVirtProviderSpec) { spec.MachineType = "virt" },
+			expected: []string{"FieldValueNotSupported: machineType"},
+		},
+		{
+			name:     "an emulator thread isolation without dedicated CPU placement",
+			mutate:   func(spec *api.KubeVirtProviderSpec) { spec.CPU = &kubevirtv1.CPU{IsolateEmulatorThread: true} },
+			expected: []string{"FieldValueForbidden: cpu.isolateEmulatorThread"},
+		},
+		{
+			name: "dedicated CPU placement with an integral CPU request",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.CPU = &kubevirtv1.CPU{DedicatedCPUPlacement: true, IsolateEmulatorThread: true}
+			},
+		},
+		{
+			name: "dedicated CPU placement with a fractional CPU request",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.CPU = &kubevirtv1.CPU{DedicatedCPUPlacement: true}
+				spec.Resources.Requests[corev1.ResourceCPU] = resource.MustParse("1500m")
+			},
+			expected: []string{"FieldValueInvalid: resources.requests.cpu"},
+		},
+		{
+			name: "dedicated CPU placement with a CPU request matching the vCPUs",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.CPU = &kubevirtv1.CPU{DedicatedCPUPlacement: true, Cores: 1, Sockets: 2}
+			},
+		},
+		{
+			name: "dedicated CPU placement with a CPU request not matching the vCPUs",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.CPU = &kubevirtv1.CPU{DedicatedCPUPlacement: true, Cores: 2, Threads: 2}
+			},
+			expected: []string{"FieldValueInvalid: resources.requests.cpu"},
+		},
+		{
+			name: "dedicated CPU placement with limits equal to the requests",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.CPU = &kubevirtv1.CPU{DedicatedCPUPlacement: true}
+				spec.Resources.Limits = corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("2"),
+					corev1.ResourceMemory: resource.MustParse("4096Mi"),
+				}
+			},
+		},
+		{
+			name: "dedicated CPU placement with limits different from the requests",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.CPU = &kubevirtv1.CPU{DedicatedCPUPlacement: true}
+				spec.Resources.Limits = corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("4"),
+					corev1.ResourceMemory: resource.MustParse("8Gi"),
+				}
+			},
+			expected: []string{"FieldValueInvalid: resources.limits.cpu", "FieldValueInvalid: resources.limits.memory"},
+		},
+		{
+			name: "guest memory larger than the requests without limits",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				guest := resource.MustParse("8Gi")
+				spec.Memory = &kubevirtv1.Memory{Guest: &guest}
+			},
+		},
+		{
+			name: "guest memory larger than the limits",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				guest := resource.MustParse("8Gi")
+				spec.Memory = &kubevirtv1.Memory{Guest: &guest}
+				spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("6Gi")}
+			},
+			expected: []string{"FieldValueInvalid: memory.guest"},
+		},
+		{
+			name: "hugepages with memory that is a multiple of the page size",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.Memory = &kubevirtv1.Memory{Hugepages: &kubevirtv1.Hugepages{PageSize: "1Gi"}}
+			},
+		},
+		{
+			name: "hugepages with memory that is not a multiple of the page size",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.Memory = &kubevirtv1.Memory{Hugepages: &kubevirtv1.Hugepages{PageSize: "1Gi"}}
+				spec.Resources.Requests[corev1.ResourceMemory] = resource.MustParse("4500Mi")
+			},
+			expected: []string{"FieldValueInvalid: resources.requests.memory"},
+		},
+		{
+			name: "hugepages with guest memory that is not a multiple of the page size",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				guest := resource.MustParse("3001Mi")
+				spec.Memory = &kubevirtv1.Memory{Hugepages: &kubevirtv1.Hugepages{PageSize: "2Mi"}, Guest: &guest}
+			},
+			expected: []string{"FieldValueInvalid: memory.guest"},
+		},
+		{
+			name: "hugepages with an invalid page size",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.Memory = &kubevirtv1.Memory{Hugepages: &kubevirtv1.Hugepages{PageSize: "huge"}}
+			},
+			expected: []string{"FieldValueInvalid: memory.hugepages.pageSize"},
+		},
+		{
+			name: "hugepages with limits different from the requests",
+			mutate: func(spec *api.KubeVirtProviderSpec) {
+				spec.Memory = &kubevirtv1.Memory{Hugepages: &kubevirtv1.Hugepages{PageSize: "2Mi"}}
+				spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")}
+			},
+			expected: []string{"FieldValueInvalid: resources.limits.memory"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		It("should validate "+test.name, func() {
+			spec := newProviderSpec()
+			test.mutate(spec)
+
+			errs := ValidateKubevirtProviderSpec(spec, NewOptions())
+			if len(test.expected) == 0 {
+				Expect(errs).To(BeEmpty())
+				return
+			}
+			Expect(errorFields(errs)).To(ConsistOf(test.expected))
+		})
+	}
+
+	It("should validate the machine type against the allowed machine types of the given options", func() {
+		spec := newProviderSpec()
+		spec.MachineType = "virt"
+		options := NewOptions()
+		options.AllowedMachineTypes = []string{"virt"}
+
+		Expect(ValidateKubevirtProviderSpec(spec, options)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/apis"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/logging"
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	"github.com/pkg/errors"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// providerName is the provider name of machine classes handled by this provider.
+const providerName = "KubeVirt"
+
+// MachineClassValidator is an http.Handler that serves admission reviews of machine classes,
+// rejecting machine classes whose kubevirt provider spec is invalid.
+type MachineClassValidator struct {
+	options *validation.Options
+}
+
+// NewMachineClassValidator creates a new MachineClassValidator that validates provider specs with the given options.
+func NewMachineClassValidator(options *validation.Options) *MachineClassValidator {
+	return &MachineClassValidator{
+		options: options,
+	}
+}
+
+// ServeHTTP decodes the admission review in the given request, validates the machine class in it,
+// and writes the admission review with the response to the given response writer.
+func (v *MachineClassValidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	review, err := decodeAdmissionReview(r)
+	if err != nil {
+		logging.InfoS(2, "Could not decode admission review", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = v.validate(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	data, err := json.Marshal(review)
+	if err != nil {
+		logging.ErrorS(err, "Could not marshal admission review to JSON")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		logging.ErrorS(err, "Could not write admission review")
+	}
+}
+
+// validate validates the machine class in the given admission request.
+// Only machine classes whose provider is explicitly KubeVirt are validated. Machine classes of other providers
+// or without a provider, and machine classes that are being deleted, e.g. whose finalizers are being removed,
+// are allowed without validation.
+func (v *MachineClassValidator) validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return allowed()
+	}
+
+	machineClass := &v1alpha1.MachineClass{}
+	if err := json.Unmarshal(req.Object.Raw, machineClass); err != nil {
+		return denied(http.StatusBadRequest, fmt.Sprintf("could not unmarshal machine class from JSON: %v", err))
+	}
+	if !strings.EqualFold(machineClass.Provider, providerName) || machineClass.DeletionTimestamp != nil {
+		return allowed()
+	}
+
+	var spec *api.KubeVirtProviderSpec
+	if err := json.Unmarshal(machineClass.ProviderSpec.Raw, &spec); err != nil {
+		return denied(http.StatusUnprocessableEntity, fmt.Sprintf("could not unmarshal provider spec from JSON: %v", err))
+	}
+	if spec == nil {
+		return denied(http.StatusUnprocessableEntity, "provider spec is empty")
+	}
+	if errs := validation.ValidateKubevirtProviderSpec(spec, v.options); len(errs) > 0 {
+		logging.InfoS(2, "Rejecting machine class", logging.KeyMachineClass, req.Name, logging.KeyNamespace, req.Namespace, "err", errs.ToAggregate())
+		return denied(http.StatusUnprocessableEntity, fmt.Sprintf("invalid provider spec: %v", errs.ToAggregate()))
+	}
+	return allowed()
+}
+
+// decodeAdmissionReview decodes the admission review in the body of the given request.
+func decodeAdmissionReview(r *http.Request) (*admissionv1.AdmissionReview, error) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		return nil, errors.Errorf("unsupported content type %q", contentType)
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read request body")
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(data, review); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal admission review from JSON")
+	}
+	if review.Request == nil {
+		return nil, errors.New("admission review contains no request")
+	}
+	return review, nil
+}
+
+// allowed returns an admission response allowing the request.
+func allowed() *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
+// denied returns an admission response denying the request with the given code and message.
+func denied(code int32, message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Message: message,
+		},
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2020 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/validation"
+	. "github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/webhook"
+
+	"github.com/gardener/machine-controller-manager/pkg/apis/machine/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	validProviderSpec = `{"region":"local","zone":"local-1","resources":{"requests":{"cpu":"1","memory":"4096M"}},` +
+		`"rootVolume":{"pvc":{"resources":{"requests":{"storage":"10Gi"}}},"source":{"http":{"url":"http://images/focal.img"}}}}`
+	invalidProviderSpec = `{"zone":"local-1"}`
+	uid                 = types.UID("9d1f2c3e-7e4a-4b7e-9d0e-3f0c2b1a5e6d")
+)
+
+var _ = Describe("MachineClassValidator", func() {
+	newMachineClass := func(provider, providerSpec string) *v1alpha1.MachineClass {
+		return &v1alpha1.MachineClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "machine-class-1",
+				Namespace: "default",
+			},
+			Provider:     provider,
+			ProviderSpec: runtime.RawExtension{Raw: []byte(providerSpec)},
+		}
+	}
+
+	review := func(operation admissionv1.Operation, machineClass *v1alpha1.MachineClass) *admissionv1.AdmissionResponse {
+		object, err := json.Marshal(machineClass)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(&admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       uid,
+				Name:      machineClass.Name,
+				Namespace: machineClass.Namespace,
+				Operation: operation,
+				Object:    runtime.RawExtension{Raw: object},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		NewMachineClassValidator(validation.NewOptions()).ServeHTTP(w, r)
+		Expect(w.Code).To(Equal(http.StatusOK))
+
+		result := &admissionv1.AdmissionReview{}
+		Expect(json.Unmarshal(w.Body.Bytes(), result)).To(Succeed())
+		Expect(result.Request).To(BeNil())
+		Expect(result.Response).NotTo(BeNil())
+		Expect(result.Response.UID).To(Equal(uid))
+		return result.Response
+	}
+
+	It("should allow a KubeVirt machine class with a valid provider spec", func() {
+		response := review(admissionv1.Create, newMachineClass("KubeVirt", validProviderSpec))
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	It("should deny a KubeVirt machine class with an invalid provider spec", func() {
+		response := review(admissionv1.Update, newMachineClass("kubevirt", invalidProviderSpec))
+		Expect(response.Allowed).To(BeFalse())
+		Expect(response.Result.Code).To(Equal(int32(http.StatusUnprocessableEntity)))
+		Expect(response.Result.Message).To(ContainSubstring("region"))
+	})
+
+	It("should deny a KubeVirt machine class without a provider spec", func() {
+		response := review(admissionv1.Create, newMachineClass("KubeVirt", "null"))
+		Expect(response.Allowed).To(BeFalse())
+		Expect(response.Result.Code).To(Equal(int32(http.StatusUnprocessableEntity)))
+	})
+
+	It("should allow a machine class of another provider without validation", func() {
+		response := review(admissionv1.Create, newMachineClass("AWS", invalidProviderSpec))
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	It("should allow a machine class without a provider without validation", func() {
+		response := review(admissionv1.Create, newMachineClass("", invalidProviderSpec))
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	It("should allow a KubeVirt machine class that is being deleted without validation", func() {
+		machineClass := newMachineClass("KubeVirt", invalidProviderSpec)
+		now := metav1.Now()
+		machineClass.DeletionTimestamp = &now
+		response := review(admissionv1.Update, machineClass)
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	It("should allow deleting a KubeVirt machine class without validation", func() {
+		response := review(admissionv1.Delete, newMachineClass("KubeVirt", invalidProviderSpec))
+		Expect(response.Allowed).To(BeTrue())
+	})
+
+	It("should reject a request with an unsupported content type", func() {
+		r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader([]byte("{}")))
+		r.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		NewMachineClassValidator(validation.NewOptions()).ServeHTTP(w, r)
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -12,6 +12,6 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:generate mockgen -package core -destination=mocks.go github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core ClientFactory,ServerVersionFactory,Timer
+//go:generate mockgen -package core -destination=mocks.go github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core ClientFactory,ServerVersionFactory,SubresourceClient,Timer
 
 package core
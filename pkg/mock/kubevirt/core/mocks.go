@@ -1,10 +1,11 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core (interfaces: ClientFactory,ServerVersionFactory,Timer)
+// Source: github.com/gardener/machine-controller-manager-provider-kubevirt/pkg/kubevirt/core (interfaces: ClientFactory,ServerVersionFactory,SubresourceClient,Timer)
 
 // Package core is a generated GoMock package.
 package core
 
 import (
+	context "context"
 	reflect "reflect"
 	time "time"
 
@@ -90,6 +91,57 @@ func (mr *MockServerVersionFactoryMockRecorder) GetServerVersion(arg0 interface{
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetServerVersion", reflect.TypeOf((*MockServerVersionFactory)(nil).GetServerVersion), arg0)
 }
 
+// MockSubresourceClient is a mock of SubresourceClient interface.
+type MockSubresourceClient struct {
+	ctrl     *gomock.Controller
+	recorder *MockSubresourceClientMockRecorder
+}
+
+// MockSubresourceClientMockRecorder is the mock recorder for MockSubresourceClient.
+type MockSubresourceClientMockRecorder struct {
+	mock *MockSubresourceClient
+}
+
+// NewMockSubresourceClient creates a new mock instance.
+func NewMockSubresourceClient(ctrl *gomock.Controller) *MockSubresourceClient {
+	mock := &MockSubresourceClient{ctrl: ctrl}
+	mock.recorder = &MockSubresourceClientMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSubresourceClient) EXPECT() *MockSubresourceClientMockRecorder {
+	return m.recorder
+}
+
+// RestartVirtualMachine mocks base method.
+func (m *MockSubresourceClient) RestartVirtualMachine(arg0 context.Context, arg1 *v1.Secret, arg2, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RestartVirtualMachine", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RestartVirtualMachine indicates an expected call of RestartVirtualMachine.
+func (mr *MockSubresourceClientMockRecorder) RestartVirtualMachine(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestartVirtualMachine", reflect.TypeOf((*MockSubresourceClient)(nil).RestartVirtualMachine), arg0, arg1, arg2, arg3)
+}
+
+// StopVirtualMachine mocks base method.
+func (m *MockSubresourceClient) StopVirtualMachine(arg0 context.Context, arg1 *v1.Secret, arg2, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StopVirtualMachine", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StopVirtualMachine indicates an expected call of StopVirtualMachine.
+func (mr *MockSubresourceClientMockRecorder) StopVirtualMachine(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StopVirtualMachine", reflect.TypeOf((*MockSubresourceClient)(nil).StopVirtualMachine), arg0, arg1, arg2, arg3)
+}
+
 // MockTimer is a mock of Timer interface.
 type MockTimer struct {
 	ctrl     *gomock.Controller